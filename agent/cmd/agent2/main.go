@@ -66,7 +66,7 @@ func main() {
 	serv := flag.String("serv", "", "Service name")
 	hostname := flag.String("host", "", "Hostname or IP of this agent.  If not specified, uses `addr` from the legacy config file")
 	port := flag.String("port", "", "Port to run the agent on.  If not specified, uses `port` from the legacy config file.")
-	lc_addr := flag.String("lc", "", "Address of the log collector in form hostname:port.  If not specified, uses `lc_addr`:`lc_port` from the legacy config file.")
+	lc_addr := flag.String("lc", "", "Address of the log collector in form hostname:port.  If coordinator state is sharded, a comma-separated list of every coordinator.  If not specified, uses `lc_addr`:`lc_port` from the legacy config file.")
 	r_addr := flag.String("r", "", "Address of the reporting backend in form hostname:port.  If not specified, uses `r_addr`:`r_port` from the legacy config file.")
 	// isReport := flag.Bool("report", true, "If report to LC (or local mode)")
 	delayf := flag.Int("delay", 0, "Used for experimental purposes.  If specified, this delays the reporting of triggers by the specified delay (in milliseconds).  Default to 0 - no delay.")
@@ -74,6 +74,15 @@ func main() {
 	triggerratelimit := flag.Float64("triggerrate", 10000, "Rate limit for a spammy trigger in triggers/s.  Set to 0 to disable.  Default 10000.")
 	outputfile := flag.String("output", "", "Filename for outputting agent telemetry.  If specified, will write a csv of agent telemetry data.  Disabled by default.")
 	verbose := flag.Bool("verbose", false, "If set to true, prints telemetry to the command line.  False by default.")
+	outboundcapacity := flag.Int("outbound", 10000, "Maximum number of trigger and breadcrumb batches to hold while the coordinator is unreachable.  Default 10000.")
+	outboundpolicy := flag.String("outbound_policy", "drop-oldest", "What to drop when the outbound queue is full; either drop-oldest or drop-newest.  Default drop-oldest.")
+	unacked := flag.Int("unacked", 0, "MB of reported trace data to keep until the collector acknowledges it has durably written it, e.g. 64.  Unacknowledged data is resent after reconnecting.  Requires a collector that supports acks.  Default 0 (disabled).")
+	tlscert := flag.String("tls_cert", "", "Certificate file (PEM) to present on connections to the coordinator and collector, and for the remote trigger server.  If not specified, connections are plaintext.")
+	tlskey := flag.String("tls_key", "", "Private key file (PEM) for -tls_cert.")
+	tlsca := flag.String("tls_ca", "", "CA certificate file (PEM) used to verify the coordinator, the collector, and callers of the remote trigger server.  Specifying a CA enables mutual TLS, and requires -tls_cert and -tls_key.")
+	coordinatormode := flag.String("coordinator_mode", "centralized", "Either centralized, to report triggers and breadcrumbs to the coordinator, or p2p, to send triggers directly to the agents named by breadcrumbs.  Default centralized.")
+	maxhops := flag.Int("max_hops", agent.DefaultMaxHops, "In p2p mode, the maximum number of agents a trigger is forwarded through.")
+	outbounddir := flag.String("outbound_dir", "", "Directory for a file-backed outbound queue that survives agent restarts.  If not specified, the outbound queue is held in memory only.")
 
 	per_trigger_limits := make(triggerRateLimitFlags)
 	flag.Var(&per_trigger_limits, "l", "A per-trigger reporting rate limit in the form queue_id,rate where queue_id is an integer and rate is a float representing a reporting limit in MB/s.  This flag can be set multiple times to provide rate limits for different triggers.")
@@ -82,6 +91,18 @@ func main() {
 
 	delay := uint64((*delayf))
 
+	policy, err := agent.ParseOutboundPolicy(*outboundpolicy)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	mode, err := agent.ParseCoordinatorMode(*coordinatormode)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	isConfig := util.Conf_init(*serv)
 	if !isConfig {
 		fmt.Println("Failed to load config file for", *serv)
@@ -117,6 +138,18 @@ func main() {
 	}()
 
 	agent := agent.InitAgent2(*serv, *hostname, *port, *lc_addr, *r_addr, delay, *reportingratelimit, *triggerratelimit, per_trigger_limits, *outputfile, *verbose)
+	agent.ConfigureCoordinatorMode(mode, *maxhops)
+	agent.ConfigureReportingAcks(*unacked)
+	err = agent.ConfigureTLS(util.TLSConfig{CertFile: *tlscert, KeyFile: *tlskey, CAFile: *tlsca})
+	if err != nil {
+		fmt.Println("Error configuring TLS:", err)
+		return
+	}
+	err = agent.ConfigureOutboundQueue(*outboundcapacity, policy, *outbounddir)
+	if err != nil {
+		fmt.Println("Error initializing outbound queue:", err)
+		return
+	}
 	agent.Run(ctx, cancel)
 	log.Println("Agent exiting")
 	os.Exit(0)
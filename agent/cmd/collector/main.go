@@ -4,6 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/geraldleizhang/hindsight/agent/pkg/collector"
 	"github.com/geraldleizhang/hindsight/agent/pkg/util"
@@ -25,10 +31,59 @@ func resolveConfigValue(key string, value string, legacyconfigvalue string, defa
 	return value
 }
 
+/* Repeatable flag of exporters, in the form name=filename */
+type exportFlags []string
+
+func (f *exportFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *exportFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("Invalid export %v -- must be of the form exporter=filename", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
 // TODO different main methods for different cmds..........
 func main() {
 
 	tracefile := flag.String("out", "", "Filename to write trace data to.  If not specified, trace data won't be written to disk.  If you're at MPI, don't write to your home directory!")
+	tlscert := flag.String("tls_cert", "", "Certificate file (PEM) to present on agent connections.  If not specified, connections are plaintext.")
+	tlskey := flag.String("tls_key", "", "Private key file (PEM) for -tls_cert.")
+	tlsca := flag.String("tls_ca", "", "CA certificate file (PEM) used to verify agent client certificates.  If specified, agents must present a certificate, and the certificate identity is used as the agent address.")
+	quietperiod := flag.Duration("quiet_period", collector.DefaultQuietPeriod, "How long a trace must go without receiving new buffers before it is written to -out.  Default 10s.")
+	maxtraceage := flag.Duration("max_trace_age", collector.DefaultMaxTraceAge, "How long a trace can be assembled before it is written to -out, even if it is still receiving buffers.  Set to 0 for no limit.  Default 1m.")
+	assemblymb := flag.Int("assembly_mb", collector.DefaultMaxPendingBytes/(1024*1024), "MB of traces being assembled beyond which the least recently active traces are written to -out.  Set to 0 for no limit.  Default 1024.")
+	storedir := flag.String("store", "", "Directory of an indexed trace store to write trace data to, in addition to -out.  Traces in the store can be looked up by trace ID with cmd/tracestore.  If not specified, no store is written.")
+	segmentsize := flag.Int64("segment_size", collector.DefaultSegmentSize/(1024*1024), "Size in MB at which the -store starts a new segment.  Default 256.")
+	segmentage := flag.Duration("segment_age", time.Hour, "Age at which the -store starts a new segment, e.g. 1h.  Set to 0 to only start segments by size.  Default 1h.")
+	retainsize := flag.Int64("retain_size", 0, "Size in MB beyond which the oldest segments of the -store are deleted.  Default 0 (unlimited).")
+	retainage := flag.Duration("retain_age", 0, "Age beyond which segments of the -store are deleted, e.g. 24h.  Default 0 (unlimited).")
+	decoder := flag.String("decoder", "kv", fmt.Sprintf("Decoder for the tracepoints in buffer payloads, used with -export.  One of %v.  Default kv.", collector.DecoderNames()))
+	var exports exportFlags
+	flag.Var(&exports, "export", fmt.Sprintf("Decodes traces with -decoder and exports them to a file, in the form exporter=filename, e.g. otlp-json=/local/traces.json.  Exporter is one of %v.  Can be specified multiple times.", collector.ExporterNames()))
+	queryport := flag.String("query_port", "", "Port for an HTTP/JSON API to fetch finalized traces.  If not specified, the API is disabled.")
+	queryhost := flag.String("query_host", "localhost", "Interface for the -query_port API to listen on.  Set to an empty string to listen on all interfaces.  With -tls_cert, the API is served over HTTPS, and with -tls_ca, clients must present a certificate.  Default localhost.")
+	querytraces := flag.Int("query_traces", collector.DefaultRecentTraces, "Number of recently finalized traces the -query_port API holds in memory.  Older traces are read from -store.  Default 10000.")
+	querymb := flag.Int("query_mb", collector.DefaultRecentBytes/(1024*1024), "MB of recently finalized traces the -query_port API holds in memory.  Default 256.")
+	forward := flag.String("forward", "", "Comma-separated addresses of upstream collectors to forward received trace data to, e.g. central:5253.  Trace data is also written locally if -out, -store, -export, or -query_port are given.  If not specified, nothing is forwarded.")
+	forwardrouting := flag.String("forward_routing", "all", "Which upstream collectors receive each buffer: all, agent (each agent's buffers go to one upstream), or trace (each trace's buffers go to one upstream).  Default all.")
+	forwardmb := flag.Int("forward_mb", collector.DefaultMaxForwardBytes/(1024*1024), "MB of each agent's trace data to keep for each upstream collector until it is acknowledged, e.g. while the upstream is unavailable.  Default 64.")
+	forwardtlscert := flag.String("forward_tls_cert", "", "Certificate file (PEM) to present to upstream collectors.  If neither this nor -forward_tls_ca is specified, forwarding is plaintext.")
+	forwardtlskey := flag.String("forward_tls_key", "", "Private key file (PEM) for -forward_tls_cert.")
+	forwardtlsca := flag.String("forward_tls_ca", "", "CA certificate file (PEM) used to verify upstream collectors.")
+	tlsforwarders := flag.String("tls_forwarders", "", "Comma-separated certificate identities of collectors that forward to this one.  With -tls_ca, their handshakes name the agents they forward for.")
+	maxconnections := flag.Int("max_connections", collector.DefaultMaxConnections, "Maximum number of concurrent agent connections.  Further connections are closed.  Set to 0 for no limit.  Default 4096.")
+	handshaketimeout := flag.Duration("handshake_timeout", collector.DefaultHandshakeTimeout, "How long a new agent connection has to send its handshake.  Default 10s.")
+	idletimeout := flag.Duration("idle_timeout", collector.DefaultIdleTimeout, "How long an agent connection can go without sending a buffer before it is closed.  Agents reconnect automatically.  Set to 0 to never close idle connections.  Default 10m.")
+	draintimeout := flag.Duration("drain_timeout", collector.DefaultDrainTimeout, "On shutdown, how long agent connections have to finish sending the buffer in progress, and forwarded data has to be acknowledged, before trace data is written out.  Default 10s.")
+	maxframekb := flag.Int("max_frame_kb", collector.DefaultMaxFrameSize/1024, "Maximum size in KB of a buffer from an agent.  Connections that send larger buffers are closed.  Must be at least the agents' buffer size.  Default 1024.")
+	maxframeerrors := flag.Int("max_frame_errors", collector.DefaultMaxFrameErrors, "Number of invalid buffers an agent connection can send within a minute before it is closed.  Default 10.")
+	agentquota := flag.Float64("agent_quota_mb", 0, "Maximum rate in MB/s at which each agent's trace data is accepted.  Agents over their quota are slowed down by reading less from their connections.  Default 0 (unlimited).")
+	outputfile := flag.String("output", "", "Filename for outputting collector telemetry.  If specified, will write a csv of collector telemetry data.  Disabled by default.")
+	verbose := flag.Bool("verbose", false, "If set to true, prints telemetry to the command line.  False by default.")
 	port := flag.String("port", "", "Collector port.  If not specified, uses `r_port` from the legacy config lc.conf file, or 5253 as a backup")
 
 	flag.Parse()
@@ -42,9 +97,77 @@ func main() {
 	fmt.Println("Running coordinator")
 	*port = resolveConfigValue("port", *port, util.Reporting_port, "5253", "lc")
 
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		log.Println("Initiating graceful shutdown...")
+
+		go func() {
+			<-ch
+			log.Println("Exiting without graceful shutdown")
+			os.Exit(1)
+		}()
+
+		cancel()
+	}()
 
 	var c collector.Collector
 	c.Init(*port, *tracefile)
+	c.ConfigureAssembly(*quietperiod, *maxtraceage, *assemblymb*1024*1024)
+	c.ConfigureConnections(*maxconnections, *handshaketimeout, *idletimeout)
+	c.ConfigureShutdown(*draintimeout)
+	c.ConfigureFrames(*maxframekb*1024, *maxframeerrors)
+	c.ConfigureQuotas(*agentquota * 1024 * 1024)
+	err := c.ConfigureTelemetry(*outputfile, *verbose)
+	if err != nil {
+		fmt.Println("Error configuring telemetry", err)
+		return
+	}
+	if *storedir != "" {
+		err := c.ConfigureStore(*storedir, collector.StoreConfig{
+			SegmentSize: *segmentsize * 1024 * 1024,
+			SegmentAge:  *segmentage,
+			RetainSize:  *retainsize * 1024 * 1024,
+			RetainAge:   *retainage,
+		})
+		if err != nil {
+			fmt.Println("Error opening trace store", *storedir, err)
+			return
+		}
+	}
+	if len(exports) > 0 {
+		err := c.ConfigureDecoder(*decoder)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, export := range exports {
+			splits := strings.SplitN(export, "=", 2)
+			err = c.ConfigureExporter(splits[0], splits[1])
+			if err != nil {
+				fmt.Println("Error configuring export", export, err)
+				return
+			}
+		}
+	}
+	if *queryport != "" {
+		c.ConfigureQueryAPI(*queryhost, *queryport, *querytraces, *querymb*1024*1024)
+	}
+	if *forward != "" {
+		routing, err := collector.ParseRouting(*forwardrouting)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		config := util.TLSConfig{CertFile: *forwardtlscert, KeyFile: *forwardtlskey, CAFile: *forwardtlsca}
+		c.ConfigureForwarding(collector.InitForwarder(strings.Split(*forward, ","), routing, *forwardmb*1024*1024, config))
+	}
+	c.ConfigureTLS(util.TLSConfig{CertFile: *tlscert, KeyFile: *tlskey, CAFile: *tlsca})
+	if *tlsforwarders != "" {
+		c.TrustForwarders(strings.Split(*tlsforwarders, ","))
+	}
 	c.Run(ctx)
 }
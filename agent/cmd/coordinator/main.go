@@ -44,6 +44,42 @@ func (i *triggerRateLimitFlags) Set(value string) error {
 	return nil
 }
 
+type queueTimeoutFlags map[int]time.Duration
+
+func (timeouts *queueTimeoutFlags) String() string {
+	var b strings.Builder
+	for queue_id, timeout := range *timeouts {
+		fmt.Fprintf(&b, "%d=%v ", queue_id, timeout)
+	}
+	return b.String()
+}
+
+func (timeouts *queueTimeoutFlags) Set(value string) error {
+	splits := strings.Split(value, ",")
+	if len(splits) != 2 {
+		return fmt.Errorf("Invalid queue timeout %v -- must be of the form int,duration", value)
+	}
+	queue_id, err := strconv.ParseInt(splits[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	timeout, err := time.ParseDuration(splits[1])
+	if err != nil {
+		return err
+	}
+
+	(*timeouts)[int(queue_id)] = timeout
+	return nil
+}
+
+func resolveTimeout(key string, value string, legacyconfigvalue string, defaultvalue time.Duration) (time.Duration, error) {
+	value = resolveConfigValue(key, value, legacyconfigvalue, "lc")
+	if value == "" {
+		return defaultvalue, nil
+	}
+	return time.ParseDuration(value)
+}
+
 func resolveConfigValue(key string, value string, legacyconfigvalue string, service_name string) string {
 	if value == "" {
 		value = legacyconfigvalue
@@ -58,6 +94,27 @@ func resolveConfigValue(key string, value string, legacyconfigvalue string, serv
 func main() {
 
 	port := flag.String("port", "5252", "Coordinator port.  If not specified, uses `lc_port` from the legacy config lc.conf file.")
+	tlscert := flag.String("tls_cert", "", "Certificate file (PEM) to present on agent connections.  If not specified, connections are plaintext.")
+	tlskey := flag.String("tls_key", "", "Private key file (PEM) for -tls_cert.")
+	tlsca := flag.String("tls_ca", "", "CA certificate file (PEM) used to verify agent client certificates.  If specified, agents must present a certificate, and the certificate identity is used as the agent address.")
+	peers := flag.String("peers", "", "Comma-separated list of all coordinators (host:port), if coordinator state is sharded across several coordinators.  Agents must be given the same list with -lc.")
+	self := flag.String("self", "", "This coordinator's address as it appears in -peers, or as known to -parent.  Required with -peers and -parent.")
+	parent := flag.String("parent", "", "Address (host:port) of a parent coordinator, if this is a regional coordinator in a tree of coordinators.  Cannot be combined with -peers.")
+	partitions := flag.Int("partitions", 1, "Number of goroutines across which coordinator state is partitioned by trace ID, e.g. the number of cores.  Default 1.")
+	waldir := flag.String("wal", "", "Directory for a write-ahead log of coordinator state, so that state survives restarts.  If not specified, state is held in memory only.")
+	snapshotinterval := flag.Duration("snapshot_interval", time.Minute, "How often to snapshot coordinator state when using -wal.  Default 1m.")
+	tracetimeout := flag.String("trace_timeout", "", "How long to keep a trace after it was last modified, e.g. 60s.  If not specified, uses `trace_timeout` from the legacy config lc.conf file, or 60s.")
+	triggertimeout := flag.String("trigger_timeout", "", "How long to keep a trigger after it was last modified, e.g. 60s.  If not specified, uses `trigger_timeout` from the legacy config lc.conf file, or 60s.")
+	queuetimeouts := make(queueTimeoutFlags)
+	flag.Var(&queuetimeouts, "queue_timeout", "Overrides -trigger_timeout for one queue, in the form queue_id,duration, e.g. 3,5m.  Can be specified multiple times, and as `queue_timeout` lines in the legacy config file.")
+	maxtraces := flag.Int("max_traces", 0, "Maximum number of traces to track; beyond this, the least recently modified traces are evicted.  Default 0 (unlimited).")
+	maxtriggers := flag.Int("max_triggers", 0, "Maximum number of triggers to track; beyond this, the least recently modified triggers are evicted.  Default 0 (unlimited).")
+	outputfile := flag.String("output", "", "Filename for outputting coordinator telemetry.  If specified, will write a csv of coordinator telemetry data.  Disabled by default.")
+	verbose := flag.Bool("verbose", false, "If set to true, prints telemetry to the command line.  False by default.")
+	auditfile := flag.String("audit", "", "Filename for a JSON-lines audit log of every trigger's lifecycle.  If not specified, no audit log is written.")
+	auditqueues := flag.String("audit_queues", "", "Comma-separated queue IDs to include in the audit log.  If not specified, all queues are included.")
+	auditmaxsize := flag.Int64("audit_max_size", 100, "Size in MB at which the audit log is rotated.  Set to 0 to never rotate.  Default 100.")
+	auditkeep := flag.Int("audit_keep", 5, "Number of rotated audit log files to keep.  Default 5.")
 	outfile := flag.String("out", "", "Output filename for writing breadcrumb dissemination statistics.  If not specified, will not be written to file")
 
 	flag.Parse()
@@ -71,6 +128,45 @@ func main() {
 	log.Println("Running coordinator")
 	*port = resolveConfigValue("port", *port, util.Server_port, "lc")
 
+	trace_timeout, err := resolveTimeout("trace_timeout", *tracetimeout, util.Trace_timeout, 60*time.Second)
+	if err != nil {
+		fmt.Println("Invalid trace timeout:", err)
+		return
+	}
+	trigger_timeout, err := resolveTimeout("trigger_timeout", *triggertimeout, util.Trigger_timeout, 60*time.Second)
+	if err != nil {
+		fmt.Println("Invalid trigger timeout:", err)
+		return
+	}
+	for _, value := range util.Queue_timeouts {
+		legacy := make(queueTimeoutFlags)
+		if err := legacy.Set(value); err != nil {
+			fmt.Println("Invalid queue timeout in lc.conf:", err)
+			return
+		}
+		for queue_id, timeout := range legacy {
+			if _, ok := queuetimeouts[queue_id]; !ok {
+				queuetimeouts[queue_id] = timeout
+			}
+		}
+	}
+	for queue_id, timeout := range queuetimeouts {
+		fmt.Printf("    -Queue %d timeout %v\n", queue_id, timeout)
+	}
+
+	var audit_queues []int
+	for _, value := range strings.Split(*auditqueues, ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		queue_id, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			fmt.Println("Invalid audit queue:", err)
+			return
+		}
+		audit_queues = append(audit_queues, queue_id)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// // Not sure if needed
@@ -101,7 +197,32 @@ func main() {
 	}
 
 	var c coordinator.CoordinatorServer
-	err := c.Init(*port, *outfile)
+	err = c.Init(*port, *outfile)
+	if err == nil && *partitions != 1 {
+		log.Println("Partitioning coordinator state across", *partitions, "goroutines")
+		err = c.ConfigurePartitions(*partitions)
+	}
+	c.ConfigureExpiration(trace_timeout, trigger_timeout, queuetimeouts, *maxtraces, *maxtriggers)
+	if err == nil {
+		err = c.ConfigureTelemetry(*outputfile, *verbose)
+	}
+	if err == nil && *peers != "" {
+		log.Println("Sharding coordinator state across", *peers, "as", *self)
+		err = c.ConfigureShards(*self, util.ParseNodes(*peers))
+	}
+	if err == nil && *parent != "" {
+		log.Println("Regional coordinator", *self, "beneath parent", *parent)
+		err = c.ConfigureParent(*self, *parent)
+	}
+	c.ConfigureTLS(util.TLSConfig{CertFile: *tlscert, KeyFile: *tlskey, CAFile: *tlsca})
+	if err == nil && *auditfile != "" {
+		log.Println("Writing trigger audit log to", *auditfile)
+		err = c.ConfigureAudit(*auditfile, audit_queues, *auditmaxsize*1024*1024, *auditkeep)
+	}
+	if err == nil && *waldir != "" {
+		log.Println("Logging coordinator state to", *waldir)
+		err = c.ConfigureWAL(*waldir, *snapshotinterval)
+	}
 
 	if err != nil {
 		fmt.Println("Error initializing coordinator:", err)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/collector"
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+)
+
+/*
+Inspects a file written by the collector with -out, or a segment of a trace
+store, e.g.
+
+  go run cmd/hindsight-dump/main.go /local/tracedata.out
+  go run cmd/hindsight-dump/main.go -summary /local/tracedata.out
+  go run cmd/hindsight-dump/main.go -trace 12345 -json -encoding hex /local/tracedata.out
+
+Both the current file format and the older flat format are understood.  Exits
+with an error if the file is truncated or corrupt, after printing everything
+that could be read.
+*/
+
+/* One buffer read from the file */
+type Entry struct {
+	Agent    string
+	Header   memory.BufferHeader
+	Buffer   []byte
+	Received *collector.TraceRecord // The record the buffer was in; nil for files in the older format
+}
+
+type Filter struct {
+	traces map[uint64]bool
+	agent  string
+	from   time.Time
+	to     time.Time
+}
+
+func (f *Filter) matches(e *Entry) bool {
+	if len(f.traces) > 0 && !f.traces[e.Header.Trace_id] {
+		return false
+	}
+	if f.agent != "" && e.Agent != f.agent {
+		return false
+	}
+	if e.Received != nil {
+		if !f.from.IsZero() && e.Received.Last_received.Before(f.from) {
+			return false
+		}
+		if !f.to.IsZero() && e.Received.First_received.After(f.to) {
+			return false
+		}
+	}
+	return true
+}
+
+func newEntry(agent string, buffer []byte, received *collector.TraceRecord) *Entry {
+	e := &Entry{Agent: agent, Buffer: buffer, Received: received}
+	if len(buffer) >= 32 { // 32 is size of buffer header
+		e.Header = memory.ExtractBufferHeader(buffer)
+	}
+	return e
+}
+
+/* Counts bytes read, so that a truncated record can be located */
+type countingReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+/*
+Reads every buffer in the file.  Returns whether the file is in the older
+format, and an error if the file ends part-way through a record.
+*/
+func readFile(filename string, visit func(*Entry)) (legacy bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	ok, err := collector.ReadTraceFileHeader(r)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		_, err = f.Seek(0, io.SeekStart) // Undo the buffered reader's peek
+		if err != nil {
+			return true, err
+		}
+		return true, readLegacyFile(f, visit)
+	}
+
+	counter := &countingReader{r: r, offset: int64(len(collector.TraceFileMagic))}
+	for {
+		offset := counter.offset
+		record, err := collector.ReadTraceRecord(counter)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("%s is truncated or corrupt at offset %d: %v", filename, offset, err)
+		}
+		for _, buf := range record.Buffers {
+			visit(newEntry(record.Agents[buf.Agent], buf.Buffer, record))
+		}
+	}
+}
+
+func readLegacyFile(f *os.File, visit func(*Entry)) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	for {
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		agent, buffer, err := collector.ReadFromFile(f)
+		if err != nil {
+			if offset == info.Size() {
+				return nil
+			}
+			return fmt.Errorf("%s is truncated or corrupt at offset %d: %v", f.Name(), offset, err)
+		}
+		visit(newEntry(agent, buffer, nil))
+	}
+}
+
+func parseTraceIDs(value string) (map[uint64]bool, error) {
+	traces := make(map[uint64]bool)
+	for _, id := range strings.Split(value, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		trace_id, err := strconv.ParseUint(strings.TrimSpace(id), 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		traces[trace_id] = true
+	}
+	return traces, nil
+}
+
+func printEntry(e *Entry) {
+	if len(e.Buffer) < 32 {
+		fmt.Printf("%-24s  %-20s  buffer of %d bytes is too short for a header\n", e.Agent, "-", len(e.Buffer))
+		return
+	}
+	fmt.Printf("%-24s  %-20d  %10d  %10d  %10d  %20d\n", e.Agent, e.Header.Trace_id, e.Header.Buffer_id, e.Header.Prev_buffer_id, e.Header.Size, e.Header.Acquired)
+}
+
+type TraceSummary struct {
+	TraceID uint64
+	Buffers int
+	Bytes   int
+	Agents  map[string]bool
+}
+
+func printSummary(traces map[uint64]*TraceSummary) {
+	var ids []uint64
+	for trace_id := range traces {
+		ids = append(ids, trace_id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	fmt.Printf("%-20s  %8s  %12s  %s\n", "trace_id", "buffers", "bytes", "agents")
+	for _, trace_id := range ids {
+		t := traces[trace_id]
+		var agents []string
+		for agent := range t.Agents {
+			agents = append(agents, agent)
+		}
+		sort.Strings(agents)
+		fmt.Printf("%-20d  %8d  %12d  %s\n", trace_id, t.Buffers, t.Bytes, strings.Join(agents, ","))
+	}
+}
+
+type ExportedBuffer struct {
+	Agent           string `json:"agent"`
+	BufferID        int32  `json:"buffer_id"`
+	PrevBufferID    int32  `json:"prev_buffer_id"`
+	BufferNumber    int16  `json:"buffer_number"`
+	NullBufferCount int16  `json:"null_buffer_count"`
+	Size            uint32 `json:"size"`
+	Acquired        uint64 `json:"acquired"`
+	Payload         string `json:"payload"` // The buffer after its header
+}
+
+type ExportedTrace struct {
+	TraceID       uint64           `json:"trace_id"`
+	FirstReceived *time.Time       `json:"first_received,omitempty"`
+	LastReceived  *time.Time       `json:"last_received,omitempty"`
+	Buffers       []ExportedBuffer `json:"buffers"`
+}
+
+func exportEntry(traces map[uint64]*ExportedTrace, order *[]uint64, e *Entry, encode func([]byte) string) {
+	if len(e.Buffer) < 32 {
+		return
+	}
+	t, ok := traces[e.Header.Trace_id]
+	if !ok {
+		t = &ExportedTrace{TraceID: e.Header.Trace_id}
+		traces[e.Header.Trace_id] = t
+		*order = append(*order, e.Header.Trace_id)
+	}
+	if e.Received != nil {
+		if t.FirstReceived == nil || e.Received.First_received.Before(*t.FirstReceived) {
+			first := e.Received.First_received
+			t.FirstReceived = &first
+		}
+		if t.LastReceived == nil || e.Received.Last_received.After(*t.LastReceived) {
+			last := e.Received.Last_received
+			t.LastReceived = &last
+		}
+	}
+	end := len(e.Buffer)
+	if int(e.Header.Size) >= 32 && int(e.Header.Size) < end {
+		end = int(e.Header.Size)
+	}
+	t.Buffers = append(t.Buffers, ExportedBuffer{
+		Agent:           e.Agent,
+		BufferID:        e.Header.Buffer_id,
+		PrevBufferID:    e.Header.Prev_buffer_id,
+		BufferNumber:    e.Header.Buffer_number,
+		NullBufferCount: e.Header.Null_buffer_count,
+		Size:            e.Header.Size,
+		Acquired:        e.Header.Acquired,
+		Payload:         encode(e.Buffer[32:end]),
+	})
+}
+
+func main() {
+	trace := flag.String("trace", "", "Comma-separated trace IDs to include.  Decimal, or hex with a 0x prefix.  If not specified, all traces are included.")
+	agent := flag.String("agent", "", "Only include buffers reported by this agent.")
+	from := flag.String("from", "", "Only include traces received after this time (RFC 3339, e.g. 2022-03-26T21:08:46Z).  Files in the older format have no receive times.")
+	to := flag.String("to", "", "Only include traces received before this time (RFC 3339).")
+	summary := flag.Bool("summary", false, "Print the number of buffers and bytes of each trace, instead of each buffer.")
+	export := flag.Bool("json", false, "Export the selected traces as JSON, including buffer payloads.")
+	encoding := flag.String("encoding", "base64", "Encoding of payloads exported with -json; either base64 or hex.  Default base64.")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: hindsight-dump [flags] file")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	filename := flag.Arg(0)
+
+	var filter Filter
+	var err error
+	filter.agent = *agent
+	filter.traces, err = parseTraceIDs(*trace)
+	if err == nil && *from != "" {
+		filter.from, err = time.Parse(time.RFC3339, *from)
+	}
+	if err == nil && *to != "" {
+		filter.to, err = time.Parse(time.RFC3339, *to)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var encode func([]byte) string
+	switch *encoding {
+	case "base64":
+		encode = base64.StdEncoding.EncodeToString
+	case "hex":
+		encode = hex.EncodeToString
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown encoding", *encoding, "-- must be base64 or hex")
+		os.Exit(2)
+	}
+
+	summaries := make(map[uint64]*TraceSummary)
+	exported := make(map[uint64]*ExportedTrace)
+	var order []uint64
+	if !*summary && !*export {
+		fmt.Printf("%-24s  %-20s  %10s  %10s  %10s  %20s\n", "agent", "trace_id", "buffer_id", "prev_id", "size", "acquired")
+	}
+	legacy, readErr := readFile(filename, func(e *Entry) {
+		if !filter.matches(e) {
+			return
+		}
+		switch {
+		case *export:
+			exportEntry(exported, &order, e, encode)
+		case *summary:
+			t, ok := summaries[e.Header.Trace_id]
+			if !ok {
+				t = &TraceSummary{TraceID: e.Header.Trace_id, Agents: make(map[string]bool)}
+				summaries[e.Header.Trace_id] = t
+			}
+			t.Buffers++
+			t.Bytes += len(e.Buffer)
+			t.Agents[e.Agent] = true
+		default:
+			printEntry(e)
+		}
+	})
+	if legacy && (*from != "" || *to != "") {
+		fmt.Fprintln(os.Stderr, filename, "is in the older format, which has no receive times; -from and -to were ignored")
+	}
+
+	if *export {
+		traces := make([]*ExportedTrace, 0, len(order))
+		for _, trace_id := range order {
+			traces = append(traces, exported[trace_id])
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(traces)
+	} else if *summary {
+		printSummary(summaries)
+	}
+
+	if readErr != nil {
+		fmt.Fprintln(os.Stderr, readErr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"google.golang.org/grpc"
+)
+
+/*
+Queries the coordinator for the breadcrumb graph of a trace or trigger, and
+prints it as JSON or Graphviz DOT, e.g.
+
+  go run cmd/query/main.go -trace 12345
+  go run cmd/query/main.go -trigger 7,12345 -format dot | dot -Tpng > trigger.png
+
+If coordinator state is sharded, give every coordinator with -c and the
+results are merged.
+*/
+
+type KnownAt struct {
+	Addr    string    `json:"addr"`
+	Learned time.Time `json:"learned"`
+}
+
+type TriggerID struct {
+	QueueID     int32  `json:"queue_id"`
+	BaseTraceID uint64 `json:"base_trace_id"`
+}
+
+type Trace struct {
+	TraceID      uint64      `json:"trace_id"`
+	KnownAt      []KnownAt   `json:"known_at"`
+	Triggers     []TriggerID `json:"triggers"`
+	Created      time.Time   `json:"created"`
+	LastModified time.Time   `json:"last_modified"`
+}
+
+type Trigger struct {
+	ID           TriggerID `json:"id"`
+	KnownAt      []KnownAt `json:"known_at"`
+	TraceIDs     []uint64  `json:"trace_ids"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type Result struct {
+	Traces   []*Trace   `json:"traces"`
+	Triggers []*Trigger `json:"triggers"`
+}
+
+func fromUnixMs(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+/* Merges known_at entries, keeping the earliest time for each agent */
+func mergeKnownAt(existing []KnownAt, info []*datapb.KnownAt) []KnownAt {
+	for _, k := range info {
+		learned := fromUnixMs(k.LearnedUnixMs)
+		found := false
+		for i := range existing {
+			if existing[i].Addr == k.Addr {
+				found = true
+				if learned.Before(existing[i].Learned) {
+					existing[i].Learned = learned
+				}
+			}
+		}
+		if !found {
+			existing = append(existing, KnownAt{k.Addr, learned})
+		}
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].Addr < existing[j].Addr })
+	return existing
+}
+
+func mergeTimes(created *time.Time, modified *time.Time, created_ms int64, modified_ms int64) {
+	if c := fromUnixMs(created_ms); created.IsZero() || c.Before(*created) {
+		*created = c
+	}
+	if m := fromUnixMs(modified_ms); m.After(*modified) {
+		*modified = m
+	}
+}
+
+/* Adds a reply from one coordinator to the result */
+func (r *Result) merge(rsp *datapb.QueryReply) {
+	for _, info := range rsp.Traces {
+		var trace *Trace
+		for _, t := range r.Traces {
+			if t.TraceID == info.TraceId {
+				trace = t
+			}
+		}
+		if trace == nil {
+			trace = &Trace{TraceID: info.TraceId}
+			r.Traces = append(r.Traces, trace)
+		}
+		trace.KnownAt = mergeKnownAt(trace.KnownAt, info.KnownAt)
+		for _, id := range info.Triggers {
+			tid := TriggerID{id.QueueId, id.BaseTraceId}
+			if !containsTrigger(trace.Triggers, tid) {
+				trace.Triggers = append(trace.Triggers, tid)
+			}
+		}
+		mergeTimes(&trace.Created, &trace.LastModified, info.CreatedUnixMs, info.LastModifiedUnixMs)
+	}
+
+	for _, info := range rsp.Triggers {
+		tid := TriggerID{info.Id.QueueId, info.Id.BaseTraceId}
+		var trigger *Trigger
+		for _, t := range r.Triggers {
+			if t.ID == tid {
+				trigger = t
+			}
+		}
+		if trigger == nil {
+			trigger = &Trigger{ID: tid}
+			r.Triggers = append(r.Triggers, trigger)
+		}
+		trigger.KnownAt = mergeKnownAt(trigger.KnownAt, info.KnownAt)
+		for _, trace_id := range info.TraceIds {
+			if !containsTrace(trigger.TraceIDs, trace_id) {
+				trigger.TraceIDs = append(trigger.TraceIDs, trace_id)
+			}
+		}
+		mergeTimes(&trigger.Created, &trigger.LastModified, info.CreatedUnixMs, info.LastModifiedUnixMs)
+	}
+}
+
+func containsTrigger(ids []TriggerID, id TriggerID) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTrace(ids []uint64, id uint64) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+/* Writes the result as a Graphviz digraph of triggers, traces, and agents */
+func (r *Result) writeDot(w *os.File) {
+	fmt.Fprintln(w, "digraph hindsight {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	agents := make(map[string]bool)
+	for _, trigger := range r.Triggers {
+		name := fmt.Sprintf("trigger_%d_%d", trigger.ID.QueueID, trigger.ID.BaseTraceID)
+		fmt.Fprintf(w, "  %q [shape=diamond, label=\"trigger\\nqueue %d\\nbase %d\"];\n", name, trigger.ID.QueueID, trigger.ID.BaseTraceID)
+		for _, trace_id := range trigger.TraceIDs {
+			fmt.Fprintf(w, "  %q -> %q;\n", name, fmt.Sprintf("trace_%d", trace_id))
+		}
+	}
+	for _, trace := range r.Traces {
+		name := fmt.Sprintf("trace_%d", trace.TraceID)
+		fmt.Fprintf(w, "  %q [shape=box, label=\"trace\\n%d\"];\n", name, trace.TraceID)
+		for _, k := range trace.KnownAt {
+			agents[k.Addr] = true
+			fmt.Fprintf(w, "  %q -> %q [label=%q];\n", name, k.Addr, k.Learned.Format("15:04:05.000"))
+		}
+	}
+	for addr := range agents {
+		fmt.Fprintf(w, "  %q [shape=ellipse];\n", addr)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func parseTrigger(value string) (*datapb.TriggerId, error) {
+	splits := strings.Split(value, ",")
+	if len(splits) != 2 {
+		return nil, fmt.Errorf("Invalid trigger %v -- must be of the form queue_id,base_trace_id", value)
+	}
+	queue_id, err := strconv.ParseInt(splits[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	base_trace_id, err := strconv.ParseUint(splits[1], 0, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &datapb.TriggerId{QueueId: int32(queue_id), BaseTraceId: base_trace_id}, nil
+}
+
+func query(addr string, creds grpc.DialOption, req *datapb.QueryRequest) (*datapb.QueryReply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, creds, grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return datapb.NewCoordinatorClient(conn).Query(ctx, req)
+}
+
+func main() {
+	coordinators := flag.String("c", "127.0.0.1:5252", "Address of the coordinator in form hostname:port.  If coordinator state is sharded, a comma-separated list of every coordinator.")
+	trace := flag.String("trace", "", "Trace ID to look up.  Decimal, or hex with a 0x prefix.")
+	trigger := flag.String("trigger", "", "Trigger to look up, in the form queue_id,base_trace_id.")
+	format := flag.String("format", "json", "Output format; either json or dot.  Default json.")
+	tlscert := flag.String("tls_cert", "", "Client certificate file (PEM), if the coordinator requires mutual TLS.")
+	tlskey := flag.String("tls_key", "", "Private key file (PEM) for -tls_cert.")
+	tlsca := flag.String("tls_ca", "", "CA certificate file (PEM) used to verify the coordinator.  If not specified, connections are plaintext.")
+	flag.Parse()
+
+	var req datapb.QueryRequest
+	var err error
+	switch {
+	case *trigger != "":
+		req.Trigger, err = parseTrigger(*trigger)
+	case *trace != "":
+		req.TraceId, err = strconv.ParseUint(*trace, 0, 64)
+	default:
+		err = fmt.Errorf("Specify -trace or -trigger")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *format != "json" && *format != "dot" {
+		fmt.Fprintln(os.Stderr, "Unknown format", *format, "-- must be json or dot")
+		os.Exit(2)
+	}
+
+	tls := util.TLSConfig{CertFile: *tlscert, KeyFile: *tlskey, CAFile: *tlsca}
+	creds, err := tls.DialOption()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to configure TLS:", err)
+		os.Exit(1)
+	}
+
+	var result Result
+	for _, addr := range util.ParseNodes(*coordinators) {
+		rsp, err := query(addr, creds, &req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to query coordinator %s: %v\n", addr, err)
+			os.Exit(1)
+		}
+		result.merge(rsp)
+	}
+
+	if *format == "dot" {
+		result.writeDot(os.Stdout)
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(&result)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/collector"
+)
+
+/*
+Reads traces from a collector's indexed trace store (the collector's -store
+directory), e.g.
+
+  go run cmd/tracestore/main.go get -store /local/traces 12345
+  go run cmd/tracestore/main.go list -store /local/traces -since 10m
+  go run cmd/tracestore/main.go verify -store /local/traces
+
+The store can be read while the collector is writing to it.
+*/
+
+type Buffer struct {
+	Agent  string `json:"agent"`
+	Size   int    `json:"size"`
+	Buffer []byte `json:"buffer"` // base64
+}
+
+type Trace struct {
+	TraceID       uint64    `json:"trace_id"`
+	FirstReceived time.Time `json:"first_received"`
+	LastReceived  time.Time `json:"last_received"`
+	Agents        []string  `json:"agents"`
+	Buffers       []Buffer  `json:"buffers"`
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: tracestore get|list|verify -store dir [flags]")
+	fmt.Fprintln(os.Stderr, "  get -store dir trace_id     prints a trace and its buffers as JSON")
+	fmt.Fprintln(os.Stderr, "  list -store dir [-since d | -from t -to t]")
+	fmt.Fprintln(os.Stderr, "                              lists traces received in a time window")
+	fmt.Fprintln(os.Stderr, "  verify -store dir           checks every record of every segment")
+	os.Exit(2)
+}
+
+func openStore(dir string) *collector.Store {
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "Specify the store directory with -store")
+		os.Exit(2)
+	}
+	store, err := collector.OpenStoreReadOnly(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to open trace store:", err)
+		os.Exit(1)
+	}
+	return store
+}
+
+func get(args []string) {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	dir := flags.String("store", "", "Directory of the trace store.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	trace_id, err := strconv.ParseUint(flags.Arg(0), 0, 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid trace ID:", err)
+		os.Exit(2)
+	}
+
+	record, err := openStore(*dir).ReadTrace(trace_id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read trace:", err)
+		os.Exit(1)
+	}
+	if record == nil {
+		fmt.Fprintf(os.Stderr, "Trace %d is not in the store\n", trace_id)
+		os.Exit(1)
+	}
+
+	trace := Trace{record.Trace_id, record.First_received, record.Last_received, record.Agents, nil}
+	for _, buf := range record.Buffers {
+		trace.Buffers = append(trace.Buffers, Buffer{record.Agents[buf.Agent], len(buf.Buffer), buf.Buffer})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(&trace)
+}
+
+func list(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := flags.String("store", "", "Directory of the trace store.")
+	since := flags.Duration("since", 0, "List traces received within this long of now, e.g. 10m.")
+	from := flags.String("from", "", "List traces received after this time (RFC 3339, e.g. 2022-03-26T21:08:46Z).")
+	to := flags.String("to", "", "List traces received before this time (RFC 3339).  Default now.")
+	flags.Parse(args)
+
+	window_from, window_to := time.Time{}, time.Now()
+	var err error
+	if *since > 0 {
+		window_from = window_to.Add(-*since)
+	}
+	if *from != "" {
+		window_from, err = time.Parse(time.RFC3339, *from)
+	}
+	if err == nil && *to != "" {
+		window_to, err = time.Parse(time.RFC3339, *to)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid time:", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("%-20s  %-30s  %-30s  %7s  %10s\n", "trace_id", "first_received", "last_received", "records", "bytes")
+	for _, t := range openStore(*dir).List(window_from, window_to) {
+		fmt.Printf("%-20d  %-30s  %-30s  %7d  %10d\n", t.Trace_id, t.First_received.Format(time.RFC3339Nano), t.Last_received.Format(time.RFC3339Nano), t.Records, t.Bytes)
+	}
+}
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := flags.String("store", "", "Directory of the trace store.")
+	flags.Parse(args)
+
+	failed := false
+	for _, status := range openStore(*dir).Verify() {
+		if len(status.Errors) == 0 {
+			fmt.Printf("segment %d: %d records, %d bytes, OK\n", status.Id, status.Records, status.Bytes)
+			continue
+		}
+		failed = true
+		fmt.Printf("segment %d: %d records, %d bytes, %d errors\n", status.Id, status.Records, status.Bytes, len(status.Errors))
+		for _, err := range status.Errors {
+			fmt.Println("   ", err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "get":
+		get(os.Args[2:])
+	case "list":
+		list(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	default:
+		usage()
+	}
+}
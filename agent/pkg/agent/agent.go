@@ -9,6 +9,7 @@ import (
 
 	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
 	"github.com/geraldleizhang/hindsight/agent/pkg/telemetry"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
 )
 
 type Agent struct {
@@ -85,6 +86,60 @@ func InitAgent2(fname string, local_hostname string, local_port string, coordina
 	return &agent
 }
 
+/*
+Configures the queue that holds local triggers and breadcrumbs while the
+coordinator is unreachable.  If dir is non-empty the queue is backed by a
+file in dir and survives agent restarts.  Must be called before Run.
+*/
+func (agent *Agent) ConfigureOutboundQueue(capacity int, policy OutboundPolicy, dir string) (err error) {
+	fmt.Printf("  Outbound queue holds up to %d batches (%v)\n", capacity, policy)
+	if dir != "" {
+		fmt.Println("  Outbound queue is backed by", dir)
+	}
+	return agent.coordinator.ConfigureOutboundQueues(capacity, policy, dir)
+}
+
+/*
+Selects between reporting to the coordinator and sending triggers directly
+to other agents.  Must be called before Run.
+*/
+func (agent *Agent) ConfigureCoordinatorMode(mode CoordinatorMode, max_hops int) {
+	if mode == PeerToPeer {
+		fmt.Printf("  Peer-to-peer mode; triggers are forwarded up to %d hops\n", max_hops)
+	}
+	agent.coordinator.ConfigureMode(mode, max_hops)
+}
+
+/*
+Sets how many MB of reported trace data to keep until the collector
+acknowledges it has durably written it; unacknowledged data is resent after
+reconnecting to the collector.  0 disables acks, for collectors that predate
+them.  Must be called before Run.
+*/
+func (agent *Agent) ConfigureReportingAcks(max_unacked_mb int) {
+	if max_unacked_mb > 0 {
+		fmt.Printf("  Keeping up to %d MB of reported data until the collector acknowledges it\n", max_unacked_mb)
+	} else {
+		fmt.Println("  Reporting without collector acknowledgements")
+	}
+	agent.reporting.ConfigureAcks(max_unacked_mb * 1024 * 1024)
+}
+
+/*
+Enables TLS on the agent's connections to the coordinator and collector, and
+on the agent's remote trigger server.  Since the agent accepts connections,
+a CA requires a certificate and key too.  Must be called before Run.
+*/
+func (agent *Agent) ConfigureTLS(config util.TLSConfig) error {
+	if err := config.Validate(true); err != nil {
+		return err
+	}
+	fmt.Println("  Connections use", config.String())
+	agent.coordinator.tls = config
+	agent.reporting.tls = config
+	return nil
+}
+
 /* Invoked during agent initialization; just creates and links up the
 the appropriate telemetry loggers according to agent init arguments */
 func (agent *Agent) initTelemetry(report_interval time.Duration, telemetry_filename string, verbose bool, debug bool) error {
@@ -192,7 +247,6 @@ func (agent *Agent) processCompletedBuffers(batch memory.CompleteBatch) {
 */
 func (agent *Agent) processBreadcrumbs(batch memory.BreadcrumbBatch) {
 	to_report := make(map[uint64][]string)
-	num_to_report := 0
 	for trace_id, breadcrumbs := range batch {
 		/* Ignore trace ID 0 */
 		if trace_id == 0 {
@@ -203,25 +257,18 @@ func (agent *Agent) processBreadcrumbs(batch memory.BreadcrumbBatch) {
 		breadcrumbs := agent.dm.AddBreadcrumbs(trace_id, breadcrumbs)
 		if len(breadcrumbs) > 0 {
 			to_report[trace_id] = breadcrumbs
-			num_to_report += len(breadcrumbs)
 		}
 	}
 
 	/* Forward breadcrumbs as needed */
 	if len(to_report) > 0 {
-		select {
-		case agent.coordinator.breadcrumbs <- to_report:
-			break
-		default:
-			agent.metrics.dropped_breadcrumbs += num_to_report
-		}
+		agent.coordinator.Report(nil, to_report)
 	}
 }
 
 func (agent *Agent) processTriggers(batch []memory.Trigger) {
 	triggers_to_forward := make([]memory.Trigger, 0, len(batch))
 	breadcrumbs_to_forward := make(map[uint64][]string)
-	num_breadcrumbs_to_forward := 0
 	for _, t := range batch {
 		/* Add to the DataManager */
 		// TODO: update C struct to send lateral trace ids all in one or have two ids
@@ -237,35 +284,18 @@ func (agent *Agent) processTriggers(batch []memory.Trigger) {
 		for trace_id, addrs := range breadcrumbs {
 			if len(addrs) > 0 {
 				breadcrumbs_to_forward[trace_id] = append(breadcrumbs_to_forward[trace_id], addrs...)
-				num_breadcrumbs_to_forward += len(addrs)
 			}
 		}
 	}
 
-	/* Forward triggers and breadcrumbs */
-	if len(triggers_to_forward) > 0 {
-		select {
-		case agent.coordinator.localtriggers <- triggers_to_forward:
-			break
-		default:
-			// Connection to coordinator is bottlenecked; drop the triggers
-			agent.metrics.dropped_triggers += len(triggers_to_forward)
-		}
-	}
-	if len(breadcrumbs_to_forward) > 0 {
-		select {
-		case agent.coordinator.breadcrumbs <- breadcrumbs_to_forward:
-			break
-		default:
-			// Connection to coordinator is bottlenecked; drop the breadcrumbs
-			agent.metrics.dropped_breadcrumbs += num_breadcrumbs_to_forward
-		}
+	/* Forward triggers and breadcrumbs; the outbound queue applies its overflow policy if the coordinator is bottlenecked */
+	if len(triggers_to_forward) > 0 || len(breadcrumbs_to_forward) > 0 {
+		agent.coordinator.Report(triggers_to_forward, breadcrumbs_to_forward)
 	}
 }
 
 func (agent *Agent) processRemoteTriggers(batch []memory.Trigger) {
 	breadcrumbs_to_forward := make(map[uint64][]string)
-	num_breadcrumbs_to_forward := 0
 	for _, t := range batch {
 		queue := agent.tm.getQueue(t.Queue_id)
 		// TODO: update C struct to send lateral trace ids all in one or have two ids
@@ -275,19 +305,12 @@ func (agent *Agent) processRemoteTriggers(batch []memory.Trigger) {
 		for trace_id, addrs := range breadcrumbs {
 			if len(addrs) > 0 {
 				breadcrumbs_to_forward[trace_id] = append(breadcrumbs_to_forward[trace_id], addrs...)
-				num_breadcrumbs_to_forward += len(addrs)
 			}
 		}
 	}
 
 	if len(breadcrumbs_to_forward) > 0 {
-		select {
-		case agent.coordinator.breadcrumbs <- breadcrumbs_to_forward:
-			break
-		default:
-			// Connection to coordinator is bottlenecked; drop the breadcrumbs
-			agent.metrics.dropped_breadcrumbs += num_breadcrumbs_to_forward
-		}
+		agent.coordinator.Report(nil, breadcrumbs_to_forward)
 	}
 }
 
@@ -2,28 +2,61 @@ package agent
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
 	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
 	"google.golang.org/grpc"
 )
 
+/* Reported to the coordinator when registering */
+const AgentVersion = "0.2"
+
+var AgentCapabilities = []string{"connect-stream", "outbound-ack"}
+
+/*
+The agent's connection(s) to the coordinator.  Coordinator state can be
+sharded across several coordinators by trace ID; in that case the agent
+keeps a stream open to every coordinator, and routes each trace's triggers
+and breadcrumbs to the coordinator that owns the trace.
+
+In peer-to-peer mode (see p2p.go) there is no coordinator, and triggers are
+sent directly to other agents.
+*/
 type Coordinator struct {
 	datapb.UnimplementedAgentServer
 
 	enabled bool
 
-	local_addr  string // The address that the coordinator uses to contact us
-	local_port  string
-	remote_addr string // Address of the coordinator
+	local_addr string // The address that the coordinator uses to contact us
+	local_port string
+	tls        util.TLSConfig // Optional TLS for the coordinator connection and remote trigger server
+
+	mode           CoordinatorMode
+	p2p            *P2PDisseminator      // Only in peer-to-peer mode
+	shards         []*CoordinatorShard   // One per coordinator
+	ring           *util.HashRing        // Maps trace IDs to coordinators
+	remotetriggers chan []memory.Trigger // Remote triggers received from coordinator
 
-	localtriggers  chan []memory.Trigger    // Local triggers to be reported to coordinator
-	breadcrumbs    chan map[uint64][]string // Breadcrumbs to be reported to coordinator
-	remotetriggers chan []memory.Trigger    // Remote triggers received from coordinator
+	rejected_triggers    uint64 // Triggers the coordinator rejected because it was overloaded; accessed atomically
+	rejected_breadcrumbs uint64 // As above, for breadcrumbs
+}
+
+/* The connection to one coordinator */
+type CoordinatorShard struct {
+	r           *Coordinator
+	remote_addr string         // Address of the coordinator
+	outbound    *OutboundQueue // Local triggers and breadcrumbs to be reported to this coordinator
+	last_warn   time.Time      // Last time we warned about rejections
 }
 
 func InitCoordinator(enabled bool, local_hostname string, local_port string, remote_addr string) *Coordinator {
@@ -37,15 +70,142 @@ func (r *Coordinator) Init(enabled bool, local_hostname string, local_port strin
 
 	r.local_port = local_port
 	r.local_addr = local_hostname + ":" + local_port
-	r.remote_addr = remote_addr
 
-	r.localtriggers = make(chan []memory.Trigger, 500)
-	r.breadcrumbs = make(chan map[uint64][]string, 500)
+	// remote_addr may be a comma-separated list of coordinators
+	r.ring = util.NewHashRing(util.ParseNodes(remote_addr), util.DefaultVirtualNodes)
+	for _, addr := range r.ring.Nodes() {
+		r.shards = append(r.shards, &CoordinatorShard{r: r, remote_addr: addr, outbound: NewOutboundQueue(10000, DropOldest)})
+	}
+
 	r.remotetriggers = make(chan []memory.Trigger, 500)
 }
 
-/* Send a batch of local triggers to the coordinator */
-func (r *Coordinator) sendTriggers(rpcclient datapb.CoordinatorClient, triggers []memory.Trigger) error {
+/*
+Selects between reporting to the coordinator and peer-to-peer dissemination.
+In peer-to-peer mode, triggers are forwarded at most max_hops agents from
+where they fired.  Must be called before Run.
+*/
+func (r *Coordinator) ConfigureMode(mode CoordinatorMode, max_hops int) {
+	r.mode = mode
+	if mode == PeerToPeer {
+		r.p2p = NewP2PDisseminator(r.local_addr, max_hops, 100000)
+	} else {
+		r.p2p = nil
+	}
+}
+
+/* Returns the shard that owns trace_id */
+func (r *Coordinator) shardFor(trace_id uint64) *CoordinatorShard {
+	if len(r.shards) == 1 {
+		return r.shards[0]
+	}
+	owner := r.ring.Get(trace_id)
+	for _, shard := range r.shards {
+		if shard.remote_addr == owner {
+			return shard
+		}
+	}
+	return r.shards[0]
+}
+
+/*
+Enqueues local triggers and breadcrumbs to be reported, routing each trace's
+triggers and breadcrumbs to the coordinator that owns the trace.  Returns
+false if anything was dropped because an outbound queue is full.
+*/
+func (r *Coordinator) Report(triggers []memory.Trigger, breadcrumbs map[uint64][]string) bool {
+	if r.p2p != nil {
+		r.p2p.Trigger(triggers, "", 0)
+		r.p2p.Breadcrumbs(breadcrumbs)
+		return true
+	}
+	if len(r.shards) == 0 {
+		return false
+	}
+	if len(r.shards) == 1 {
+		return r.shards[0].outbound.Push(triggers, breadcrumbs)
+	}
+
+	shard_triggers := make(map[*CoordinatorShard][]memory.Trigger)
+	shard_breadcrumbs := make(map[*CoordinatorShard]map[uint64][]string)
+	for _, trigger := range triggers {
+		shard := r.shardFor(trigger.Trace_id)
+		shard_triggers[shard] = append(shard_triggers[shard], trigger)
+	}
+	for trace_id, addrs := range breadcrumbs {
+		shard := r.shardFor(trace_id)
+		if _, ok := shard_breadcrumbs[shard]; !ok {
+			shard_breadcrumbs[shard] = make(map[uint64][]string)
+		}
+		shard_breadcrumbs[shard][trace_id] = addrs
+	}
+
+	accepted := true
+	for _, shard := range r.shards {
+		if len(shard_triggers[shard]) > 0 || len(shard_breadcrumbs[shard]) > 0 {
+			accepted = shard.outbound.Push(shard_triggers[shard], shard_breadcrumbs[shard]) && accepted
+		}
+	}
+	return accepted
+}
+
+/*
+Configures the outbound queue of each shard.  With more than one coordinator,
+each shard's queue is backed by a file in its own subdirectory of dir.
+*/
+func (r *Coordinator) ConfigureOutboundQueues(capacity int, policy OutboundPolicy, dir string) (err error) {
+	for _, shard := range r.shards {
+		if dir == "" {
+			shard.outbound = NewOutboundQueue(capacity, policy)
+			continue
+		}
+		shard_dir := dir
+		if len(r.shards) > 1 {
+			shard_dir = filepath.Join(dir, strings.ReplaceAll(shard.remote_addr, ":", "_"))
+		}
+		shard.outbound, err = OpenOutboundQueue(capacity, policy, shard_dir)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/* Total number of unacknowledged outbound entries across all shards */
+func (r *Coordinator) OutboundLen() (total int) {
+	for _, shard := range r.shards {
+		total += shard.outbound.Len()
+	}
+	return
+}
+
+/* Returns and resets the number of triggers and breadcrumbs rejected by coordinators */
+func (r *Coordinator) TakeRejected() (triggers int, breadcrumbs int) {
+	triggers = int(atomic.SwapUint64(&r.rejected_triggers, 0))
+	breadcrumbs = int(atomic.SwapUint64(&r.rejected_breadcrumbs, 0))
+	return
+}
+
+/* As OutboundQueue.TakeDropped, summed across all shards */
+func (r *Coordinator) TakeOutboundDropped() (triggers int, breadcrumbs int) {
+	for _, shard := range r.shards {
+		t, b := shard.outbound.TakeDropped()
+		triggers += t
+		breadcrumbs += b
+	}
+	return
+}
+
+/* In peer-to-peer mode, returns and resets the number of triggers that weren't sent to other agents */
+func (r *Coordinator) TakeP2PUndelivered() int {
+	if r.p2p == nil {
+		return 0
+	}
+	return r.p2p.TakeUndelivered()
+}
+
+/* Convert a batch of local triggers to the wire format */
+func (r *Coordinator) triggerRequest(triggers []memory.Trigger) *datapb.TriggerRequest {
 	var request datapb.TriggerRequest
 	request.Src = r.local_addr
 
@@ -57,22 +217,33 @@ func (r *Coordinator) sendTriggers(rpcclient datapb.CoordinatorClient, triggers
 		request.Triggers = append(request.Triggers, &t)
 	}
 
-	if r.enabled {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		_, err := rpcclient.LocalTrigger(ctx, &request)
+	return &request
+}
 
-		return err
+/*
+Received a batch of remote triggers over the legacy unary RPC, or in
+peer-to-peer mode, from another agent
+*/
+func (r *Coordinator) RemoteTrigger(ctx context.Context, in *datapb.TriggerRequest) (*datapb.TriggerReply, error) {
+	if r.p2p != nil {
+		triggers := r.p2p.Trigger(remoteTriggers(in), in.Src, int(in.Hops))
+		r.deliverRemoteTriggers(triggers)
+		return &datapb.TriggerReply{Accepted: int32(len(in.Triggers))}, nil
 	}
-
-	return nil
+	r.receiveRemoteTriggers(in)
+	return &datapb.TriggerReply{}, nil
 }
 
-/* Received a batch of remote triggers from the coordinator */
-func (r *Coordinator) RemoteTrigger(ctx context.Context, in *datapb.TriggerRequest) (*datapb.TriggerReply, error) {
+/*
+Converts received remote triggers into memory.Triggers and hands them to the
+agent.  Used for triggers received over the Connect stream and over the
+legacy RemoteTrigger RPC.
+*/
+func (r *Coordinator) receiveRemoteTriggers(in *datapb.TriggerRequest) {
+	r.deliverRemoteTriggers(remoteTriggers(in))
+}
 
-	var triggers []memory.Trigger
+func remoteTriggers(in *datapb.TriggerRequest) (triggers []memory.Trigger) {
 	for _, trigger := range in.Triggers {
 		for _, traceid := range trigger.GetTraceIds() {
 			// TODO: update memory.Trigger with list of trace ids
@@ -83,7 +254,10 @@ func (r *Coordinator) RemoteTrigger(ctx context.Context, in *datapb.TriggerReque
 			triggers = append(triggers, mt)
 		}
 	}
+	return
+}
 
+func (r *Coordinator) deliverRemoteTriggers(triggers []memory.Trigger) {
 	if len(triggers) > 0 {
 		select {
 		case r.remotetriggers <- triggers:
@@ -93,12 +267,14 @@ func (r *Coordinator) RemoteTrigger(ctx context.Context, in *datapb.TriggerReque
 			// TODO: counters here
 		}
 	}
-
-	return &datapb.TriggerReply{}, nil
 }
 
-/* After we are connected to the coordinator, this loops over the outgoing breadcrumbs, reporting them in batches */
-func (r *Coordinator) BreadcrumbsLoop(ctx context.Context) {
+/*
+Connects to the coordinator in a loop.  Once connected, local triggers and
+breadcrumbs are streamed up to the coordinator, and remote triggers are
+streamed back down on the same connection.
+*/
+func (shard *CoordinatorShard) StreamLoop(ctx context.Context) {
 	firsttime := true
 	for {
 		select {
@@ -108,10 +284,10 @@ func (r *Coordinator) BreadcrumbsLoop(ctx context.Context) {
 			break
 		}
 
-		conn, err := grpc.Dial(r.remote_addr, grpc.WithInsecure(), grpc.WithTimeout(10*time.Second))
+		err := shard.connectAndStream(ctx)
 		if err != nil {
 			if firsttime {
-				log.Printf("Unable to send breadcrumbs to %s; will retry every 2 seconds (reason: %s)\n", r.remote_addr, err.Error())
+				log.Printf("Unable to connect to coordinator %s; will retry every 2 seconds (reason: %s)\n", shard.remote_addr, err.Error())
 				firsttime = false
 			}
 			select {
@@ -120,71 +296,195 @@ func (r *Coordinator) BreadcrumbsLoop(ctx context.Context) {
 			case <-time.After(2 * time.Second):
 				continue
 			}
-			continue
 		}
-		defer conn.Close()
 
-		rpcclient := datapb.NewCoordinatorClient(conn)
+		firsttime = true
+	}
+}
 
-		err = r.ReportBreadcrumbs(ctx, rpcclient)
-		if err != nil {
-			if firsttime {
-				log.Printf("Unable to send breadcrumbs to %s; will retry every 2 seconds (reason: %s)\n", r.remote_addr, err.Error())
-				firsttime = false
-			}
-			select {
-			case <-ctx.Done():
+func (shard *CoordinatorShard) connectAndStream(ctx context.Context) error {
+	creds, err := shard.r.tls.DialOption()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(shard.remote_addr, creds, grpc.WithBlock(), grpc.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := datapb.NewCoordinatorClient(conn)
+
+	heartbeat_interval, err := shard.register(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	streamctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go shard.heartbeatLoop(streamctx, client, heartbeat_interval)
+
+	stream, err := client.Connect(streamctx)
+	if err != nil {
+		return err
+	}
+
+	// Identify ourselves to the coordinator
+	err = stream.Send(&datapb.AgentMessage{Src: shard.r.local_addr})
+	if err != nil {
+		return err
+	}
+	log.Println("Connected to coordinator", shard.remote_addr)
+
+	// Replay anything that wasn't acknowledged on a previous connection
+	shard.outbound.Rewind()
+
+	// Receive remote triggers, acknowledgements, and rejections until the stream breaks
+	recv_err := make(chan error, 1)
+	rejections := make(chan *datapb.CoordinatorMessage, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recv_err <- err
 				return
-			case <-time.After(2 * time.Second):
-				continue
 			}
+			if msg.Triggers != nil {
+				shard.r.receiveRemoteTriggers(msg.Triggers)
+			}
+			if msg.Ack != 0 {
+				shard.outbound.Ack(msg.Ack)
+			}
+			if msg.Rejected != 0 {
+				select {
+				case rejections <- msg:
+				default:
+					// Already backing off
+				}
+			}
+		}
+	}()
+
+	err = shard.sendLoop(streamctx, stream, recv_err, rejections)
+	stream.CloseSend()
+	return err
+}
+
+/* Announces this agent to the coordinator; returns the requested heartbeat interval */
+func (shard *CoordinatorShard) register(ctx context.Context, client datapb.CoordinatorClient) (time.Duration, error) {
+	var request datapb.RegisterRequest
+	request.Src = shard.r.local_addr
+	request.Version = AgentVersion
+	request.Capabilities = AgentCapabilities
+
+	rsp, err := client.Register(ctx, &request)
+	if err != nil {
+		return 0, err
+	}
+	interval := time.Duration(rsp.HeartbeatIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return interval, nil
+}
+
+/*
+Heartbeats the coordinator until ctx is cancelled.  If the coordinator has
+forgotten about us (e.g. it restarted, or declared us dead), registers again.
+Failed heartbeats are ignored; a broken connection is detected by the stream.
+*/
+func (shard *CoordinatorShard) heartbeatLoop(ctx context.Context, client datapb.CoordinatorClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rsp, err := client.Heartbeat(ctx, &datapb.HeartbeatRequest{Src: shard.r.local_addr})
+		if err != nil || rsp.Registered {
 			continue
 		}
 
-		firsttime = true
+		log.Println("Coordinator does not know about us; registering again")
+		new_interval, err := shard.register(ctx, client)
+		if err == nil && new_interval != interval {
+			interval = new_interval
+			ticker.Reset(interval)
+		}
 	}
 }
 
-func (r *Coordinator) ReportBreadcrumbs(ctx context.Context, rpcclient datapb.CoordinatorClient) error {
+/*
+Loops over the outbound queue, streaming local triggers and breadcrumbs to
+the coordinator in batches.  Entries remain in the outbound queue until the
+coordinator acknowledges them.
+*/
+func (shard *CoordinatorShard) sendLoop(ctx context.Context, stream datapb.Coordinator_ConnectClient, recv_err chan error, rejections chan *datapb.CoordinatorMessage) error {
+	// Breadcrumb addresses are sent as IDs; the mapping is scoped to the stream
 	addr_to_id := make(map[string]int32)
 	seed := int32(0)
+	replay := false
 
 	for {
-		// Accumulate a batch of up to 100 breadcrumbs
-		var accumulated []map[uint64][]string
-
-		// Block waiting for some breadcrumbs
-		for len(accumulated) == 0 {
-			select {
-			case <-ctx.Done():
-				return nil
-			case breadcrumbs := <-r.breadcrumbs:
-				if len(breadcrumbs) > 0 {
-					accumulated = append(accumulated, breadcrumbs)
-				}
+		// Back off if the coordinator is overloaded
+		select {
+		case rejection := <-rejections:
+			err := shard.backoff(ctx, rejection, recv_err)
+			if err != nil || ctx.Err() != nil {
+				return err
 			}
+			replay = true
+
+			// Rejected messages may have carried address mappings; start afresh
+			addr_to_id = make(map[string]int32)
+			seed = 0
+		default:
 		}
 
-		// Now try to batch as many additional breadcrumbs as possible (without blocking)
-	Accumulation:
-		for len(accumulated) < 100 {
+		// Take a batch of up to 100 entries
+		entries := shard.outbound.Next(100)
+
+		// Block waiting for some triggers or breadcrumbs
+		if len(entries) == 0 {
 			select {
 			case <-ctx.Done():
 				return nil
-			case breadcrumbs := <-r.breadcrumbs:
-				if len(breadcrumbs) > 0 {
-					accumulated = append(accumulated, breadcrumbs)
+			case err := <-recv_err:
+				return streamError(err)
+			case rejection := <-rejections:
+				err := shard.backoff(ctx, rejection, recv_err)
+				if err != nil || ctx.Err() != nil {
+					return err
 				}
-			default:
-				break Accumulation
+				replay = true
+				addr_to_id = make(map[string]int32)
+				seed = 0
+				continue
+			case <-shard.outbound.Ready():
+				continue
 			}
 		}
 
+		var msg datapb.AgentMessage
+		msg.Seq = entries[len(entries)-1].Seq
+		msg.Replay = replay
+
+		var triggers []memory.Trigger
+		for _, entry := range entries {
+			triggers = append(triggers, entry.Triggers...)
+		}
+		if len(triggers) > 0 {
+			msg.Triggers = shard.r.triggerRequest(triggers)
+		}
+
 		// Construct RPC request object, mapping from string addrs to ints
 		var request datapb.BreadcrumbsRequest
-		request.Src = r.local_addr
-		for _, breadcrumbs := range accumulated {
-			for trace_id, addrs := range breadcrumbs {
+		request.Src = shard.r.local_addr
+		for _, entry := range entries {
+			for trace_id, addrs := range entry.Breadcrumbs {
 				var bcs datapb.Breadcrumbs
 				bcs.TraceId = trace_id
 				request.Breadcrumbs = append(request.Breadcrumbs, &bcs)
@@ -206,91 +506,67 @@ func (r *Coordinator) ReportBreadcrumbs(ctx context.Context, rpcclient datapb.Co
 				}
 			}
 		}
+		if len(request.Breadcrumbs) > 0 {
+			msg.Breadcrumbs = &request
+		}
 
-		if r.enabled {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			_, err := rpcclient.Breadcrumbs(ctx, &request)
+		if shard.r.enabled {
+			err := stream.Send(&msg)
 			if err != nil {
 				return err
 			}
+			replay = false
+		} else {
+			shard.outbound.Ack(msg.Seq)
 		}
 	}
 }
 
-func (r *Coordinator) TriggersLoop(ctx context.Context) {
-	firsttime := true
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			break
-		}
-
-		conn, err := grpc.Dial(r.remote_addr, grpc.WithInsecure(), grpc.WithTimeout(10*time.Second))
-		if err != nil {
-			if firsttime {
-				log.Printf("Unable to send local triggers to %s; will retry every 2 seconds (reason: %s)\n", r.remote_addr, err.Error())
-				firsttime = false
-			}
-			time.Sleep(time.Duration(2) * time.Second)
-			continue
-		}
-		defer conn.Close()
-
-		rpcclient := datapb.NewCoordinatorClient(conn)
-
-		err = r.ReportTriggers(ctx, rpcclient)
-		if err != nil {
-			if firsttime {
-				log.Printf("Unable to send local triggers to %s; will retry every 2 seconds (reason: %s)\n", r.remote_addr, err.Error())
-				firsttime = false
-			}
-			time.Sleep(time.Duration(2) * time.Second)
-			continue
-		}
-
-		firsttime = true
+func streamError(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("Coordinator closed the stream")
 	}
+	return err
 }
 
-func (r *Coordinator) ReportTriggers(ctx context.Context, rpcclient datapb.CoordinatorClient) error {
-	for {
-		// Accumulate a batch of up to 100 triggers
-		var accumulated []memory.Trigger
-
-		// Block waiting for some triggers
-		for len(accumulated) == 0 {
-			select {
-			case <-ctx.Done():
-				return nil
-			case triggers := <-r.localtriggers:
-				accumulated = append(accumulated, triggers...)
-			}
-		}
-
-		// Now try to batch as many additional triggers as possible (without blocking)
-	Accumulation:
-		for len(accumulated) < 100 {
-			select {
-			case <-ctx.Done():
-				return nil
-			case triggers := <-r.localtriggers:
-				accumulated = append(accumulated, triggers...)
-			default:
-				break Accumulation
-			}
-		}
+/*
+The coordinator rejected a message because it is overloaded, and discards
+everything we send until we replay.  Waits for the coordinator's retry hint,
+then rewinds the outbound queue so that the rejected message and everything
+after it are resent.  Rejected entries stay queued, so the outbound queue's
+overflow policy applies if the coordinator remains overloaded.
+*/
+func (shard *CoordinatorShard) backoff(ctx context.Context, rejection *datapb.CoordinatorMessage, recv_err chan error) error {
+	triggers := rejection.TriggerReply.GetRejected()
+	breadcrumbs := rejection.BreadcrumbsReply.GetRejected()
+	atomic.AddUint64(&shard.r.rejected_triggers, uint64(triggers))
+	atomic.AddUint64(&shard.r.rejected_breadcrumbs, uint64(breadcrumbs))
+
+	retry_after_ms := rejection.TriggerReply.GetRetryAfterMs()
+	if ms := rejection.BreadcrumbsReply.GetRetryAfterMs(); ms > retry_after_ms {
+		retry_after_ms = ms
+	}
+	retry_after := time.Duration(retry_after_ms) * time.Millisecond
+	if retry_after <= 0 {
+		retry_after = 100 * time.Millisecond
+	}
 
-		// Send them
-		err := r.sendTriggers(rpcclient, accumulated)
+	now := time.Now()
+	if now.After(shard.last_warn.Add(1 * time.Second)) {
+		log.Printf("Coordinator %s is overloaded and rejected %d triggers, %d breadcrumbs; retrying in %v\n", shard.remote_addr, triggers, breadcrumbs, retry_after)
+		shard.last_warn = now
+	}
 
-		if err != nil {
-			return err
-		}
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-recv_err:
+		return streamError(err)
+	case <-time.After(retry_after):
 	}
+
+	shard.outbound.Rewind()
+	return nil
 }
 
 func (r *Coordinator) Run(ctx context.Context, cancel context.CancelFunc) {
@@ -302,7 +578,13 @@ func (r *Coordinator) Run(ctx context.Context, cancel context.CancelFunc) {
 		cancel()
 		return
 	}
-	s := grpc.NewServer()
+	opts, err := r.tls.ServerOptions()
+	if err != nil {
+		log.Printf("Coordinator unable to configure TLS for remote triggers: %v\n", err)
+		cancel()
+		return
+	}
+	s := grpc.NewServer(opts...)
 	datapb.RegisterAgentServer(s, r)
 
 	go func() {
@@ -322,20 +604,30 @@ func (r *Coordinator) Run(ctx context.Context, cancel context.CancelFunc) {
 		log.Println("Stopped receiving remote triggers from coordinator")
 	}()
 
+	if r.p2p != nil {
+		log.Println("Triggers will be sent directly to other agents (peer-to-peer mode)")
+		r.p2p.Run(ctx, r.tls)
+		s.Stop()
+		return
+	}
+
+	log.Println("Triggers and breadcrumbs will be reported to", strings.Join(r.ring.Nodes(), ", "))
 	wg := new(sync.WaitGroup)
-	wg.Add(2)
-	go func() {
-		log.Println("Breadcrumbs will be reported to", r.remote_addr)
-		r.BreadcrumbsLoop(ctx)
-		log.Println("Stopped sending breadcrumbs to coordinator")
-		wg.Done()
-	}()
-	go func() {
-		log.Println("Triggers will be reported to", r.remote_addr)
-		r.TriggersLoop(ctx)
-		log.Println("Stopped sending local triggers to coordinator")
-		wg.Done()
-	}()
+	for _, shard := range r.shards {
+		wg.Add(1)
+		go func(shard *CoordinatorShard) {
+			shard.StreamLoop(ctx)
+			wg.Done()
+		}(shard)
+	}
 	wg.Wait()
+	log.Println("Stopped streaming to coordinator")
 	s.Stop()
+
+	for _, shard := range r.shards {
+		err = shard.outbound.Close()
+		if err != nil {
+			log.Println("Error closing outbound queue:", err)
+		}
+	}
 }
@@ -37,6 +37,11 @@ type Stats struct {
 	event_horizon        time.Duration
 	dropped_triggers     int
 	dropped_breadcrumbs  int
+	outbound_queued      int
+	outbound_dropped     int // Triggers and breadcrumbs dropped by the outbound queue
+	rejected_triggers    int
+	rejected_breadcrumbs int
+	p2p_undelivered      int
 
 	queue_totals QueueStats
 	queue_ids    []int
@@ -108,6 +113,8 @@ func (s *Stats) Str() string {
 	fmt.Fprintf(&b, "(%.0f bufs/s, %d bufs total), ", s.buffer_throughput, s.complete_buffers)
 	fmt.Fprintf(&b, "Avg batch %.1f, ", s.mean_batchsize)
 	fmt.Fprintf(&b, "Drops %d,%d ", s.dropped_triggers, s.dropped_breadcrumbs)
+	fmt.Fprintf(&b, "Outbound %d (dropped %d) ", s.outbound_queued, s.outbound_dropped)
+	fmt.Fprintf(&b, "Rejected %d,%d ", s.rejected_triggers, s.rejected_breadcrumbs)
 	if s.diagnostics != nil {
 		fmt.Fprintf(&b, "  ||  %v", s.diagnostics.Str())
 	}
@@ -142,6 +149,15 @@ func (agent *Agent) calculateAgentStats(duration_nanos float64, debug bool) Stat
 	stats.dropped_triggers = metrics.dropped_triggers
 	stats.dropped_breadcrumbs = metrics.dropped_breadcrumbs
 
+	/* Anything the outbound queue dropped while the coordinator was unreachable */
+	outbound_triggers, outbound_breadcrumbs := agent.coordinator.TakeOutboundDropped()
+	stats.outbound_dropped = outbound_triggers + outbound_breadcrumbs
+	stats.outbound_queued = agent.coordinator.OutboundLen()
+
+	/* Triggers and breadcrumbs the coordinator rejected; these are retried, not lost */
+	stats.rejected_triggers, stats.rejected_breadcrumbs = agent.coordinator.TakeRejected()
+	stats.p2p_undelivered = agent.coordinator.TakeP2PUndelivered()
+
 	if debug {
 		diagnostics := agent.calculateDiagnostics()
 		stats.diagnostics = &diagnostics
@@ -301,11 +317,16 @@ func (g *AgentTelemetryGenerator) Headers() []string {
 		"tput_evicted_triggers",
 
 		// Other percentages and instantaneous measurements
-		"cache_occupancy",     // How much of the cache capacity is used by data from this queue
-		"eviction_percent",    // How much triggered trace data is being lost
-		"internal_bottleneck", // For diagnostics - should be 0 most of the time - measures data dropped internally due to bottlenecks
-		"event_horizon_ms",    // For untriggered data, the time in cache before being evicted
-		"report_horizon_ms",   // For triggered traces, mean time until data is reported
+		"cache_occupancy",      // How much of the cache capacity is used by data from this queue
+		"eviction_percent",     // How much triggered trace data is being lost
+		"internal_bottleneck",  // For diagnostics - should be 0 most of the time - measures data dropped internally due to bottlenecks
+		"event_horizon_ms",     // For untriggered data, the time in cache before being evicted
+		"report_horizon_ms",    // For triggered traces, mean time until data is reported
+		"outbound_queued",      // Triggers and breadcrumb batches awaiting acknowledgement by the coordinator
+		"outbound_dropped",     // Triggers and breadcrumbs dropped by the outbound queue's overflow policy
+		"rejected_triggers",    // Triggers rejected by an overloaded coordinator, to be retried
+		"rejected_breadcrumbs", // Breadcrumbs rejected by an overloaded coordinator, to be retried
+		"p2p_undelivered",      // In peer-to-peer mode, triggers dropped because another agent was slow or unreachable
 	}
 }
 
@@ -365,6 +386,11 @@ func generateTotalsRow(agent *Agent, now time.Time, interval time.Duration, stat
 	internal_bottleneck := 100 * float64(stats.dropped_triggers) / float64(stats.queue_totals.trigger_count)
 	row["internal_bottleneck"] = strconv.FormatFloat(internal_bottleneck, 'f', 1, 64)
 	row["event_horizon_ms"] = strconv.FormatFloat(float64(stats.event_horizon)/float64(time.Millisecond), 'f', 0, 64)
+	row["outbound_queued"] = strconv.Itoa(stats.outbound_queued)
+	row["outbound_dropped"] = strconv.Itoa(stats.outbound_dropped)
+	row["rejected_triggers"] = strconv.Itoa(stats.rejected_triggers)
+	row["rejected_breadcrumbs"] = strconv.Itoa(stats.rejected_breadcrumbs)
+	row["p2p_undelivered"] = strconv.Itoa(stats.p2p_undelivered)
 
 	return row
 }
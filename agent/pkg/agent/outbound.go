@@ -0,0 +1,407 @@
+package agent
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+)
+
+/*
+This file defines the OutboundQueue, which holds local triggers and
+breadcrumbs until the coordinator has acknowledged them.  Entries are
+replayed in order whenever the connection to the coordinator is
+re-established.
+
+The queue is bounded; when full, either the oldest or the newest entry
+is dropped according to the configured OutboundPolicy.  The queue can
+optionally be backed by a file so that its contents survive an agent
+restart.
+*/
+type OutboundPolicy int
+
+const (
+	DropOldest OutboundPolicy = iota // When full, discard the oldest entry to make room
+	DropNewest                       // When full, discard the entry being enqueued
+)
+
+func ParseOutboundPolicy(name string) (OutboundPolicy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	}
+	return DropOldest, fmt.Errorf("Unknown outbound queue policy %q -- must be drop-oldest or drop-newest", name)
+}
+
+func (p OutboundPolicy) String() string {
+	if p == DropNewest {
+		return "drop-newest"
+	}
+	return "drop-oldest"
+}
+
+/* A batch of local triggers and/or breadcrumbs awaiting acknowledgement */
+type OutboundEntry struct {
+	Seq         uint64
+	Triggers    []memory.Trigger
+	Breadcrumbs map[uint64][]string
+}
+
+func (e *OutboundEntry) breadcrumbCount() (count int) {
+	for _, addrs := range e.Breadcrumbs {
+		count += len(addrs)
+	}
+	return
+}
+
+type OutboundQueue struct {
+	mu       sync.Mutex
+	entries  *list.List    // Unacknowledged entries, oldest first
+	unsent   *list.Element // First entry not yet sent on the current connection
+	capacity int
+	policy   OutboundPolicy
+	next_seq uint64
+	ready    chan struct{} // Signalled when there are entries to send
+
+	file     *os.File // Optional; nil if not disk-backed
+	acked    int      // Records in file that are no longer live
+	filename string
+
+	dropped_triggers    int
+	dropped_breadcrumbs int
+}
+
+/* Record types in the backing file */
+const (
+	outboundRecordEntry byte = 'E'
+	outboundRecordAck   byte = 'A'
+)
+
+/* Larger records in the backing file are taken to be corrupt */
+const maxOutboundRecordSize = 64 * 1024 * 1024
+
+func NewOutboundQueue(capacity int, policy OutboundPolicy) *OutboundQueue {
+	var q OutboundQueue
+	q.entries = list.New()
+	q.capacity = capacity
+	q.policy = policy
+	q.next_seq = 1
+	q.ready = make(chan struct{}, 1)
+	return &q
+}
+
+/*
+Creates an OutboundQueue backed by a file in dir.  Any entries left over from
+a previous run are loaded and will be sent once connected.  Writes are not
+fsynced; the file protects against agent restarts rather than host failures.
+*/
+func OpenOutboundQueue(capacity int, policy OutboundPolicy, dir string) (q *OutboundQueue, err error) {
+	q = NewOutboundQueue(capacity, policy)
+	q.filename = filepath.Join(dir, "outbound.log")
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	err = q.load()
+	if err != nil {
+		return
+	}
+
+	// Rewrite the file with just the live entries
+	err = q.rewrite()
+	if err != nil {
+		return
+	}
+
+	q.unsent = q.entries.Front()
+	if q.entries.Len() > 0 {
+		log.Printf("Loaded %d unacknowledged entries from %s\n", q.entries.Len(), q.filename)
+		q.signal()
+	}
+	return
+}
+
+func (q *OutboundQueue) load() error {
+	f, err := os.Open(q.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		kind, payload, err := readOutboundRecord(f)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// A truncated final record is expected if the agent crashed mid-write
+			log.Printf("Ignoring remainder of %s: %v\n", q.filename, err)
+			return nil
+		}
+
+		switch kind {
+		case outboundRecordEntry:
+			var entry OutboundEntry
+			err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry)
+			if err != nil {
+				// As for a truncated record, keep the entries read so far
+				log.Printf("Ignoring remainder of %s: %v\n", q.filename, err)
+				return nil
+			}
+			q.entries.PushBack(&entry)
+			if entry.Seq >= q.next_seq {
+				q.next_seq = entry.Seq + 1
+			}
+		case outboundRecordAck:
+			q.removeUpTo(binary.LittleEndian.Uint64(payload))
+		}
+	}
+}
+
+/*
+Rewrites the file with just the live entries.  The entries are written and
+fsynced to a temporary file that then replaces the old one, so that a crash
+part way through does not lose the queue.
+*/
+func (q *OutboundQueue) rewrite() error {
+	tmp := q.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for e := q.entries.Front(); e != nil && err == nil; e = e.Next() {
+		err = writeEntry(f, e.Value.(*OutboundEntry))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// Subsequent records are appended to the new file
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.acked = 0
+	return nil
+}
+
+func (q *OutboundQueue) writeEntry(entry *OutboundEntry) error {
+	return writeEntry(q.file, entry)
+}
+
+func writeEntry(f *os.File, entry *OutboundEntry) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(entry)
+	if err != nil {
+		return err
+	}
+	return writeOutboundRecord(f, outboundRecordEntry, buf.Bytes())
+}
+
+func (q *OutboundQueue) writeAck(seq uint64) error {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payload, seq)
+	return writeOutboundRecord(q.file, outboundRecordAck, payload)
+}
+
+func writeOutboundRecord(f *os.File, kind byte, payload []byte) error {
+	record := make([]byte, 5, 5+len(payload))
+	record[0] = kind
+	binary.LittleEndian.PutUint32(record[1:], uint32(len(payload)))
+	record = append(record, payload...)
+	_, err := f.Write(record)
+	return err
+}
+
+func readOutboundRecord(f *os.File) (kind byte, payload []byte, err error) {
+	header := make([]byte, 5)
+	_, err = io.ReadFull(f, header)
+	if err != nil {
+		return
+	}
+	kind = header[0]
+	size := binary.LittleEndian.Uint32(header[1:])
+	if size > maxOutboundRecordSize {
+		err = fmt.Errorf("Outbound queue record of %d bytes exceeds the maximum of %d", size, maxOutboundRecordSize)
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(f, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (q *OutboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+/* Signalled whenever there might be new entries to send */
+func (q *OutboundQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+/*
+Enqueues local triggers and/or breadcrumbs to be sent to the coordinator.
+Returns false if the entry was dropped because the queue is full.
+*/
+func (q *OutboundQueue) Push(triggers []memory.Trigger, breadcrumbs map[uint64][]string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := &OutboundEntry{Seq: q.next_seq, Triggers: triggers, Breadcrumbs: breadcrumbs}
+
+	if q.capacity > 0 && q.entries.Len() >= q.capacity {
+		if q.policy == DropNewest {
+			q.countDropped(entry)
+			return false
+		}
+		oldest := q.entries.Front()
+		q.countDropped(oldest.Value.(*OutboundEntry))
+		q.remove(oldest)
+		if q.file != nil {
+			q.writeAck(oldest.Value.(*OutboundEntry).Seq)
+		}
+	}
+
+	q.next_seq++
+	element := q.entries.PushBack(entry)
+	if q.unsent == nil {
+		q.unsent = element
+	}
+	if q.file != nil {
+		err := q.writeEntry(entry)
+		if err != nil {
+			log.Println("Error writing outbound queue entry to", q.filename, err)
+		}
+	}
+	q.signal()
+	return true
+}
+
+func (q *OutboundQueue) countDropped(entry *OutboundEntry) {
+	q.dropped_triggers += len(entry.Triggers)
+	q.dropped_breadcrumbs += entry.breadcrumbCount()
+}
+
+func (q *OutboundQueue) remove(element *list.Element) {
+	if element == q.unsent {
+		q.unsent = element.Next()
+	}
+	q.entries.Remove(element)
+	q.acked++
+}
+
+func (q *OutboundQueue) removeUpTo(seq uint64) {
+	for q.entries.Len() > 0 {
+		oldest := q.entries.Front()
+		if oldest.Value.(*OutboundEntry).Seq > seq {
+			break
+		}
+		q.remove(oldest)
+	}
+}
+
+/*
+Returns up to max entries that have not yet been sent on the current
+connection, marking them as sent.  Non-blocking; returns nil if there
+is nothing to send.
+*/
+func (q *OutboundQueue) Next(max int) (entries []*OutboundEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.unsent != nil && len(entries) < max {
+		entries = append(entries, q.unsent.Value.(*OutboundEntry))
+		q.unsent = q.unsent.Next()
+	}
+	return
+}
+
+/* The coordinator has processed all entries up to and including seq */
+func (q *OutboundQueue) Ack(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	before := q.entries.Len()
+	q.removeUpTo(seq)
+	if q.file == nil || q.entries.Len() == before {
+		return
+	}
+
+	/* Compact the file once it is mostly acknowledged entries */
+	if q.entries.Len() == 0 || (q.acked > 1000 && q.acked > 2*q.entries.Len()) {
+		err := q.rewrite()
+		if err != nil {
+			log.Println("Error compacting outbound queue", q.filename, err)
+		}
+	} else {
+		q.writeAck(seq)
+	}
+}
+
+/*
+Marks every unacknowledged entry as unsent, so that they are replayed in
+order on the next connection.
+*/
+func (q *OutboundQueue) Rewind() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.unsent = q.entries.Front()
+	if q.unsent != nil {
+		q.signal()
+	}
+}
+
+/* Number of unacknowledged entries */
+func (q *OutboundQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.entries.Len()
+}
+
+/* Returns and resets the number of triggers and breadcrumbs dropped due to overflow */
+func (q *OutboundQueue) TakeDropped() (triggers int, breadcrumbs int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	triggers, breadcrumbs = q.dropped_triggers, q.dropped_breadcrumbs
+	q.dropped_triggers, q.dropped_breadcrumbs = 0, 0
+	return
+}
+
+func (q *OutboundQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file != nil {
+		return q.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func seqs(entries []*OutboundEntry) (s []uint64) {
+	for _, entry := range entries {
+		s = append(s, entry.Seq)
+	}
+	return
+}
+
+func TestOutboundQueueReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewOutboundQueue(10, DropOldest)
+	for i := 0; i < 5; i++ {
+		assert.True(q.Push([]memory.Trigger{{Queue_id: i}}, nil), "Push should succeed")
+	}
+
+	assert.Equal([]uint64{1, 2, 3}, seqs(q.Next(3)), "First batch")
+	assert.Equal([]uint64{4, 5}, seqs(q.Next(3)), "Second batch")
+	assert.Equal(0, len(q.Next(3)), "Nothing left to send")
+
+	q.Ack(2)
+	assert.Equal(3, q.Len(), "Acked entries are removed")
+
+	// Connection drops; everything unacked gets resent in order
+	q.Rewind()
+	assert.Equal([]uint64{3, 4, 5}, seqs(q.Next(10)), "Unacked entries are replayed")
+
+	q.Ack(5)
+	assert.Equal(0, q.Len(), "All entries acked")
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewOutboundQueue(2, DropOldest)
+	q.Push([]memory.Trigger{{Queue_id: 1}}, nil)
+	q.Push(nil, map[uint64][]string{7: {"a", "b"}})
+	assert.True(q.Push([]memory.Trigger{{Queue_id: 3}}, nil), "drop-oldest accepts new entries")
+	assert.Equal([]uint64{2, 3}, seqs(q.Next(10)), "Oldest entry was dropped")
+	triggers, breadcrumbs := q.TakeDropped()
+	assert.Equal(1, triggers, "Dropped one trigger")
+	assert.Equal(0, breadcrumbs, "Dropped no breadcrumbs")
+
+	q = NewOutboundQueue(2, DropNewest)
+	q.Push([]memory.Trigger{{Queue_id: 1}}, nil)
+	q.Push([]memory.Trigger{{Queue_id: 2}}, nil)
+	assert.False(q.Push(nil, map[uint64][]string{7: {"a", "b"}}), "drop-newest rejects new entries")
+	assert.Equal([]uint64{1, 2}, seqs(q.Next(10)), "Newest entry was dropped")
+	triggers, breadcrumbs = q.TakeDropped()
+	assert.Equal(0, triggers, "Dropped no triggers")
+	assert.Equal(2, breadcrumbs, "Dropped two breadcrumbs")
+}
+
+func TestOutboundQueueDiskBacked(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	q, err := OpenOutboundQueue(10, DropOldest, dir)
+	assert.NoError(err)
+	q.Push([]memory.Trigger{{Queue_id: 1, Base_trace_id: 5, Trace_id: 5}}, nil)
+	q.Push(nil, map[uint64][]string{5: {"a:1"}})
+	q.Push([]memory.Trigger{{Queue_id: 3}}, nil)
+	q.Next(10)
+	q.Ack(1)
+	assert.NoError(q.Close())
+
+	// Reopen, as if the agent restarted
+	q, err = OpenOutboundQueue(10, DropOldest, dir)
+	assert.NoError(err)
+	entries := q.Next(10)
+	assert.Equal([]uint64{2, 3}, seqs(entries), "Unacked entries survive a restart")
+	assert.Equal([]string{"a:1"}, entries[0].Breadcrumbs[5], "Breadcrumbs are restored")
+
+	assert.True(q.Push(nil, nil))
+	assert.Equal([]uint64{4}, seqs(q.Next(10)), "Sequence numbers continue after a restart")
+	assert.NoError(q.Close())
+}
+
+func TestOutboundQueueCorruptFile(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, corrupt := range map[string][]byte{
+		"oversized record":  {outboundRecordEntry, 0xff, 0xff, 0xff, 0xff},
+		"undecodable entry": {outboundRecordEntry, 3, 0, 0, 0, 1, 2, 3},
+	} {
+		dir := t.TempDir()
+		q, err := OpenOutboundQueue(10, DropOldest, dir)
+		assert.NoError(err)
+		q.Push([]memory.Trigger{{Queue_id: 1}}, nil)
+		assert.NoError(q.Close())
+
+		f, err := os.OpenFile(filepath.Join(dir, "outbound.log"), os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(err)
+		f.Write(corrupt)
+		f.Close()
+
+		q, err = OpenOutboundQueue(10, DropOldest, dir)
+		assert.NoError(err, name)
+		assert.Equal([]uint64{1}, seqs(q.Next(10)), "Entries before the %s are kept", name)
+		assert.NoError(q.Close())
+
+		_, err = os.Stat(filepath.Join(dir, "outbound.log.tmp"))
+		assert.True(os.IsNotExist(err), "The rewritten file replaces the old one")
+	}
+}
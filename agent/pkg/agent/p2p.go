@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"google.golang.org/grpc"
+)
+
+/*
+In peer-to-peer mode the agent doesn't use a coordinator.  Breadcrumbs name
+other agents, so when a trigger fires the agent sends it straight to the
+agents named by the breadcrumbs of the trigger's traces, using their
+RemoteTrigger servers.  Recipients forward the trigger along their own
+breadcrumbs in the same way.
+
+Each agent remembers which triggers it has seen for each trace, so a trigger
+that comes back around a loop is ignored.  Triggers also carry a hop count,
+and are not forwarded more than max_hops agents from where they fired.
+*/
+type CoordinatorMode int
+
+const (
+	Centralized CoordinatorMode = iota // Triggers and breadcrumbs are reported to the coordinator
+	PeerToPeer                         // Triggers are sent directly to other agents
+)
+
+func ParseCoordinatorMode(name string) (CoordinatorMode, error) {
+	switch name {
+	case "centralized":
+		return Centralized, nil
+	case "p2p":
+		return PeerToPeer, nil
+	}
+	return Centralized, fmt.Errorf("Unknown coordinator mode %q -- must be centralized or p2p", name)
+}
+
+func (m CoordinatorMode) String() string {
+	if m == PeerToPeer {
+		return "p2p"
+	}
+	return "centralized"
+}
+
+const DefaultMaxHops = 8
+
+/* The triggers and breadcrumbs of one trace, for peer-to-peer dissemination */
+type p2pTrace struct {
+	id        uint64
+	triggers  map[TriggerID]int   // Triggers of the trace, and how many hops they had travelled
+	addrs     map[string]struct{} // Agents that the trace's triggers have been sent to
+	lru_entry *list.Element
+}
+
+/* Triggers bound for another agent */
+type p2pMessage struct {
+	addr string
+	req  *datapb.TriggerRequest
+}
+
+/*
+Peer-to-peer dissemination state.  Used by both the agent's processing loop
+and the RemoteTrigger server, so it is guarded by a mutex.  Only the most
+recently used traces are remembered.
+*/
+type P2PDisseminator struct {
+	undelivered uint64 // Triggers dropped rather than sent, for telemetry; first, so that it is aligned for atomic access
+
+	mu         sync.Mutex
+	local_addr string
+	max_hops   int
+	capacity   int
+	traces     map[uint64]*p2pTrace
+	lru        *list.List
+
+	outgoing     chan p2pMessage // Triggers to send to other agents
+	dropped      int             // Messages dropped because outgoing was full
+	last_warn    time.Time
+	idle         chan *p2pPeer // Send loops that have exited after idling
+	idle_timeout time.Duration
+}
+
+/* A send loop to one agent, and its queue of triggers */
+type p2pPeer struct {
+	addr     string
+	requests chan *datapb.TriggerRequest
+}
+
+func NewP2PDisseminator(local_addr string, max_hops int, capacity int) *P2PDisseminator {
+	var p P2PDisseminator
+	p.local_addr = local_addr
+	p.max_hops = max_hops
+	p.capacity = capacity
+	p.traces = make(map[uint64]*p2pTrace)
+	p.lru = list.New()
+	p.outgoing = make(chan p2pMessage, 10000)
+	p.idle = make(chan *p2pPeer)
+	p.idle_timeout = 1 * time.Minute
+	p.last_warn = time.Now()
+	return &p
+}
+
+func (p *P2PDisseminator) getTrace(trace_id uint64) *p2pTrace {
+	if trace, ok := p.traces[trace_id]; ok {
+		p.lru.MoveToFront(trace.lru_entry)
+		return trace
+	}
+	trace := &p2pTrace{id: trace_id, triggers: make(map[TriggerID]int), addrs: make(map[string]struct{})}
+	trace.lru_entry = p.lru.PushFront(trace)
+	p.traces[trace_id] = trace
+	for p.lru.Len() > p.capacity {
+		oldest := p.lru.Remove(p.lru.Back()).(*p2pTrace)
+		delete(p.traces, oldest.id)
+	}
+	return trace
+}
+
+/*
+Records triggers that fired locally (with hops 0) or that were received from
+src after travelling hops agents.  The triggers are sent on to agents where
+their traces are already known.  Returns the triggers that hadn't been seen
+before; the rest are duplicates, e.g. from a loop, and should be ignored.
+*/
+func (p *P2PDisseminator) Trigger(triggers []memory.Trigger, src string, hops int) (fresh []memory.Trigger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sends := make(map[p2pDestination][]*datapb.Trigger)
+	for _, t := range triggers {
+		trace := p.getTrace(t.Trace_id)
+		id := TriggerID{t.Queue_id, t.Base_trace_id}
+		if _, seen := trace.triggers[id]; seen {
+			continue
+		}
+		trace.triggers[id] = hops
+		fresh = append(fresh, t)
+
+		for addr := range trace.addrs {
+			if addr != src {
+				p.addSend(sends, addr, trace.id, id, hops)
+			}
+		}
+		if src != "" {
+			trace.addrs[src] = struct{}{} // src already knows of the trigger
+		}
+	}
+	p.send(sends)
+	return
+}
+
+/*
+Records breadcrumbs of triggered traces, and sends each trace's triggers to
+agents that haven't been sent them yet.
+*/
+func (p *P2PDisseminator) Breadcrumbs(breadcrumbs map[uint64][]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sends := make(map[p2pDestination][]*datapb.Trigger)
+	for trace_id, addrs := range breadcrumbs {
+		trace := p.getTrace(trace_id)
+		for _, addr := range addrs {
+			if _, known := trace.addrs[addr]; known || addr == p.local_addr {
+				continue
+			}
+			trace.addrs[addr] = struct{}{}
+			for id, hops := range trace.triggers {
+				p.addSend(sends, addr, trace.id, id, hops)
+			}
+		}
+	}
+	p.send(sends)
+}
+
+/* Triggers to one agent with the same hop count are sent together */
+type p2pDestination struct {
+	addr string
+	hops int
+}
+
+func (p *P2PDisseminator) addSend(sends map[p2pDestination][]*datapb.Trigger, addr string, trace_id uint64, id TriggerID, hops int) {
+	if hops+1 > p.max_hops {
+		return
+	}
+	dst := p2pDestination{addr, hops + 1}
+	sends[dst] = append(sends[dst], &datapb.Trigger{QueueId: int32(id.queue_id), BaseTraceId: id.base_trace_id, TraceIds: []uint64{trace_id}})
+}
+
+func (p *P2PDisseminator) send(sends map[p2pDestination][]*datapb.Trigger) {
+	for dst, triggers := range sends {
+		req := &datapb.TriggerRequest{Src: p.local_addr, Triggers: triggers, Hops: int32(dst.hops)}
+		select {
+		case p.outgoing <- p2pMessage{dst.addr, req}:
+		default:
+			p.dropped += len(triggers)
+			atomic.AddUint64(&p.undelivered, uint64(len(triggers)))
+		}
+	}
+	now := time.Now()
+	if p.dropped > 0 && now.After(p.last_warn.Add(1*time.Second)) {
+		log.Printf("Warning: peer-to-peer dissemination is bottlenecked; dropped %d triggers\n", p.dropped)
+		p.dropped = 0
+		p.last_warn = now
+	}
+}
+
+/* Returns and resets the number of triggers that were dropped rather than sent to another agent */
+func (p *P2PDisseminator) TakeUndelivered() int {
+	return int(atomic.SwapUint64(&p.undelivered, 0))
+}
+
+/*
+Sends outgoing triggers, with one connection and goroutine per destination
+agent.  Send loops exit once they have been idle for a while, so that agents
+that have left the cluster don't accumulate.
+*/
+func (p *P2PDisseminator) Run(ctx context.Context, tls util.TLSConfig) {
+	peers := make(map[string]*p2pPeer)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case peer := <-p.idle:
+			delete(peers, peer.addr)
+			if len(peer.requests) > 0 {
+				// Triggers were queued while the send loop was exiting
+				peers[peer.addr] = peer
+				go p.sendLoop(ctx, tls, peer)
+			}
+		case msg := <-p.outgoing:
+			peer, ok := peers[msg.addr]
+			if !ok {
+				peer = &p2pPeer{addr: msg.addr, requests: make(chan *datapb.TriggerRequest, 1000)}
+				peers[msg.addr] = peer
+				go p.sendLoop(ctx, tls, peer)
+			}
+			select {
+			case peer.requests <- msg.req:
+			default:
+				// The agent is unreachable or slow; the trigger is dropped
+				atomic.AddUint64(&p.undelivered, uint64(len(msg.req.Triggers)))
+			}
+		}
+	}
+}
+
+/*
+Sends triggers to one agent.  Triggers that can't be delivered are dropped.
+After a minute without triggers to send, the connection is closed and the
+send loop hands itself back to Run and exits.
+*/
+func (p *P2PDisseminator) sendLoop(ctx context.Context, tls util.TLSConfig, peer *p2pPeer) {
+	var conn *grpc.ClientConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	last_warn := time.Time{}
+	idle := time.NewTimer(p.idle_timeout)
+	defer idle.Stop()
+	for {
+		var req *datapb.TriggerRequest
+		select {
+		case <-ctx.Done():
+			return
+		case <-idle.C:
+			select {
+			case p.idle <- peer:
+			case <-ctx.Done():
+			}
+			return
+		case req = <-peer.requests:
+		}
+
+		err := p.sendTo(ctx, tls, peer.addr, &conn, req)
+		if err != nil {
+			atomic.AddUint64(&p.undelivered, uint64(len(req.Triggers)))
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			if now := time.Now(); now.After(last_warn.Add(1 * time.Second)) {
+				log.Printf("Unable to send %d triggers to agent %s: %v\n", len(req.Triggers), peer.addr, err)
+				last_warn = now
+			}
+		}
+
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(p.idle_timeout)
+	}
+}
+
+func (p *P2PDisseminator) sendTo(ctx context.Context, tls util.TLSConfig, addr string, conn **grpc.ClientConn, req *datapb.TriggerRequest) (err error) {
+	if *conn == nil {
+		creds, err := tls.DialOption()
+		if err != nil {
+			return err
+		}
+		*conn, err = grpc.Dial(addr, creds, grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = datapb.NewAgentClient(*conn).RemoteTrigger(ctx, req)
+	return
+}
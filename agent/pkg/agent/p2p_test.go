@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP2PDissemination(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewP2PDisseminator("a:1", 2, 100)
+	trigger := memory.Trigger{Queue_id: 3, Base_trace_id: 7, Trace_id: 7}
+
+	// A local trigger is sent to the agents named by the trace's breadcrumbs
+	assert.Equal(1, len(p.Trigger([]memory.Trigger{trigger}, "", 0)))
+	assert.Equal(0, len(p.outgoing), "No breadcrumbs yet")
+	p.Breadcrumbs(map[uint64][]string{7: {"b:1", "a:1"}})
+	msg := <-p.outgoing
+	assert.Equal("b:1", msg.addr)
+	assert.Equal("a:1", msg.req.Src)
+	assert.Equal(int32(1), msg.req.Hops)
+	assert.Equal(uint64(7), msg.req.Triggers[0].BaseTraceId)
+	assert.Equal(0, len(p.outgoing), "Triggers are never sent to ourselves")
+
+	// Each agent is sent the trigger once
+	p.Breadcrumbs(map[uint64][]string{7: {"b:1"}})
+	assert.Equal(0, len(p.outgoing))
+	p.Breadcrumbs(map[uint64][]string{7: {"c:1"}})
+	assert.Equal("c:1", (<-p.outgoing).addr)
+
+	// A trigger that comes back around a loop is ignored
+	assert.Equal(0, len(p.Trigger([]memory.Trigger{trigger}, "c:1", 2)))
+	assert.Equal(0, len(p.outgoing))
+
+	// A remote trigger is forwarded along our breadcrumbs, but not back to its sender
+	remote := memory.Trigger{Queue_id: 3, Base_trace_id: 8, Trace_id: 8}
+	assert.Equal(1, len(p.Trigger([]memory.Trigger{remote}, "b:1", 1)))
+	p.Breadcrumbs(map[uint64][]string{8: {"b:1", "d:1"}})
+	msg = <-p.outgoing
+	assert.Equal("d:1", msg.addr)
+	assert.Equal(int32(2), msg.req.Hops)
+	assert.Equal(0, len(p.outgoing))
+
+	// Triggers are not forwarded beyond the hop limit
+	far := memory.Trigger{Queue_id: 3, Base_trace_id: 9, Trace_id: 9}
+	p.Trigger([]memory.Trigger{far}, "b:1", 2)
+	p.Breadcrumbs(map[uint64][]string{9: {"d:1"}})
+	assert.Equal(0, len(p.outgoing))
+}
+
+func TestP2PSenders(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewP2PDisseminator("a:1", 2, 100)
+	p.idle_timeout = 10 * time.Millisecond
+
+	// An idle send loop hands itself back and exits
+	peer := &p2pPeer{addr: "b:1", requests: make(chan *datapb.TriggerRequest, 1)}
+	exited := make(chan bool)
+	go func() {
+		p.sendLoop(ctx, util.TLSConfig{}, peer)
+		exited <- true
+	}()
+	assert.Equal(peer, <-p.idle)
+	<-exited
+
+	// Triggers dropped because an agent's queue is full are counted
+	go p.Run(ctx, util.TLSConfig{})
+	for i := 0; i < 1010; i++ {
+		p.outgoing <- p2pMessage{"127.0.0.1:1", &datapb.TriggerRequest{Triggers: []*datapb.Trigger{{}}}}
+	}
+	undelivered := 0
+	assert.Eventually(func() bool {
+		undelivered += p.TakeUndelivered()
+		return undelivered >= 9
+	}, 5*time.Second, 10*time.Millisecond)
+}
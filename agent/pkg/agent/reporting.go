@@ -2,12 +2,16 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
 
 	"github.com/juju/ratelimit"
 )
@@ -20,9 +24,76 @@ type Reporting struct {
 	buffer_size int
 	bucket      *ratelimit.Bucket
 
-	agent_addr  string     // Address of this agent
-	remote_addr string     // Address of the trace data backend (not the coordinator)
-	data        chan []int // Buffers to be reported to collector
+	agent_addr  string         // Address of this agent
+	remote_addr string         // Address of the trace data backend (not the coordinator)
+	tls         util.TLSConfig // Optional TLS for the collector connection
+	data        chan []int     // Buffers to be reported to collector
+
+	pending []int          // Buffers not yet sent when the connection failed; sent first after reconnecting
+	session uint64         // Identifies this run of the agent to the collector
+	unacked unackedBuffers // Copies of sent buffers, until the collector acknowledges them
+}
+
+/* How long to wait for the collector to reply to the connection handshake */
+const handshakeTimeout = 10 * time.Second
+
+/*
+Copies of reported buffers that the collector hasn't acknowledged, oldest
+first.  Beyond max_bytes, the oldest copies are dropped, and can no longer be
+resent.
+*/
+type unackedBuffers struct {
+	mu        sync.Mutex
+	max_bytes int // 0 if acks are disabled
+	next_seq  uint64
+	buffers   []unackedBuffer
+	bytes     int
+	dropped   uint64 // Copies dropped before they were acknowledged
+}
+
+type unackedBuffer struct {
+	seq  uint64
+	data []byte
+}
+
+/* Keeps a copy of a buffer, returning the buffer's sequence number */
+func (u *unackedBuffers) add(data []byte) unackedBuffer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.next_seq++
+	b := unackedBuffer{u.next_seq, append([]byte(nil), data...)}
+	u.buffers = append(u.buffers, b)
+	u.bytes += len(b.data)
+	for u.bytes > u.max_bytes && len(u.buffers) > 1 {
+		u.bytes -= len(u.buffers[0].data)
+		u.buffers = u.buffers[1:]
+		u.dropped++
+		if u.dropped == 1 || u.dropped%1000 == 0 {
+			log.Printf("Collector hasn't acknowledged %d MB of trace data; %d unacknowledged buffers dropped so far\n", u.max_bytes/(1024*1024), u.dropped)
+		}
+	}
+	return b
+}
+
+/* The collector has durably written everything up to and including seq */
+func (u *unackedBuffers) ack(seq uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	acked := 0
+	for acked < len(u.buffers) && u.buffers[acked].seq <= seq {
+		u.bytes -= len(u.buffers[acked].data)
+		acked++
+	}
+	u.buffers = u.buffers[acked:]
+}
+
+/* Buffers to resend after reconnecting */
+func (u *unackedBuffers) unacknowledged() []unackedBuffer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]unackedBuffer(nil), u.buffers...)
 }
 
 func InitReporting(api *memory.GoAgentAPI, rate_limit_mb float64, enabled bool, remote_addr string,
@@ -46,6 +117,16 @@ func (r *Reporting) Init(api *memory.GoAgentAPI, rate_limit_mb float64, enabled
 
 	r.agent_addr = local_hostname + ":" + local_port
 	r.remote_addr = remote_addr
+	r.session = uint64(time.Now().UnixNano())
+}
+
+/*
+Sets how many bytes of sent buffers to keep until the collector acknowledges
+them.  0, the default, disables acks, for collectors that predate them.
+Must be called before Run.
+*/
+func (r *Reporting) ConfigureAcks(max_unacked_bytes int) {
+	r.unacked.max_bytes = max_unacked_bytes
 }
 
 func doWrite(conn net.Conn, src []byte) error {
@@ -71,6 +152,19 @@ func writeLengthPrefixed(conn net.Conn, buf []byte) (err error) {
 	return
 }
 
+/* Writes a buffer preceded by its sequence number, as one message */
+func writeSequenced(conn net.Conn, b unackedBuffer) (err error) {
+	prefix := make([]byte, 12)
+	binary.LittleEndian.PutUint32(prefix, uint32(8+len(b.data)))
+	binary.LittleEndian.PutUint64(prefix[4:], b.seq)
+	err = doWrite(conn, prefix)
+	if err != nil {
+		return
+	}
+	err = doWrite(conn, b.data)
+	return
+}
+
 /* Reports trace data to the collector TODO grpc? */
 func (r *Reporting) reportData(conn net.Conn, buffers []int) (err error) {
 	// Apply rate-limiting
@@ -78,8 +172,13 @@ func (r *Reporting) reportData(conn net.Conn, buffers []int) (err error) {
 		r.bucket.Wait(int64(len(buffers) * r.buffer_size))
 	}
 
-	if r.enabled {
-		for _, buffer_id := range buffers {
+	if !r.enabled {
+		r.returnBuffers(buffers)
+		return
+	}
+
+	if r.unacked.max_bytes == 0 {
+		for i, buffer_id := range buffers {
 			// Get the buffer data from the buffer pool
 			header, data := r.api.ExtractBuffer(buffer_id)
 			data = data[0:header.Size]
@@ -87,23 +186,121 @@ func (r *Reporting) reportData(conn net.Conn, buffers []int) (err error) {
 			// Send it
 			err = writeLengthPrefixed(conn, data)
 			if err != nil {
-				break // Stop writing and allow error to propagate; always return all buffers to pool
+				// Keep whatever wasn't sent for the next connection
+				r.returnBuffers(buffers[:i])
+				r.pending = buffers[i:]
+				return
 			}
 		}
+		r.returnBuffers(buffers)
+		return
 	}
 
-	// Return the buffers
-	if len(buffers) > 0 {
-		r.api.Available <- buffers
+	// Copy the buffers, so they can be returned to the pool before they are acknowledged
+	copies := make([]unackedBuffer, len(buffers))
+	for i, buffer_id := range buffers {
+		header, data := r.api.ExtractBuffer(buffer_id)
+		copies[i] = r.unacked.add(data[0:header.Size])
 	}
+	r.returnBuffers(buffers)
 
+	for _, b := range copies {
+		err = writeSequenced(conn, b)
+		if err != nil {
+			return // Unacknowledged buffers are resent after reconnecting
+		}
+	}
 	return
 }
 
-/* We need to inform the reporting backend of this agent's identity */
+func (r *Reporting) returnBuffers(buffers []int) {
+	if len(buffers) > 0 {
+		r.api.Available <- buffers
+	}
+}
+
+/*
+We need to inform the reporting backend of this agent's identity.  With acks,
+the collector replies with the sequence number up to which it has our data.
+*/
 func (r *Reporting) writeConnectionHandshake(conn net.Conn) error {
-	agent_addr_bytes := []byte(r.agent_addr)
-	return writeLengthPrefixed(conn, agent_addr_bytes)
+	if r.unacked.max_bytes == 0 {
+		agent_addr_bytes := []byte(r.agent_addr)
+		return writeLengthPrefixed(conn, agent_addr_bytes)
+	}
+
+	err := writeLengthPrefixed(conn, util.EncodeAckedHandshake(r.session, r.agent_addr))
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	seq, err := readAck(conn)
+	if err != nil {
+		return fmt.Errorf("Collector did not acknowledge handshake (collectors that predate acks need -unacked 0): %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	r.unacked.ack(seq)
+	return nil
+}
+
+func readAck(conn net.Conn) (uint64, error) {
+	buf := make([]byte, 8)
+	for read := 0; read < len(buf); {
+		n, err := conn.Read(buf[read:])
+		if err != nil {
+			return 0, err
+		}
+		read += n
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+/* Receives acks from the collector until the connection fails */
+func (r *Reporting) readAcks(conn net.Conn, errs chan error) {
+	for {
+		seq, err := readAck(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		r.unacked.ack(seq)
+	}
+}
+
+/* Sends anything left over from the previous connection */
+func (r *Reporting) resend(conn net.Conn) error {
+	if r.unacked.max_bytes == 0 {
+		buffers := r.pending
+		r.pending = nil
+		return r.reportData(conn, buffers)
+	}
+
+	unacked := r.unacked.unacknowledged()
+	if len(unacked) > 0 {
+		log.Printf("Resending %d unacknowledged buffers to the collector\n", len(unacked))
+	}
+	for _, b := range unacked {
+		if r.bucket != nil {
+			r.bucket.Wait(int64(len(b.data)))
+		}
+		err := writeSequenced(conn, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Connects to the collector, using TLS if configured */
+func (r *Reporting) dial() (net.Conn, error) {
+	if !r.tls.Enabled() {
+		return net.Dial("tcp", r.remote_addr)
+	}
+	config, err := r.tls.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", r.remote_addr, config)
 }
 
 func (r *Reporting) Run(ctx context.Context) {
@@ -117,7 +314,7 @@ func (r *Reporting) Run(ctx context.Context) {
 		default:
 			break
 		}
-		conn, err := net.Dial("tcp", r.remote_addr)
+		conn, err := r.dial()
 		if err != nil {
 			if firsttime {
 				log.Println("Unable to connect to reporting backend, retrying every 2 seconds", r.remote_addr, err)
@@ -132,9 +329,8 @@ func (r *Reporting) Run(ctx context.Context) {
 			}
 			continue
 		}
-		defer conn.Close()
-
 		err = r.ReportData(ctx, conn)
+		conn.Close()
 		if err != nil {
 			if firsttime {
 				log.Println("Error in DataLoop:", err, " -- will retry every 2 seconds")
@@ -158,10 +354,20 @@ func (r *Reporting) ReportData(ctx context.Context, conn net.Conn) (err error) {
 	if err != nil {
 		return err
 	}
+	acks := make(chan error, 1)
+	if r.unacked.max_bytes != 0 {
+		go r.readAcks(conn, acks)
+	}
+	err = r.resend(conn)
+	if err != nil {
+		return err
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case err = <-acks:
+			return err
 		case buffers := <-r.data:
 			err = r.reportData(conn, buffers)
 			if err != nil {
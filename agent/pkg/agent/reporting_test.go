@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnackedBuffers(t *testing.T) {
+	assert := assert.New(t)
+
+	var u unackedBuffers
+	u.max_bytes = 10
+	data := []byte("abcd")
+	first := u.add(data)
+	data[0] = 'z'
+	assert.Equal(uint64(1), first.seq)
+	assert.Equal("abcd", string(first.data), "Buffers are copied, so they can be returned to the pool")
+
+	u.add([]byte("efgh"))
+	u.add([]byte("ijkl"))
+	unacked := u.unacknowledged()
+	assert.Equal(2, len(unacked), "Oldest copy is dropped beyond max_bytes")
+	assert.Equal(uint64(2), unacked[0].seq)
+	assert.Equal(uint64(1), u.dropped)
+
+	u.ack(2)
+	unacked = u.unacknowledged()
+	assert.Equal(1, len(unacked))
+	assert.Equal(uint64(3), unacked[0].seq)
+	assert.Equal(4, u.bytes)
+
+	u.ack(3)
+	assert.Equal(0, len(u.unacknowledged()))
+	assert.Equal(uint64(4), u.add([]byte("mnop")).seq, "Sequence numbers continue after acks")
+}
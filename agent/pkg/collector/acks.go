@@ -0,0 +1,184 @@
+package collector
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Agents that expect acknowledgements identify each run with a session ID and
+number their buffers (see util.ReportingAckMagic).  A reportingSession
+tracks which of a session's buffers have been received and durably written,
+across the agent's reconnections.  Acks are cumulative: the collector acks
+the sequence number up to which every buffer has been written, even though
+traces, and so buffers, are written out of order.
+
+A gap in the sequence numbers received means the agent dropped buffers
+before it could resend them, so missing buffers are treated as written.
+
+If buffers can't be written, their session is abandoned and its connection
+closed.  The agent reconnects to a new session, which acks nothing, and
+resends everything it still holds; buffers that had been written are then
+written again.
+*/
+type reportingSession struct {
+	mu          sync.Mutex
+	key         sessionKey
+	conn        net.Conn        // The agent's current connection, to which acks are sent
+	received    uint64          // Highest sequence number received
+	durable     uint64          // Every sequence number up to here has been written
+	outstanding []uint64        // Sequence numbers received but not yet durable, in order
+	done        map[uint64]bool // Outstanding sequence numbers that have been written
+
+	disconnected time.Time // When conn was last closed, if it is nil
+}
+
+type sessionKey struct {
+	agent string
+	id    uint64
+}
+
+/* Sessions are kept for a while after a disconnect, so that the agent can resume */
+const sessionTimeout = 10 * time.Minute
+
+/* How long to wait for an agent to accept an ack, before giving up on it */
+const ackWriteTimeout = 5 * time.Second
+
+type reportingSessions struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*reportingSession
+}
+
+func (ss *reportingSessions) Init() {
+	ss.sessions = make(map[sessionKey]*reportingSession)
+}
+
+/*
+Attaches a new connection to an agent's session, and replies to the agent's
+handshake with the sequence number up to which its buffers are written.
+*/
+func (ss *reportingSessions) connect(agent string, id uint64, conn net.Conn) (*reportingSession, error) {
+	ss.mu.Lock()
+	now := time.Now()
+	for key, s := range ss.sessions {
+		s.mu.Lock()
+		if s.conn == nil && now.Sub(s.disconnected) > sessionTimeout {
+			delete(ss.sessions, key)
+		}
+		s.mu.Unlock()
+	}
+	key := sessionKey{agent, id}
+	s, ok := ss.sessions[key]
+	if !ok {
+		s = &reportingSession{key: key, done: make(map[uint64]bool)}
+		ss.sessions[key] = s
+	}
+	ss.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = conn
+	return s, s.sendAck()
+}
+
+/* Abandons the sessions of buffers that couldn't be written, so that their agents resend them */
+func (ss *reportingSessions) abandon(buffers []*ReceivedBuffer) {
+	abandoned := make(map[*reportingSession]bool)
+	for _, buf := range buffers {
+		if buf.session == nil || abandoned[buf.session] {
+			continue
+		}
+		s := buf.session
+		abandoned[s] = true
+		ss.mu.Lock()
+		if ss.sessions[s.key] == s {
+			delete(ss.sessions, s.key)
+		}
+		ss.mu.Unlock()
+
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		log.Printf("Unable to write buffers from %s, closing its connection so that it resends them\n", s.key.agent)
+	}
+}
+
+func (s *reportingSession) disconnect(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == conn {
+		s.conn = nil
+		s.disconnected = time.Now()
+	}
+}
+
+/* Returns false if the buffer was already received, e.g. it was resent after a reconnect */
+func (s *reportingSession) receive(seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.received {
+		return false
+	}
+	if len(s.outstanding) == 0 {
+		s.durable = seq - 1 // Anything skipped was dropped by the agent
+	}
+	s.outstanding = append(s.outstanding, seq)
+	s.received = seq
+	return true
+}
+
+/* Records that buffers have been durably written, and acks the agent if that advances its acks */
+func (s *reportingSession) written(seqs []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seq := range seqs {
+		if seq > s.durable {
+			s.done[seq] = true
+		}
+	}
+	for len(s.outstanding) > 0 && s.done[s.outstanding[0]] {
+		delete(s.done, s.outstanding[0])
+		s.outstanding = s.outstanding[1:]
+	}
+	durable := s.durable
+	if len(s.outstanding) > 0 {
+		s.durable = s.outstanding[0] - 1 // Gaps before the oldest outstanding buffer were dropped by the agent
+	} else {
+		s.durable = s.received
+	}
+	if s.durable != durable {
+		s.sendAck()
+	}
+}
+
+/* Must be called with mu held */
+func (s *reportingSession) sendAck() error {
+	if s.conn == nil {
+		return nil
+	}
+	ack := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ack, s.durable)
+	s.conn.SetWriteDeadline(time.Now().Add(ackWriteTimeout))
+	_, err := s.conn.Write(ack)
+	s.conn.SetWriteDeadline(time.Time{})
+	return err // If the connection failed, its reader will find out
+}
+
+/* Acks buffers once they have been durably written */
+func acknowledge(buffers []*ReceivedBuffer) {
+	seqs := make(map[*reportingSession][]uint64)
+	for _, buf := range buffers {
+		if buf.session != nil {
+			seqs[buf.session] = append(seqs[buf.session], buf.seq)
+		}
+	}
+	for session, written := range seqs {
+		session.written(written)
+	}
+}
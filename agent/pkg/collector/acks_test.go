@@ -0,0 +1,173 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+/* Connects an agent that expects acks, returning the collector's reply to the handshake */
+func connectAcked(c *Collector, session uint64, agent string) (net.Conn, uint64) {
+	agent_conn, collector_conn := net.Pipe()
+	go c.handleConnection(collector_conn)
+	writeFrame(agent_conn, util.EncodeAckedHandshake(session, agent))
+	return agent_conn, readAckFrom(agent_conn)
+}
+
+func writeFrame(conn net.Conn, data []byte) {
+	prefix := make([]byte, 4)
+	binary.LittleEndian.PutUint32(prefix, uint32(len(data)))
+	conn.Write(append(prefix, data...))
+}
+
+func writeSequencedFrame(conn net.Conn, seq uint64, buffer []byte) {
+	data := make([]byte, 8+len(buffer))
+	binary.LittleEndian.PutUint64(data, seq)
+	copy(data[8:], buffer)
+	writeFrame(conn, data)
+}
+
+func readAckFrom(conn net.Conn) uint64 {
+	ack := make([]byte, 8)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for read := 0; read < len(ack); {
+		n, err := conn.Read(ack[read:])
+		if err != nil {
+			return 0
+		}
+		read += n
+	}
+	return binary.LittleEndian.Uint64(ack)
+}
+
+/* Reads acks until one reaches seq, returning the last ack read */
+func awaitAck(conn net.Conn, seq uint64) (ack uint64) {
+	for ack < seq {
+		next := readAckFrom(conn)
+		if next == 0 {
+			return
+		}
+		ack = next
+	}
+	return
+}
+
+func TestAcknowledgedDelivery(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var c Collector
+	c.Init("0", "")
+	c.ConfigureAssembly(20*time.Millisecond, 0, 0)
+	assert.NoError(c.ConfigureStore(dir, StoreConfig{}))
+	go c.traceWriter()
+
+	conn, ack := connectAcked(&c, 1, "a:1")
+	assert.Equal(uint64(0), ack, "Nothing written yet")
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+	writeSequencedFrame(conn, 2, makeBuffer(6, 2, "two"))
+	assert.Equal(uint64(2), awaitAck(conn, 2), "Acked once the traces are written")
+
+	// Buffer 3 is in flight when the connection drops
+	writeSequencedFrame(conn, 3, makeBuffer(6, 3, "three"))
+	conn.Close()
+
+	// The agent reconnects and resends buffer 3, since it hasn't been acked
+	conn, ack = connectAcked(&c, 1, "a:1")
+	assert.True(ack >= 2)
+	writeSequencedFrame(conn, 3, makeBuffer(6, 3, "three"))
+	writeSequencedFrame(conn, 5, makeBuffer(7, 5, "five"))
+	assert.Equal(uint64(5), awaitAck(conn, 5), "Buffer 4 was dropped by the agent")
+
+	record, err := c.writers[0].(*Store).ReadTrace(6)
+	assert.NoError(err)
+	assert.Equal(2, len(record.Buffers), "Resent buffer is discarded")
+
+	// A restarted agent starts a new session
+	conn, ack = connectAcked(&c, 2, "a:1")
+	assert.Equal(uint64(0), ack)
+	conn.Close()
+}
+
+/* A TraceWriter whose writes fail until it is fixed */
+type failingWriter struct {
+	mu      sync.Mutex
+	failing bool
+	written []uint64
+}
+
+func (w *failingWriter) WriteTrace(t *TraceToStore) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failing {
+		return fmt.Errorf("Disk full")
+	}
+	w.written = append(w.written, t.trace_id)
+	return nil
+}
+
+func (w *failingWriter) Sync() error  { return nil }
+func (w *failingWriter) Close() error { return nil }
+
+func TestAcknowledgedDeliveryAfterFailedWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Collector
+	c.Init("0", "")
+	c.ConfigureAssembly(20*time.Millisecond, 0, 0)
+	writer := &failingWriter{failing: true}
+	c.writers = append(c.writers, writer)
+	go c.traceWriter()
+
+	conn, _ := connectAcked(&c, 1, "a:1")
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+	assert.Equal(uint64(0), awaitAck(conn, 1), "Connection is closed without an ack")
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(err)
+
+	// The agent reconnects to a new session and resends the buffer
+	writer.mu.Lock()
+	writer.failing = false
+	writer.mu.Unlock()
+	conn, ack := connectAcked(&c, 1, "a:1")
+	assert.Equal(uint64(0), ack, "Nothing acked in the new session")
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+	assert.Equal(uint64(1), awaitAck(conn, 1))
+	writer.mu.Lock()
+	assert.Equal([]uint64{5}, writer.written)
+	writer.mu.Unlock()
+	conn.Close()
+}
+
+func TestSessionSequenceGap(t *testing.T) {
+	assert := assert.New(t)
+
+	// A long-running agent resends to a collector that has no record of its session
+	s := &reportingSession{done: make(map[uint64]bool)}
+	start := time.Now()
+	assert.True(s.receive(5000000000))
+	assert.True(s.receive(5000000002))
+	assert.True(time.Since(start) < time.Second, "Gaps are not filled one sequence number at a time")
+	assert.Equal(0, len(s.done))
+	assert.Equal(uint64(4999999999), s.durable)
+
+	// Buffers written out of order are acked once every earlier buffer is written
+	s.written([]uint64{5000000002})
+	assert.Equal(uint64(4999999999), s.durable)
+	assert.Equal(1, len(s.done))
+	s.written([]uint64{5000000000})
+	assert.Equal(uint64(5000000002), s.durable, "Buffer 5000000001 was dropped by the agent")
+	assert.Equal(0, len(s.done))
+	assert.Equal(0, len(s.outstanding))
+	assert.False(s.receive(5000000001))
+}
@@ -0,0 +1,122 @@
+package collector
+
+import (
+	"container/list"
+	"time"
+)
+
+/*
+The Assembler groups buffers received from all agents by trace ID.  Agents
+report the buffers of a trace at different times, e.g. as a trigger is
+disseminated, so a trace is only finalized once no new buffers have arrived
+for a quiet period.  Each finalized trace is written as one contiguous
+record.
+
+A buffer that arrives after its trace was finalized starts a new trace to
+store, so a trace can occasionally be written as several records.
+
+So that traces that keep receiving buffers don't stay in memory
+indefinitely, a trace is also finalized once it has been assembled for
+max_age, and the least recently active traces are finalized whenever the
+pending traces exceed max_bytes.
+*/
+type Assembler struct {
+	quiet_period time.Duration
+	max_age      time.Duration // 0 for no limit
+	max_bytes    int           // 0 for no limit
+	bytes        int           // Size of the buffers of pending traces
+	traces       map[uint64]*TraceToStore
+	lru          *list.List // Traces ordered by when they last received a buffer
+	by_age       *list.List // Traces ordered by when they first received a buffer
+}
+
+func (a *Assembler) Init(quiet_period time.Duration) {
+	a.quiet_period = quiet_period
+	a.traces = make(map[uint64]*TraceToStore)
+	a.lru = list.New()
+	a.by_age = list.New()
+}
+
+/* Limits how long a trace is assembled, and the size of pending traces (0 for no limit) */
+func (a *Assembler) Limit(max_age time.Duration, max_bytes int) {
+	a.max_age = max_age
+	a.max_bytes = max_bytes
+}
+
+/*
+Adds a received buffer to its trace.  Returns the traces removed to bring
+the pending traces back within max_bytes, which may include this one.
+*/
+func (a *Assembler) Add(r *ReceivedBuffer, now time.Time) (finalized []*TraceToStore) {
+	t, ok := a.traces[r.trace_id]
+	if !ok {
+		t = initTraceToStore(r.trace_id)
+		t.first_received = now
+		t.lru_entry = a.lru.PushFront(t)
+		t.age_entry = a.by_age.PushBack(t)
+		a.traces[r.trace_id] = t
+	} else {
+		a.lru.MoveToFront(t.lru_entry)
+	}
+	t.last_received = now
+	t.size += len(r.buffer)
+	a.bytes += len(r.buffer)
+	t.AddBuffer(r)
+
+	for a.max_bytes > 0 && a.bytes > a.max_bytes {
+		finalized = append(finalized, a.remove(a.lru.Back().Value.(*TraceToStore)))
+	}
+	return
+}
+
+/*
+Removes and returns traces that haven't received a buffer within the quiet
+period, or that have been assembled for longer than max_age
+*/
+func (a *Assembler) Finalize(now time.Time) (finalized []*TraceToStore) {
+	cutoff := now.Add(-a.quiet_period)
+	for a.lru.Len() > 0 {
+		t := a.lru.Back().Value.(*TraceToStore)
+		if t.last_received.After(cutoff) {
+			break
+		}
+		finalized = append(finalized, a.remove(t))
+	}
+	if a.max_age > 0 {
+		cutoff = now.Add(-a.max_age)
+		for a.by_age.Len() > 0 {
+			t := a.by_age.Front().Value.(*TraceToStore)
+			if t.first_received.After(cutoff) {
+				break
+			}
+			finalized = append(finalized, a.remove(t))
+		}
+	}
+	return
+}
+
+/* Removes and returns all traces, e.g. on shutdown */
+func (a *Assembler) FinalizeAll() (finalized []*TraceToStore) {
+	for a.lru.Len() > 0 {
+		finalized = append(finalized, a.remove(a.lru.Back().Value.(*TraceToStore)))
+	}
+	return
+}
+
+func (a *Assembler) remove(t *TraceToStore) *TraceToStore {
+	a.lru.Remove(t.lru_entry)
+	a.by_age.Remove(t.age_entry)
+	delete(a.traces, t.trace_id)
+	a.bytes -= t.size
+	return t
+}
+
+/* The number of traces still being assembled */
+func (a *Assembler) Pending() int {
+	return len(a.traces)
+}
+
+/* The size of the buffers of traces still being assembled */
+func (a *Assembler) PendingBytes() int {
+	return a.bytes
+}
@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A buffer with a 32 byte header, as written by the client library */
+func makeBuffer(trace_id uint64, buffer_id int32, payload string) []byte {
+	buf := make([]byte, 32+len(payload))
+	binary.LittleEndian.PutUint64(buf[0:], trace_id)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(buffer_id))
+	binary.LittleEndian.PutUint32(buf[20:], ^uint32(0))
+	binary.LittleEndian.PutUint32(buf[24:], uint32(len(buf)))
+	copy(buf[32:], payload)
+	return buf
+}
+
+func received(agent string, trace_id uint64, buffer_id int32, payload string) *ReceivedBuffer {
+	return &ReceivedBuffer{trace_id: trace_id, source_agent: agent, buffer: makeBuffer(trace_id, buffer_id, payload)}
+}
+
+func TestAssembler(t *testing.T) {
+	assert := assert.New(t)
+
+	var a Assembler
+	a.Init(time.Second)
+	start := time.Now()
+
+	// Buffers of two traces arrive interleaved from two agents
+	a.Add(received("a:1", 7, 1, "one"), start)
+	a.Add(received("a:1", 8, 2, "two"), start)
+	a.Add(received("b:1", 7, 3, "three"), start.Add(500*time.Millisecond))
+
+	assert.Equal(0, len(a.Finalize(start.Add(900*time.Millisecond))), "Both traces are still receiving buffers")
+	finalized := a.Finalize(start.Add(1200 * time.Millisecond))
+	assert.Equal(1, len(finalized), "Trace 8 has been quiet")
+	assert.Equal(uint64(8), finalized[0].trace_id)
+	assert.Equal(1, a.Pending())
+
+	var file bytes.Buffer
+	assert.NoError(WriteTraceFileHeader(&file))
+	file.Write(finalized[0].Record())
+	for _, trace := range a.FinalizeAll() {
+		file.Write(trace.Record())
+	}
+
+	r := bufio.NewReader(&file)
+	ok, err := ReadTraceFileHeader(r)
+	assert.NoError(err)
+	assert.True(ok)
+
+	record, err := ReadTraceRecord(r)
+	assert.NoError(err)
+	assert.Equal(uint64(8), record.Trace_id)
+	assert.Equal([]string{"a:1"}, record.Agents)
+
+	record, err = ReadTraceRecord(r)
+	assert.NoError(err)
+	assert.Equal(uint64(7), record.Trace_id)
+	assert.Equal([]string{"a:1", "b:1"}, record.Agents, "Contributing agents are listed")
+	assert.Equal(2, len(record.Buffers), "All of the trace's buffers are in one record")
+	assert.Equal(1, record.Buffers[1].Agent)
+	assert.Equal("three", string(record.Buffers[1].Buffer[32:]))
+	assert.Equal(start.UnixNano(), record.First_received.UnixNano())
+	assert.Equal(start.Add(500*time.Millisecond).UnixNano(), record.Last_received.UnixNano())
+
+	_, err = ReadTraceRecord(r)
+	assert.Equal(io.EOF, err)
+
+	// Files in the older format have no header
+	ok, err = ReadTraceFileHeader(bufio.NewReader(bytes.NewReader([]byte{4, 0, 0, 0, 'a', ':', '1', '1'})))
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestAssemblerLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	var a Assembler
+	a.Init(time.Second)
+	a.Limit(3*time.Second, 0)
+	start := time.Now()
+	payload := "0123456789"
+
+	// A trace that keeps receiving buffers is finalized once it reaches max_age
+	for i := 0; i < 5; i++ {
+		now := start.Add(time.Duration(i) * 900 * time.Millisecond)
+		a.Add(received("a:1", 7, int32(i), payload), now)
+		finalized := a.Finalize(now)
+		if i < 4 {
+			assert.Empty(finalized, "Trace 7 is still receiving buffers")
+		} else {
+			assert.Equal(1, len(finalized), "Trace 7 is older than max_age")
+			assert.Equal(uint64(7), finalized[0].trace_id)
+		}
+	}
+	assert.Equal(0, a.Pending())
+	assert.Equal(0, a.PendingBytes())
+
+	// The least recently active trace is finalized once traces exceed max_bytes
+	a.Limit(0, 3*(32+10))
+	assert.Empty(a.Add(received("a:1", 8, 1, payload), start))
+	assert.Empty(a.Add(received("a:1", 9, 2, payload), start))
+	assert.Empty(a.Add(received("a:1", 8, 3, payload), start))
+	evicted := a.Add(received("a:1", 10, 4, payload), start)
+	assert.Equal(1, len(evicted), "Trace 9 was least recently active")
+	assert.Equal(uint64(9), evicted[0].trace_id)
+	assert.Equal(2, a.Pending())
+	assert.Equal(3*(32+10), a.PendingBytes())
+
+	// A single buffer larger than max_bytes is finalized straight away
+	evicted = a.Add(received("a:1", 11, 5, strings.Repeat(payload, 10)), start)
+	assert.Equal(3, len(evicted))
+	assert.Equal(0, a.Pending())
+	assert.Equal(0, a.PendingBytes())
+}
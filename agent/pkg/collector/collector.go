@@ -2,113 +2,517 @@ package collector
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+	"github.com/geraldleizhang/hindsight/agent/pkg/telemetry"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
 )
 
 type Collector struct {
-	tracefile string
-	port      string
-	incoming  chan *ReceivedBuffer
+	tracefile    string
+	port         string
+	tls          util.TLSConfig  // Optional TLS for agent connections
+	forwarders   map[string]bool // Certificate identities of collectors whose handshakes name the agents they forward for
+	incoming     fairQueue       // Received buffers waiting to be assembled
+	agents       agentIngests    // Per-agent statistics and quotas
+	metrics      CollectorMetrics
+	reporter     *telemetry.Reporter // Optional; see ConfigureTelemetry
+	quiet_period time.Duration       // How long a trace goes without new buffers before it is written
+	max_age      time.Duration       // How long a trace is assembled before it is written regardless
+	max_pending  int                 // Size of traces being assembled beyond which the least active are written
+	writers      []TraceWriter       // Where finalized traces are written
+	decoding     *decodingWriter     // Optional decoding and export of finalized traces
+	store        *Store              // Optional indexed store of traces
+	query        *QueryAPI           // Optional HTTP API for fetching traces
+	query_addr   string
+	forwarder    *Forwarder // Optional forwarding of received buffers to upstream collectors
+	forward_only bool       // Set if received buffers are forwarded, but not written locally
+	sessions     reportingSessions
+
+	conns             connections
+	handshake_timeout time.Duration
+	idle_timeout      time.Duration // 0 to never close idle connections
+	drain_timeout     time.Duration
+	max_frame_size    int
+	max_frame_errors  int // Invalid buffers a connection can send before it is closed
+	query_server      *http.Server
+	stop              chan bool // Closed to stop assembling and writing traces
+	stopped           chan bool // Closed once traces are written and writers closed
+}
+
+/* Somewhere that finalized traces are written */
+type TraceWriter interface {
+	WriteTrace(t *TraceToStore) error
+	Sync() error // Flushes written traces to stable storage
+	Close() error
+}
+
+/* Writes traces to a single file, in the order they are finalized */
+type traceFile struct {
+	f *os.File
+}
+
+func createTraceFile(filename string) (*traceFile, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteTraceFileHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &traceFile{f}, nil
+}
+
+func (tf *traceFile) WriteTrace(t *TraceToStore) error {
+	return doFileWrite(tf.f, t.Record())
+}
+
+func (tf *traceFile) Sync() error {
+	return tf.f.Sync()
+}
+
+func (tf *traceFile) Close() error {
+	err := tf.f.Sync()
+	if e := tf.f.Close(); err == nil {
+		err = e
+	}
+	return err
 }
 
+const DefaultQuietPeriod = 10 * time.Second
+const DefaultMaxTraceAge = 1 * time.Minute
+const DefaultMaxPendingBytes = 1024 * 1024 * 1024
+
 func (c *Collector) Init(port string, tracefile string) {
 	c.tracefile = tracefile
 	c.port = port
-	c.incoming = make(chan *ReceivedBuffer, 1000)
+	c.incoming.Init(fairQueueDepth)
+	c.agents.Init(0)
+	c.metrics.Init()
+	c.quiet_period = DefaultQuietPeriod
+	c.max_age = DefaultMaxTraceAge
+	c.max_pending = DefaultMaxPendingBytes
+	c.sessions.Init()
+	c.conns.Init(DefaultMaxConnections)
+	c.handshake_timeout = DefaultHandshakeTimeout
+	c.idle_timeout = DefaultIdleTimeout
+	c.drain_timeout = DefaultDrainTimeout
+	c.max_frame_size = DefaultMaxFrameSize
+	c.max_frame_errors = DefaultMaxFrameErrors
+	c.stop = make(chan bool)
+	c.stopped = make(chan bool)
+}
+
+/*
+Limits the number of concurrent agent connections (0 for no limit), how long
+a new connection has to send its handshake, and how long a connection can go
+without sending a buffer before it is closed (0 for no limit).  Must be
+called before Run.
+*/
+func (c *Collector) ConfigureConnections(max_connections int, handshake_timeout time.Duration, idle_timeout time.Duration) {
+	c.conns.max = max_connections
+	c.handshake_timeout = handshake_timeout
+	c.idle_timeout = idle_timeout
+}
+
+/*
+Limits each agent to quota_bytes_per_second of buffers (0 for no limit).  An
+agent over its quota is throttled by no longer reading from its connection
+until it is back within quota.  Must be called before Run.
+*/
+func (c *Collector) ConfigureQuotas(quota_bytes_per_second float64) {
+	c.agents.Init(quota_bytes_per_second)
+}
+
+/*
+Limits the size of frames from agents, and how many invalid buffers a
+connection can send within a minute before it is closed.  Connections that send a frame
+larger than max_frame_size are closed straight away.  Must be called before
+Run.
+*/
+func (c *Collector) ConfigureFrames(max_frame_size int, max_frame_errors int) {
+	c.max_frame_size = max_frame_size
+	c.max_frame_errors = max_frame_errors
+}
+
+/*
+Sets how long connections have to finish sending the buffer in progress when
+the collector shuts down.  The same deadline applies to forwarding buffered
+data upstream.  Must be called before Run.
+*/
+func (c *Collector) ConfigureShutdown(drain_timeout time.Duration) {
+	c.drain_timeout = drain_timeout
+}
+
+/*
+Configures how long a trace must go without receiving new buffers before it
+is written to the trace file.  Regardless, a trace is written once it has
+been assembled for max_age, and the least recently active traces are written
+once traces being assembled exceed max_pending_bytes (0 for no limit on
+either).  Must be called before Run.
+*/
+func (c *Collector) ConfigureAssembly(quiet_period time.Duration, max_age time.Duration, max_pending_bytes int) {
+	c.quiet_period = quiet_period
+	c.max_age = max_age
+	c.max_pending = max_pending_bytes
+}
+
+/*
+Writes traces to an indexed store in dir, in addition to -out if given.
+Must be called before Run.
+*/
+func (c *Collector) ConfigureStore(dir string, config StoreConfig) error {
+	store, err := OpenStore(dir, config)
+	if err != nil {
+		return err
+	}
+	c.store = store
+	c.writers = append(c.writers, store)
+	log.Println("Writing trace data to store", dir)
+	return nil
+}
+
+/*
+Sets the decoder run on finalized traces, by name (see RegisterDecoder).
+Decoded traces are passed to exporters, so must be called before
+ConfigureExporter.
+*/
+func (c *Collector) ConfigureDecoder(name string) error {
+	decoder, err := NewDecoder(name)
+	if err != nil {
+		return err
+	}
+	c.decoding = &decodingWriter{name: name, decoder: decoder}
+	return nil
+}
+
+/*
+Exports decoded traces to a file, using the exporter registered with name
+(see RegisterExporter).  Can be called several times.  Must be called before
+Run.
+*/
+func (c *Collector) ConfigureExporter(name string, filename string) error {
+	if c.decoding == nil {
+		return fmt.Errorf("Exporting traces with %s requires a decoder", name)
+	}
+	exporter, err := NewExporter(name, filename)
+	if err != nil {
+		return err
+	}
+	if len(c.decoding.exporters) == 0 {
+		c.writers = append(c.writers, c.decoding)
+	}
+	c.decoding.exporters = append(c.decoding.exporters, exporter)
+	log.Printf("Exporting traces decoded with %s to %s as %s\n", c.decoding.name, filename, name)
+	return nil
+}
+
+/*
+Serves finalized traces over HTTP on host:port (see QueryAPI); an empty host
+listens on all interfaces.  If TLS is enabled for agent connections, the API
+is served over HTTPS with the same configuration, so with a CA clients must
+present a certificate.  The most recent max_traces traces, up to max_bytes,
+are held in memory; older traces are read from the trace store, if there is
+one.  Must be called before Run.
+*/
+func (c *Collector) ConfigureQueryAPI(host string, port string, max_traces int, max_bytes int) {
+	c.query = new(QueryAPI)
+	c.query.Init(nil, max_traces, max_bytes)
+	c.query_addr = net.JoinHostPort(host, port)
+	c.writers = append(c.writers, c.query)
+}
+
+/*
+Forwards received buffers to upstream collectors, in addition to writing
+them locally if -out, -store, etc. are configured (see Forwarder).  Must be
+called before Run.
+*/
+func (c *Collector) ConfigureForwarding(forwarder *Forwarder) {
+	c.forwarder = forwarder
+}
+
+/*
+Enables TLS for agent connections.  If the config includes a CA, agents must
+present a client certificate, and the certificate's identity is used in place
+of the agent address sent in the connection handshake.  Must be called before
+Run.
+*/
+func (c *Collector) ConfigureTLS(config util.TLSConfig) {
+	c.tls = config
+}
+
+/*
+With mutual TLS, trusts the collectors with these certificate identities to
+name the agents whose buffers they forward, rather than naming those agents
+by the forwarding collector's identity.  Must be called before Run.
+*/
+func (c *Collector) TrustForwarders(identities []string) {
+	c.forwarders = make(map[string]bool)
+	for _, identity := range identities {
+		c.forwarders[identity] = true
+	}
 }
 
 func (c *Collector) Run(ctx context.Context) {
-	fmt.Println("Collector listening on TCP port", c.port)
+	fmt.Println("Collector listening on TCP port", c.port, "using", c.tls.String())
 	listener, err := net.Listen("tcp", ":"+c.port)
 	if err != nil {
 		fmt.Println("Error listening on port", c.port, err)
 		return
 	}
+	if c.tls.Enabled() {
+		config, err := c.tls.ServerConfig()
+		if err != nil {
+			fmt.Println("Error configuring TLS", err)
+			listener.Close()
+			return
+		}
+		listener = tls.NewListener(listener, config)
+	}
 
 	if c.tracefile != "" {
+		tf, err := createTraceFile(c.tracefile)
+		if err != nil {
+			fmt.Println("Error creating", c.tracefile, err)
+			listener.Close()
+			return
+		}
 		log.Println("Writing trace data to", c.tracefile)
-		go c.fileWriter(c.tracefile)
+		c.writers = append(c.writers, tf)
+	}
+	if c.query != nil {
+		c.query.store = c.store
+		c.query_server = &http.Server{Addr: c.query_addr, Handler: c.query.Handler()}
+		if c.tls.Enabled() {
+			c.query_server.TLSConfig, err = c.tls.ServerConfig()
+			if err != nil {
+				fmt.Println("Error configuring TLS for trace queries", err)
+				listener.Close()
+				return
+			}
+		}
+		go c.serveQueries()
+	}
+	c.forward_only = len(c.writers) == 0 && c.forwarder != nil
+	if len(c.writers) > 0 {
+		go c.traceWriter()
+	} else if c.forwarder != nil {
+		log.Println("Forwarding trace data without writing it locally")
+		close(c.stopped)
 	} else {
 		log.Println("Not writing trace data to disk")
 		go c.printer()
 	}
 
+	// Telemetry outlives ctx, to report on the shutdown
+	reporter_ctx, stop_reporter := context.WithCancel(context.Background())
+	reporter_done := make(chan bool)
+	if c.reporter != nil {
+		go func() {
+			err := c.reporter.Run(reporter_ctx)
+			if err != nil {
+				log.Println("Error in telemetry reporter:", err)
+			}
+			close(reporter_done)
+		}()
+	} else {
+		close(reporter_done)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting new connection", err)
-			return
+			if ctx.Err() == nil {
+				fmt.Println("Error accepting new connection", err)
+			}
+			break
 		}
 		go c.handleConnection(conn)
 	}
+	c.shutdown()
+	stop_reporter()
+	<-reporter_done
 }
 
-func doRead(conn net.Conn, dst []byte) error {
-	for len(dst) > 0 {
-		read, err := conn.Read(dst)
-		if err != nil {
-			return err
+/*
+Stops reading from agent connections, writes everything received, and closes
+the writers.  Connections have until the drain timeout to finish sending the
+buffer in progress, and the forwarder has until then to forward what it has.
+*/
+func (c *Collector) shutdown() {
+	log.Println("Collector shutting down; draining agent connections")
+	deadline := time.Now().Add(c.drain_timeout)
+	c.conns.drain(deadline)
+	if c.forwarder != nil {
+		if !c.forwarder.Flush(deadline) {
+			log.Println("Upstream collectors did not acknowledge all forwarded trace data before the drain timeout")
 		}
+		c.forwarder.Close()
+	}
+	close(c.stop)
+	<-c.stopped
+	close(c.conns.flushed) // Acks have been sent, so connections can close
 
-		dst = dst[read:]
+	if c.query_server != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(c.drain_timeout))
+		c.query_server.Shutdown(ctx)
+		cancel()
+	}
+	log.Println("Collector shut down")
+}
+
+func (c *Collector) serveQueries() {
+	log.Println("Serving trace queries on", c.query_addr, "using", c.tls.String())
+	var err error
+	if c.query_server.TLSConfig != nil {
+		err = c.query_server.ListenAndServeTLS("", "") // Certificates are in TLSConfig
+	} else {
+		err = c.query_server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Println("Error serving trace queries on", c.query_addr, err)
 	}
-	return nil
 }
 
-func readLengthPrefixed(conn net.Conn) (buf []byte, err error) {
-	szbuf := make([]byte, 4)
-	err = doRead(conn, szbuf)
+/* Reads the next frame, subject to the idle timeout, unless the connection is being drained */
+func (c *Collector) readFrame(tracked *connection) (frame []byte, err error) {
+	if !c.conns.awaitFrame(tracked, c.idle_timeout) {
+		return nil, fmt.Errorf("Collector is shutting down")
+	}
+	sz, err := readFrameSize(tracked.conn)
+	if err != nil {
+		return
+	}
+	err = checkFrameSize(sz, c.max_frame_size)
 	if err != nil {
+		atomic.AddUint64(&tracked.frame_errors, 1)
+		c.metrics.frameError(tracked.agent)
 		return
 	}
-	sz := binary.LittleEndian.Uint32(szbuf)
-	buf = make([]byte, sz)
-	err = doRead(conn, buf)
+	c.conns.inFrame(tracked, c.idle_timeout)
+	frame = make([]byte, sz)
+	err = doRead(tracked.conn, frame)
 	return
 }
 
 func (c *Collector) handleConnection(conn net.Conn) {
-	buf, err := readLengthPrefixed(conn)
+	defer conn.Close()
+	tracked, ok := c.conns.add(conn)
+	if !ok {
+		return
+	}
+	var session *reportingSession
+	var ingest *agentIngest
+	defer func() {
+		c.incoming.remove(tracked)
+		c.conns.remove(tracked) // If draining, waits until acks are sent
+		if tracked.agent != "" {
+			c.metrics.connected(tracked.agent, -1)
+		}
+		if ingest != nil {
+			c.agents.disconnect(ingest)
+		}
+		if session != nil {
+			session.disconnect(conn)
+		}
+	}()
+
+	if !c.conns.awaitFrame(tracked, c.handshake_timeout) {
+		return
+	}
+	buf, err := readLengthPrefixed(conn, maxHandshakeSize)
 	if err != nil {
-		fmt.Println("Error receiving handshake from new agent connection", err)
+		if !c.conns.isDraining() {
+			fmt.Println("Error receiving handshake from new agent connection", err)
+		}
 		return
 	}
 	agent_addr := string(buf)
+	session_id, acked_addr, acked := util.DecodeAckedHandshake(buf)
+	if acked {
+		agent_addr = acked_addr
+	}
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		if identity, ok := util.PeerIdentity(tlsconn.ConnectionState()); ok && !c.forwarders[identity] {
+			agent_addr = identity
+		}
+	}
 	fmt.Println("New connection from", agent_addr)
+	ingest = c.agents.connect(agent_addr)
+	tracked.agent = agent_addr
+	c.metrics.connected(agent_addr, 1)
+
+	if acked {
+		session, err = c.sessions.connect(agent_addr, session_id, conn)
+		if err != nil {
+			fmt.Println("Error replying to handshake from", agent_addr, err)
+			return
+		}
+	}
 
 	for {
-		buf, err := readLengthPrefixed(conn)
+		frame, err := c.readFrame(tracked)
 		if err != nil {
-			fmt.Println("Error in handleConnection receiving next buffer", err)
+			if !c.conns.isDraining() {
+				fmt.Println("Error in handleConnection receiving next buffer from", agent_addr, err)
+			}
 			return
 		}
-		if len(buf) >= 32 { // 32 is size of buffer header
-			header := memory.ExtractBufferHeader(buf)
-			// header := memory.ExtractBufferHeader(buf)
-			// fmt.Println("Read buf of size", len(buf), header)
-			// fmt.Println("Buffer ID was", header.Buffer_id, "Prev Buffer ID was", header.Prev_buffer_id)
-			var r ReceivedBuffer
-			r.trace_id = header.Trace_id
-			r.source_agent = agent_addr
-			r.buffer = buf
-			c.incoming <- &r
+		seq, buf, header, err := parseFrame(frame, session != nil)
+		if seq != 0 && !session.receive(seq) {
+			continue // Resent after a reconnect, but we already have it
+		}
+		if err != nil {
+			if seq != 0 {
+				session.written([]uint64{seq}) // Nothing to write
+			}
+			if !c.frameError(tracked, agent_addr, err) {
+				return
+			}
+			continue
+		}
+
+		var r ReceivedBuffer
+		r.trace_id = header.Trace_id
+		r.source_agent = agent_addr
+		r.buffer = buf
+		r.session = session
+		r.seq = seq
+		r.received = time.Now()
+		throttled := ingest.received(len(buf)) // Throttles the connection if the agent is over quota
+		c.metrics.received(&r, throttled)
+		if c.forwarder != nil {
+			c.forwarder.Forward(&r, c.forward_only) // If not written locally, acked once forwarded
+		}
+		if !c.forward_only {
+			c.incoming.push(tracked, &r)
 		}
 	}
 }
 
-func (c *Collector) fileWriter(filename string) {
-	f, err := os.Create(filename)
-	if err != nil {
-		fmt.Println("Error creating /local/buffers.out: ", err)
-		return
+/* Assembles received buffers into traces, and writes each finalized trace as one record */
+func (c *Collector) traceWriter() {
+	var assembler Assembler
+	assembler.Init(c.quiet_period)
+	assembler.Limit(c.max_age, c.max_pending)
+	check_interval := c.quiet_period / 4
+	if check_interval < 10*time.Millisecond {
+		check_interval = 10 * time.Millisecond
 	}
+	finalize := time.NewTicker(check_interval)
 	ticker := time.NewTicker(1 * time.Second)
 	count := 0
 	last_report := time.Now()
@@ -120,21 +524,97 @@ func (c *Collector) fileWriter(filename string) {
 				interval := now.Sub(last_report)
 				last_report = now
 				tput := (float64(count) / interval.Seconds()) / (1024 * 1024)
-				log.Printf("%.2f MB/s\n", tput)
+				log.Printf("%.2f MB/s (%d traces, %.2f MB being assembled)\n", tput, assembler.Pending(), float64(assembler.PendingBytes())/(1024*1024))
+				c.agents.reportThrottled(interval)
+				c.metrics.recordState(assembler.Pending())
 				count = 0
 			}
-		case r := <-c.incoming:
+		case now := <-finalize.C:
+			{
+				c.writeTraces(assembler.Finalize(now))
+			}
+		case <-c.incoming.ready:
+			{
+				// Take a batch, so that a flood of buffers doesn't delay finalizing traces
+				var evicted []*TraceToStore
+				for i := 0; i < 1000; i++ {
+					r := c.incoming.pop()
+					if r == nil {
+						break
+					}
+					count += len(r.buffer)
+					evicted = append(evicted, assembler.Add(r, time.Now())...)
+				}
+				c.writeTraces(evicted)
+				if c.incoming.pending() {
+					c.incoming.signal()
+				}
+			}
+		case <-c.stop:
 			{
-				count += len(r.buffer)
-				err = r.WriteToFile(f)
-				if err != nil {
-					fmt.Println("Error writing buffer to file: ", err)
+				// Connections have drained, so nothing more will arrive
+				for r := c.incoming.pop(); r != nil; r = c.incoming.pop() {
+					c.writeTraces(assembler.Add(r, time.Now()))
 				}
+				log.Printf("Writing %d traces still being assembled\n", assembler.Pending())
+				c.writeTraces(assembler.FinalizeAll())
+				c.closeWriters()
+				close(c.stopped)
+				return
 			}
 		}
 	}
 }
 
+func (c *Collector) closeWriters() {
+	for _, w := range c.writers {
+		err := w.Close()
+		if err != nil {
+			fmt.Println("Error closing trace writer: ", err)
+		}
+	}
+}
+
+/*
+Writes finalized traces to every writer, then acks their buffers once all
+writers have flushed them to stable storage.  The sessions of buffers that
+couldn't be written are abandoned, so that their agents resend them.
+*/
+func (c *Collector) writeTraces(traces []*TraceToStore) {
+	if len(traces) == 0 {
+		return
+	}
+	var written, failed []*ReceivedBuffer
+	var written_traces []*TraceToStore
+	for _, t := range traces {
+		ok := true
+		for _, w := range c.writers {
+			err := w.WriteTrace(t)
+			if err != nil {
+				fmt.Println("Error writing trace: ", err)
+				ok = false
+			}
+		}
+		if ok {
+			written = append(written, t.buffers...)
+			written_traces = append(written_traces, t)
+		} else {
+			failed = append(failed, t.buffers...)
+		}
+	}
+	for _, w := range c.writers {
+		err := w.Sync()
+		if err != nil {
+			fmt.Println("Error syncing trace data: ", err)
+			c.sessions.abandon(append(failed, written...))
+			return
+		}
+	}
+	c.sessions.abandon(failed)
+	c.metrics.written(written_traces, written, time.Now())
+	acknowledge(written)
+}
+
 func (c *Collector) printer() {
 	ticker := time.NewTicker(1 * time.Second)
 	count := 0
@@ -148,11 +628,23 @@ func (c *Collector) printer() {
 				last_report = now
 				tput := (float64(count) / interval.Seconds()) / (1024 * 1024)
 				log.Printf("%.2f MB/s\n", tput)
+				c.agents.reportThrottled(interval)
 				count = 0
 			}
-		case r := <-c.incoming:
+		case <-c.incoming.ready:
 			{
-				count += len(r.buffer)
+				for r := c.incoming.pop(); r != nil; r = c.incoming.pop() {
+					count += len(r.buffer)
+					acknowledge([]*ReceivedBuffer{r}) // Not writing to disk, so nothing to wait for
+				}
+			}
+		case <-c.stop:
+			{
+				for r := c.incoming.pop(); r != nil; r = c.incoming.pop() {
+					acknowledge([]*ReceivedBuffer{r})
+				}
+				close(c.stopped)
+				return
 			}
 		}
 	}
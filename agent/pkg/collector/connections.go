@@ -0,0 +1,131 @@
+package collector
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+The collector tracks open agent connections, to limit how many there are and
+to drain them on shutdown.  Draining lets each connection finish reading the
+buffer in progress, up to a deadline, while connections waiting for their
+next buffer stop immediately.  Drained connections stay open until received
+buffers have been written, so that agents still receive their acks.
+*/
+type connections struct {
+	mu       sync.Mutex
+	max      int // 0 for no limit
+	open     map[*connection]bool
+	rejected uint64 // Connections closed because there were too many
+	wg       sync.WaitGroup
+
+	draining bool
+	deadline time.Time // Deadline for connections to finish the buffer in progress
+	flushed  chan bool // Closed once drained buffers have been written
+}
+
+type connection struct {
+	frame_errors uint64    // Invalid buffers received since errors_since; first, so that it is aligned for atomic access
+	errors_since time.Time // Start of the window in which frame_errors are counted
+	conn         net.Conn
+	agent        string // Once the handshake is received
+	in_frame     bool   // Whether a buffer is partly read
+}
+
+const DefaultMaxConnections = 4096
+const DefaultHandshakeTimeout = 10 * time.Second
+const DefaultIdleTimeout = 10 * time.Minute
+const DefaultDrainTimeout = 10 * time.Second
+
+func (cs *connections) Init(max int) {
+	cs.max = max
+	cs.open = make(map[*connection]bool)
+	cs.flushed = make(chan bool)
+}
+
+/* Returns false if the connection should be closed, because there are too many or we are draining */
+func (cs *connections) add(conn net.Conn) (*connection, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.draining {
+		return nil, false
+	}
+	if cs.max > 0 && len(cs.open) >= cs.max {
+		cs.rejected++
+		if cs.rejected == 1 || cs.rejected%1000 == 0 {
+			log.Printf("Too many agent connections (-max_connections %d); %d connections rejected so far\n", cs.max, cs.rejected)
+		}
+		return nil, false
+	}
+	c := &connection{conn: conn}
+	cs.open[c] = true
+	cs.wg.Add(1)
+	return c, true
+}
+
+/* Once a connection stops reading; if draining, waits until its buffers are written */
+func (cs *connections) remove(c *connection) {
+	cs.mu.Lock()
+	delete(cs.open, c)
+	draining := cs.draining
+	cs.mu.Unlock()
+	cs.wg.Done()
+	if draining {
+		<-cs.flushed
+	}
+}
+
+func readDeadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+/* Before reading the next buffer; returns false if the connection should stop */
+func (cs *connections) awaitFrame(c *connection, idle_timeout time.Duration) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.draining {
+		return false
+	}
+	c.in_frame = false
+	c.conn.SetReadDeadline(readDeadline(idle_timeout))
+	return true
+}
+
+/* Once a buffer's length has been read */
+func (cs *connections) inFrame(c *connection, idle_timeout time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c.in_frame = true
+	if cs.draining {
+		c.conn.SetReadDeadline(cs.deadline)
+	} else {
+		c.conn.SetReadDeadline(readDeadline(idle_timeout))
+	}
+}
+
+/* Stops connections from reading further buffers, and waits until they have */
+func (cs *connections) drain(deadline time.Time) {
+	cs.mu.Lock()
+	cs.draining = true
+	cs.deadline = deadline
+	for c := range cs.open {
+		if c.in_frame {
+			c.conn.SetReadDeadline(deadline)
+		} else {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+	cs.mu.Unlock()
+	cs.wg.Wait()
+}
+
+func (cs *connections) isDraining() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.draining
+}
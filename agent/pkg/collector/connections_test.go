@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var c Collector
+	c.Init("0", "")
+	c.ConfigureAssembly(time.Hour, 0, 0)
+	c.ConfigureConnections(2, time.Second, 0)
+	assert.NoError(c.ConfigureStore(dir, StoreConfig{}))
+	go c.traceWriter()
+
+	conn, _ := connectAcked(&c, 1, "a:1")
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+
+	// An idle connection that never sends its handshake
+	idle, collector_conn := net.Pipe()
+	go c.handleConnection(collector_conn)
+	for open := 0; open < 2; time.Sleep(time.Millisecond) {
+		c.conns.mu.Lock()
+		open = len(c.conns.open)
+		c.conns.mu.Unlock()
+	}
+
+	// Beyond the limit, connections are closed straight away
+	rejected, collector_conn := net.Pipe()
+	go c.handleConnection(collector_conn)
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.Error(err)
+	assert.False(isTimeout(err), "Closed, rather than timed out")
+
+	// Shutting down writes the trace without waiting for its quiet period, then acks it
+	done := make(chan bool)
+	go func() {
+		c.shutdown()
+		close(done)
+	}()
+	assert.Equal(uint64(1), awaitAck(conn, 1))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("Shutdown did not complete")
+	}
+	_, err = idle.Read(make([]byte, 1))
+	assert.Error(err, "Connections are closed")
+
+	store, err := OpenStoreReadOnly(dir)
+	assert.NoError(err)
+	record, err := store.ReadTrace(5)
+	assert.NoError(err)
+	assert.Equal(1, len(record.Buffers), "Store was closed cleanly")
+}
+
+func isTimeout(err error) bool {
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout()
+	}
+	return false
+}
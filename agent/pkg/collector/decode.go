@@ -0,0 +1,212 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+)
+
+/*
+To the collector, the payload of a buffer after its 32 byte header is opaque.
+A Decoder understands the format that a service writes its tracepoints in,
+and turns them into typed events.  Decoders are registered by name, and the
+collector runs the configured decoder on each assembled trace.
+
+Each thread that writes to a trace fills a chain of buffers, in which every
+buffer names the buffer before it (see memory.BufferHeader).  A tracepoint
+can be split across the buffers of a chain, so a decoder is given the
+payloads of each chain at once, concatenated in the order they were written.
+Chains from different threads are decoded separately.
+*/
+type Decoder interface {
+	Decode(agent string, payload []byte) ([]Event, error)
+}
+
+type EventKind int
+
+const (
+	Annotation EventKind = iota
+	Span
+	Log
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Span:
+		return "span"
+	case Log:
+		return "log"
+	default:
+		return "annotation"
+	}
+}
+
+func ParseEventKind(value string) (EventKind, error) {
+	switch value {
+	case "span":
+		return Span, nil
+	case "log":
+		return Log, nil
+	case "annotation":
+		return Annotation, nil
+	}
+	return Annotation, fmt.Errorf("Unknown event kind %q -- must be span, log, or annotation", value)
+}
+
+/* A typed event decoded from a tracepoint */
+type Event struct {
+	Kind           EventKind
+	Agent          string // The agent whose buffers contained the event
+	Name           string
+	Timestamp      time.Time
+	Duration       time.Duration // Spans only
+	Span_id        uint64        // For a log or annotation, the span it belongs to, if any
+	Parent_span_id uint64
+	Attributes     map[string]string
+}
+
+/* The events of an assembled trace */
+type DecodedTrace struct {
+	Trace_id       uint64
+	First_received time.Time
+	Last_received  time.Time
+	Agents         []string
+	Events         []Event
+	Errors         []error // Payloads that couldn't be fully decoded
+}
+
+var decoders = make(map[string]func() Decoder)
+
+/* Makes a decoder available by name; called from init functions */
+func RegisterDecoder(name string, newDecoder func() Decoder) {
+	decoders[name] = newDecoder
+}
+
+func NewDecoder(name string) (Decoder, error) {
+	newDecoder, ok := decoders[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown decoder %q; available decoders are %v", name, DecoderNames())
+	}
+	return newDecoder(), nil
+}
+
+func DecoderNames() (names []string) {
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+/* Runs a decoder on every agent's buffers of a trace */
+func DecodeTrace(record *TraceRecord, decoder Decoder) *DecodedTrace {
+	decoded := &DecodedTrace{
+		Trace_id:       record.Trace_id,
+		First_received: record.First_received,
+		Last_received:  record.Last_received,
+		Agents:         record.Agents,
+	}
+
+	by_agent := make([][]*chainedBuffer, len(record.Agents))
+	for _, buf := range record.Buffers {
+		if len(buf.Buffer) < 32 { // 32 is size of buffer header
+			continue
+		}
+		header := memory.ExtractBufferHeader(buf.Buffer)
+		end := len(buf.Buffer)
+		if int(header.Size) >= 32 && int(header.Size) < end {
+			end = int(header.Size)
+		}
+		by_agent[buf.Agent] = append(by_agent[buf.Agent], &chainedBuffer{header: header, payload: buf.Buffer[32:end]})
+	}
+
+	for i, buffers := range by_agent {
+		for _, payload := range chainPayloads(buffers) {
+			decoded.decode(decoder, record.Agents[i], payload)
+		}
+	}
+	sort.SliceStable(decoded.Events, func(i, j int) bool { return decoded.Events[i].Timestamp.Before(decoded.Events[j].Timestamp) })
+	return decoded
+}
+
+/* Decodes the payload of one of an agent's chains of buffers */
+func (t *DecodedTrace) decode(decoder Decoder, agent string, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	events, err := decoder.Decode(agent, payload)
+	for j := range events {
+		events[j].Agent = agent
+	}
+	t.Events = append(t.Events, events...)
+	if err != nil {
+		t.Errors = append(t.Errors, fmt.Errorf("Trace %d from %s: %v", t.Trace_id, agent, err))
+	}
+}
+
+type chainedBuffer struct {
+	header   memory.BufferHeader
+	payload  []byte
+	next     *chainedBuffer // The following buffer of the same chain, if received
+	has_prev bool           // Set if the preceding buffer of the chain was received
+}
+
+/*
+Rebuilds an agent's chains of buffers from their headers, returning the
+concatenated payload of each chain, oldest chain first.  A buffer follows
+the buffer whose ID is its Prev_buffer_id and whose Buffer_number is one
+less; since buffer IDs are reused, the most recently acquired such buffer
+is chosen.  If a buffer of a chain is missing, the remainder is returned as
+a separate chain.
+*/
+func chainPayloads(buffers []*chainedBuffer) (payloads [][]byte) {
+	sort.SliceStable(buffers, func(a, b int) bool { return buffers[a].header.Acquired < buffers[b].header.Acquired })
+	by_id := make(map[int32][]*chainedBuffer)
+	for _, b := range buffers {
+		if b.header.Buffer_number > 0 {
+			candidates := by_id[b.header.Prev_buffer_id]
+			for j := len(candidates) - 1; j >= 0; j-- {
+				prev := candidates[j]
+				if prev.next == nil && prev.header.Buffer_number == b.header.Buffer_number-1 {
+					prev.next = b
+					b.has_prev = true
+					break
+				}
+			}
+		}
+		by_id[b.header.Buffer_id] = append(by_id[b.header.Buffer_id], b)
+	}
+
+	for _, b := range buffers {
+		if b.has_prev {
+			continue
+		}
+		var payload []byte
+		for ; b != nil; b = b.next {
+			payload = append(payload, b.payload...)
+		}
+		payloads = append(payloads, payload)
+	}
+	return
+}
+
+/* The trace's buffers as a record, without serializing them */
+func (t *TraceToStore) toRecord() *TraceRecord {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	record := &TraceRecord{Trace_id: t.trace_id, First_received: t.first_received, Last_received: t.last_received}
+	agent_ids := make(map[string]int)
+	for _, buf := range t.buffers {
+		i, ok := agent_ids[buf.source_agent]
+		if !ok {
+			i = len(record.Agents)
+			agent_ids[buf.source_agent] = i
+			record.Agents = append(record.Agents, buf.source_agent)
+		}
+		record.Buffers = append(record.Buffers, RecordBuffer{Agent: i, Buffer: buf.buffer})
+	}
+	return record
+}
@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A buffer of a thread's chain, as written by the client library */
+func threadBuffer(trace_id uint64, buffer_id int32, prev_buffer_id int32, buffer_number int16, acquired uint64, payload []byte) []byte {
+	buf := makeBuffer(trace_id, buffer_id, string(payload))
+	binary.LittleEndian.PutUint64(buf[8:], acquired)
+	binary.LittleEndian.PutUint32(buf[20:], uint32(prev_buffer_id))
+	binary.LittleEndian.PutUint16(buf[28:], uint16(buffer_number))
+	return buf
+}
+
+func TestDecodeAndExport(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1000, 0)
+
+	span := EncodeKV(map[string]string{"event": "span", "name": "GET /", "time": "1000000000000", "dur": "5000000", "span": "a1", "http.status": "200"})
+	log := EncodeKV(map[string]string{"event": "log", "name": "cache miss", "time": "1001000000000", "span": "a1"})
+	annotation := EncodeKV(map[string]string{"name": "queued", "time": "1002000000000"})
+	stream := append(append([]byte(nil), span...), log...)
+
+	// Agent a's tracepoints are split across two buffers, which arrive out of order
+	record := &TraceRecord{Trace_id: 9, First_received: start, Last_received: start, Agents: []string{"a:1", "b:1"}}
+	record.Buffers = []RecordBuffer{
+		{Agent: 0, Buffer: threadBuffer(9, 2, 1, 1, 2, stream[20:])},
+		{Agent: 1, Buffer: threadBuffer(9, 1, 1, 0, 1, annotation)},
+		{Agent: 0, Buffer: threadBuffer(9, 1, 1, 0, 1, stream[:20])},
+	}
+
+	decoder, err := NewDecoder("kv")
+	assert.NoError(err)
+	decoded := DecodeTrace(record, decoder)
+	assert.Equal(0, len(decoded.Errors))
+	assert.Equal(3, len(decoded.Events))
+	assert.Equal(Span, decoded.Events[0].Kind)
+	assert.Equal("GET /", decoded.Events[0].Name)
+	assert.Equal(uint64(0xa1), decoded.Events[0].Span_id)
+	assert.Equal(5*time.Millisecond, decoded.Events[0].Duration)
+	assert.Equal(map[string]string{"http.status": "200"}, decoded.Events[0].Attributes)
+	assert.Equal(Log, decoded.Events[1].Kind)
+	assert.Equal(Annotation, decoded.Events[2].Kind)
+	assert.Equal("b:1", decoded.Events[2].Agent)
+
+	// Truncated tracepoints are reported, after decoding what's there
+	record.Buffers = record.Buffers[1:]
+	assert.Equal(1, len(DecodeTrace(record, decoder).Errors))
+
+	_, err = NewDecoder("nope")
+	assert.Error(err)
+
+	dir, err := ioutil.TempDir("", "export")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	otlp, err := NewExporter("otlp-json", filepath.Join(dir, "traces.otlp.json"))
+	assert.NoError(err)
+	assert.NoError(otlp.Export(decoded))
+	assert.NoError(otlp.Close())
+	var data otlpTracesData
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "traces.otlp.json"))
+	assert.NoError(json.Unmarshal(b, &data))
+	assert.Equal(2, len(data.ResourceSpans), "One resource per agent")
+	spans := data.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(1, len(spans))
+	assert.Equal("00000000000000000000000000000009", spans[0].TraceId)
+	assert.Equal("00000000000000a1", spans[0].SpanId)
+	assert.Equal("cache miss", spans[0].Events[0].Name, "Logs are events of their span")
+	assert.Equal("b:1", data.ResourceSpans[1].ScopeSpans[0].Spans[0].Name, "Annotations without a span are grouped by agent")
+
+	jaeger, err := NewExporter("jaeger", filepath.Join(dir, "traces.jaeger.json"))
+	assert.NoError(err)
+	assert.NoError(jaeger.Export(decoded))
+	assert.NoError(jaeger.Export(decoded))
+	assert.NoError(jaeger.Close())
+	var traces struct {
+		Data []jaegerTrace `json:"data"`
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "traces.jaeger.json"))
+	assert.NoError(json.Unmarshal(b, &traces))
+	assert.Equal(2, len(traces.Data))
+	assert.Equal(2, len(traces.Data[0].Spans))
+	assert.Equal(int64(5000), traces.Data[0].Spans[0].Duration)
+	assert.Equal("a:1", traces.Data[0].Processes[traces.Data[0].Spans[0].ProcessID].ServiceName)
+}
+
+func TestDecodeThreadChains(t *testing.T) {
+	assert := assert.New(t)
+
+	span := func(name string, time string) []byte {
+		return EncodeKV(map[string]string{"event": "span", "name": name, "time": time, "dur": "1000"})
+	}
+	thread1 := append(span("one", "1000000000000"), span("two", "1000000000001")...)
+	thread2 := append(span("three", "1000000000002"), span("four", "1000000000003")...)
+	half1, half2 := len(thread1)/2+3, len(thread2)/2+3 // Each splits the second span
+
+	// Two threads fill buffers at the same time, so their buffers interleave by acquired time
+	record := &TraceRecord{Trace_id: 9, Agents: []string{"a:1"}}
+	record.Buffers = []RecordBuffer{
+		{Agent: 0, Buffer: threadBuffer(9, 4, 3, 1, 4, thread2[half2:])},
+		{Agent: 0, Buffer: threadBuffer(9, 1, 1, 0, 1, thread1[:half1])},
+		{Agent: 0, Buffer: threadBuffer(9, 3, 3, 0, 2, thread2[:half2])},
+		{Agent: 0, Buffer: threadBuffer(9, 2, 1, 1, 3, thread1[half1:])},
+	}
+
+	decoder, err := NewDecoder("kv")
+	assert.NoError(err)
+	decoded := DecodeTrace(record, decoder)
+	assert.Equal(0, len(decoded.Errors))
+	var names []string
+	for _, e := range decoded.Events {
+		names = append(names, e.Name)
+	}
+	assert.Equal([]string{"one", "two", "three", "four"}, names)
+
+	// A reused buffer ID continues the most recent chain that used it
+	record.Buffers = append(record.Buffers,
+		RecordBuffer{Agent: 0, Buffer: threadBuffer(9, 1, 1, 0, 5, thread1[:half1])},
+		RecordBuffer{Agent: 0, Buffer: threadBuffer(9, 5, 1, 1, 6, thread1[half1:])},
+	)
+	decoded = DecodeTrace(record, decoder)
+	assert.Equal(0, len(decoded.Errors))
+	assert.Equal(6, len(decoded.Events))
+
+	// The rest of a chain whose buffer is missing is decoded separately
+	record.Buffers = record.Buffers[:4]
+	record.Buffers[3] = RecordBuffer{Agent: 0, Buffer: threadBuffer(9, 2, 7, 1, 3, thread1[half1:])}
+	assert.Equal(2, len(DecodeTrace(record, decoder).Errors), "Both halves of thread 1 are incomplete")
+}
+
+type failingExporter struct{}
+
+func (failingExporter) Export(trace *DecodedTrace) error { return fmt.Errorf("Exporter unavailable") }
+func (failingExporter) Sync() error                      { return fmt.Errorf("Exporter unavailable") }
+func (failingExporter) Close() error                     { return nil }
+
+func TestExportErrors(t *testing.T) {
+	assert := assert.New(t)
+	decoder, err := NewDecoder("kv")
+	assert.NoError(err)
+
+	// Export errors are logged, so that the trace can still be acknowledged
+	w := &decodingWriter{name: "kv", decoder: decoder, exporters: []Exporter{failingExporter{}}}
+	assert.NoError(w.WriteTrace(storedTrace(9, time.Now(), received("a:1", 9, 1, ""))))
+	assert.NoError(w.Sync())
+}
@@ -0,0 +1,174 @@
+package collector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+An Exporter writes decoded traces out in the format of some other tracing
+system.  Exporters are registered by name, and write to a file.
+*/
+type Exporter interface {
+	Export(trace *DecodedTrace) error
+	Sync() error // Flushes exported traces to stable storage
+	Close() error
+}
+
+var exporters = make(map[string]func(filename string) (Exporter, error))
+
+/* Makes an exporter available by name; called from init functions */
+func RegisterExporter(name string, newExporter func(filename string) (Exporter, error)) {
+	exporters[name] = newExporter
+}
+
+func NewExporter(name string, filename string) (Exporter, error) {
+	newExporter, ok := exporters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown exporter %q; available exporters are %v", name, ExporterNames())
+	}
+	return newExporter(filename)
+}
+
+func ExporterNames() (names []string) {
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+/*
+Decodes finalized traces, and passes them to exporters.  Exports are best
+effort: export errors are logged, rather than failing the write, so that a
+broken exporter doesn't stop traces being acknowledged to agents.
+*/
+type decodingWriter struct {
+	name      string // Name of the decoder
+	decoder   Decoder
+	exporters []Exporter
+}
+
+func (d *decodingWriter) WriteTrace(t *TraceToStore) error {
+	decoded := DecodeTrace(t.toRecord(), d.decoder)
+	for _, err := range decoded.Errors {
+		log.Println("Error decoding", err)
+	}
+	for _, exporter := range d.exporters {
+		err := exporter.Export(decoded)
+		if err != nil {
+			log.Printf("Error exporting trace %d: %v\n", t.trace_id, err)
+		}
+	}
+	return nil
+}
+
+func (d *decodingWriter) Sync() error {
+	for _, exporter := range d.exporters {
+		err := exporter.Sync()
+		if err != nil {
+			log.Println("Error syncing exported traces:", err)
+		}
+	}
+	return nil
+}
+
+func (d *decodingWriter) Close() (err error) {
+	for _, exporter := range d.exporters {
+		if e := exporter.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+/*
+Other tracing systems model traces as spans, so exporters convert decoded
+events into spans.  Logs and annotations become events of the span they
+name.  Those that don't name a span are grouped into one span per agent,
+covering the agent's part of the trace.
+*/
+type exportSpan struct {
+	agent          string
+	span_id        uint64
+	parent_span_id uint64
+	name           string
+	start          time.Time
+	end            time.Time
+	attributes     map[string]string
+	events         []Event
+}
+
+/* A stable span ID, for spans that don't have one */
+func syntheticSpanID(trace_id uint64, agent string, index int) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%d", trace_id, agent, index)
+	return h.Sum64()
+}
+
+func (t *DecodedTrace) spans() (spans []*exportSpan) {
+	by_id := make(map[uint64]*exportSpan)
+	for i, e := range t.Events {
+		if e.Kind != Span {
+			continue
+		}
+		span := &exportSpan{
+			agent:          e.Agent,
+			span_id:        e.Span_id,
+			parent_span_id: e.Parent_span_id,
+			name:           e.Name,
+			start:          e.Timestamp,
+			end:            e.Timestamp.Add(e.Duration),
+			attributes:     e.Attributes,
+		}
+		if span.span_id == 0 {
+			span.span_id = syntheticSpanID(t.Trace_id, e.Agent, i)
+		}
+		by_id[span.span_id] = span
+		spans = append(spans, span)
+	}
+
+	agent_spans := make(map[string]*exportSpan)
+	for _, e := range t.Events {
+		if e.Kind == Span {
+			continue
+		}
+		if span, ok := by_id[e.Span_id]; ok {
+			span.events = append(span.events, e)
+			continue
+		}
+		span, ok := agent_spans[e.Agent]
+		if !ok {
+			span = &exportSpan{agent: e.Agent, span_id: syntheticSpanID(t.Trace_id, e.Agent, -1), name: e.Agent, start: e.Timestamp, end: e.Timestamp}
+			agent_spans[e.Agent] = span
+			spans = append(spans, span)
+		}
+		if e.Timestamp.Before(span.start) {
+			span.start = e.Timestamp
+		}
+		if e.Timestamp.After(span.end) {
+			span.end = e.Timestamp
+		}
+		span.events = append(span.events, e)
+	}
+	return
+}
+
+/* The name of an event exported as part of a span */
+func (e *Event) exportName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Kind.String()
+}
+
+func sortedKeys(attributes map[string]string) (keys []string) {
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -1,10 +1,15 @@
 package collector
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 /*
@@ -15,12 +20,22 @@ type TraceToStore struct {
 	m        sync.Mutex
 	trace_id uint64
 	buffers  []*ReceivedBuffer // Group buffers by source agent
+
+	first_received time.Time
+	last_received  time.Time
+	size           int           // Total size of the buffers added
+	lru_entry      *list.Element // Entry in the Assembler's LRU
+	age_entry      *list.Element // Entry in the Assembler's list by age
 }
 
 type ReceivedBuffer struct {
 	trace_id     uint64
 	source_agent string
 	buffer       []byte
+
+	session  *reportingSession // Set if the agent expects an ack once the buffer is written
+	seq      uint64
+	received time.Time
 }
 
 func initTraceToStore(trace_id uint64) *TraceToStore {
@@ -131,3 +146,189 @@ func ReadFromFile(f *os.File) (source_agent string, buffer []byte, err error) {
 	buffer, err = readFileLengthPrefixed(f)
 	return
 }
+
+/*
+Files of assembled traces begin with TraceFileMagic, followed by one record
+per trace.  Each record is contiguous, so a reader can skip from trace to
+trace.  All integers are little endian.  A record is:
+
+	uint32 length of the remainder of the record
+	uint64 trace ID
+	int64  time the first buffer was received (unix nanoseconds)
+	int64  time the last buffer was received (unix nanoseconds)
+	uint32 number of contributing agents, then each agent (length prefixed)
+	uint32 number of buffers, then for each buffer the index of its agent
+	       (uint32) and the buffer (length prefixed)
+
+Files written before traces were assembled have no magic header, and are
+read with ReadFromFile.
+*/
+const TraceFileMagic = "HINDSIGHT-TRACES-v1\n"
+
+/* An assembled trace, as read from a file */
+type TraceRecord struct {
+	Trace_id       uint64
+	First_received time.Time
+	Last_received  time.Time
+	Agents         []string // Agents that contributed buffers to the trace
+	Buffers        []RecordBuffer
+}
+
+type RecordBuffer struct {
+	Agent  int // Index into Agents
+	Buffer []byte
+}
+
+func WriteTraceFileHeader(w io.Writer) error {
+	_, err := io.WriteString(w, TraceFileMagic)
+	return err
+}
+
+/*
+Reads the magic header at the start of a file of assembled traces.  Returns
+false, and leaves the reader unchanged, if the file is in the older format.
+*/
+func ReadTraceFileHeader(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(len(TraceFileMagic))
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if string(magic) != TraceFileMagic {
+		return false, nil
+	}
+	_, err = r.Discard(len(TraceFileMagic))
+	return true, err
+}
+
+func putUint32(b *bytes.Buffer, v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	b.Write(buf[:])
+}
+
+func putUint64(b *bytes.Buffer, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+/* Serializes the trace's buffers as a record */
+func (t *TraceToStore) Record() []byte {
+	t.m.Lock()
+	buffers := t.buffers
+	t.m.Unlock()
+
+	agent_ids := make(map[string]uint32)
+	var agents []string
+	for _, buf := range buffers {
+		if _, ok := agent_ids[buf.source_agent]; !ok {
+			agent_ids[buf.source_agent] = uint32(len(agents))
+			agents = append(agents, buf.source_agent)
+		}
+	}
+
+	var b bytes.Buffer
+	putUint32(&b, 0) // Length, filled in below
+	putUint64(&b, t.trace_id)
+	putUint64(&b, uint64(t.first_received.UnixNano()))
+	putUint64(&b, uint64(t.last_received.UnixNano()))
+	putUint32(&b, uint32(len(agents)))
+	for _, agent := range agents {
+		putUint32(&b, uint32(len(agent)))
+		b.WriteString(agent)
+	}
+	putUint32(&b, uint32(len(buffers)))
+	for _, buf := range buffers {
+		putUint32(&b, agent_ids[buf.source_agent])
+		putUint32(&b, uint32(len(buf.buffer)))
+		b.Write(buf.buffer)
+	}
+
+	record := b.Bytes()
+	binary.LittleEndian.PutUint32(record, uint32(len(record)-4))
+	return record
+}
+
+/* Parses a record, excluding its length prefix */
+func parseTraceRecord(data []byte) (*TraceRecord, error) {
+	truncated := fmt.Errorf("Trace record is truncated")
+	next := func(n int) []byte {
+		if len(data) < n {
+			return nil
+		}
+		b := data[:n]
+		data = data[n:]
+		return b
+	}
+	nextUint32 := func() (uint32, bool) {
+		b := next(4)
+		if b == nil {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(b), true
+	}
+
+	fixed := next(24)
+	if fixed == nil {
+		return nil, truncated
+	}
+	var t TraceRecord
+	t.Trace_id = binary.LittleEndian.Uint64(fixed[0:])
+	t.First_received = time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[8:])))
+	t.Last_received = time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[16:])))
+
+	num_agents, ok := nextUint32()
+	if !ok {
+		return nil, truncated
+	}
+	for i := uint32(0); i < num_agents; i++ {
+		sz, ok := nextUint32()
+		agent := next(int(sz))
+		if !ok || agent == nil {
+			return nil, truncated
+		}
+		t.Agents = append(t.Agents, string(agent))
+	}
+
+	num_buffers, ok := nextUint32()
+	if !ok {
+		return nil, truncated
+	}
+	for i := uint32(0); i < num_buffers; i++ {
+		agent, ok1 := nextUint32()
+		sz, ok2 := nextUint32()
+		buf := next(int(sz))
+		if !ok1 || !ok2 || buf == nil {
+			return nil, truncated
+		}
+		if agent >= num_agents {
+			return nil, fmt.Errorf("Trace record buffer has invalid agent %d", agent)
+		}
+		t.Buffers = append(t.Buffers, RecordBuffer{Agent: int(agent), Buffer: buf})
+	}
+	return &t, nil
+}
+
+/* Reads the next record from a file of assembled traces; returns io.EOF at the end of the file */
+func ReadTraceRecord(r io.Reader) (*TraceRecord, error) {
+	szbuf := make([]byte, 4)
+	_, err := io.ReadFull(r, szbuf)
+	if err != nil {
+		return nil, err
+	}
+	sz := binary.LittleEndian.Uint32(szbuf)
+	if sz > 1024*1024*1024 {
+		return nil, fmt.Errorf("Invalid trace record of size %d", sz)
+	}
+	data := make([]byte, sz)
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTraceRecord(data)
+}
@@ -0,0 +1,511 @@
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+)
+
+/*
+A collector can forward the buffers it receives to upstream collectors, e.g.
+a per-rack collector in front of a central one.  Buffers are forwarded as
+they are received, before assembly, using the same protocol as agents.  Each
+agent's buffers are forwarded over their own connection, whose handshake
+names the agent, so the upstream collector sees the original agent address.
+
+Forwarding always uses acknowledged delivery (see util.ReportingAckMagic).
+Buffers are kept until the upstream acknowledges them, so they are resent
+if the upstream restarts, and are buffered while it is unavailable.
+
+Buffers that are only acked to their agent once forwarded are never dropped:
+once an agent's queue for an upstream is full, forwarding its buffers blocks,
+so the collector stops reading from the agent until the upstream catches up.
+Other buffers, which are acked once written locally, are dropped oldest
+first instead.  An agent's queue, and its connection to the upstream, are
+closed once the agent has sent nothing for forwardIdleTimeout.
+*/
+type Forwarder struct {
+	upstreams []*upstream
+	routing   Routing
+	cancel    context.CancelFunc
+}
+
+/* Which upstreams a buffer is forwarded to */
+type Routing int
+
+const (
+	RouteAll     Routing = iota // Every upstream receives every buffer
+	RouteByAgent                // Each agent's buffers go to one upstream
+	RouteByTrace                // Each trace's buffers go to one upstream
+)
+
+func (r Routing) String() string {
+	switch r {
+	case RouteByAgent:
+		return "agent"
+	case RouteByTrace:
+		return "trace"
+	default:
+		return "all"
+	}
+}
+
+func ParseRouting(value string) (Routing, error) {
+	switch value {
+	case "all":
+		return RouteAll, nil
+	case "agent":
+		return RouteByAgent, nil
+	case "trace":
+		return RouteByTrace, nil
+	}
+	return RouteAll, fmt.Errorf("Unknown routing %q -- must be all, agent, or trace", value)
+}
+
+/* By default, up to 64MB of each agent's buffers are kept for each upstream until acknowledged */
+const DefaultMaxForwardBytes = 64 * 1024 * 1024
+
+/* How long to wait before reconnecting to an upstream */
+const forwardRetryInterval = 2 * time.Second
+
+/* How long an agent's queue is kept once it is empty and the agent sends nothing */
+const forwardIdleTimeout = 10 * time.Minute
+
+var errForwardIdle = errors.New("Agent is idle")
+
+type upstream struct {
+	addr      string
+	tls       util.TLSConfig
+	max_bytes int
+	ctx       context.Context // Cancelled when the forwarder is closed
+
+	idle_timeout time.Duration // How long an empty queue is kept while its agent sends nothing
+
+	mu     sync.Mutex
+	agents map[string]*forwardQueue
+}
+
+/*
+A buffer being forwarded.  If the agent is waiting for the buffer to be
+acknowledged, it is acked once every upstream it was forwarded to has
+acknowledged it, or dropped it.
+*/
+type forwardedBuffer struct {
+	r         *ReceivedBuffer
+	remaining *int32 // Upstreams yet to acknowledge the buffer; nil if not acking the agent
+}
+
+/*
+One agent's buffers for one upstream, oldest first, until the upstream
+acknowledges them.  Beyond max_bytes, adding a buffer that the agent awaits
+an ack for blocks, and otherwise the oldest buffers are dropped.
+*/
+type forwardQueue struct {
+	upstream *upstream
+	agent    string
+	session  uint64 // Identifies this queue to the upstream
+
+	mu         sync.Mutex
+	acked      *sync.Cond // Signalled when the upstream acknowledges buffers
+	next_seq   uint64
+	buffers    []forwardedSeq
+	bytes      int
+	dropped    uint64
+	blocked    uint64    // Times adding a buffer waited for the upstream
+	last_added time.Time // For closing idle queues
+	closed     bool      // Set once the queue is removed from its upstream
+	notify     chan bool // Signalled when buffers are added
+}
+
+type forwardedSeq struct {
+	seq uint64
+	forwardedBuffer
+}
+
+func InitForwarder(addrs []string, routing Routing, max_bytes int, config util.TLSConfig) *Forwarder {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Forwarder{routing: routing, cancel: cancel}
+	for _, addr := range addrs {
+		f.upstreams = append(f.upstreams, &upstream{
+			addr:      addr,
+			tls:       config,
+			max_bytes: max_bytes,
+			ctx:       ctx,
+			agents:    make(map[string]*forwardQueue),
+
+			idle_timeout: forwardIdleTimeout,
+		})
+	}
+	return f
+}
+
+func hashRoute(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+/* The upstreams that a buffer is forwarded to */
+func (f *Forwarder) route(r *ReceivedBuffer) []*upstream {
+	switch f.routing {
+	case RouteByAgent:
+		return []*upstream{f.upstreams[hashRoute([]byte(r.source_agent), len(f.upstreams))]}
+	case RouteByTrace:
+		key := make([]byte, 8)
+		binary.LittleEndian.PutUint64(key, r.trace_id)
+		return []*upstream{f.upstreams[hashRoute(key, len(f.upstreams))]}
+	default:
+		return f.upstreams
+	}
+}
+
+/*
+Queues a received buffer to be forwarded.  With ack, the buffer is acked to
+its agent once the upstreams acknowledge it, for collectors that forward
+instead of writing locally.
+*/
+func (f *Forwarder) Forward(r *ReceivedBuffer, ack bool) {
+	upstreams := f.route(r)
+	b := forwardedBuffer{r: r}
+	if ack && r.session != nil {
+		remaining := int32(len(upstreams))
+		b.remaining = &remaining
+	}
+	for _, u := range upstreams {
+		for !u.queue(r.source_agent).add(b) {
+			// The queue was closed for being idle; add to a new one
+		}
+	}
+}
+
+/*
+Stops forwarding, e.g. on shutdown after Flush.  Buffers that haven't been
+forwarded are not acked to their agents, which resend them.
+*/
+func (f *Forwarder) Close() {
+	f.cancel()
+	for _, u := range f.upstreams {
+		u.mu.Lock()
+		for _, q := range u.agents {
+			q.mu.Lock()
+			q.acked.Broadcast()
+			q.mu.Unlock()
+		}
+		u.mu.Unlock()
+	}
+}
+
+/*
+Waits until upstreams have acknowledged everything forwarded, e.g. on
+shutdown.  Returns false if they haven't by the deadline.
+*/
+func (f *Forwarder) Flush(deadline time.Time) bool {
+	for !f.flushed() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (f *Forwarder) flushed() bool {
+	for _, u := range f.upstreams {
+		u.mu.Lock()
+		queues := make([]*forwardQueue, 0, len(u.agents))
+		for _, q := range u.agents {
+			queues = append(queues, q)
+		}
+		u.mu.Unlock()
+		for _, q := range queues {
+			q.mu.Lock()
+			pending := len(q.buffers)
+			q.mu.Unlock()
+			if pending > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/* Returns the agent's queue, connecting to the upstream on its behalf the first time */
+func (u *upstream) queue(agent string) *forwardQueue {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	q, ok := u.agents[agent]
+	if !ok {
+		q = &forwardQueue{upstream: u, agent: agent, session: uint64(time.Now().UnixNano()), notify: make(chan bool, 1)}
+		q.acked = sync.NewCond(&q.mu)
+		q.last_added = time.Now()
+		u.agents[agent] = q
+		go q.run()
+	}
+	return q
+}
+
+/* Acks buffers to their agents once every upstream is done with them */
+func forwarded(buffers []forwardedSeq) {
+	var done []*ReceivedBuffer
+	for _, b := range buffers {
+		if b.remaining != nil && atomic.AddInt32(b.remaining, -1) == 0 {
+			done = append(done, b.r)
+		}
+	}
+	acknowledge(done)
+}
+
+/*
+Adds a buffer to the queue, first waiting for room if the agent awaits an
+ack for it.  Returns false if the queue has been closed for being idle.
+*/
+func (q *forwardQueue) add(b forwardedBuffer) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	if b.remaining != nil && q.full(len(b.r.buffer)) {
+		q.blocked++
+		if q.blocked == 1 || q.blocked%1000 == 0 {
+			log.Printf("Upstream %s hasn't acknowledged %d MB of trace data from %s; not reading from the agent until it does (%d times so far)\n", q.upstream.addr, q.upstream.max_bytes/(1024*1024), q.agent, q.blocked)
+		}
+		for q.full(len(b.r.buffer)) && q.upstream.ctx.Err() == nil {
+			q.acked.Wait()
+		}
+		if q.upstream.ctx.Err() != nil {
+			q.mu.Unlock()
+			return true // Not forwarded, so the agent resends it
+		}
+	}
+	q.last_added = time.Now()
+	q.next_seq++
+	q.buffers = append(q.buffers, forwardedSeq{q.next_seq, b})
+	q.bytes += len(b.r.buffer)
+	var dropped []forwardedSeq
+	for q.bytes > q.upstream.max_bytes && len(q.buffers) > 1 {
+		q.bytes -= len(q.buffers[0].r.buffer)
+		dropped = append(dropped, q.buffers[0])
+		q.buffers = q.buffers[1:]
+		q.dropped++
+		if q.dropped == 1 || q.dropped%1000 == 0 {
+			log.Printf("Upstream %s hasn't acknowledged %d MB of trace data from %s; %d buffers dropped so far\n", q.upstream.addr, q.upstream.max_bytes/(1024*1024), q.agent, q.dropped)
+		}
+	}
+	q.mu.Unlock()
+
+	forwarded(dropped) // Only buffers that were already acked to their agent are dropped
+	select {
+	case q.notify <- true:
+	default:
+	}
+	return true
+}
+
+/* Whether adding size bytes would exceed max_bytes; must be called with mu held */
+func (q *forwardQueue) full(size int) bool {
+	return len(q.buffers) > 0 && q.bytes+size > q.upstream.max_bytes
+}
+
+/* Removes the queue from its upstream if it is empty and idle, returning true if it was removed */
+func (q *forwardQueue) retireIfIdle() bool {
+	q.upstream.mu.Lock()
+	defer q.upstream.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.buffers) > 0 || time.Since(q.last_added) < q.upstream.idle_timeout {
+		return false
+	}
+	q.closed = true
+	delete(q.upstream.agents, q.agent)
+	return true
+}
+
+/* The upstream has durably written everything up to and including seq */
+func (q *forwardQueue) ack(seq uint64) {
+	q.mu.Lock()
+	acked := 0
+	for acked < len(q.buffers) && q.buffers[acked].seq <= seq {
+		q.bytes -= len(q.buffers[acked].r.buffer)
+		acked++
+	}
+	done := q.buffers[:acked]
+	q.buffers = q.buffers[acked:]
+	if acked > 0 {
+		q.acked.Broadcast()
+	}
+	q.mu.Unlock()
+
+	forwarded(done)
+}
+
+/* Whether the queue is empty and nothing has been added for the idle timeout */
+func (q *forwardQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.buffers) == 0 && time.Since(q.last_added) >= q.upstream.idle_timeout
+}
+
+/* The oldest buffer after seq, if there is one */
+func (q *forwardQueue) next(seq uint64) (forwardedSeq, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.buffers) == 0 || seq >= q.buffers[len(q.buffers)-1].seq {
+		return forwardedSeq{}, false
+	}
+	if seq < q.buffers[0].seq {
+		return q.buffers[0], true
+	}
+	return q.buffers[seq+1-q.buffers[0].seq], true
+}
+
+/* Connects to the upstream, using TLS if configured */
+func (u *upstream) dial() (net.Conn, error) {
+	if !u.tls.Enabled() {
+		return net.Dial("tcp", u.addr)
+	}
+	config, err := u.tls.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", u.addr, config)
+}
+
+/*
+Forwards the agent's buffers to the upstream, reconnecting whenever the
+connection fails, until the forwarder is closed or the agent is idle
+*/
+func (q *forwardQueue) run() {
+	log.Printf("Forwarding trace data from %s to %s\n", q.agent, q.upstream.addr)
+	ctx := q.upstream.ctx
+	firsttime := true
+	for ctx.Err() == nil {
+		if q.retireIfIdle() {
+			log.Printf("Stopped forwarding trace data from idle agent %s to %s\n", q.agent, q.upstream.addr)
+			return
+		}
+		conn, err := q.upstream.dial()
+		if err == nil {
+			var connected bool
+			connected, err = q.forward(ctx, conn)
+			conn.Close()
+			if connected {
+				firsttime = true
+			}
+		}
+		if err == errForwardIdle || ctx.Err() != nil {
+			continue
+		}
+		if firsttime {
+			log.Printf("Error forwarding trace data from %s to %s: %v -- will retry every %v\n", q.agent, q.upstream.addr, err, forwardRetryInterval)
+			firsttime = false
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(forwardRetryInterval):
+		}
+	}
+}
+
+func writeForwarded(conn net.Conn, b forwardedSeq) error {
+	frame := make([]byte, 12+len(b.r.buffer))
+	binary.LittleEndian.PutUint32(frame, uint32(8+len(b.r.buffer)))
+	binary.LittleEndian.PutUint64(frame[4:], b.seq)
+	copy(frame[12:], b.r.buffer)
+	for len(frame) > 0 {
+		written, err := conn.Write(frame)
+		if err != nil {
+			return err
+		}
+		frame = frame[written:]
+	}
+	return nil
+}
+
+func readForwardAck(conn net.Conn) (uint64, error) {
+	ack := make([]byte, 8)
+	err := doRead(conn, ack)
+	return binary.LittleEndian.Uint64(ack), err
+}
+
+/*
+Sends the agent's handshake, then its buffers, until the connection fails,
+the forwarder is closed, or the agent has been idle for the idle timeout
+*/
+func (q *forwardQueue) forward(ctx context.Context, conn net.Conn) (connected bool, err error) {
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // Unblocks writes to an upstream that has stopped reading
+		case <-finished:
+		}
+	}()
+
+	handshake := util.EncodeAckedHandshake(q.session, q.agent)
+	prefix := make([]byte, 4)
+	binary.LittleEndian.PutUint32(prefix, uint32(len(handshake)))
+	_, err = conn.Write(append(prefix, handshake...))
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(ackWriteTimeout))
+	sent, err := readForwardAck(conn)
+	if err != nil {
+		err = fmt.Errorf("Upstream did not acknowledge handshake: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	q.ack(sent)
+	connected = true
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			seq, err := readForwardAck(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			q.ack(seq)
+		}
+	}()
+
+	idle := time.NewTicker(q.upstream.idle_timeout)
+	defer idle.Stop()
+	for {
+		b, ok := q.next(sent)
+		if !ok {
+			select {
+			case <-q.notify:
+				continue
+			case err = <-errs:
+				return
+			case <-ctx.Done():
+				return
+			case <-idle.C:
+				if q.idle() {
+					err = errForwardIdle
+					return
+				}
+				continue
+			}
+		}
+		err = writeForwarded(conn, b)
+		if err != nil {
+			return
+		}
+		sent = b.seq
+	}
+}
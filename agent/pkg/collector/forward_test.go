@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarding(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// The upstream collector writes to a store
+	var upstream Collector
+	upstream.Init("0", "")
+	upstream.ConfigureAssembly(20*time.Millisecond, 0, 0)
+	assert.NoError(upstream.ConfigureStore(dir, StoreConfig{}))
+	go upstream.traceWriter()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go upstream.handleConnection(conn)
+		}
+	}()
+
+	// The forwarding collector doesn't write locally, so acks once the upstream has written
+	var c Collector
+	c.Init("0", "")
+	c.ConfigureForwarding(InitForwarder([]string{listener.Addr().String()}, RouteAll, DefaultMaxForwardBytes, util.TLSConfig{}))
+	c.forward_only = true
+
+	conn, ack := connectAcked(&c, 1, "a:1")
+	assert.Equal(uint64(0), ack)
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+	writeSequencedFrame(conn, 2, makeBuffer(5, 2, "two"))
+	assert.Equal(uint64(2), awaitAck(conn, 2), "Acked once the upstream has written the trace")
+	conn.Close()
+
+	record, err := upstream.store.ReadTrace(5)
+	assert.NoError(err)
+	assert.Equal(2, len(record.Buffers))
+	assert.Equal([]string{"a:1"}, record.Agents, "The agent's handshake is forwarded")
+
+	// Routing picks one upstream per agent or per trace
+	f := InitForwarder([]string{"x:1", "y:1", "z:1"}, RouteByAgent, DefaultMaxForwardBytes, util.TLSConfig{})
+	first := f.route(received("a:1", 1, 1, ""))
+	assert.Equal(1, len(first))
+	assert.Equal(first, f.route(received("a:1", 2, 1, "")))
+	f.routing = RouteByTrace
+	assert.Equal(f.route(received("a:1", 7, 1, "")), f.route(received("b:1", 7, 1, "")))
+	_, err = ParseRouting("nope")
+	assert.Error(err)
+}
+
+/* An upstream that acks handshakes, then only acks buffers when told to */
+func stalledUpstream(t *testing.T) (addr string, frames chan []byte, acks chan uint64) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	frames, acks = make(chan []byte, 100), make(chan uint64, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				for seq := range acks {
+					ack := make([]byte, 8)
+					binary.LittleEndian.PutUint64(ack, seq)
+					conn.Write(ack)
+				}
+			}()
+			if _, err := readLengthPrefixed(conn, DefaultMaxFrameSize); err != nil {
+				return
+			}
+			acks <- 0
+			for {
+				frame, err := readLengthPrefixed(conn, DefaultMaxFrameSize)
+				if err != nil {
+					return
+				}
+				frames <- frame
+			}
+		}
+	}()
+	return listener.Addr().String(), frames, acks
+}
+
+func TestForwardingBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	addr, frames, acks := stalledUpstream(t)
+
+	buffer := func(buffer_id int32) *ReceivedBuffer {
+		r := received("a:1", 5, buffer_id, "payload")
+		r.session = &reportingSession{done: make(map[uint64]bool)}
+		r.seq = uint64(buffer_id)
+		return r
+	}
+	f := InitForwarder([]string{addr}, RouteAll, 2*len(buffer(0).buffer), util.TLSConfig{})
+	f.upstreams[0].idle_timeout = 50 * time.Millisecond
+	f.Forward(buffer(1), true)
+	f.Forward(buffer(2), true)
+	<-frames
+	<-frames
+
+	// The queue is full, so forwarding blocks rather than dropping a buffer the agent awaits
+	forwarded := make(chan bool)
+	go func() {
+		f.Forward(buffer(3), true)
+		close(forwarded)
+	}()
+	select {
+	case <-forwarded:
+		t.Fatal("Forwarded beyond the queue's limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	q := f.upstreams[0].queue("a:1")
+	q.mu.Lock()
+	assert.Equal(uint64(0), q.dropped)
+	assert.Equal(uint64(1), q.blocked)
+	q.mu.Unlock()
+
+	acks <- 1
+	<-forwarded
+	assert.Equal(uint64(3), binary.LittleEndian.Uint64(<-frames), "Forwarded once the upstream acknowledged buffer 1")
+
+	// Once acknowledged and idle, the agent's queue is closed
+	acks <- 3
+	assert.Eventually(func() bool {
+		f.upstreams[0].mu.Lock()
+		defer f.upstreams[0].mu.Unlock()
+		return len(f.upstreams[0].agents) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Closing the forwarder unblocks forwarding
+	f.upstreams[0].idle_timeout = time.Hour
+	f.Forward(buffer(4), true)
+	f.Forward(buffer(5), true)
+	forwarded = make(chan bool)
+	go func() {
+		f.Forward(buffer(6), true)
+		close(forwarded)
+	}()
+	f.Close()
+	<-forwarded
+}
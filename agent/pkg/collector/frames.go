@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/memory"
+)
+
+/*
+Every message from an agent is a frame: a uint32 length, then that many
+bytes.  Frame lengths are checked before anything is allocated, and each
+buffer's header is checked against its frame, so that a misbehaving or
+malicious peer can't exhaust the collector's memory or pollute traces.
+
+Agents' buffers are a few KB, so by default frames are limited to 1MB.
+*/
+const DefaultMaxFrameSize = 1024 * 1024
+
+/* Invalid buffers a connection can send before it is closed */
+const DefaultMaxFrameErrors = 10
+
+/* Invalid buffers count towards max_frame_errors for this long */
+const frameErrorWindow = 1 * time.Minute
+
+/* Handshakes are an agent's address, plus a session for acked agents */
+const maxHandshakeSize = 4096
+
+const bufferHeaderSize = 32
+
+func doRead(r io.Reader, dst []byte) error {
+	_, err := io.ReadFull(r, dst)
+	return err
+}
+
+func readFrameSize(r io.Reader) (uint32, error) {
+	szbuf := make([]byte, 4)
+	err := doRead(r, szbuf)
+	return binary.LittleEndian.Uint32(szbuf), err
+}
+
+func checkFrameSize(sz uint32, max_size int) error {
+	if uint64(sz) > uint64(max_size) {
+		return fmt.Errorf("Frame of %d bytes exceeds the maximum of %d", sz, max_size)
+	}
+	return nil
+}
+
+/* Reads a frame, rejecting frames larger than max_size before reading them */
+func readLengthPrefixed(r io.Reader, max_size int) (buf []byte, err error) {
+	sz, err := readFrameSize(r)
+	if err == nil {
+		err = checkFrameSize(sz, max_size)
+	}
+	if err != nil {
+		return
+	}
+	buf = make([]byte, sz)
+	err = doRead(r, buf)
+	return
+}
+
+/*
+Splits a frame into the buffer and, if the agent numbers its buffers, the
+buffer's sequence number, and checks the buffer's header.  The sequence
+number is returned even if the buffer is invalid, so that it can be acked.
+*/
+func parseFrame(frame []byte, sequenced bool) (seq uint64, buf []byte, header memory.BufferHeader, err error) {
+	buf = frame
+	if sequenced {
+		if len(frame) < 8 {
+			err = fmt.Errorf("Frame of %d bytes is too short for a sequence number", len(frame))
+			return
+		}
+		seq = binary.LittleEndian.Uint64(frame)
+		buf = frame[8:]
+	}
+	if len(buf) < bufferHeaderSize {
+		err = fmt.Errorf("Buffer of %d bytes is shorter than its header", len(buf))
+		return
+	}
+	header = memory.ExtractBufferHeader(buf)
+	if int(header.Size) != len(buf) {
+		err = fmt.Errorf("Buffer header size %d does not match the %d bytes received", header.Size, len(buf))
+	} else if header.Trace_id == 0 {
+		err = fmt.Errorf("Buffer has no trace ID")
+	}
+	return
+}
+
+/*
+Counts an invalid buffer from a connection.  Returns false once the
+connection has sent more than max_frame_errors within frameErrorWindow, and
+should be closed.
+*/
+func (c *Collector) frameError(tracked *connection, agent string, err error) bool {
+	now := time.Now()
+	if now.Sub(tracked.errors_since) >= frameErrorWindow {
+		tracked.errors_since = now
+		atomic.StoreUint64(&tracked.frame_errors, 0)
+	}
+	errors := atomic.AddUint64(&tracked.frame_errors, 1)
+	c.metrics.frameError(agent)
+	if errors > uint64(c.max_frame_errors) {
+		log.Printf("Closing connection from %s after %d invalid buffers: %v\n", agent, errors, err)
+		return false
+	}
+	if errors == 1 {
+		log.Printf("Invalid buffer from %s: %v\n", agent, err)
+	}
+	return true
+}
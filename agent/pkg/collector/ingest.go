@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+/*
+Received buffers are queued per connection, and the trace writer takes
+buffers from connections in turn, so that one noisy agent can't starve the
+others.  Each connection can only queue a few buffers; once its queue is
+full, the connection stops reading until the writer catches up, which pushes
+back on the agent over TCP rather than dropping data.
+*/
+type fairQueue struct {
+	mu     sync.Mutex
+	space  *sync.Cond // Signalled when buffers are taken
+	depth  int        // Buffers each connection can queue
+	queues map[*connection]*connectionQueue
+	active []*connectionQueue // Queues with buffers, in turn
+	next   int                // Index into active of the queue whose turn is next
+	ready  chan bool          // Signalled when buffers are added
+}
+
+type connectionQueue struct {
+	buffers []*ReceivedBuffer
+	active  bool
+}
+
+/* Buffers each connection can queue before it stops reading */
+const fairQueueDepth = 64
+
+func (fq *fairQueue) Init(depth int) {
+	fq.space = sync.NewCond(&fq.mu)
+	fq.depth = depth
+	fq.queues = make(map[*connection]*connectionQueue)
+	fq.ready = make(chan bool, 1)
+}
+
+/* Queues a buffer from a connection, waiting while the connection's queue is full */
+func (fq *fairQueue) push(conn *connection, r *ReceivedBuffer) {
+	fq.mu.Lock()
+	q, ok := fq.queues[conn]
+	if !ok {
+		q = &connectionQueue{}
+		fq.queues[conn] = q
+	}
+	for len(q.buffers) >= fq.depth {
+		fq.space.Wait()
+	}
+	q.buffers = append(q.buffers, r)
+	if !q.active {
+		q.active = true
+		fq.active = append(fq.active, q)
+	}
+	fq.mu.Unlock()
+	fq.signal()
+}
+
+func (fq *fairQueue) signal() {
+	select {
+	case fq.ready <- true:
+	default:
+	}
+}
+
+func (fq *fairQueue) pending() bool {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	return len(fq.active) > 0
+}
+
+/* Takes the next buffer, from the connection whose turn it is; nil if there are none */
+func (fq *fairQueue) pop() *ReceivedBuffer {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if len(fq.active) == 0 {
+		return nil
+	}
+	if fq.next >= len(fq.active) {
+		fq.next = 0
+	}
+	q := fq.active[fq.next]
+	r := q.buffers[0]
+	q.buffers[0] = nil
+	q.buffers = q.buffers[1:]
+	if len(q.buffers) == 0 {
+		q.active = false
+		fq.active = append(fq.active[:fq.next], fq.active[fq.next+1:]...)
+	} else {
+		fq.next++
+	}
+	fq.space.Broadcast()
+	return r
+}
+
+/* Once a connection closes; buffers it already queued are still taken */
+func (fq *fairQueue) remove(conn *connection) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	delete(fq.queues, conn)
+}
+
+/*
+Quota state for an agent, kept across its reconnections.  With a quota, an
+agent that exceeds its rate is throttled: its connection stops reading until
+the agent is back within its quota.  Throughput and throttle time are
+reported in telemetry (see CollectorMetrics); throttling is also logged.
+
+An agent's entry is kept for agentIngestTimeout after its last connection
+closes, so that reconnecting doesn't reset its quota, and is then removed.
+*/
+type agentIngest struct {
+	throttled int64             // Nanoseconds spent throttled; first, so that it is aligned for atomic access
+	bucket    *ratelimit.Bucket // nil if there is no quota
+
+	connections  int       // Open connections from the agent; guarded by agentIngests.mu
+	disconnected time.Time // When the agent's last connection closed
+
+	reported_throttled int64 // Value of throttled as of the last throttling report
+}
+
+const agentIngestTimeout = 1 * time.Minute
+
+type agentIngests struct {
+	mu     sync.Mutex
+	quota  float64 // Bytes per second for each agent; 0 for no quota
+	agents map[string]*agentIngest
+}
+
+func (ai *agentIngests) Init(quota float64) {
+	ai.quota = quota
+	ai.agents = make(map[string]*agentIngest)
+}
+
+/* Returns the agent's entry for a new connection, removing entries of agents that are gone */
+func (ai *agentIngests) connect(agent string) *agentIngest {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	now := time.Now()
+	for name, a := range ai.agents {
+		if a.connections == 0 && now.Sub(a.disconnected) > agentIngestTimeout {
+			delete(ai.agents, name)
+		}
+	}
+	a, ok := ai.agents[agent]
+	if !ok {
+		a = &agentIngest{}
+		if ai.quota > 0 {
+			// Agents can burst up to a second's worth of their quota
+			a.bucket = ratelimit.NewBucketWithRate(ai.quota, int64(ai.quota))
+		}
+		ai.agents[agent] = a
+	}
+	a.connections++
+	return a
+}
+
+func (ai *agentIngests) disconnect(a *agentIngest) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	a.connections--
+	if a.connections == 0 {
+		a.disconnected = time.Now()
+	}
+}
+
+/* Waits if the agent is over its quota after a buffer of size bytes, returning how long */
+func (a *agentIngest) received(size int) (wait time.Duration) {
+	if a.bucket == nil {
+		return
+	}
+	wait = a.bucket.Take(int64(size))
+	if wait > 0 {
+		atomic.AddInt64(&a.throttled, int64(wait))
+		time.Sleep(wait)
+	}
+	return
+}
+
+/* Logs the agents that were throttled since the last report */
+func (ai *agentIngests) reportThrottled(interval time.Duration) {
+	ai.mu.Lock()
+	names := make([]string, 0, len(ai.agents))
+	for name := range ai.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var throttled []string
+	for _, name := range names {
+		a := ai.agents[name]
+		wait := atomic.LoadInt64(&a.throttled)
+		if wait > a.reported_throttled {
+			throttled = append(throttled, fmt.Sprintf("%s throttled %v", name, time.Duration(wait-a.reported_throttled).Round(time.Millisecond)))
+		}
+		a.reported_throttled = wait
+	}
+	ai.mu.Unlock()
+
+	if len(throttled) > 0 {
+		log.Printf("Agents over quota in the last %v: %s\n", interval.Round(time.Second), strings.Join(throttled, ", "))
+	}
+}
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairQueue(t *testing.T) {
+	assert := assert.New(t)
+	var fq fairQueue
+	fq.Init(4)
+	noisy, quiet := &connection{}, &connection{}
+
+	for i := int32(1); i <= 4; i++ {
+		fq.push(noisy, received("noisy:1", 1, i, ""))
+	}
+	fq.push(quiet, received("quiet:1", 2, 1, ""))
+
+	// The noisy connection's queue is full, so it waits until a buffer is taken
+	pushed := make(chan bool)
+	go func() {
+		fq.push(noisy, received("noisy:1", 1, 5, ""))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		assert.Fail("Push to a full queue did not wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.Equal("noisy:1", fq.pop().source_agent)
+	assert.Equal("quiet:1", fq.pop().source_agent, "Connections take turns")
+	<-pushed
+	for i := 0; i < 4; i++ {
+		assert.Equal("noisy:1", fq.pop().source_agent)
+	}
+	assert.Nil(fq.pop())
+
+	// Agents over their quota are throttled
+	var agents agentIngests
+	agents.Init(100000)
+	a := agents.connect("a:1")
+	assert.Equal(time.Duration(0), a.received(100000), "Within the burst")
+	assert.True(a.received(10000) > 50*time.Millisecond)
+	assert.True(a.throttled > int64(50*time.Millisecond))
+
+	// The quota is kept across reconnections, until the agent has been gone a while
+	agents.disconnect(a)
+	assert.Equal(a, agents.connect("a:1"))
+	agents.disconnect(a)
+	a.disconnected = time.Now().Add(-agentIngestTimeout - time.Second)
+	agents.connect("b:1")
+	assert.Equal(1, len(agents.agents), "a:1 is removed")
+}
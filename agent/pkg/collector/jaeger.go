@@ -0,0 +1,145 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+The jaeger exporter writes traces in the JSON format returned by Jaeger's
+query API, which the Jaeger UI can open as a file.  The file is one JSON
+document, so it is only complete once the collector closes it.  Each agent
+is a Jaeger process, with the agent's address as its service name.
+*/
+type JaegerExporter struct {
+	f     *os.File
+	first bool
+}
+
+func init() {
+	RegisterExporter("jaeger", func(filename string) (Exporter, error) {
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteString("{\"data\":[\n")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &JaegerExporter{f, true}, nil
+	})
+}
+
+type jaegerTag struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64       `json:"timestamp"`
+	Fields    []jaegerTag `json:"fields"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	StartTime     int64             `json:"startTime"` // Microseconds
+	Duration      int64             `json:"duration"`  // Microseconds
+	Tags          []jaegerTag       `json:"tags"`
+	Logs          []jaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+}
+
+type jaegerProcess struct {
+	ServiceName string      `json:"serviceName"`
+	Tags        []jaegerTag `json:"tags"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+}
+
+func jaegerTags(attributes map[string]string) []jaegerTag {
+	tags := []jaegerTag{}
+	for _, key := range sortedKeys(attributes) {
+		tags = append(tags, jaegerTag{key, "string", attributes[key]})
+	}
+	return tags
+}
+
+func jaegerTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func (x *JaegerExporter) Export(trace *DecodedTrace) error {
+	converted := jaegerTrace{TraceID: fmt.Sprintf("%016x", trace.Trace_id), Spans: []jaegerSpan{}, Processes: make(map[string]jaegerProcess)}
+	process_ids := make(map[string]string)
+	for _, span := range trace.spans() {
+		process_id, ok := process_ids[span.agent]
+		if !ok {
+			process_id = fmt.Sprintf("p%d", len(process_ids)+1)
+			process_ids[span.agent] = process_id
+			converted.Processes[process_id] = jaegerProcess{span.agent, []jaegerTag{}}
+		}
+
+		s := jaegerSpan{
+			TraceID:       converted.TraceID,
+			SpanID:        fmt.Sprintf("%016x", span.span_id),
+			OperationName: span.name,
+			References:    []jaegerReference{},
+			StartTime:     jaegerTime(span.start),
+			Duration:      jaegerTime(span.end) - jaegerTime(span.start),
+			Tags:          jaegerTags(span.attributes),
+			Logs:          []jaegerLog{},
+			ProcessID:     process_id,
+		}
+		if span.parent_span_id != 0 {
+			s.References = append(s.References, jaegerReference{"CHILD_OF", converted.TraceID, fmt.Sprintf("%016x", span.parent_span_id)})
+		}
+		for _, e := range span.events {
+			fields := append([]jaegerTag{{"event", "string", e.exportName()}}, jaegerTags(e.Attributes)...)
+			s.Logs = append(s.Logs, jaegerLog{jaegerTime(e.Timestamp), fields})
+		}
+		converted.Spans = append(converted.Spans, s)
+	}
+	if len(converted.Spans) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(&converted)
+	if err != nil {
+		return err
+	}
+	if !x.first {
+		b = append([]byte(",\n"), b...)
+	}
+	x.first = false
+	_, err = x.f.Write(b)
+	return err
+}
+
+func (x *JaegerExporter) Sync() error {
+	return x.f.Sync()
+}
+
+func (x *JaegerExporter) Close() error {
+	_, err := x.f.WriteString("\n]}\n")
+	if e := x.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
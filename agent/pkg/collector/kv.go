@@ -0,0 +1,127 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+The kv decoder is a reference decoder for a simple tracepoint format.  Each
+tracepoint is a uint32 length followed by that many bytes of fields, and each
+field is a key (uint16 length, then the key) and a value (uint32 length, then
+the value).  All integers are little endian.
+
+Some keys have a meaning to the decoder, and the rest become attributes:
+
+	event   span, log, or annotation (default annotation)
+	name    the event's name
+	time    unix nanoseconds, in decimal
+	dur     a span's duration in nanoseconds, in decimal
+	span    the span's ID, or the span a log or annotation belongs to, in hex
+	parent  a span's parent span ID, in hex
+*/
+type KVDecoder struct{}
+
+func init() {
+	RegisterDecoder("kv", func() Decoder { return KVDecoder{} })
+}
+
+/* Encodes a tracepoint in the kv format, e.g. for clients written in Go and for tests */
+func EncodeKV(fields map[string]string) []byte {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tracepoint := make([]byte, 4)
+	for _, key := range keys {
+		value := fields[key]
+		field := make([]byte, 2+len(key)+4+len(value))
+		binary.LittleEndian.PutUint16(field, uint16(len(key)))
+		copy(field[2:], key)
+		binary.LittleEndian.PutUint32(field[2+len(key):], uint32(len(value)))
+		copy(field[6+len(key):], value)
+		tracepoint = append(tracepoint, field...)
+	}
+	binary.LittleEndian.PutUint32(tracepoint, uint32(len(tracepoint)-4))
+	return tracepoint
+}
+
+func (KVDecoder) Decode(agent string, payload []byte) (events []Event, err error) {
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return events, fmt.Errorf("%d trailing bytes after the last tracepoint", len(payload))
+		}
+		size := binary.LittleEndian.Uint32(payload)
+		if uint64(size) > uint64(len(payload)-4) {
+			return events, fmt.Errorf("Tracepoint of %d bytes is truncated to %d bytes", size, len(payload)-4)
+		}
+		fields, err := decodeKVFields(payload[4 : 4+size])
+		if err != nil {
+			return events, err
+		}
+		event, err := kvEvent(fields)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+		payload = payload[4+size:]
+	}
+	return
+}
+
+func decodeKVFields(tracepoint []byte) (map[string]string, error) {
+	fields := make(map[string]string)
+	for len(tracepoint) > 0 {
+		if len(tracepoint) < 2 {
+			return nil, fmt.Errorf("Tracepoint field is truncated")
+		}
+		key_size := int(binary.LittleEndian.Uint16(tracepoint))
+		if len(tracepoint) < 2+key_size+4 {
+			return nil, fmt.Errorf("Tracepoint field is truncated")
+		}
+		key := string(tracepoint[2 : 2+key_size])
+		value_size := binary.LittleEndian.Uint32(tracepoint[2+key_size:])
+		tracepoint = tracepoint[6+key_size:]
+		if uint64(value_size) > uint64(len(tracepoint)) {
+			return nil, fmt.Errorf("Value of tracepoint field %q is truncated", key)
+		}
+		fields[key] = string(tracepoint[:value_size])
+		tracepoint = tracepoint[value_size:]
+	}
+	return fields, nil
+}
+
+func kvEvent(fields map[string]string) (event Event, err error) {
+	event.Attributes = make(map[string]string)
+	for key, value := range fields {
+		switch key {
+		case "event":
+			event.Kind, err = ParseEventKind(value)
+		case "name":
+			event.Name = value
+		case "time":
+			var ns int64
+			ns, err = strconv.ParseInt(value, 10, 64)
+			event.Timestamp = time.Unix(0, ns)
+		case "dur":
+			var ns int64
+			ns, err = strconv.ParseInt(value, 10, 64)
+			event.Duration = time.Duration(ns)
+		case "span":
+			event.Span_id, err = strconv.ParseUint(value, 16, 64)
+		case "parent":
+			event.Parent_span_id, err = strconv.ParseUint(value, 16, 64)
+		default:
+			event.Attributes[key] = value
+		}
+		if err != nil {
+			return event, fmt.Errorf("Invalid tracepoint field %s=%q: %v", key, value, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,287 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/telemetry"
+)
+
+/*
+Counters for collector telemetry.  These are updated by each connection's
+goroutine and by the trace writer, so they are guarded by a mutex.  Counters
+are reset each time telemetry is reported, apart from open connections.
+*/
+type CollectorMetrics struct {
+	mu          sync.Mutex
+	agents      map[string]*AgentMetrics
+	connections map[string]int // Open connections of each agent
+
+	assembling  int   // Traces currently being assembled
+	trace_bytes []int // Size of each trace written
+}
+
+type AgentMetrics struct {
+	bytes         int             // Bytes of buffers received from the agent
+	buffers       int             // Buffers received from the agent
+	traces        map[uint64]bool // Distinct traces the agent sent buffers for
+	connections   int             // Open connections from the agent
+	frame_errors  int             // Invalid or oversized frames received from the agent
+	throttled     time.Duration   // Time the agent spent throttled for exceeding its quota
+	written       int             // Buffers from the agent durably written
+	write_latency time.Duration   // Total time from receiving to durably writing written buffers
+	max_latency   time.Duration
+}
+
+func (m *AgentMetrics) add(other *AgentMetrics) {
+	m.bytes += other.bytes
+	m.buffers += other.buffers
+	for trace_id := range other.traces {
+		m.traces[trace_id] = true
+	}
+	m.connections += other.connections
+	m.frame_errors += other.frame_errors
+	m.throttled += other.throttled
+	m.written += other.written
+	m.write_latency += other.write_latency
+	if other.max_latency > m.max_latency {
+		m.max_latency = other.max_latency
+	}
+}
+
+func (m *CollectorMetrics) Init() {
+	m.agents = make(map[string]*AgentMetrics)
+	m.connections = make(map[string]int)
+}
+
+/* Returns the metrics of agent addr; must be called with mu held */
+func (m *CollectorMetrics) agent(addr string) *AgentMetrics {
+	if am, ok := m.agents[addr]; ok {
+		return am
+	}
+	am := &AgentMetrics{traces: make(map[uint64]bool)}
+	m.agents[addr] = am
+	return am
+}
+
+/* Applies update to the metrics of agent addr */
+func (m *CollectorMetrics) update(addr string, update func(*AgentMetrics)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(m.agent(addr))
+}
+
+func (m *CollectorMetrics) connected(addr string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections[addr] += delta
+	if m.connections[addr] <= 0 {
+		delete(m.connections, addr)
+	}
+}
+
+func (m *CollectorMetrics) received(r *ReceivedBuffer, throttled time.Duration) {
+	m.update(r.source_agent, func(am *AgentMetrics) {
+		am.bytes += len(r.buffer)
+		am.buffers++
+		am.traces[r.trace_id] = true
+		am.throttled += throttled
+	})
+}
+
+func (m *CollectorMetrics) frameError(addr string) {
+	m.update(addr, func(am *AgentMetrics) { am.frame_errors++ })
+}
+
+/* Records traces, and their buffers, once they are durably written */
+func (m *CollectorMetrics) written(traces []*TraceToStore, buffers []*ReceivedBuffer, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range traces {
+		size := 0
+		for _, r := range t.buffers {
+			size += len(r.buffer)
+		}
+		m.trace_bytes = append(m.trace_bytes, size)
+	}
+	for _, r := range buffers {
+		am := m.agent(r.source_agent)
+		latency := now.Sub(r.received)
+		am.written++
+		am.write_latency += latency
+		if latency > am.max_latency {
+			am.max_latency = latency
+		}
+	}
+}
+
+/* Records the current state of the trace writer; called by its goroutine */
+func (m *CollectorMetrics) recordState(assembling int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assembling = assembling
+}
+
+/* A snapshot of the metrics for one reporting interval */
+type CollectorStats struct {
+	totals      AgentMetrics
+	agent_addrs []string
+	agents      []AgentMetrics
+
+	assembling     int
+	traces_written int
+	trace_bytes    map[string]int // Percentiles of the size of traces written
+}
+
+func intPercentile(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+/* Calculates stats and resets for the next interval */
+func (m *CollectorMetrics) takeStats() CollectorStats {
+	m.mu.Lock()
+	agents, trace_bytes := m.agents, m.trace_bytes
+	for addr, connections := range m.connections {
+		m.agent(addr).connections = connections
+	}
+	stats := CollectorStats{assembling: m.assembling, totals: AgentMetrics{traces: make(map[uint64]bool)}}
+	m.agents = make(map[string]*AgentMetrics)
+	m.trace_bytes = nil
+	m.mu.Unlock()
+
+	for addr := range agents {
+		stats.agent_addrs = append(stats.agent_addrs, addr)
+	}
+	sort.Strings(stats.agent_addrs)
+	for _, addr := range stats.agent_addrs {
+		stats.agents = append(stats.agents, *agents[addr])
+		stats.totals.add(agents[addr])
+	}
+
+	sort.Ints(trace_bytes)
+	stats.traces_written = len(trace_bytes)
+	stats.trace_bytes = map[string]int{
+		"p50": intPercentile(trace_bytes, 0.5),
+		"p99": intPercentile(trace_bytes, 0.99),
+		"max": intPercentile(trace_bytes, 1),
+	}
+	return stats
+}
+
+type CollectorTelemetryGenerator struct {
+	metrics *CollectorMetrics
+}
+
+func (g *CollectorTelemetryGenerator) Init(metrics *CollectorMetrics) {
+	g.metrics = metrics
+}
+
+/* TelemetryGenerator interface */
+func (g *CollectorTelemetryGenerator) Headers() []string {
+	return []string{
+		// Preamble
+		"t",
+		"interval_ms",
+		"agent", // "total", or the agent address
+
+		// Counts for the interval
+		"bytes",                // Bytes of buffers received
+		"buffers",              // Buffers received
+		"traces",               // Distinct traces that buffers were received for
+		"connections",          // Open agent connections, at the end of the interval
+		"frame_errors",         // Invalid or oversized frames received
+		"throttled_ms",         // Time spent throttled for exceeding -agent_quota_mb
+		"written",              // Buffers durably written
+		"write_latency_avg_ms", // Time from receiving buffers to durably writing them
+		"write_latency_max_ms",
+
+		// Totals only
+		"traces_assembling", // Traces currently being assembled
+		"traces_written",    // Traces written, each as one record
+		"trace_bytes_p50",   // Size of traces written
+		"trace_bytes_p99",
+		"trace_bytes_max",
+	}
+}
+
+func generateAgentRow(now time.Time, interval time.Duration, m *AgentMetrics, agent string) map[string]string {
+	row := make(map[string]string)
+	row["t"] = strconv.FormatInt(now.UTC().UnixNano(), 10)
+	row["interval_ms"] = strconv.FormatInt(interval.Milliseconds(), 10)
+	row["agent"] = agent
+	row["bytes"] = strconv.Itoa(m.bytes)
+	row["buffers"] = strconv.Itoa(m.buffers)
+	row["traces"] = strconv.Itoa(len(m.traces))
+	row["connections"] = strconv.Itoa(m.connections)
+	row["frame_errors"] = strconv.Itoa(m.frame_errors)
+	row["throttled_ms"] = strconv.FormatInt(m.throttled.Milliseconds(), 10)
+	row["written"] = strconv.Itoa(m.written)
+	var avg time.Duration
+	if m.written > 0 {
+		avg = m.write_latency / time.Duration(m.written)
+	}
+	row["write_latency_avg_ms"] = strconv.FormatInt(avg.Milliseconds(), 10)
+	row["write_latency_max_ms"] = strconv.FormatInt(m.max_latency.Milliseconds(), 10)
+	return row
+}
+
+func (g *CollectorTelemetryGenerator) NextData(now time.Time, interval time.Duration) (rows []map[string]string) {
+	stats := g.metrics.takeStats()
+
+	totals := generateAgentRow(now, interval, &stats.totals, "total")
+	totals["traces_assembling"] = strconv.Itoa(stats.assembling)
+	totals["traces_written"] = strconv.Itoa(stats.traces_written)
+	totals["trace_bytes_p50"] = strconv.Itoa(stats.trace_bytes["p50"])
+	totals["trace_bytes_p99"] = strconv.Itoa(stats.trace_bytes["p99"])
+	totals["trace_bytes_max"] = strconv.Itoa(stats.trace_bytes["max"])
+	rows = append(rows, totals)
+
+	for i, addr := range stats.agent_addrs {
+		rows = append(rows, generateAgentRow(now, interval, &stats.agents[i], addr))
+	}
+	return rows
+}
+
+/*
+Creates the telemetry reporter according to the -output and -verbose flags,
+also reporting to any other receivers given.  Must be called before Run.
+*/
+func (c *Collector) ConfigureTelemetry(telemetry_filename string, verbose bool, others ...telemetry.Receiver) error {
+	var receivers []telemetry.Receiver
+	if telemetry_filename != "" {
+		fmt.Println("Outputting telemetry to", telemetry_filename)
+		r, err := telemetry.NewCsvReceiver(telemetry_filename)
+		if err != nil {
+			return err
+		}
+		receivers = append(receivers, r)
+	}
+	if verbose {
+		fmt.Println("Outputting telemetry to stdout")
+		receivers = append(receivers, telemetry.NewStdoutReceiver(" "))
+	}
+	receivers = append(receivers, others...)
+	if len(receivers) == 0 {
+		return nil
+	}
+
+	var receiver telemetry.Receiver
+	if len(receivers) == 1 {
+		receiver = receivers[0]
+	} else {
+		receiver = telemetry.NewMultiReceiver(receivers)
+	}
+
+	var generator CollectorTelemetryGenerator
+	generator.Init(&c.metrics)
+
+	c.reporter = new(telemetry.Reporter)
+	c.reporter.Init(1*time.Second, &generator, receiver)
+	return nil
+}
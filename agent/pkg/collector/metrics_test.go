@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorTelemetry(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var c Collector
+	c.Init("0", "")
+	c.ConfigureAssembly(20*time.Millisecond, 0, 0)
+	assert.NoError(c.ConfigureStore(dir, StoreConfig{}))
+	go c.traceWriter()
+
+	var generator CollectorTelemetryGenerator
+	generator.Init(&c.metrics)
+
+	conn, _ := connectAcked(&c, 1, "a:1")
+	writeSequencedFrame(conn, 1, makeBuffer(5, 1, "one"))
+	writeSequencedFrame(conn, 2, makeBuffer(5, 2, "two"))
+	writeSequencedFrame(conn, 3, makeBuffer(6, 3, "three"))
+	writeSequencedFrame(conn, 4, makeBuffer(0, 4, "invalid"))
+	assert.Equal(uint64(4), awaitAck(conn, 4))
+
+	rows := generator.NextData(time.Now(), time.Second)
+	assert.Equal(2, len(rows), "Totals, then one row per agent")
+	totals, agent := rows[0], rows[1]
+	assert.Equal("total", totals["agent"])
+	assert.Equal("a:1", agent["agent"])
+	assert.Equal("3", agent["buffers"])
+	assert.Equal("107", agent["bytes"])
+	assert.Equal("2", agent["traces"])
+	assert.Equal("1", agent["connections"])
+	assert.Equal("1", agent["frame_errors"])
+	assert.Equal("3", agent["written"])
+	assert.Equal("2", totals["traces_written"])
+	assert.Equal("70", totals["trace_bytes_max"])
+	for _, header := range generator.Headers() {
+		_, ok := totals[header]
+		assert.True(ok, header)
+	}
+
+	// Counters are reset each interval, but connections stay open
+	rows = generator.NextData(time.Now(), time.Second)
+	assert.Equal("0", rows[1]["buffers"])
+	assert.Equal("1", rows[1]["connections"])
+}
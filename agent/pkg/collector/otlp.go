@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+The otlp-json exporter writes the OpenTelemetry protocol's JSON encoding,
+one TracesData object per line, as read by the OpenTelemetry collector's
+file receiver.  Each agent is a resource, with the agent's address as its
+service name.  Hindsight trace IDs are 64 bits, so they are zero-extended to
+OpenTelemetry's 128 bits.
+*/
+type OTLPExporter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func init() {
+	RegisterExporter("otlp-json", func(filename string) (Exporter, error) {
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &OTLPExporter{f, json.NewEncoder(f)}, nil
+	})
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesData struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributes(attributes map[string]string) (converted []otlpAttribute) {
+	for _, key := range sortedKeys(attributes) {
+		converted = append(converted, otlpAttribute{key, otlpValue{attributes[key]}})
+	}
+	return
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (x *OTLPExporter) Export(trace *DecodedTrace) error {
+	var data otlpTracesData
+	resources := make(map[string]*otlpResourceSpans)
+	for _, span := range trace.spans() {
+		resource, ok := resources[span.agent]
+		if !ok {
+			resource = new(otlpResourceSpans)
+			resource.Resource.Attributes = otlpAttributes(map[string]string{"service.name": span.agent})
+			resource.ScopeSpans = make([]otlpScopeSpans, 1)
+			resource.ScopeSpans[0].Scope.Name = "hindsight"
+			resources[span.agent] = resource
+			data.ResourceSpans = append(data.ResourceSpans, resource)
+		}
+
+		converted := otlpSpan{
+			TraceId:           fmt.Sprintf("%032x", trace.Trace_id),
+			SpanId:            fmt.Sprintf("%016x", span.span_id),
+			Name:              span.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: otlpTime(span.start),
+			EndTimeUnixNano:   otlpTime(span.end),
+			Attributes:        otlpAttributes(span.attributes),
+		}
+		if span.parent_span_id != 0 {
+			converted.ParentSpanId = fmt.Sprintf("%016x", span.parent_span_id)
+		}
+		for _, e := range span.events {
+			converted.Events = append(converted.Events, otlpEvent{otlpTime(e.Timestamp), e.exportName(), otlpAttributes(e.Attributes)})
+		}
+		resource.ScopeSpans[0].Spans = append(resource.ScopeSpans[0].Spans, converted)
+	}
+	if len(data.ResourceSpans) == 0 {
+		return nil
+	}
+	return x.enc.Encode(&data)
+}
+
+func (x *OTLPExporter) Sync() error {
+	return x.f.Sync()
+}
+
+func (x *OTLPExporter) Close() error {
+	return x.f.Close()
+}
@@ -0,0 +1,286 @@
+package collector
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The QueryAPI serves finalized traces over HTTP, as JSON:
+
+	GET /traces                  recently finalized traces, newest first
+	GET /traces/{trace_id}       a trace and its buffers
+	GET /traces/stream           newly finalized traces, one JSON object per line
+
+The most recent traces are held in memory.  Older traces are read from the
+trace store, if the collector has one.  Trace IDs are decimal strings in
+responses, since they exceed the integers that JavaScript can represent.
+*/
+type QueryAPI struct {
+	mu          sync.Mutex
+	store       *Store     // Optional
+	recent      *list.List // Recently finalized traces, newest first
+	by_id       map[uint64]*list.Element
+	max_traces  int
+	max_bytes   int
+	bytes       int
+	subscribers map[chan *TraceRecord]bool
+	closed      bool   // Once closed, new subscribers get an already-closed channel
+	dropped     uint64 // Traces not sent to slow subscribers
+}
+
+const DefaultRecentTraces = 10000
+const DefaultRecentBytes = 256 * 1024 * 1024
+
+/* Traces are dropped for a stream subscriber that falls this far behind */
+const subscriberBacklog = 1000
+
+func (q *QueryAPI) Init(store *Store, max_traces int, max_bytes int) {
+	q.store = store
+	q.recent = list.New()
+	q.by_id = make(map[uint64]*list.Element)
+	q.max_traces = max_traces
+	q.max_bytes = max_bytes
+	q.subscribers = make(map[chan *TraceRecord]bool)
+}
+
+type QueryTraceSummary struct {
+	TraceID       uint64    `json:"trace_id,string"`
+	FirstReceived time.Time `json:"first_received"`
+	LastReceived  time.Time `json:"last_received"`
+	Agents        []string  `json:"agents"`
+	Buffers       int       `json:"buffers"`
+	Bytes         int       `json:"bytes"`
+}
+
+type QueryBuffer struct {
+	Agent  string `json:"agent"`
+	Buffer []byte `json:"buffer"` // base64
+}
+
+type QueryTrace struct {
+	QueryTraceSummary
+	BufferData []QueryBuffer `json:"buffer_data"`
+}
+
+func summarize(record *TraceRecord) QueryTraceSummary {
+	summary := QueryTraceSummary{
+		TraceID:       record.Trace_id,
+		FirstReceived: record.First_received,
+		LastReceived:  record.Last_received,
+		Agents:        record.Agents,
+		Buffers:       len(record.Buffers),
+	}
+	for _, buf := range record.Buffers {
+		summary.Bytes += len(buf.Buffer)
+	}
+	return summary
+}
+
+func queryTrace(record *TraceRecord) *QueryTrace {
+	trace := &QueryTrace{QueryTraceSummary: summarize(record)}
+	for _, buf := range record.Buffers {
+		trace.BufferData = append(trace.BufferData, QueryBuffer{record.Agents[buf.Agent], buf.Buffer})
+	}
+	return trace
+}
+
+/* Adds a finalized trace; the QueryAPI is a TraceWriter */
+func (q *QueryAPI) WriteTrace(t *TraceToStore) error {
+	record := t.toRecord()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// A trace written as several records is merged.  Records may be being
+	// read by requests and subscribers, so the merge is into a copy.
+	if e, ok := q.by_id[record.Trace_id]; ok {
+		existing := e.Value.(*TraceRecord)
+		merged := *existing
+		merged.Agents = append([]string(nil), existing.Agents...)
+		merged.Buffers = append([]RecordBuffer(nil), existing.Buffers...)
+		merged.merge(record)
+		q.bytes += summarize(&merged).Bytes - summarize(existing).Bytes
+		e.Value = &merged
+		q.recent.MoveToFront(e)
+	} else {
+		q.by_id[record.Trace_id] = q.recent.PushFront(record)
+		q.bytes += summarize(record).Bytes
+	}
+	for q.recent.Len() > 1 && (q.recent.Len() > q.max_traces || q.bytes > q.max_bytes) {
+		oldest := q.recent.Remove(q.recent.Back()).(*TraceRecord)
+		delete(q.by_id, oldest.Trace_id)
+		q.bytes -= summarize(oldest).Bytes
+	}
+
+	for ch := range q.subscribers {
+		select {
+		case ch <- record:
+		default:
+			q.dropped++
+			if q.dropped == 1 || q.dropped%1000 == 0 {
+				log.Printf("Query API stream subscriber is too slow; %d traces dropped so far\n", q.dropped)
+			}
+		}
+	}
+	return nil
+}
+
+func (q *QueryAPI) Sync() error {
+	return nil
+}
+
+func (q *QueryAPI) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for ch := range q.subscribers {
+		close(ch)
+		delete(q.subscribers, ch)
+	}
+	return nil
+}
+
+/* Returns nil if the trace isn't held in memory or in the store */
+func (q *QueryAPI) GetTrace(trace_id uint64) (*TraceRecord, error) {
+	q.mu.Lock()
+	e, ok := q.by_id[trace_id]
+	q.mu.Unlock()
+	if ok {
+		return e.Value.(*TraceRecord), nil
+	}
+	if q.store != nil {
+		return q.store.ReadTrace(trace_id)
+	}
+	return nil, nil
+}
+
+/* The most recently finalized traces, newest first, finalized after since */
+func (q *QueryAPI) Recent(limit int, since time.Time) (traces []QueryTraceSummary) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	traces = []QueryTraceSummary{}
+	for e := q.recent.Front(); e != nil && len(traces) < limit; e = e.Next() {
+		record := e.Value.(*TraceRecord)
+		if !record.Last_received.After(since) {
+			continue
+		}
+		traces = append(traces, summarize(record))
+	}
+	return
+}
+
+func (q *QueryAPI) subscribe() chan *TraceRecord {
+	ch := make(chan *TraceRecord, subscriberBacklog)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		close(ch)
+		return ch
+	}
+	q.subscribers[ch] = true
+	return ch
+}
+
+func (q *QueryAPI) unsubscribe(ch chan *TraceRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.subscribers, ch)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (q *QueryAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/traces", q.handleRecent)
+	mux.HandleFunc("/traces/stream", q.handleStream)
+	mux.HandleFunc("/traces/", q.handleTrace)
+	return mux
+}
+
+func (q *QueryAPI) handleRecent(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	var since time.Time
+	var err error
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+	}
+	if value := r.URL.Query().Get("since"); err == nil && value != "" {
+		since, err = time.Parse(time.RFC3339, value)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, q.Recent(limit, since))
+}
+
+func (q *QueryAPI) handleTrace(w http.ResponseWriter, r *http.Request) {
+	trace_id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/traces/"), 0, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid trace ID: %v", err))
+		return
+	}
+	record, err := q.GetTrace(trace_id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if record == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Trace %d not found", trace_id))
+		return
+	}
+	writeJSON(w, http.StatusOK, queryTrace(record))
+}
+
+/* Streams traces as they are finalized; with ?buffers=true, includes their buffers */
+func (q *QueryAPI) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	buffers := r.URL.Query().Get("buffers") == "true"
+
+	ch := q.subscribe()
+	defer q.unsubscribe(ch)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case record, ok := <-ch:
+			if !ok {
+				return
+			}
+			var err error
+			if buffers {
+				err = enc.Encode(queryTrace(record))
+			} else {
+				err = enc.Encode(summarize(record))
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getJSON(url string, value interface{}) int {
+	rsp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	defer rsp.Body.Close()
+	json.NewDecoder(rsp.Body).Decode(value)
+	return rsp.StatusCode
+}
+
+func TestQueryAPI(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(dir, StoreConfig{})
+	assert.NoError(err)
+
+	var q QueryAPI
+	q.Init(store, 2, DefaultRecentBytes)
+	server := httptest.NewServer(q.Handler())
+	defer server.Close()
+
+	now := time.Now()
+	for trace_id := uint64(1); trace_id <= 3; trace_id++ {
+		trace := storedTrace(trace_id, now, received("a:1", trace_id, 1, "one"), received("b:1", trace_id, 2, "two"))
+		assert.NoError(store.WriteTrace(trace))
+		assert.NoError(q.WriteTrace(trace))
+	}
+
+	var recent []QueryTraceSummary
+	assert.Equal(http.StatusOK, getJSON(server.URL+"/traces", &recent))
+	assert.Equal(2, len(recent), "Only the most recent traces are held in memory")
+	assert.Equal(uint64(3), recent[0].TraceID, "Newest first")
+	assert.Equal([]string{"a:1", "b:1"}, recent[0].Agents)
+	assert.Equal(2, recent[0].Buffers)
+	assert.Equal(70, recent[0].Bytes)
+
+	var trace QueryTrace
+	assert.Equal(http.StatusOK, getJSON(server.URL+"/traces/1", &trace), "Older traces are read from the store")
+	assert.Equal(uint64(1), trace.TraceID)
+	assert.Equal(2, len(trace.BufferData))
+	assert.Equal("two", string(trace.BufferData[1].Buffer[32:]))
+	assert.Equal(http.StatusNotFound, getJSON(server.URL+"/traces/0x99", &trace))
+	assert.Equal(http.StatusBadRequest, getJSON(server.URL+"/traces/abc", &trace))
+
+	// Subscribe, then finalize another trace
+	rsp, err := http.Get(server.URL + "/traces/stream?buffers=true")
+	assert.NoError(err)
+	defer rsp.Body.Close()
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		subscribed = len(q.subscribers) > 0
+		q.mu.Unlock()
+	}
+	assert.NoError(q.WriteTrace(storedTrace(4, now, received("c:1", 4, 1, "four"))))
+	line, err := bufio.NewReader(rsp.Body).ReadBytes('\n')
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal(line, &trace))
+	assert.Equal(uint64(4), trace.TraceID)
+	assert.Equal("four", string(trace.BufferData[0].Buffer[32:]))
+
+	// Closing ends the stream, and streams that subscribe afterwards end at once
+	assert.NoError(q.Close())
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(err)
+	client := http.Client{Timeout: 5 * time.Second}
+	late, err := client.Get(server.URL + "/traces/stream")
+	assert.NoError(err)
+	_, err = ioutil.ReadAll(late.Body)
+	assert.NoError(err, "Stream opened after Close does not hang")
+	late.Body.Close()
+}
@@ -0,0 +1,581 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The Store is a segmented on-disk store of assembled traces with an index by
+trace ID.  Each segment is a file of trace records in the same format as
+-out (see TraceFileMagic), plus an index file with one fixed-size entry per
+record:
+
+	uint64 trace ID
+	uint64 offset of the record in the segment
+	uint32 length of the record
+	int64  time the first buffer was received (unix nanoseconds)
+	int64  time the last buffer was received (unix nanoseconds)
+
+The index of every segment is held in memory, so a trace can be read with
+a single seek.  Once a segment reaches a maximum size or age a new segment
+is started, and the oldest segments are deleted once the store exceeds its
+retention limits.
+*/
+type StoreConfig struct {
+	SegmentSize int64         // Start a new segment once the current one reaches this size
+	SegmentAge  time.Duration // Start a new segment once the current one is this old; 0 for no limit
+	RetainSize  int64         // Delete the oldest segments once the store exceeds this size; 0 for no limit
+	RetainAge   time.Duration // Delete segments whose traces are all older than this; 0 for no limit
+}
+
+const DefaultSegmentSize = 256 * 1024 * 1024
+
+const indexEntrySize = 36
+
+type indexEntry struct {
+	trace_id       uint64
+	offset         int64
+	length         uint32
+	first_received time.Time
+	last_received  time.Time
+}
+
+type segment struct {
+	id      int
+	size    int64     // Bytes in the segment's data file
+	created time.Time // When the segment was started
+	entries []indexEntry
+}
+
+/* One record of a trace in the store */
+type traceLocation struct {
+	segment *segment
+	entry   indexEntry
+}
+
+/* A trace in the store, without its buffers */
+type TraceSummary struct {
+	Trace_id       uint64
+	First_received time.Time
+	Last_received  time.Time
+	Records        int   // Traces are occasionally written as several records
+	Bytes          int64 // Total size of the trace's records
+}
+
+type Store struct {
+	mu       sync.Mutex
+	dir      string
+	config   StoreConfig
+	segments []*segment // Oldest first; the last is the current segment
+	index    map[uint64][]traceLocation
+	data     *os.File // Data file of the current segment
+	idx      *os.File // Index file of the current segment
+	readonly bool
+}
+
+func (s *Store) dataFilename(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("segment-%08d.traces", id))
+}
+
+func (s *Store) indexFilename(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("segment-%08d.index", id))
+}
+
+/*
+Opens the store in dir for writing, creating it if necessary, and loads the
+index of every existing segment.  If the collector stopped mid-write,
+incomplete records at the end of the last segment are discarded.  Writes go
+to a new segment.
+*/
+func OpenStore(dir string, config StoreConfig) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+	s := &Store{dir: dir, config: config, index: make(map[uint64][]traceLocation)}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	next := 0
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1].id + 1
+	}
+	err = s.startSegment(next)
+	if err == nil {
+		s.applyRetention(time.Now())
+	}
+	return s, err
+}
+
+/*
+Opens the store in dir for reading, e.g. while a collector is writing to it.
+Nothing in the store is modified.
+*/
+func OpenStoreReadOnly(dir string) (*Store, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, index: make(map[uint64][]traceLocation), readonly: true}
+	return s, s.load()
+}
+
+/* Loads the index of every segment in the store */
+func (s *Store) load() error {
+	filenames, err := filepath.Glob(filepath.Join(s.dir, "segment-*.traces"))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for _, filename := range filenames {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(filename), "segment-%08d.traces", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		seg, err := s.loadSegment(id)
+		if err != nil {
+			return err
+		}
+		s.addSegment(seg)
+	}
+	return nil
+}
+
+/* Loads a segment's index, rebuilding it from the data file if it is incomplete */
+func (s *Store) loadSegment(id int) (*segment, error) {
+	info, err := os.Stat(s.dataFilename(id))
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, size: info.Size(), created: info.ModTime()}
+
+	idx, err := os.ReadFile(s.indexFilename(id))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	covered := int64(len(TraceFileMagic))
+	for len(idx) >= indexEntrySize {
+		entry := decodeIndexEntry(idx)
+		seg.entries = append(seg.entries, entry)
+		covered = entry.offset + int64(entry.length)
+		idx = idx[indexEntrySize:]
+	}
+	if covered == seg.size && len(idx) == 0 {
+		return seg, nil
+	}
+
+	if !s.readonly {
+		// A read-only store may be reading a segment that is still being written
+		log.Printf("Rebuilding index of %s\n", s.dataFilename(id))
+	}
+	return s.rebuildIndex(id)
+}
+
+/*
+Scans a segment's data file and rewrites its index, truncating any
+incomplete final record.  A read-only store only rebuilds the index in
+memory.
+*/
+func (s *Store) rebuildIndex(id int) (*segment, error) {
+	mode := os.O_RDWR
+	if s.readonly {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(s.dataFilename(id), mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, created: info.ModTime()}
+
+	r := bufio.NewReader(f)
+	ok, err := ReadTraceFileHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s is not a segment of trace records", s.dataFilename(id))
+	}
+	offset := int64(len(TraceFileMagic))
+	for {
+		record, err := ReadTraceRecord(r)
+		if err != nil {
+			if err != io.EOF && !s.readonly {
+				log.Printf("Discarding incomplete record at offset %d of %s: %v\n", offset, s.dataFilename(id), err)
+			}
+			break
+		}
+		length := uint32(recordSize(record))
+		seg.entries = append(seg.entries, indexEntry{record.Trace_id, offset, length, record.First_received, record.Last_received})
+		offset += int64(length)
+	}
+	seg.size = offset
+	if s.readonly {
+		return seg, nil
+	}
+	err = f.Truncate(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx []byte
+	for _, entry := range seg.entries {
+		idx = append(idx, encodeIndexEntry(entry)...)
+	}
+	return seg, os.WriteFile(s.indexFilename(id), idx, 0644)
+}
+
+/* The size of a record, including its length prefix */
+func recordSize(record *TraceRecord) int {
+	size := 4 + 24 + 4 + 4
+	for _, agent := range record.Agents {
+		size += 4 + len(agent)
+	}
+	for _, buf := range record.Buffers {
+		size += 8 + len(buf.Buffer)
+	}
+	return size
+}
+
+func encodeIndexEntry(entry indexEntry) []byte {
+	b := make([]byte, indexEntrySize)
+	binary.LittleEndian.PutUint64(b[0:], entry.trace_id)
+	binary.LittleEndian.PutUint64(b[8:], uint64(entry.offset))
+	binary.LittleEndian.PutUint32(b[16:], entry.length)
+	binary.LittleEndian.PutUint64(b[20:], uint64(entry.first_received.UnixNano()))
+	binary.LittleEndian.PutUint64(b[28:], uint64(entry.last_received.UnixNano()))
+	return b
+}
+
+func decodeIndexEntry(b []byte) indexEntry {
+	var entry indexEntry
+	entry.trace_id = binary.LittleEndian.Uint64(b[0:])
+	entry.offset = int64(binary.LittleEndian.Uint64(b[8:]))
+	entry.length = binary.LittleEndian.Uint32(b[16:])
+	entry.first_received = time.Unix(0, int64(binary.LittleEndian.Uint64(b[20:])))
+	entry.last_received = time.Unix(0, int64(binary.LittleEndian.Uint64(b[28:])))
+	return entry
+}
+
+func (s *Store) addSegment(seg *segment) {
+	s.segments = append(s.segments, seg)
+	for _, entry := range seg.entries {
+		s.index[entry.trace_id] = append(s.index[entry.trace_id], traceLocation{seg, entry})
+	}
+}
+
+/*
+Starts a new segment, then closes the current one, if any.  If the new
+segment's files can't be opened, the current segment remains open.  Must be
+called with mu held.
+*/
+func (s *Store) startSegment(id int) error {
+	data, err := os.OpenFile(s.dataFilename(id), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = WriteTraceFileHeader(data)
+	if err != nil {
+		data.Close()
+		os.Remove(s.dataFilename(id))
+		return err
+	}
+	idx, err := os.OpenFile(s.indexFilename(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		data.Close()
+		os.Remove(s.dataFilename(id))
+		return err
+	}
+
+	if s.data != nil {
+		s.data.Close()
+		s.idx.Close()
+	}
+	s.data, s.idx = data, idx
+	s.addSegment(&segment{id: id, size: int64(len(TraceFileMagic)), created: time.Now()})
+	return nil
+}
+
+/* Appends a finalized trace to the current segment */
+func (s *Store) WriteTrace(t *TraceToStore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readonly {
+		return fmt.Errorf("Trace store %s was opened read-only", s.dir)
+	}
+
+	current := s.segments[len(s.segments)-1]
+	now := time.Now()
+	if current.size >= s.config.SegmentSize || (s.config.SegmentAge > 0 && now.Sub(current.created) >= s.config.SegmentAge) {
+		err := s.startSegment(current.id + 1)
+		if err != nil {
+			return err
+		}
+		current = s.segments[len(s.segments)-1]
+		s.applyRetention(now)
+	}
+
+	record := t.Record()
+	entry := indexEntry{t.trace_id, current.size, uint32(len(record)), t.first_received, t.last_received}
+	err := doFileWrite(s.data, record)
+	if err == nil {
+		err = doFileWrite(s.idx, encodeIndexEntry(entry))
+	}
+	if err != nil {
+		s.rollback(current)
+		return err
+	}
+	current.size += int64(len(record))
+	current.entries = append(current.entries, entry)
+	s.index[entry.trace_id] = append(s.index[entry.trace_id], traceLocation{current, entry})
+	return nil
+}
+
+/*
+Truncates the current segment's files back to the end of its last complete
+record after a failed write, so that the next record is written at the
+offset its index entry records.  If that fails, a new segment is started
+instead; the partial record is discarded when the segment is next loaded.
+Must be called with mu held.
+*/
+func (s *Store) rollback(current *segment) {
+	err := truncateFile(s.data, current.size)
+	if err == nil {
+		err = truncateFile(s.idx, int64(len(current.entries))*indexEntrySize)
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("Unable to truncate segment %d after a failed write, starting a new segment: %v\n", current.id, err)
+	err = s.startSegment(current.id + 1)
+	if err != nil {
+		log.Printf("Unable to start segment %d: %v\n", current.id+1, err)
+	}
+}
+
+/* Truncates a file and moves its offset to the new end */
+func truncateFile(f *os.File, size int64) error {
+	err := f.Truncate(size)
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	return err
+}
+
+/* Deletes the oldest segments beyond the retention limits; must be called with mu held */
+func (s *Store) applyRetention(now time.Time) {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		too_big := s.config.RetainSize > 0 && total > s.config.RetainSize
+		too_old := s.config.RetainAge > 0 && len(oldest.entries) > 0 && now.Sub(oldest.entries[len(oldest.entries)-1].last_received) > s.config.RetainAge
+		if !too_big && !too_old {
+			return
+		}
+		s.deleteSegment(oldest)
+		total -= oldest.size
+	}
+}
+
+func (s *Store) deleteSegment(seg *segment) {
+	for _, entry := range seg.entries {
+		locations := s.index[entry.trace_id]
+		remaining := locations[:0]
+		for _, loc := range locations {
+			if loc.segment != seg {
+				remaining = append(remaining, loc)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(s.index, entry.trace_id)
+		} else {
+			s.index[entry.trace_id] = remaining
+		}
+	}
+	s.segments = s.segments[1:]
+	os.Remove(s.dataFilename(seg.id))
+	os.Remove(s.indexFilename(seg.id))
+	log.Printf("Deleted trace store segment %d (%d traces) due to retention limits\n", seg.id, len(seg.entries))
+}
+
+/* Flushes the current segment to stable storage */
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readonly {
+		return nil
+	}
+	err := s.data.Sync()
+	if err == nil {
+		err = s.idx.Sync()
+	}
+	return err
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readonly {
+		return nil
+	}
+	err := s.data.Sync()
+	if err == nil {
+		err = s.idx.Sync()
+	}
+	s.data.Close()
+	s.idx.Close()
+	return err
+}
+
+func (s *Store) readRecord(loc traceLocation) (*TraceRecord, error) {
+	f, err := os.Open(s.dataFilename(loc.segment.id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, loc.entry.length)
+	_, err = f.ReadAt(data, loc.entry.offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != loc.entry.length-4 {
+		return nil, fmt.Errorf("Index of segment %d doesn't match record at offset %d", loc.segment.id, loc.entry.offset)
+	}
+	return parseTraceRecord(data[4:])
+}
+
+/*
+Reads all of the buffers of a trace.  If the trace was written as several
+records, they are merged.  Returns nil if the trace isn't in the store.
+*/
+func (s *Store) ReadTrace(trace_id uint64) (*TraceRecord, error) {
+	s.mu.Lock()
+	locations := append([]traceLocation(nil), s.index[trace_id]...)
+	s.mu.Unlock()
+
+	var merged *TraceRecord
+	for _, loc := range locations {
+		record, err := s.readRecord(loc)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = record
+		} else {
+			merged.merge(record)
+		}
+	}
+	return merged, nil
+}
+
+/* Adds another record of the same trace */
+func (t *TraceRecord) merge(other *TraceRecord) {
+	agents := make(map[string]int)
+	for i, agent := range t.Agents {
+		agents[agent] = i
+	}
+	for _, buf := range other.Buffers {
+		agent := other.Agents[buf.Agent]
+		i, ok := agents[agent]
+		if !ok {
+			i = len(t.Agents)
+			agents[agent] = i
+			t.Agents = append(t.Agents, agent)
+		}
+		t.Buffers = append(t.Buffers, RecordBuffer{Agent: i, Buffer: buf.Buffer})
+	}
+	if other.First_received.Before(t.First_received) {
+		t.First_received = other.First_received
+	}
+	if other.Last_received.After(t.Last_received) {
+		t.Last_received = other.Last_received
+	}
+}
+
+/* Lists the traces that received buffers between from and to, ordered by when they were first received */
+func (s *Store) List(from time.Time, to time.Time) (traces []TraceSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for trace_id, locations := range s.index {
+		summary := TraceSummary{Trace_id: trace_id}
+		for _, loc := range locations {
+			if summary.Records == 0 || loc.entry.first_received.Before(summary.First_received) {
+				summary.First_received = loc.entry.first_received
+			}
+			if loc.entry.last_received.After(summary.Last_received) {
+				summary.Last_received = loc.entry.last_received
+			}
+			summary.Records++
+			summary.Bytes += int64(loc.entry.length)
+		}
+		if summary.Last_received.Before(from) || summary.First_received.After(to) {
+			continue
+		}
+		traces = append(traces, summary)
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].First_received.Before(traces[j].First_received) })
+	return
+}
+
+/* The result of verifying one segment */
+type SegmentStatus struct {
+	Id      int
+	Records int
+	Bytes   int64
+	Errors  []error
+}
+
+/*
+Checks that every record of every segment can be read, and matches the
+segment's index.
+*/
+func (s *Store) Verify() (statuses []SegmentStatus) {
+	s.mu.Lock()
+	segments := append([]*segment(nil), s.segments...)
+	s.mu.Unlock()
+
+	for _, seg := range segments {
+		status := SegmentStatus{Id: seg.id}
+		s.mu.Lock()
+		entries := append([]indexEntry(nil), seg.entries...)
+		s.mu.Unlock()
+		for _, entry := range entries {
+			record, err := s.readRecord(traceLocation{seg, entry})
+			if err == nil && record.Trace_id != entry.trace_id {
+				err = fmt.Errorf("Record at offset %d is trace %d, but the index says %d", entry.offset, record.Trace_id, entry.trace_id)
+			}
+			if err != nil {
+				status.Errors = append(status.Errors, err)
+				continue
+			}
+			status.Records++
+			status.Bytes += int64(entry.length)
+		}
+		statuses = append(statuses, status)
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storedTrace(trace_id uint64, at time.Time, buffers ...*ReceivedBuffer) *TraceToStore {
+	t := initTraceToStore(trace_id)
+	t.first_received = at
+	t.last_received = at
+	for _, buf := range buffers {
+		t.AddBuffer(buf)
+	}
+	return t
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	start := time.Now().Add(-time.Hour)
+	store, err := OpenStore(dir, StoreConfig{SegmentSize: 200})
+	assert.NoError(err)
+	for trace_id := uint64(1); trace_id <= 10; trace_id++ {
+		at := start.Add(time.Duration(trace_id) * time.Minute)
+		assert.NoError(store.WriteTrace(storedTrace(trace_id, at, received("a:1", trace_id, 1, "payload"))))
+	}
+	// A late buffer is written as a second record of trace 3
+	assert.NoError(store.WriteTrace(storedTrace(3, start.Add(30*time.Minute), received("b:1", 3, 2, "late"))))
+	assert.True(len(store.segments) > 2, "Segments are rotated by size")
+
+	record, err := store.ReadTrace(3)
+	assert.NoError(err)
+	assert.Equal([]string{"a:1", "b:1"}, record.Agents, "Records of a trace are merged")
+	assert.Equal(2, len(record.Buffers))
+	assert.Equal("late", string(record.Buffers[1].Buffer[32:]))
+	assert.Equal(start.Add(30*time.Minute).UnixNano(), record.Last_received.UnixNano())
+	record, err = store.ReadTrace(99)
+	assert.NoError(err)
+	assert.Nil(record)
+
+	listed := store.List(start.Add(4*time.Minute), start.Add(6*time.Minute))
+	assert.Equal(4, len(listed), "Traces 4, 5, and 6, and trace 3 whose records span the window")
+	assert.Equal(uint64(3), listed[0].Trace_id)
+	assert.Equal(2, listed[0].Records)
+	assert.Equal(1, len(store.List(start.Add(25*time.Minute), start.Add(35*time.Minute))))
+	assert.NoError(store.Close())
+
+	// A crash mid-write leaves an incomplete record and no index entry for it
+	last := store.segments[len(store.segments)-1]
+	f, err := os.OpenFile(store.dataFilename(last.id), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(err)
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	reader, err := OpenStoreReadOnly(dir)
+	assert.NoError(err)
+	for _, status := range reader.Verify() {
+		assert.Equal(0, len(status.Errors))
+	}
+	info, _ := os.Stat(store.dataFilename(last.id))
+	assert.Equal(last.size+7, info.Size(), "Read-only stores don't modify segments")
+
+	reopened, err := OpenStore(dir, StoreConfig{SegmentSize: 200, RetainSize: 600})
+	assert.NoError(err)
+	info, _ = os.Stat(store.dataFilename(last.id))
+	assert.Equal(last.size, info.Size(), "Incomplete record is discarded")
+	assert.True(len(reopened.segments) < len(store.segments), "Oldest segments are deleted beyond the retention size")
+	record, err = reopened.ReadTrace(10)
+	assert.NoError(err)
+	assert.Equal(uint64(10), record.Trace_id)
+	record, err = reopened.ReadTrace(1)
+	assert.NoError(err)
+	assert.Nil(record, "Trace 1 was in a deleted segment")
+	assert.NoError(reopened.Close())
+}
+
+func TestStoreFailedWrite(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace-store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	store, err := OpenStore(dir, StoreConfig{})
+	assert.NoError(err)
+	assert.NoError(store.WriteTrace(storedTrace(1, now, received("a:1", 1, 1, "one"))))
+
+	// A partial record is truncated, so the next record is where the index says
+	current := store.segments[0]
+	store.data.Write([]byte{200, 0, 0, 0, 1, 2, 3})
+	store.idx.Write([]byte{1, 2, 3})
+	store.rollback(current)
+	assert.NoError(store.WriteTrace(storedTrace(2, now, received("a:1", 2, 2, "two"))))
+	record, err := store.ReadTrace(2)
+	assert.NoError(err)
+	assert.Equal("two", string(record.Buffers[0].Buffer[32:]))
+	info, _ := os.Stat(store.dataFilename(current.id))
+	assert.Equal(current.size, info.Size())
+
+	// If the segment can't be truncated, writes continue in a new segment
+	store.idx.Close()
+	store.idx, err = os.Open(store.indexFilename(current.id))
+	assert.NoError(err)
+	assert.Error(store.WriteTrace(storedTrace(3, now, received("a:1", 3, 3, "three"))))
+	assert.Equal(2, len(store.segments))
+	assert.NoError(store.WriteTrace(storedTrace(4, now, received("a:1", 4, 4, "four"))))
+
+	// If a new segment can't be started, the current segment stays open
+	next := store.segments[1].id + 1
+	assert.NoError(os.Mkdir(store.dataFilename(next), 0755))
+	assert.Error(store.startSegment(next))
+	assert.Equal(2, len(store.segments))
+	assert.NoError(os.Remove(store.dataFilename(next)))
+	assert.NoError(store.WriteTrace(storedTrace(5, now, received("a:1", 5, 5, "five"))))
+	assert.NoError(store.Close())
+
+	reopened, err := OpenStore(dir, StoreConfig{})
+	assert.NoError(err)
+	for trace_id, payload := range map[uint64]string{1: "one", 2: "two", 4: "four", 5: "five"} {
+		record, err := reopened.ReadTrace(trace_id)
+		assert.NoError(err)
+		assert.Equal(payload, string(record.Buffers[0].Buffer[32:]))
+	}
+	record, err = reopened.ReadTrace(3)
+	assert.NoError(err)
+	assert.Nil(record, "The failed write of trace 3 was discarded")
+	assert.NoError(reopened.Close())
+}
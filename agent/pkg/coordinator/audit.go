@@ -0,0 +1,226 @@
+package coordinator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The audit log records the lifecycle of every trigger as JSON lines, so that
+when a trace turns up incomplete we can see which agents learned of the
+trigger, when, and why.  Each line is one event:
+
+  - created: the coordinator first heard of the trigger, from src
+  - known: the trigger became known at agent, via the trigger or a breadcrumb
+  - sent: the trigger was sent to agent
+  - send_failed: the trigger could not be sent to agent; see error
+  - expired: the trigger expired, or the coordinator shut down
+  - evicted: the trigger was evicted because of max_triggers
+
+A trigger is known at an agent via "trigger" if the agent reported the
+trigger itself, or via "breadcrumb" if the trigger's trace trace_id is known
+at the agent (from a breadcrumb reported by src, if set).
+
+The log can be restricted to some queues, and is rotated once it reaches a
+maximum size.
+*/
+type AuditEvent struct {
+	Time            time.Time `json:"t"`
+	Event           string    `json:"event"`
+	Queue           int       `json:"queue"`
+	BaseTraceId     uint64    `json:"base_trace_id"`
+	Agent           string    `json:"agent,omitempty"`
+	Src             string    `json:"src,omitempty"`
+	Via             string    `json:"via,omitempty"`
+	TraceId         uint64    `json:"trace_id,omitempty"`
+	TraceIds        []uint64  `json:"trace_ids,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	TotalAgents     int       `json:"total_agents,omitempty"`
+	DisseminationMs int64     `json:"dissemination_ms,omitempty"`
+}
+
+var (
+	errAgentDead    = fmt.Errorf("agent is dead")
+	errAgentBacklog = fmt.Errorf("agent's backlog of triggers is full")
+)
+
+type AuditLog struct {
+	filename string
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64        // Bytes written to the current file
+	max_size int64        // Rotate once the file reaches this size; 0 to never rotate
+	keep     int          // Number of rotated files to keep
+	queues   map[int]bool // If non-empty, only these queues are logged
+	events   chan AuditEvent
+	dropped  uint64 // Events dropped because the log fell behind; accessed atomically
+	wg       *sync.WaitGroup
+}
+
+/*
+Opens an audit log, appending to filename if it exists.  If queues is
+non-empty, only triggers of those queues are logged.  Once the file reaches
+max_size bytes it is rotated, keeping up to keep old files named
+filename.1 (most recent) to filename.keep.
+*/
+func NewAuditLog(filename string, queues []int, max_size int64, keep int) (a *AuditLog, err error) {
+	a = new(AuditLog)
+	a.filename = filename
+	a.max_size = max_size
+	a.keep = keep
+	a.queues = make(map[int]bool)
+	for _, queue_id := range queues {
+		a.queues[queue_id] = true
+	}
+	a.events = make(chan AuditEvent, 10000)
+	a.wg = new(sync.WaitGroup)
+	err = a.open()
+	return
+}
+
+func (a *AuditLog) open() (err error) {
+	a.file, err = os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	info, err := a.file.Stat()
+	if err != nil {
+		return
+	}
+	a.size = info.Size()
+	a.writer = bufio.NewWriter(a.file)
+	return
+}
+
+/* Closes the current file, shifts older files along, and starts a new file */
+func (a *AuditLog) rotate() error {
+	a.writer.Flush()
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+	if a.keep > 0 {
+		for i := a.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.filename, i), fmt.Sprintf("%s.%d", a.filename, i+1))
+		}
+		err = os.Rename(a.filename, a.filename+".1")
+	} else {
+		err = os.Remove(a.filename)
+	}
+	if err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) write(e AuditEvent) {
+	line, err := json.Marshal(&e)
+	if err != nil {
+		log.Println("Audit log error:", err)
+		return
+	}
+	line = append(line, '\n')
+	if a.max_size > 0 && a.size > 0 && a.size+int64(len(line)) > a.max_size {
+		if err := a.rotate(); err != nil {
+			log.Println("Audit log error rotating", a.filename, err)
+		}
+	}
+	n, _ := a.writer.Write(line)
+	a.size += int64(n)
+}
+
+/* Writes events to file until cancelled, then drains any remaining events */
+func (a *AuditLog) Run() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		flush := time.NewTicker(1 * time.Second)
+		defer flush.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				for {
+					select {
+					case e := <-a.events:
+						a.write(e)
+					default:
+						a.writer.Flush()
+						if err := a.file.Close(); err != nil {
+							log.Println("Audit log error closing file", err)
+						}
+						return
+					}
+				}
+			case e := <-a.events:
+				a.write(e)
+			case <-flush.C:
+				a.writer.Flush()
+				if dropped := atomic.SwapUint64(&a.dropped, 0); dropped > 0 {
+					log.Printf("Warning: audit log is bottlenecked; dropped %d events\n", dropped)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+func (a *AuditLog) AwaitCompletion() {
+	a.wg.Wait()
+}
+
+/* Safe to call on a nil AuditLog, in which case nothing is recorded */
+func (a *AuditLog) record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if len(a.queues) > 0 && !a.queues[e.Queue] {
+		return
+	}
+	select {
+	case a.events <- e:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+func (a *AuditLog) created(now time.Time, id TriggerID, src string, trace_ids []uint64) {
+	a.record(AuditEvent{Time: now, Event: "created", Queue: id.queue_id, BaseTraceId: id.base_trace_id, Src: src, TraceIds: trace_ids})
+}
+
+func (a *AuditLog) known(now time.Time, id TriggerID, agent string, via string, src string, trace_id uint64) {
+	a.record(AuditEvent{Time: now, Event: "known", Queue: id.queue_id, BaseTraceId: id.base_trace_id, Agent: agent, Via: via, Src: src, TraceId: trace_id})
+}
+
+func (a *AuditLog) sent(triggers []Trigger, agent string, err error) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	for _, t := range triggers {
+		e := AuditEvent{Time: now, Event: "sent", Queue: t.id.queue_id, BaseTraceId: t.id.base_trace_id, Agent: agent}
+		if err != nil {
+			e.Event = "send_failed"
+			e.Error = err.Error()
+		}
+		a.record(e)
+	}
+}
+
+func (a *AuditLog) finished(now time.Time, event string, trigger *triggerstate) {
+	a.record(AuditEvent{
+		Time:            now,
+		Event:           event,
+		Queue:           trigger.id.queue_id,
+		BaseTraceId:     trigger.id.base_trace_id,
+		TotalAgents:     len(trigger.known_at),
+		DisseminationMs: trigger.last_modified.Sub(trigger.created).Milliseconds(),
+	})
+}
@@ -0,0 +1,90 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAudit(t *testing.T, filename string) (events []AuditEvent) {
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	return
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	var c Coordinator
+	c.Init()
+	audit, err := NewAuditLog(filename, []int{3}, 0, 0)
+	assert.NoError(err)
+	c.audit = audit
+	cancel := audit.Run()
+
+	c.AddBreadcrumb("a", 7, []string{"b"})
+	c.AddTrigger("a", Trigger{TriggerID{3, 7}, []uint64{7}})
+	c.AddTrigger("a", Trigger{TriggerID{4, 7}, []uint64{7}}) // Not audited
+	c.AddBreadcrumb("b", 7, []string{"c"})
+	audit.sent([]Trigger{{TriggerID{3, 7}, nil}}, "c", nil)
+	audit.sent([]Trigger{{TriggerID{3, 7}, nil}}, "d", errAgentDead)
+	c.expireAll()
+
+	cancel()
+	audit.AwaitCompletion()
+
+	events := readAudit(t, filename)
+	var names []string
+	for _, e := range events {
+		assert.Equal(3, e.Queue)
+		names = append(names, e.Event)
+	}
+	assert.Equal([]string{"created", "known", "known", "known", "sent", "send_failed", "expired"}, names)
+
+	assert.Equal("a", events[1].Agent)
+	assert.Equal("trigger", events[1].Via)
+	assert.Equal("b", events[2].Agent, "b was already named by a breadcrumb")
+	assert.Equal("breadcrumb", events[2].Via)
+	assert.Equal("c", events[3].Agent)
+	assert.Equal("b", events[3].Src, "c was named by a breadcrumb from b")
+	assert.Equal(uint64(7), events[3].TraceId)
+	assert.Equal("agent is dead", events[5].Error)
+	assert.Equal(3, events[6].TotalAgents)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	assert := assert.New(t)
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	audit, err := NewAuditLog(filename, nil, 200, 2)
+	assert.NoError(err)
+	cancel := audit.Run()
+	for i := 0; i < 20; i++ {
+		audit.sent([]Trigger{{TriggerID{1, uint64(i)}, nil}}, "a", nil)
+	}
+	cancel()
+	audit.AwaitCompletion()
+
+	total := 0
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		info, err := os.Stat(name)
+		assert.NoError(err)
+		assert.True(info.Size() <= 200)
+		total += len(readAudit(t, name))
+	}
+	_, err = os.Stat(filename + ".3")
+	assert.True(os.IsNotExist(err), "Only 2 old files are kept")
+	assert.True(total < 20, "The oldest events were rotated away")
+}
@@ -22,11 +22,25 @@ type FinishedTrigger struct {
 }
 
 type Coordinator struct {
-	now         time.Time
-	traces      map[uint64]*tracestate      // All known traces
-	triggers    map[TriggerID]*triggerstate // All known triggers
-	trigger_lru *list.List                  // For expiring triggers
-	trace_lru   *list.List                  // For expiring traces
+	now          time.Time
+	traces       map[uint64]*tracestate      // All known traces
+	triggers     map[TriggerID]*triggerstate // All known triggers
+	trigger_lru  *list.List                  // All triggers, for evicting when over capacity
+	trigger_lrus map[int]*list.List          // Triggers of each queue, for expiring triggers
+	trace_lru    *list.List                  // For expiring traces
+
+	trace_timeout   time.Duration         // Time since last modified before a trace expires
+	trigger_timeout time.Duration         // Time since last modified before a trigger expires
+	queue_timeouts  map[int]time.Duration // Per-queue overrides of trigger_timeout
+	max_traces      int                   // If nonzero, least recently modified traces are evicted beyond this
+	max_triggers    int                   // If nonzero, least recently modified triggers are evicted beyond this
+
+	evicted_traces   int // Traces evicted due to max_traces
+	evicted_triggers int // Triggers evicted due to max_triggers
+
+	audit *AuditLog // Optional log of every trigger's lifecycle
+
+	owns func(trace_id uint64) bool // With partitions, whether this partition owns a trace; nil if it owns every trace
 }
 
 func (c *Coordinator) Init() {
@@ -34,13 +48,50 @@ func (c *Coordinator) Init() {
 	c.traces = make(map[uint64]*tracestate)
 	c.triggers = make(map[TriggerID]*triggerstate)
 	c.trigger_lru = list.New()
+	c.trigger_lrus = make(map[int]*list.List)
 	c.trace_lru = list.New()
+	c.trace_timeout = 60 * time.Second
+	c.trigger_timeout = 60 * time.Second
+	c.queue_timeouts = make(map[int]time.Duration)
+}
+
+/* Whether a trace's state is kept here, rather than by another partition */
+func (c *Coordinator) ownsTrace(trace_id uint64) bool {
+	return c.owns == nil || c.owns(trace_id)
+}
+
+/*
+Whether this is a trigger's home partition, which owns its base trace.  Only
+the home partition records the trigger's lifecycle; other partitions hold the
+trigger just to disseminate it along their traces' breadcrumbs.
+*/
+func (c *Coordinator) isHome(id TriggerID) bool {
+	return c.ownsTrace(id.base_trace_id)
+}
+
+/* The timeout for triggers of the given queue */
+func (c *Coordinator) triggerTimeout(queue_id int) time.Duration {
+	if timeout, ok := c.queue_timeouts[queue_id]; ok {
+		return timeout
+	}
+	return c.trigger_timeout
+}
+
+/* The longest that any trigger is kept */
+func (c *Coordinator) maxTriggerTimeout() time.Duration {
+	max := c.trigger_timeout
+	for _, timeout := range c.queue_timeouts {
+		if timeout > max {
+			max = timeout
+		}
+	}
+	return max
 }
 
 /* Trace representation internal to the Coordinator */
 type tracestate struct {
 	id              uint64
-	known_at        map[string]struct{}         // Agents where this trace is known
+	known_at        map[string]time.Time        // Agents where this trace is known, and when we learned it
 	triggers        map[TriggerID]*triggerstate // Triggers of this trace
 	created         time.Time
 	last_modified   time.Time
@@ -51,12 +102,14 @@ type tracestate struct {
 /* Trigger representation internal to the coordinator */
 type triggerstate struct {
 	id              TriggerID
-	known_at        map[string]struct{}    // Agents where this trigger is known
+	known_at        map[string]time.Time   // Agents where this trigger is known, and when we learned it
 	traces          map[uint64]*tracestate // Traces of this trigger
+	lateral         map[uint64]struct{}    // Traces of this trigger owned by other partitions
 	created         time.Time
 	last_modified   time.Time
 	last_breadcrumb time.Time
-	lru_entry       *list.Element
+	lru_entry       *list.Element // Entry in trigger_lru
+	queue_lru_entry *list.Element // Entry in the trigger's queue's LRU
 }
 
 func (ts *triggerstate) Trigger() Trigger {
@@ -65,6 +118,9 @@ func (ts *triggerstate) Trigger() Trigger {
 	for trace_id, _ := range ts.traces {
 		t.trace_ids = append(t.trace_ids, trace_id)
 	}
+	for trace_id := range ts.lateral {
+		t.trace_ids = append(t.trace_ids, trace_id)
+	}
 	return t
 }
 
@@ -74,11 +130,18 @@ func (c *Coordinator) getTrigger(id TriggerID) *triggerstate {
 	}
 	var trigger triggerstate
 	trigger.id = id
-	trigger.known_at = make(map[string]struct{})
+	trigger.known_at = make(map[string]time.Time)
 	trigger.traces = make(map[uint64]*tracestate)
+	trigger.lateral = make(map[uint64]struct{})
 	trigger.created = c.now
 	trigger.last_modified = c.now
 	trigger.lru_entry = c.trigger_lru.PushFront(&trigger)
+	queue_lru, ok := c.trigger_lrus[id.queue_id]
+	if !ok {
+		queue_lru = list.New()
+		c.trigger_lrus[id.queue_id] = queue_lru
+	}
+	trigger.queue_lru_entry = queue_lru.PushFront(&trigger)
 	c.triggers[id] = &trigger
 	return &trigger
 }
@@ -89,7 +152,7 @@ func (c *Coordinator) getTrace(id uint64) *tracestate {
 	}
 	var trace tracestate
 	trace.id = id
-	trace.known_at = make(map[string]struct{})
+	trace.known_at = make(map[string]time.Time)
 	trace.triggers = make(map[TriggerID]*triggerstate)
 	trace.last_modified = c.now
 	trace.created = c.now
@@ -98,41 +161,132 @@ func (c *Coordinator) getTrace(id uint64) *tracestate {
 	return &trace
 }
 
-func (c *Coordinator) checkTriggerExpiration(cutoff time.Time) (finished []FinishedTrigger) {
-	for c.trigger_lru.Len() > 0 {
-		trigger := c.trigger_lru.Back().Value.(*triggerstate)
-		if trigger.last_modified.After(cutoff) {
-			break
+/* Records that addr is known at now, unless it was already known */
+func learn(known_at map[string]time.Time, addr string, now time.Time) {
+	if _, ok := known_at[addr]; !ok {
+		known_at[addr] = now
+	}
+}
+
+/* Records that a trigger is known at addr, unless it was already known */
+func (c *Coordinator) learnTrigger(trigger *triggerstate, addr string, via string, src string, trace_id uint64) {
+	if _, ok := trigger.known_at[addr]; !ok {
+		trigger.known_at[addr] = c.now
+		if !c.isHome(trigger.id) {
+			return
 		}
+		c.audit.known(c.now, trigger.id, addr, via, src, trace_id)
+	}
+}
+
+/* Marks a trigger as modified, for expiration and eviction */
+func (c *Coordinator) touchTrigger(trigger *triggerstate) {
+	c.trigger_lru.MoveToFront(trigger.lru_entry)
+	c.trigger_lrus[trigger.id.queue_id].MoveToFront(trigger.queue_lru_entry)
+	trigger.last_modified = c.now
+}
+
+/*
+Removes a trigger; event is recorded in the audit log, e.g. expired or evicted.
+Appends the finished trigger to finished if this is the trigger's home partition.
+*/
+func (c *Coordinator) removeTrigger(finished []FinishedTrigger, trigger *triggerstate, event string) []FinishedTrigger {
+	for _, tracestate := range trigger.traces {
+		delete(tracestate.triggers, trigger.id)
+	}
+	delete(c.triggers, trigger.id)
+	c.trigger_lru.Remove(trigger.lru_entry)
+	c.trigger_lrus[trigger.id.queue_id].Remove(trigger.queue_lru_entry)
+
+	if !c.isHome(trigger.id) {
+		return finished
+	}
+	c.audit.finished(c.now, event, trigger)
 
-		for _, tracestate := range trigger.traces {
-			delete(tracestate.triggers, trigger.id)
+	var ft FinishedTrigger
+	ft.queue_id = trigger.id.queue_id
+	ft.total_agents = len(trigger.known_at)
+	ft.dissemination_time = trigger.last_modified.Sub(trigger.created)
+	return append(finished, ft)
+}
+
+func (c *Coordinator) removeTrace(trace *tracestate) {
+	for _, triggerstate := range trace.triggers {
+		delete(triggerstate.traces, trace.id)
+	}
+	delete(c.traces, trace.id)
+	c.trace_lru.Remove(trace.lru_entry)
+}
+
+/*
+Expires triggers that haven't been modified within their queue's timeout,
+then evicts the least recently modified triggers if there are more than
+max_triggers.  Returns the expired and evicted triggers.
+*/
+func (c *Coordinator) checkTriggerExpiration(now time.Time) (finished []FinishedTrigger) {
+	for queue_id, queue_lru := range c.trigger_lrus {
+		cutoff := now.Add(-c.triggerTimeout(queue_id))
+		for queue_lru.Len() > 0 {
+			trigger := queue_lru.Back().Value.(*triggerstate)
+			if trigger.last_modified.After(cutoff) {
+				break
+			}
+			finished = c.removeTrigger(finished, trigger, "expired")
 		}
-		delete(c.triggers, trigger.id)
-		c.trigger_lru.Remove(trigger.lru_entry)
+	}
 
-		var ft FinishedTrigger
-		ft.queue_id = trigger.id.queue_id
-		ft.total_agents = len(trigger.known_at)
-		ft.dissemination_time = trigger.last_modified.Sub(trigger.created)
-		finished = append(finished, ft)
+	for c.max_triggers > 0 && len(c.triggers) > c.max_triggers {
+		trigger := c.trigger_lru.Back().Value.(*triggerstate)
+		finished = c.removeTrigger(finished, trigger, "evicted")
+		c.evicted_triggers++
 	}
 	return
 }
 
-func (c *Coordinator) checkTraceExpiration(cutoff time.Time) {
-	for c.trace_lru.Len() > 0 {
+/*
+Expires traces that haven't been modified within the trace timeout, then
+evicts the least recently modified traces if there are more than max_traces.
+
+A trace that belongs to a live trigger with a longer timeout than the trace
+timeout is kept, so that breadcrumbs arriving late can still disseminate the
+trigger.
+*/
+func (c *Coordinator) checkTraceExpiration(now time.Time) {
+	cutoff := now.Add(-c.trace_timeout)
+	for remaining := c.trace_lru.Len(); remaining > 0; remaining-- {
 		trace := c.trace_lru.Back().Value.(*tracestate)
 		if trace.last_modified.After(cutoff) {
 			break
 		}
+		if c.heldByTrigger(trace, now) {
+			c.trace_lru.MoveToFront(trace.lru_entry)
+			continue
+		}
+		c.removeTrace(trace)
+	}
 
-		for _, triggerstate := range trace.triggers {
-			delete(triggerstate.traces, trace.id)
+	for c.max_traces > 0 && len(c.traces) > c.max_traces {
+		c.removeTrace(c.trace_lru.Back().Value.(*tracestate))
+		c.evicted_traces++
+	}
+}
+
+func (c *Coordinator) heldByTrigger(trace *tracestate, now time.Time) bool {
+	for _, trigger := range trace.triggers {
+		timeout := c.triggerTimeout(trigger.id.queue_id)
+		if timeout > c.trace_timeout && trigger.last_modified.After(now.Add(-timeout)) {
+			return true
 		}
-		delete(c.traces, trace.id)
-		c.trace_lru.Remove(trace.lru_entry)
 	}
+	return false
+}
+
+/* Expires all triggers, e.g. on shutdown */
+func (c *Coordinator) expireAll() (finished []FinishedTrigger) {
+	for c.trigger_lru.Len() > 0 {
+		finished = c.removeTrigger(finished, c.trigger_lru.Back().Value.(*triggerstate), "expired")
+	}
+	return
 }
 
 /*
@@ -146,10 +300,12 @@ This method adds the trigger to the coordinator if it does not
 already exist, and will expire after a timeout.
 */
 func (c *Coordinator) AddTrigger(src string, t Trigger) []string {
+	if _, exists := c.triggers[t.id]; !exists && c.isHome(t.id) {
+		c.audit.created(c.now, t.id, src, t.trace_ids)
+	}
 	trigger := c.getTrigger(t.id)
-	trigger.known_at[src] = struct{}{}
-	c.trigger_lru.MoveToFront(trigger.lru_entry)
-	trigger.last_modified = c.now
+	c.learnTrigger(trigger, src, "trigger", src, 0)
+	c.touchTrigger(trigger)
 
 	/*
 		We now need to disseminate the trigger as follows:
@@ -161,6 +317,14 @@ func (c *Coordinator) AddTrigger(src string, t Trigger) []string {
 		if _, ok := trigger.traces[trace_id]; ok {
 			continue // trace already attached to this trigger, do nothing
 		}
+		if !c.ownsTrace(trace_id) {
+			// Another partition disseminates along this trace's breadcrumbs
+			if _, ok := trigger.lateral[trace_id]; !ok {
+				trigger.lateral[trace_id] = struct{}{}
+				needs_rebroadcasting = true
+			}
+			continue
+		}
 
 		needs_rebroadcasting = true
 
@@ -171,9 +335,9 @@ func (c *Coordinator) AddTrigger(src string, t Trigger) []string {
 
 		// Update where the trigger and trace are known
 		for addr, _ := range trace.known_at {
-			trigger.known_at[addr] = struct{}{}
+			c.learnTrigger(trigger, addr, "breadcrumb", "", trace_id)
 		}
-		trace.known_at[src] = struct{}{}
+		learn(trace.known_at, src, c.now)
 
 		// Touch LRU
 		c.trace_lru.MoveToFront(trace.lru_entry)
@@ -226,7 +390,7 @@ func (c *Coordinator) AddBreadcrumb(src string, trace_id uint64, addrs []string)
 			if _, ok := trigger.known_at[addr]; !ok {
 				// trigger isn't known at this address yet; must disseminate
 				triggers_to_disseminate = append(triggers_to_disseminate, trigger.Trigger())
-				trigger.known_at[addr] = struct{}{}
+				c.learnTrigger(trigger, addr, "breadcrumb", src, trace_id)
 				trigger.last_breadcrumb = c.now
 			}
 		}
@@ -235,14 +399,13 @@ func (c *Coordinator) AddBreadcrumb(src string, trace_id uint64, addrs []string)
 			to_disseminate[addr] = triggers_to_disseminate
 		}
 
-		trace.known_at[addr] = struct{}{}
+		learn(trace.known_at, addr, c.now)
 		trace.last_breadcrumb = c.now
 	}
 
 	// Update trigger and trace LRUs
 	for _, trigger := range trace.triggers {
-		c.trigger_lru.MoveToFront(trigger.lru_entry)
-		trigger.last_modified = c.now
+		c.touchTrigger(trigger)
 	}
 	c.trace_lru.MoveToFront(trace.lru_entry)
 	trace.last_modified = c.now
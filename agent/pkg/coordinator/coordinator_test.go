@@ -197,3 +197,62 @@ func TestCoordinatorExpiration(t *testing.T) {
 	assert.Equal(0, len(c.traces), "Traces were expired")
 
 }
+
+func TestCoordinatorQueueTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Coordinator
+	c.Init()
+	c.queue_timeouts[2] = 10 * time.Minute
+
+	fast := TriggerID{1, uint64(75)}
+	slow := TriggerID{2, uint64(77)}
+	c.AddTrigger("a", Trigger{fast, []uint64{uint64(75)}})
+	c.AddTrigger("a", Trigger{slow, []uint64{uint64(77)}})
+
+	now := c.now.Add(5 * time.Minute)
+	c.checkTraceExpiration(now)
+	finished := c.checkTriggerExpiration(now)
+
+	assert.Equal(1, len(finished), "Only the fast trigger expired")
+	assert.Equal(1, finished[0].queue_id)
+	assert.Equal(1, len(c.triggers), "Slow trigger was kept")
+	assert.Equal(1, len(c.traces), "Trace of the slow trigger was kept")
+
+	// A late breadcrumb still disseminates the slow trigger
+	c.now = now
+	to_forward := c.AddBreadcrumb("a", uint64(77), []string{"b"})
+	assert.Equal(1, len(to_forward["b"]), "Slow trigger disseminated to late breadcrumb")
+
+	c.checkTraceExpiration(now.Add(11 * time.Minute))
+	c.checkTriggerExpiration(now.Add(11 * time.Minute))
+	assert.Equal(0, len(c.triggers), "Slow trigger eventually expired")
+	assert.Equal(0, len(c.traces), "Trace eventually expired")
+}
+
+func TestCoordinatorEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Coordinator
+	c.Init()
+	c.max_traces = 2
+	c.max_triggers = 1
+
+	c.AddBreadcrumb("a", uint64(1), []string{"b"})
+	c.AddBreadcrumb("a", uint64(2), []string{"b"})
+	c.AddBreadcrumb("a", uint64(3), []string{"b"})
+	c.AddBreadcrumb("a", uint64(1), []string{"c"}) // Trace 1 is now most recent
+	c.AddTrigger("a", Trigger{TriggerID{1, uint64(1)}, []uint64{uint64(1)}})
+	c.AddTrigger("a", Trigger{TriggerID{1, uint64(3)}, []uint64{uint64(3)}})
+
+	c.checkTraceExpiration(c.now)
+	finished := c.checkTriggerExpiration(c.now)
+
+	assert.Equal(2, len(c.traces))
+	_, ok := c.traces[uint64(2)]
+	assert.False(ok, "Least recently modified trace was evicted")
+	assert.Equal(1, c.evicted_traces)
+	assert.Equal(1, len(c.triggers))
+	assert.Equal(1, len(finished), "Evicted trigger is reported as finished")
+	assert.Equal(1, c.evicted_triggers)
+}
@@ -0,0 +1,491 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"google.golang.org/grpc"
+)
+
+/*
+Coordinators can be arranged as a tree, e.g. one regional coordinator per
+datacenter beneath a global parent.  Agents connect to their regional
+coordinator as usual.  A regional coordinator connects to its parent as if
+it were an agent, and reports the agents of its region in its heartbeats.
+
+Each coordinator resolves breadcrumbs to the next hop towards the named
+agent: its own agents are used as-is, agents in the region of a child
+coordinator resolve to that child, and any other agent resolves to the
+parent.  AddTrigger and AddBreadcrumb then work unchanged at every level, so
+a regional coordinator only sends a trigger to its parent if the trigger's
+traces have breadcrumbs that leave the region.
+
+Breadcrumbs that leave a region are also sent to the parent, so that the
+parent learns which regions share a trace.  When the parent learns that a
+trace is shared with a region that doesn't know it yet, it sends the
+breadcrumbs down to that region's coordinator, so that triggers fired in
+that region make their way back up.
+
+Messages sent up are numbered and kept until the parent acknowledges them,
+like an agent's outbound queue.  An overloaded parent rejects a message and
+discards everything after it, so the regional coordinator backs off and
+replays from the rejected message, as agents do.
+*/
+const (
+	CoordinatorVersion            = "0.2"
+	RegionalCoordinatorCapability = "regional_coordinator"
+)
+
+type Parent struct {
+	addr       string // The parent coordinator
+	self       string // Our address, as known to the parent
+	tls        util.TLSConfig
+	members    *Membership                     // Agents in our region, reported in heartbeats
+	outgoing   chan *datapb.AgentMessage       // Triggers and breadcrumbs to send up
+	incoming   chan *datapb.CoordinatorMessage // Triggers and breadcrumbs sent down
+	id_to_addr map[int32]string                // Breadcrumb addresses sent down; owned by the main goroutine
+	mu         sync.Mutex                      // Guards the warning state, since partitions share the parent
+	dropped    int
+	last_warn  time.Time
+
+	window parentWindow // Messages sent up that the parent hasn't acknowledged
+}
+
+/* Messages a regional coordinator keeps while awaiting the parent's acknowledgement */
+const maxParentUnacked = 10000
+
+/*
+Numbered messages awaiting acknowledgement.  Messages are appended by the
+send loop and acknowledged by the receive loop.
+*/
+type parentWindow struct {
+	mu      sync.Mutex
+	seq     uint64                 // Sequence number of the last message added
+	unacked []*datapb.AgentMessage // In sequence order
+	sent    int                    // Index into unacked of the next message to send
+	acked   chan bool              // Signalled when messages are acknowledged
+}
+
+/*
+Configures this coordinator as a regional coordinator beneath parent.  self
+is this coordinator's address as known to the parent (with mutual TLS, the
+CommonName of our certificate).  Must be called before Run.
+*/
+func (s *CoordinatorServer) ConfigureParent(self string, parent string) error {
+	if self == "" {
+		return fmt.Errorf("Regional coordinators must specify their own address")
+	}
+	if s.ring != nil {
+		return fmt.Errorf("Sharded coordinators cannot have a parent coordinator")
+	}
+	s.parent = &Parent{
+		addr:       parent,
+		self:       self,
+		tls:        s.tls,
+		members:    &s.members,
+		outgoing:   make(chan *datapb.AgentMessage, 10000),
+		incoming:   make(chan *datapb.CoordinatorMessage, 100),
+		id_to_addr: make(map[int32]string),
+		last_warn:  time.Now(),
+	}
+	s.parent.window.acked = make(chan bool, 1)
+	return nil
+}
+
+/* Numbers a message and adds it to the window */
+func (w *parentWindow) add(msg *datapb.AgentMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq++
+	msg.Seq = w.seq
+	w.unacked = append(w.unacked, msg)
+}
+
+func (w *parentWindow) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.unacked) >= maxParentUnacked
+}
+
+/* The next message to send, or nil if everything has been sent */
+func (w *parentWindow) next() *datapb.AgentMessage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sent >= len(w.unacked) {
+		return nil
+	}
+	msg := w.unacked[w.sent]
+	w.sent++
+	return msg
+}
+
+/* Discards messages up to and including seq */
+func (w *parentWindow) ack(seq uint64) {
+	w.mu.Lock()
+	acked := 0
+	for acked < len(w.unacked) && w.unacked[acked].Seq <= seq {
+		w.unacked[acked] = nil
+		acked++
+	}
+	w.unacked = w.unacked[acked:]
+	w.sent -= acked
+	if w.sent < 0 {
+		w.sent = 0
+	}
+	w.mu.Unlock()
+	select {
+	case w.acked <- true:
+	default:
+	}
+}
+
+/* Resends every unacknowledged message, e.g. after reconnecting or a rejection */
+func (w *parentWindow) rewind() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sent = 0
+}
+
+/*
+Resolves an agent address to the next hop towards the agent: a regional
+coordinator if the agent is in a child region, the parent if the agent is
+not one of ours, or else the agent itself.
+*/
+func (cs *CoordinatorServer) route(addr string) string {
+	if region, ok := cs.members.Region(addr); ok {
+		return region
+	}
+	if cs.parent != nil && addr != cs.parent.addr && !cs.members.IsMember(addr) {
+		return cs.parent.addr
+	}
+	return addr
+}
+
+func (c *Coordinator) knownAt(trace_id uint64, addr string) bool {
+	if trace, ok := c.traces[trace_id]; ok {
+		_, known := trace.known_at[addr]
+		return known
+	}
+	return false
+}
+
+/*
+Resolves the breadcrumbs of a trace received from src to next hops.
+Breadcrumbs that leave our region are added to up, for sending to the
+parent.  Breadcrumbs into a child region that doesn't yet know the trace
+(according to c, the partition that owns the trace) are added to down, for
+sending to that region's coordinator.
+*/
+func (cs *CoordinatorServer) routeBreadcrumbs(c *Coordinator, src string, trace_id uint64, addrs []string, up map[uint64][]string, down map[string]map[uint64][]string) []string {
+	resolved := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		next := cs.route(addr)
+		switch {
+		case cs.parent != nil && next == cs.parent.addr:
+			if src != cs.parent.addr && addr != cs.parent.addr {
+				up[trace_id] = append(up[trace_id], addr)
+			}
+		case next != addr:
+			if next != src && !c.knownAt(trace_id, next) {
+				if _, ok := down[next]; !ok {
+					down[next] = make(map[uint64][]string)
+				}
+				down[next][trace_id] = append(down[next][trace_id], addr)
+			}
+		}
+		resolved = append(resolved, next)
+	}
+	return resolved
+}
+
+/* Sends breadcrumbs that were routed up to the parent or down to regional coordinators */
+func (cs *CoordinatorServer) sendBreadcrumbs(up map[uint64][]string, down map[string]map[uint64][]string) {
+	if len(up) > 0 {
+		cs.parent.Send(&datapb.AgentMessage{Breadcrumbs: breadcrumbsRequest(cs.parent.self, up)})
+	}
+	for region, breadcrumbs := range down {
+		if cs.members.IsDead(region) {
+			continue
+		}
+		cs.GetAgent(region).SendBreadcrumbs(breadcrumbsRequest("", breadcrumbs))
+	}
+}
+
+/* Builds a breadcrumbs request that includes the mapping of every address it uses */
+func breadcrumbsRequest(src string, breadcrumbs map[uint64][]string) *datapb.BreadcrumbsRequest {
+	req := &datapb.BreadcrumbsRequest{Src: src}
+	ids := make(map[string]int32)
+	for trace_id, addrs := range breadcrumbs {
+		b := &datapb.Breadcrumbs{TraceId: trace_id}
+		for _, addr := range addrs {
+			id, ok := ids[addr]
+			if !ok {
+				id = int32(len(ids))
+				ids[addr] = id
+				req.Addresses = append(req.Addresses, &datapb.BreadcrumbAddress{Id: id, Addr: addr})
+			}
+			b.Addrs = append(b.Addrs, id)
+		}
+		req.Breadcrumbs = append(req.Breadcrumbs, b)
+	}
+	return req
+}
+
+/*
+Processes triggers and breadcrumbs that the parent sent down, waiting until
+the partitions have processed them
+*/
+func (cs *CoordinatorServer) processParentMessage(ctx context.Context, msg *datapb.CoordinatorMessage) {
+	if msg.Triggers != nil {
+		msg.Triggers.Src = cs.parent.addr
+		_, err := cs.handleTriggers(ctx, msg.Triggers, true)
+		if err != nil {
+			log.Println("Triggers error:", err)
+		}
+	}
+	ret := make(chan error, len(cs.partitions))
+	submitted := 0
+	if msg.Breadcrumbs != nil {
+		msg.Breadcrumbs.Src = cs.parent.addr
+		breadcrumbs, err := decodeBreadcrumbs(msg.Breadcrumbs, cs.parent.id_to_addr)
+		if err != nil {
+			log.Println("Breadcrumbs error:", err)
+		}
+		for p, part := range cs.partitionBreadcrumbs(breadcrumbs) {
+			select {
+			case p.incoming_breadcrumbs <- &IncomingBreadcrumbs{src: cs.parent.addr, breadcrumbs: part, ret: ret}:
+				submitted++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	awaitPartitions(ctx, ret, submitted)
+}
+
+func (p *Parent) Send(msg *datapb.AgentMessage) {
+	select {
+	case p.outgoing <- msg:
+	default:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.dropped++
+		now := time.Now()
+		if now.After(p.last_warn.Add(1 * time.Second)) {
+			log.Printf("Warning: parent coordinator %s is bottlenecked; dropping %d messages\n", p.addr, p.dropped)
+			p.dropped = 0
+			p.last_warn = now
+		}
+	}
+}
+
+/* Connects to the parent in a loop, sending triggers and breadcrumbs up and receiving them down */
+func (p *Parent) Run(ctx context.Context) {
+	firsttime := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		err := p.connectAndStream(ctx)
+		if err != nil {
+			if firsttime {
+				log.Printf("Unable to connect to parent coordinator %s; will retry every 2 seconds (reason: %s)\n", p.addr, err.Error())
+				firsttime = false
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+				continue
+			}
+		}
+		firsttime = true
+	}
+}
+
+/*
+Registers with the parent and opens a Connect stream, then streams until an
+error occurs.  Unacknowledged messages are resent on the next connection.
+*/
+func (p *Parent) connectAndStream(ctx context.Context) error {
+	creds, err := p.tls.DialOption()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(p.addr, creds, grpc.WithBlock(), grpc.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := datapb.NewCoordinatorClient(conn)
+
+	req := &datapb.RegisterRequest{Src: p.self, Version: CoordinatorVersion, Capabilities: []string{RegionalCoordinatorCapability}}
+	rsp, err := client.Register(ctx, req)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(rsp.HeartbeatIntervalMs) * time.Millisecond
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&datapb.AgentMessage{Src: p.self})
+	if err != nil {
+		return err
+	}
+	log.Println("Connected to parent coordinator", p.addr)
+
+	// Resend anything that wasn't acknowledged on a previous connection
+	p.window.rewind()
+
+	errs := make(chan error, 2)
+	rejections := make(chan *datapb.CoordinatorMessage, 1)
+	go func() { errs <- p.receiveLoop(ctx, stream, rejections) }()
+	go func() { errs <- p.heartbeatLoop(ctx, client, interval) }()
+
+	replay := false
+	for {
+		select {
+		case rejection := <-rejections:
+			err = p.backoff(ctx, rejection, errs)
+			if err != nil || ctx.Err() != nil {
+				return err
+			}
+			replay = true
+		default:
+		}
+
+		msg := p.window.next()
+		if msg == nil {
+			// Stop taking messages while the window is full; Send drops them instead
+			outgoing := p.outgoing
+			if p.window.full() {
+				outgoing = nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case err = <-errs:
+				return err
+			case rejection := <-rejections:
+				err = p.backoff(ctx, rejection, errs)
+				if err != nil || ctx.Err() != nil {
+					return err
+				}
+				replay = true
+			case <-p.window.acked:
+			case msg := <-outgoing:
+				p.window.add(msg)
+			}
+			continue
+		}
+
+		msg.Replay = replay
+		err = stream.Send(msg)
+		if err != nil {
+			return err
+		}
+		replay = false
+	}
+}
+
+/*
+The parent rejected a message because it is overloaded, and discards
+everything we send until we replay.  Waits for the parent's retry hint, then
+rewinds so that the rejected message and everything after it are resent.
+*/
+func (p *Parent) backoff(ctx context.Context, rejection *datapb.CoordinatorMessage, errs chan error) error {
+	retry_after_ms := rejection.TriggerReply.GetRetryAfterMs()
+	if ms := rejection.BreadcrumbsReply.GetRetryAfterMs(); ms > retry_after_ms {
+		retry_after_ms = ms
+	}
+	retry_after := time.Duration(retry_after_ms) * time.Millisecond
+	if retry_after <= 0 {
+		retry_after = 100 * time.Millisecond
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if now.After(p.last_warn.Add(1 * time.Second)) {
+		log.Printf("Parent coordinator %s is overloaded and rejected %d triggers, %d breadcrumbs; retrying in %v\n", p.addr, rejection.TriggerReply.GetRejected(), rejection.BreadcrumbsReply.GetRejected(), retry_after)
+		p.last_warn = now
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	case <-time.After(retry_after):
+	}
+
+	p.window.rewind()
+	return nil
+}
+
+/*
+Passes triggers and breadcrumbs sent down by the parent to the main
+goroutine, and handles the parent's acknowledgements and rejections
+*/
+func (p *Parent) receiveLoop(ctx context.Context, stream datapb.Coordinator_ConnectClient, rejections chan *datapb.CoordinatorMessage) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if msg.Ack != 0 {
+			p.window.ack(msg.Ack)
+		}
+		if msg.Rejected != 0 {
+			select {
+			case rejections <- msg:
+			default:
+				// Already backing off
+			}
+		}
+		if msg.Triggers == nil && msg.Breadcrumbs == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case p.incoming <- msg:
+		}
+	}
+}
+
+/* Heartbeats the parent, reporting the agents in our region */
+func (p *Parent) heartbeatLoop(ctx context.Context, client datapb.CoordinatorClient, interval time.Duration) error {
+	if interval <= 0 {
+		interval = 1 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rsp, err := client.Heartbeat(ctx, &datapb.HeartbeatRequest{Src: p.self, Members: p.members.Reachable()})
+		if err != nil {
+			return err
+		}
+		if !rsp.Registered {
+			return fmt.Errorf("Parent coordinator %s has forgotten us", p.addr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
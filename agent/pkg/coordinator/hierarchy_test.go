@@ -0,0 +1,139 @@
+package coordinator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func newTestServer(ctx context.Context) *CoordinatorServer {
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	cs.ctx = ctx
+	for _, p := range cs.partitions {
+		go p.Run(ctx)
+	}
+	return &cs
+}
+
+func sendBreadcrumbs(cs *CoordinatorServer, src string, breadcrumbs map[uint64][]string) {
+	cs.Breadcrumbs(context.Background(), breadcrumbsRequest(src, breadcrumbs))
+}
+
+func sendTrigger(cs *CoordinatorServer, src string, queue_id int32, trace_id uint64) {
+	req := &datapb.TriggerRequest{Src: src, Triggers: []*datapb.Trigger{{QueueId: queue_id, BaseTraceId: trace_id, TraceIds: []uint64{trace_id}}}}
+	cs.LocalTrigger(context.Background(), req)
+}
+
+func TestRegionalCoordinator(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cs := newTestServer(ctx)
+	assert.NoError(cs.ConfigureParent("region1:5252", "root:5252"))
+	cs.members.Register("a:1", "", nil, time.Now())
+	cs.members.Register("a:2", "", nil, time.Now())
+
+	// Breadcrumbs within the region stay in the region
+	sendBreadcrumbs(cs, "a:1", map[uint64][]string{7: {"a:2"}})
+	sendTrigger(cs, "a:1", 3, 7)
+	assert.Equal(0, len(cs.parent.outgoing))
+	assert.Equal(1, len(cs.GetAgent("a:2").outgoing_triggers))
+
+	// Breadcrumbs naming other regions resolve to the parent, and are sent up
+	sendBreadcrumbs(cs, "a:1", map[uint64][]string{8: {"b:1"}})
+	assert.True(cs.partition(8).c.knownAt(8, "root:5252"))
+	assert.False(cs.partition(8).c.knownAt(8, "b:1"))
+	up := <-cs.parent.outgoing
+	assert.Equal("b:1", up.Breadcrumbs.Addresses[0].Addr)
+
+	// So triggers of the trace are sent up too
+	sendTrigger(cs, "a:1", 3, 8)
+	up = <-cs.parent.outgoing
+	assert.Equal(uint64(8), up.Triggers.Triggers[0].BaseTraceId)
+
+	// Triggers sent down by the parent reach the region's agents, and aren't sent back up
+	cs.processParentMessage(ctx, &datapb.CoordinatorMessage{Breadcrumbs: breadcrumbsRequest("", map[uint64][]string{9: {"a:2"}})})
+	cs.processParentMessage(ctx, &datapb.CoordinatorMessage{Triggers: triggerRequest([]Trigger{{TriggerID{3, 9}, []uint64{9}}})})
+	assert.Equal(2, len(cs.GetAgent("a:2").outgoing_triggers))
+	assert.Equal(0, len(cs.parent.outgoing))
+}
+
+func TestParentCoordinator(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cs := newTestServer(ctx)
+	for _, region := range []string{"region1:5252", "region2:5252"} {
+		cs.members.Register(region, CoordinatorVersion, []string{RegionalCoordinatorCapability}, time.Now())
+	}
+	cs.members.SetRegion("region1:5252", []string{"a:1", "a:2"})
+	cs.members.SetRegion("region2:5252", []string{"b:1"})
+	assert.Equal([]string{"a:1", "a:2", "b:1", "region1:5252", "region2:5252"}, cs.members.Reachable())
+
+	// Region 2 learns that a trace is shared with region 1, which is told about it
+	sendBreadcrumbs(cs, "region2:5252", map[uint64][]string{7: {"a:1"}})
+	assert.True(cs.partition(7).c.knownAt(7, "region1:5252"))
+	down := <-cs.GetAgent("region1:5252").outgoing_crumbs
+	assert.Equal("a:1", down.Addresses[0].Addr)
+	assert.Equal(uint64(7), down.Breadcrumbs[0].TraceId)
+
+	// Only once
+	sendBreadcrumbs(cs, "region2:5252", map[uint64][]string{7: {"a:2"}})
+	assert.Equal(0, len(cs.GetAgent("region1:5252").outgoing_crumbs))
+
+	// A trigger from one region is sent down to the other
+	sendTrigger(cs, "region2:5252", 3, 7)
+	triggers := <-cs.GetAgent("region1:5252").outgoing_triggers
+	assert.Equal(TriggerID{3, 7}, triggers[0].id)
+	assert.Equal(0, len(cs.GetAgent("region2:5252").outgoing_triggers))
+}
+
+func TestOverloadedParent(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The parent is overloaded: nothing is draining its queues
+	var root CoordinatorServer
+	root.Init("0", "")
+	root.ctx = ctx
+	root.partitions[0].incoming_triggers = make(chan *IncomingTriggers)
+	go root.runCoordinator(ctx)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	server := grpc.NewServer()
+	datapb.RegisterCoordinatorServer(server, &root)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	var region CoordinatorServer
+	region.Init("0", "")
+	assert.NoError(region.ConfigureParent("region1:5252", lis.Addr().String()))
+	go region.parent.Run(ctx)
+	region.parent.Send(&datapb.AgentMessage{Triggers: triggerRequest([]Trigger{{TriggerID{3, 7}, []uint64{7}}})})
+
+	assert.Eventually(func() bool {
+		_, rejected := triggerCounts(&root, "region1:5252")
+		return rejected >= 2
+	}, 10*time.Second, 10*time.Millisecond, "Rejected messages are replayed")
+
+	// Once the parent recovers, the region's triggers are delivered
+	go root.partitions[0].Run(ctx)
+	assert.Eventually(func() bool {
+		received, _ := triggerCounts(&root, "region1:5252")
+		return received == 1
+	}, 10*time.Second, 10*time.Millisecond, "Rejected triggers are delivered rather than lost")
+	assert.Eventually(func() bool {
+		region.parent.window.mu.Lock()
+		defer region.parent.window.mu.Unlock()
+		return len(region.parent.window.unacked) == 0
+	}, 10*time.Second, 10*time.Millisecond, "Delivered messages are acknowledged")
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,7 +19,7 @@ type CsvLogger struct {
 	begin            time.Time
 	wg               *sync.WaitGroup
 	Finished         chan []FinishedTrigger
-	dropped_finished int
+	dropped_finished uint64 // Accessed atomically
 }
 
 func NewCsvLogger(filename string) (r *CsvLogger, err error) {
@@ -36,6 +37,15 @@ func NewCsvLogger(filename string) (r *CsvLogger, err error) {
 	return
 }
 
+/* Queues finished triggers to be logged, or drops them if the logger is behind */
+func (r *CsvLogger) Log(finished []FinishedTrigger) {
+	select {
+	case r.Finished <- finished:
+	default:
+		atomic.AddUint64(&r.dropped_finished, uint64(len(finished)))
+	}
+}
+
 func (r *CsvLogger) AwaitCompletion() {
 	r.wg.Wait()
 }
@@ -0,0 +1,222 @@
+package coordinator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Membership tracks the agents that have registered with the coordinator and
+their liveness, based on heartbeats.
+
+An agent that misses heartbeats is first marked suspect, and then dead.
+The coordinator stops sending remote triggers to dead agents and eventually
+garbage collects its per-agent state.  Collected agents are still remembered
+as dead for a while, and then forgotten entirely.  Agents that have never registered
+(e.g. agents only named by breadcrumbs) are not tracked here.
+*/
+type MemberState int
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Dead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
+type Member struct {
+	addr           string
+	version        string
+	capabilities   []string
+	state          MemberState
+	registered     time.Time
+	last_heartbeat time.Time
+	collected      bool // Per-agent state has been garbage collected
+}
+
+type Membership struct {
+	mu      sync.Mutex
+	members map[string]*Member
+	regions map[string]string // Agents in the region of a regional coordinator, to that coordinator
+
+	heartbeat_interval time.Duration // Interval that agents are asked to heartbeat
+	suspect_after      time.Duration // Missed heartbeats before an agent is suspect
+	dead_after         time.Duration // Missed heartbeats before an agent is dead
+	collect_after      time.Duration // Time dead before per-agent state is garbage collected
+	forget_after       time.Duration // Time after being collected before a member is forgotten
+}
+
+func (m *Membership) Init(heartbeat_interval time.Duration) {
+	m.members = make(map[string]*Member)
+	m.regions = make(map[string]string)
+	m.heartbeat_interval = heartbeat_interval
+	m.suspect_after = 3 * heartbeat_interval
+	m.dead_after = 10 * heartbeat_interval
+	m.collect_after = 60 * heartbeat_interval
+	m.forget_after = 60 * heartbeat_interval
+}
+
+func (m *Membership) Register(addr string, version string, capabilities []string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member := &Member{
+		addr:           addr,
+		version:        version,
+		capabilities:   capabilities,
+		state:          Alive,
+		registered:     now,
+		last_heartbeat: now,
+	}
+	m.members[addr] = member
+}
+
+/* Returns false if the agent isn't registered and must register again */
+func (m *Membership) Heartbeat(addr string, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[addr]
+	if !ok || member.collected {
+		return false
+	}
+	member.last_heartbeat = now
+	member.state = Alive
+	return true
+}
+
+/* True if the agent is registered and hasn't been garbage collected */
+func (m *Membership) IsMember(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[addr]
+	return ok && !member.collected
+}
+
+/*
+Records the agents in the region of a regional coordinator, replacing any
+that it previously reported.
+*/
+func (m *Membership) SetRegion(coordinator string, agents []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for addr, region := range m.regions {
+		if region == coordinator {
+			delete(m.regions, addr)
+		}
+	}
+	for _, addr := range agents {
+		if addr != coordinator {
+			m.regions[addr] = coordinator
+		}
+	}
+}
+
+/* The regional coordinator of an agent, if the agent is in a region */
+func (m *Membership) Region(addr string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	coordinator, ok := m.regions[addr]
+	if !ok {
+		return "", false
+	}
+	if member, ok := m.members[coordinator]; !ok || member.collected {
+		return "", false
+	}
+	return coordinator, true
+}
+
+/*
+Every agent reachable through this coordinator: registered agents that
+aren't dead, and the agents in the regions of regional coordinators.
+*/
+func (m *Membership) Reachable() (agents []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for addr, member := range m.members {
+		if member.state != Dead {
+			agents = append(agents, addr)
+		}
+	}
+	for addr, coordinator := range m.regions {
+		if member, ok := m.members[coordinator]; ok && member.state != Dead {
+			agents = append(agents, addr)
+		}
+	}
+	sort.Strings(agents)
+	return
+}
+
+/* True if the agent registered but has since stopped heartbeating */
+func (m *Membership) IsDead(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[addr]
+	return ok && member.state == Dead
+}
+
+/* True if the agent is registered and not dead */
+func (m *Membership) IsLive(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[addr]
+	return ok && member.state != Dead
+}
+
+/*
+Updates member states based on missed heartbeats.  Returns the agents that
+have been dead long enough for their per-agent state to be garbage collected.
+Dead members are remembered so that they continue to be skipped until they
+register again, until forget_after has also passed.
+*/
+func (m *Membership) Check(now time.Time) (collect []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for addr, member := range m.members {
+		silence := now.Sub(member.last_heartbeat)
+		switch {
+		case silence >= m.dead_after+m.collect_after+m.forget_after && member.collected:
+			delete(m.members, addr)
+		case silence >= m.dead_after+m.collect_after:
+			if !member.collected {
+				member.collected = true
+				collect = append(collect, addr)
+			}
+			member.state = Dead
+		case silence >= m.dead_after:
+			member.state = Dead
+		case silence >= m.suspect_after:
+			member.state = Suspect
+		}
+	}
+	return
+}
+
+/* A snapshot of all members, sorted by address */
+func (m *Membership) List() (members []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].addr < members[j].addr })
+	return
+}
@@ -0,0 +1,40 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipLiveness(t *testing.T) {
+	assert := assert.New(t)
+
+	var m Membership
+	m.Init(time.Second)
+	now := time.Now()
+
+	m.Register("a:1", "0.2", []string{"connect-stream"}, now)
+	assert.True(m.IsLive("a:1"), "Registered agent is live")
+	assert.False(m.IsDead("b:1"), "Unregistered agents are never dead")
+	assert.False(m.Heartbeat("b:1", now), "Unregistered agent must register")
+
+	m.Check(now.Add(5 * time.Second))
+	assert.Equal(Suspect, m.List()[0].state, "Missed 3 heartbeats")
+
+	m.Check(now.Add(10 * time.Second))
+	assert.True(m.IsDead("a:1"), "Missed 10 heartbeats")
+
+	assert.True(m.Heartbeat("a:1", now.Add(11*time.Second)), "Dead agents can come back")
+	assert.True(m.IsLive("a:1"))
+
+	collect := m.Check(now.Add(100 * time.Second))
+	assert.Equal([]string{"a:1"}, collect, "Long-dead agent is garbage collected")
+	assert.Empty(m.Check(now.Add(101*time.Second)), "Only collected once")
+	assert.False(m.Heartbeat("a:1", now.Add(102*time.Second)), "Collected agent must register again")
+	assert.True(m.IsDead("a:1"), "Collected agent is still skipped")
+
+	m.Check(now.Add(200 * time.Second))
+	assert.Empty(m.List(), "Collected agent is eventually forgotten")
+	assert.False(m.IsDead("a:1"))
+}
@@ -0,0 +1,249 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/telemetry"
+)
+
+/*
+Counters for coordinator telemetry.  These are updated by the gRPC handlers,
+the main coordinator goroutine, and each agent's send loop, so they are
+guarded by a mutex.  Counters are reset each time telemetry is reported.
+*/
+type CoordinatorMetrics struct {
+	mu     sync.Mutex
+	totals AgentMetrics
+	agents map[string]*AgentMetrics
+
+	traces           []int // Traces currently tracked by each partition
+	triggers         []int // Triggers currently tracked by each partition
+	evicted_traces   int   // Traces evicted due to max_traces
+	evicted_triggers int   // Triggers evicted due to max_triggers
+
+	dissemination []time.Duration // Dissemination time of each finished trigger
+}
+
+type AgentMetrics struct {
+	triggers_received    int // Local triggers received from the agent
+	breadcrumbs_received int // Breadcrumbs received from the agent
+	rejected_triggers    int // Incoming triggers rejected because the coordinator was overloaded
+	rejected_breadcrumbs int // Incoming breadcrumbs rejected because the coordinator was overloaded
+	triggers_sent        int // Remote triggers sent to the agent
+	triggers_dropped     int // Remote triggers for the agent dropped due to backlog or because it is dead
+}
+
+func (m *AgentMetrics) add(other *AgentMetrics) {
+	m.triggers_received += other.triggers_received
+	m.breadcrumbs_received += other.breadcrumbs_received
+	m.rejected_triggers += other.rejected_triggers
+	m.rejected_breadcrumbs += other.rejected_breadcrumbs
+	m.triggers_sent += other.triggers_sent
+	m.triggers_dropped += other.triggers_dropped
+}
+
+func (m *CoordinatorMetrics) Init() {
+	m.agents = make(map[string]*AgentMetrics)
+}
+
+/* Returns the metrics of agent addr; must be called with mu held */
+func (m *CoordinatorMetrics) agent(addr string) *AgentMetrics {
+	if am, ok := m.agents[addr]; ok {
+		return am
+	}
+	am := &AgentMetrics{}
+	m.agents[addr] = am
+	return am
+}
+
+/* Applies update to the metrics of agent addr */
+func (m *CoordinatorMetrics) update(addr string, update func(*AgentMetrics)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(m.agent(addr))
+}
+
+/* Records the current state of a partition; called by the partition's goroutine */
+func (m *CoordinatorMetrics) recordState(partition int, c *Coordinator, finished []FinishedTrigger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.traces) <= partition {
+		m.traces = append(m.traces, 0)
+		m.triggers = append(m.triggers, 0)
+	}
+	m.traces[partition] = len(c.traces)
+	m.triggers[partition] = len(c.triggers)
+	m.evicted_traces, c.evicted_traces = m.evicted_traces+c.evicted_traces, 0
+	m.evicted_triggers, c.evicted_triggers = m.evicted_triggers+c.evicted_triggers, 0
+	for _, ft := range finished {
+		m.dissemination = append(m.dissemination, ft.dissemination_time)
+	}
+}
+
+/* A snapshot of the metrics for one reporting interval */
+type CoordinatorStats struct {
+	totals      AgentMetrics
+	agent_addrs []string
+	agents      []AgentMetrics
+
+	traces           int
+	triggers         int
+	evicted_traces   int
+	evicted_triggers int
+
+	finished_triggers int
+	dissemination_p50 time.Duration
+	dissemination_p90 time.Duration
+	dissemination_p99 time.Duration
+	dissemination_max time.Duration
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+/* Calculates stats and resets for the next interval */
+func (m *CoordinatorMetrics) takeStats() CoordinatorStats {
+	m.mu.Lock()
+	agents, dissemination := m.agents, m.dissemination
+	var stats CoordinatorStats
+	for i := range m.traces {
+		stats.traces += m.traces[i]
+		stats.triggers += m.triggers[i]
+	}
+	stats.evicted_traces, stats.evicted_triggers = m.evicted_traces, m.evicted_triggers
+	m.agents = make(map[string]*AgentMetrics)
+	m.dissemination = nil
+	m.evicted_traces, m.evicted_triggers = 0, 0
+	m.mu.Unlock()
+
+	for addr := range agents {
+		stats.agent_addrs = append(stats.agent_addrs, addr)
+	}
+	sort.Strings(stats.agent_addrs)
+	for _, addr := range stats.agent_addrs {
+		stats.agents = append(stats.agents, *agents[addr])
+		stats.totals.add(agents[addr])
+	}
+
+	sort.Slice(dissemination, func(i, j int) bool { return dissemination[i] < dissemination[j] })
+	stats.finished_triggers = len(dissemination)
+	stats.dissemination_p50 = percentile(dissemination, 0.5)
+	stats.dissemination_p90 = percentile(dissemination, 0.9)
+	stats.dissemination_p99 = percentile(dissemination, 0.99)
+	stats.dissemination_max = percentile(dissemination, 1)
+	return stats
+}
+
+type CoordinatorTelemetryGenerator struct {
+	metrics *CoordinatorMetrics
+}
+
+func (g *CoordinatorTelemetryGenerator) Init(metrics *CoordinatorMetrics) {
+	g.metrics = metrics
+}
+
+/* TelemetryGenerator interface */
+func (g *CoordinatorTelemetryGenerator) Headers() []string {
+	return []string{
+		// Preamble
+		"t",
+		"interval_ms",
+		"agent", // "total", or the agent address
+
+		// Counts for the interval
+		"triggers_received",    // Local triggers received from agents
+		"breadcrumbs_received", // Breadcrumbs received from agents
+		"rejected_triggers",    // Incoming triggers rejected because the coordinator was overloaded
+		"rejected_breadcrumbs", // Incoming breadcrumbs rejected because the coordinator was overloaded
+		"triggers_sent",        // Remote triggers sent to agents
+		"triggers_dropped",     // Remote triggers dropped due to agent backlog or because the agent is dead
+
+		// Totals only
+		"traces",            // Traces currently tracked
+		"triggers",          // Triggers currently tracked
+		"evicted_traces",    // Traces evicted due to -max_traces
+		"evicted_triggers",  // Triggers evicted due to -max_triggers
+		"finished_triggers", // Triggers that expired or were evicted
+		"dissemination_p50_ms",
+		"dissemination_p90_ms",
+		"dissemination_p99_ms",
+		"dissemination_max_ms",
+	}
+}
+
+func generateAgentRow(now time.Time, interval time.Duration, m *AgentMetrics, agent string) map[string]string {
+	row := make(map[string]string)
+	row["t"] = strconv.FormatInt(now.UTC().UnixNano(), 10)
+	row["interval_ms"] = strconv.FormatInt(interval.Milliseconds(), 10)
+	row["agent"] = agent
+	row["triggers_received"] = strconv.Itoa(m.triggers_received)
+	row["breadcrumbs_received"] = strconv.Itoa(m.breadcrumbs_received)
+	row["rejected_triggers"] = strconv.Itoa(m.rejected_triggers)
+	row["rejected_breadcrumbs"] = strconv.Itoa(m.rejected_breadcrumbs)
+	row["triggers_sent"] = strconv.Itoa(m.triggers_sent)
+	row["triggers_dropped"] = strconv.Itoa(m.triggers_dropped)
+	return row
+}
+
+func (g *CoordinatorTelemetryGenerator) NextData(now time.Time, interval time.Duration) (rows []map[string]string) {
+	stats := g.metrics.takeStats()
+
+	totals := generateAgentRow(now, interval, &stats.totals, "total")
+	totals["traces"] = strconv.Itoa(stats.traces)
+	totals["triggers"] = strconv.Itoa(stats.triggers)
+	totals["evicted_traces"] = strconv.Itoa(stats.evicted_traces)
+	totals["evicted_triggers"] = strconv.Itoa(stats.evicted_triggers)
+	totals["finished_triggers"] = strconv.Itoa(stats.finished_triggers)
+	totals["dissemination_p50_ms"] = strconv.FormatInt(stats.dissemination_p50.Milliseconds(), 10)
+	totals["dissemination_p90_ms"] = strconv.FormatInt(stats.dissemination_p90.Milliseconds(), 10)
+	totals["dissemination_p99_ms"] = strconv.FormatInt(stats.dissemination_p99.Milliseconds(), 10)
+	totals["dissemination_max_ms"] = strconv.FormatInt(stats.dissemination_max.Milliseconds(), 10)
+	rows = append(rows, totals)
+
+	for i, addr := range stats.agent_addrs {
+		rows = append(rows, generateAgentRow(now, interval, &stats.agents[i], addr))
+	}
+	return rows
+}
+
+/* Creates the telemetry reporter according to the -output and -verbose flags */
+func (s *CoordinatorServer) ConfigureTelemetry(telemetry_filename string, verbose bool) error {
+	var receivers []telemetry.Receiver
+	if telemetry_filename != "" {
+		fmt.Println("Outputting telemetry to", telemetry_filename)
+		r, err := telemetry.NewCsvReceiver(telemetry_filename)
+		if err != nil {
+			return err
+		}
+		receivers = append(receivers, r)
+	}
+	if verbose {
+		fmt.Println("Outputting telemetry to stdout")
+		receivers = append(receivers, telemetry.NewStdoutReceiver(" "))
+	}
+	if len(receivers) == 0 {
+		return nil
+	}
+
+	var receiver telemetry.Receiver
+	if len(receivers) == 1 {
+		receiver = receivers[0]
+	} else {
+		receiver = telemetry.NewMultiReceiver(receivers)
+	}
+
+	var generator CoordinatorTelemetryGenerator
+	generator.Init(&s.metrics)
+
+	s.reporter = new(telemetry.Reporter)
+	s.reporter.Init(1*time.Second, &generator, receiver)
+	return nil
+}
@@ -0,0 +1,45 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoordinatorTelemetry(t *testing.T) {
+	assert := assert.New(t)
+
+	var metrics CoordinatorMetrics
+	metrics.Init()
+	metrics.update("a:1", func(m *AgentMetrics) { m.triggers_received += 2 })
+	metrics.update("b:1", func(m *AgentMetrics) { m.triggers_sent += 3 })
+
+	var c Coordinator
+	c.Init()
+	c.AddTrigger("a:1", Trigger{TriggerID{1, 5}, []uint64{5}})
+	var finished []FinishedTrigger
+	for i := 1; i <= 100; i++ {
+		finished = append(finished, FinishedTrigger{dissemination_time: time.Duration(i) * time.Millisecond})
+	}
+	metrics.recordState(0, &c, finished)
+
+	var g CoordinatorTelemetryGenerator
+	g.Init(&metrics)
+	rows := g.NextData(time.Now(), time.Second)
+
+	assert.Equal(3, len(rows), "Totals plus one row per agent")
+	assert.Equal("total", rows[0]["agent"])
+	assert.Equal("2", rows[0]["triggers_received"])
+	assert.Equal("3", rows[0]["triggers_sent"])
+	assert.Equal("1", rows[0]["triggers"])
+	assert.Equal("50", rows[0]["dissemination_p50_ms"])
+	assert.Equal("99", rows[0]["dissemination_p99_ms"])
+	assert.Equal("100", rows[0]["dissemination_max_ms"])
+	assert.Equal("a:1", rows[1]["agent"])
+	assert.Equal("3", rows[2]["triggers_sent"])
+
+	rows = g.NextData(time.Now(), time.Second)
+	assert.Equal(1, len(rows), "Counters reset each interval")
+	assert.Equal("0", rows[0]["finished_triggers"])
+}
@@ -0,0 +1,444 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+)
+
+/*
+The coordinator's state is partitioned by trace ID, and each partition is
+owned by its own goroutine, so that triggers and breadcrumbs of different
+traces are processed in parallel.  The gRPC handlers split each request by
+trace and hand the parts to the partitions that own them.
+
+A trigger can name several lateral traces that are owned by different
+partitions.  Each trigger has a home partition, the owner of its base trace,
+which accumulates every trace the trigger has named, as a single coordinator
+would.  The home partition processes the trigger first, and the trigger,
+with all of its traces, is then fanned out to the partitions that own its
+other traces.  Each of those partitions disseminates the whole trigger along
+the breadcrumbs of its own traces, so the trigger reaches every agent that
+knows any of its traces, and agents are sent the trigger again whenever it
+gains traces.  An agent that knows traces in several partitions may be sent
+the same trigger more than once.
+
+With the write-ahead log, each partition logs and snapshots its own state in
+a subdirectory of the WAL directory.
+*/
+type Partition struct {
+	index int
+	cs    *CoordinatorServer
+	c     Coordinator // Traces owned by this partition, and their triggers
+	wal   *WAL        // Optional write-ahead log of this partition's state
+
+	incoming_triggers    chan *IncomingTriggers
+	incoming_breadcrumbs chan *IncomingBreadcrumbs
+	incoming_queries     chan *IncomingQuery
+
+	recovered bool // State was recovered from the WAL and must be re-disseminated
+}
+
+func (p *Partition) Init(index int, cs *CoordinatorServer) {
+	p.index = index
+	p.cs = cs
+	p.c.Init()
+	p.c.owns = func(trace_id uint64) bool { return cs.partition(trace_id) == p }
+	p.incoming_triggers = make(chan *IncomingTriggers, 10000)
+	p.incoming_breadcrumbs = make(chan *IncomingBreadcrumbs, 10000)
+	p.incoming_queries = make(chan *IncomingQuery, 100)
+}
+
+/*
+Partitions coordinator state across n goroutines.  Must be called before Run
+and before the other Configure methods.
+*/
+func (s *CoordinatorServer) ConfigurePartitions(n int) error {
+	if n < 1 {
+		return fmt.Errorf("Coordinator must have at least one partition, got %d", n)
+	}
+	s.partitions = make([]*Partition, n)
+	for i := range s.partitions {
+		s.partitions[i] = new(Partition)
+		s.partitions[i].Init(i, s)
+	}
+	return nil
+}
+
+/* The partition that owns a trace */
+func (s *CoordinatorServer) partition(trace_id uint64) *Partition {
+	if len(s.partitions) == 1 {
+		return s.partitions[0]
+	}
+	// Fibonacci hashing, so that sequential trace IDs are spread evenly
+	return s.partitions[((trace_id*0x9E3779B97F4A7C15)>>32)%uint64(len(s.partitions))]
+}
+
+/* Groups triggers into a request for each of the partitions that f chooses */
+func groupTriggers(req *datapb.TriggerRequest, f func(t *datapb.Trigger) []*Partition) map[*Partition]*datapb.TriggerRequest {
+	parts := make(map[*Partition]*datapb.TriggerRequest)
+	for _, t := range req.Triggers {
+		for _, p := range f(t) {
+			part, ok := parts[p]
+			if !ok {
+				part = &datapb.TriggerRequest{Src: req.Src}
+				parts[p] = part
+			}
+			part.Triggers = append(part.Triggers, t)
+		}
+	}
+	return parts
+}
+
+/* Groups triggers by their home partitions */
+func (s *CoordinatorServer) homeTriggers(req *datapb.TriggerRequest) map[*Partition]*datapb.TriggerRequest {
+	return groupTriggers(req, func(t *datapb.Trigger) []*Partition {
+		return []*Partition{s.partition(t.BaseTraceId)}
+	})
+}
+
+/* Groups triggers by the partitions, other than their home, that own their traces */
+func (s *CoordinatorServer) fanoutTriggers(req *datapb.TriggerRequest) map[*Partition]*datapb.TriggerRequest {
+	return groupTriggers(req, func(t *datapb.Trigger) (owners []*Partition) {
+		home := s.partition(t.BaseTraceId)
+		seen := map[*Partition]bool{home: true}
+		for _, trace_id := range t.TraceIds {
+			if p := s.partition(trace_id); !seen[p] {
+				seen[p] = true
+				owners = append(owners, p)
+			}
+		}
+		return
+	})
+}
+
+/* Splits breadcrumbs by the partitions that own their traces */
+func (s *CoordinatorServer) partitionBreadcrumbs(breadcrumbs map[uint64][]string) map[*Partition]map[uint64][]string {
+	parts := make(map[*Partition]map[uint64][]string)
+	for trace_id, addrs := range breadcrumbs {
+		p := s.partition(trace_id)
+		if _, ok := parts[p]; !ok {
+			parts[p] = make(map[uint64][]string)
+		}
+		parts[p][trace_id] = addrs
+	}
+	return parts
+}
+
+/*
+Hands triggers to a partition.  Unless block is set, returns false rather
+than waiting if the partition's queue is full.
+*/
+func submitTriggers(ctx context.Context, p *Partition, incoming *IncomingTriggers, block bool) bool {
+	if block {
+		select {
+		case p.incoming_triggers <- incoming:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case p.incoming_triggers <- incoming:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Hands triggers to their home partitions, then fans them out to the
+partitions that own their other traces, and waits until all have been
+processed.  Returns false if a partition's queue was full, in which case
+some of the triggers may have been processed; processing triggers again is
+harmless, so the sender should back off and resend them all.
+*/
+func (s *CoordinatorServer) handleTriggers(ctx context.Context, req *datapb.TriggerRequest, block bool) (ok bool, err error) {
+	ret := make(chan error, len(s.partitions))
+	var fanout chan *datapb.TriggerRequest
+	if len(s.partitions) > 1 {
+		fanout = make(chan *datapb.TriggerRequest, len(s.partitions))
+	}
+
+	submitted := 0
+	for p, part := range s.homeTriggers(req) {
+		if !submitTriggers(ctx, p, &IncomingTriggers{req: part, ret: ret, fanout: fanout}, block) {
+			return false, nil
+		}
+		submitted++
+	}
+	if fanout == nil {
+		return true, awaitPartitions(ctx, ret, submitted)
+	}
+
+	complete := &datapb.TriggerRequest{Src: req.Src}
+	for i := 0; i < submitted; i++ {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case part := <-fanout:
+			complete.Triggers = append(complete.Triggers, part.Triggers...)
+		}
+	}
+
+	submitted = 0
+	for p, part := range s.fanoutTriggers(complete) {
+		if !submitTriggers(ctx, p, &IncomingTriggers{req: part, ret: ret}, block) {
+			return false, nil
+		}
+		submitted++
+	}
+	return true, awaitPartitions(ctx, ret, submitted)
+}
+
+/* Hands breadcrumbs to their partitions without blocking; returns false if any partition's queue was full */
+func (s *CoordinatorServer) submitBreadcrumbs(src string, breadcrumbs map[uint64][]string, ret chan error) (submitted int, ok bool) {
+	ok = true
+	for p, part := range s.partitionBreadcrumbs(breadcrumbs) {
+		select {
+		case p.incoming_breadcrumbs <- &IncomingBreadcrumbs{src: src, breadcrumbs: part, ret: ret}:
+			submitted++
+		default:
+			ok = false
+		}
+	}
+	return
+}
+
+/* Waits for submitted parts of a request to be processed by their partitions */
+func awaitPartitions(ctx context.Context, ret chan error, submitted int) (err error) {
+	for i := 0; i < submitted; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ret:
+			if e != nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+/* The WAL directory of a partition */
+func (s *CoordinatorServer) partitionDir(dir string, index int) string {
+	if len(s.partitions) == 1 {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf("partition-%d", index))
+}
+
+/*
+Checks that state in a WAL directory was written with the same number of
+partitions.  Traces are assigned to partitions by hash, so state can't be
+recovered into a different number of partitions.
+*/
+func (s *CoordinatorServer) checkWALPartitions(dir string) error {
+	written := 0
+	if _, err := os.Stat(filepath.Join(dir, "coordinator.snapshot")); err == nil {
+		written = 1
+	} else if _, err := os.Stat(filepath.Join(dir, "coordinator.wal")); err == nil {
+		written = 1
+	}
+	subdirs, err := filepath.Glob(filepath.Join(dir, "partition-*"))
+	if err != nil {
+		return err
+	}
+	if len(subdirs) > 0 {
+		written = len(subdirs)
+	}
+	if written != 0 && written != len(s.partitions) {
+		return fmt.Errorf("WAL in %s was written with %d partitions; run with %d partitions, or remove it to discard the state", dir, written, written)
+	}
+	return nil
+}
+
+/* Opens the partition's WAL in dir and recovers any state left by a previous run */
+func (p *Partition) recover(dir string) error {
+	var err error
+	p.wal, err = OpenWAL(dir)
+	if err != nil {
+		return err
+	}
+
+	// Recovered triggers were already audited before the restart
+	audit := p.c.audit
+	p.c.audit = nil
+	replayed, err := p.wal.Recover(&p.c)
+	p.c.audit = audit
+	if err != nil {
+		return err
+	}
+
+	// Anything that would have expired while we were down is discarded
+	p.c.now = time.Now()
+	p.c.checkTraceExpiration(p.c.now)
+	p.c.checkTriggerExpiration(p.c.now)
+
+	p.recovered = len(p.c.triggers) > 0
+	log.Printf("Recovered %d traces and %d triggers from %s (%d log records)\n", len(p.c.traces), len(p.c.triggers), dir, replayed)
+	return nil
+}
+
+func (p *Partition) snapshot() {
+	p.c.now = time.Now()
+	err := p.wal.Snapshot(&p.c)
+	if err != nil {
+		log.Println("Error writing coordinator snapshot:", err)
+	}
+}
+
+func (p *Partition) checkExpirations() {
+	p.c.now = time.Now()
+	p.c.checkTraceExpiration(p.c.now)
+	finished := p.c.checkTriggerExpiration(p.c.now)
+	p.cs.metrics.recordState(p.index, &p.c, finished)
+	if p.cs.logger != nil && len(finished) > 0 {
+		p.cs.logger.Log(finished)
+	}
+}
+
+func (p *Partition) processTriggers(incoming *IncomingTriggers) {
+	p.c.now = time.Now()
+	req := incoming.req
+
+	triggers_to_forward := make(map[string][]Trigger)
+	for _, t := range req.Triggers {
+		// Store the received trigger
+		var trigger Trigger
+		trigger.id.queue_id = int(t.QueueId)
+		trigger.id.base_trace_id = t.BaseTraceId
+		trigger.trace_ids = t.TraceIds
+		if p.wal != nil {
+			p.wal.LogTrigger(p.c.now, req.Src, trigger)
+		}
+		forwarding_addrs := p.c.AddTrigger(req.Src, trigger)
+
+		// Forward the trigger to any addresses specified
+		for _, addr := range forwarding_addrs {
+			triggers_to_forward[addr] = append(triggers_to_forward[addr], trigger)
+		}
+	}
+
+	if p.wal != nil {
+		p.wal.Flush()
+	}
+
+	// Do the forwarding
+	p.cs.forward(triggers_to_forward)
+
+	p.checkExpirations()
+	if incoming.fanout != nil {
+		incoming.fanout <- p.completeTriggers(req)
+		return
+	}
+	select {
+	case incoming.ret <- nil:
+	default:
+	}
+}
+
+/* The triggers of a request, with every trace that this partition knows they have */
+func (p *Partition) completeTriggers(req *datapb.TriggerRequest) *datapb.TriggerRequest {
+	complete := &datapb.TriggerRequest{Src: req.Src}
+	for _, t := range req.Triggers {
+		trigger, ok := p.c.triggers[TriggerID{int(t.QueueId), t.BaseTraceId}]
+		if !ok {
+			// Already evicted
+			complete.Triggers = append(complete.Triggers, t)
+			continue
+		}
+		complete.Triggers = append(complete.Triggers, &datapb.Trigger{QueueId: t.QueueId, BaseTraceId: t.BaseTraceId, TraceIds: trigger.Trigger().trace_ids})
+	}
+	return complete
+}
+
+func (p *Partition) processBreadcrumbs(incoming *IncomingBreadcrumbs) {
+	p.c.now = time.Now()
+
+	triggers_to_forward := make(map[string][]Trigger)
+	up := make(map[uint64][]string)
+	down := make(map[string]map[uint64][]string)
+	for trace_id, addrs := range incoming.breadcrumbs {
+		// Breadcrumbs name agents, which may be in other regions
+		addrs = p.cs.routeBreadcrumbs(&p.c, incoming.src, trace_id, addrs, up, down)
+
+		// Store the received breadcrumbs
+		if p.wal != nil {
+			p.wal.LogBreadcrumb(p.c.now, incoming.src, trace_id, addrs)
+		}
+		to_forward := p.c.AddBreadcrumb(incoming.src, trace_id, addrs)
+
+		// Forward any necessary triggers
+		for addr, triggers := range to_forward {
+			if len(triggers) > 0 {
+				triggers_to_forward[addr] = append(triggers_to_forward[addr], triggers...)
+			}
+		}
+	}
+
+	if p.wal != nil {
+		p.wal.Flush()
+	}
+
+	// Do the forwarding
+	p.cs.forward(triggers_to_forward)
+	p.cs.sendBreadcrumbs(up, down)
+
+	p.checkExpirations()
+	select {
+	case incoming.ret <- nil:
+	default:
+	}
+}
+
+/* The goroutine that owns the partition's state */
+func (p *Partition) Run(ctx context.Context) {
+	var snapshots <-chan time.Time
+	if p.wal != nil {
+		if p.recovered {
+			/* Dissemination in flight before a restart may have been lost, so send again */
+			p.cs.forward(p.c.pendingDissemination())
+		}
+		if p.cs.snapshot_interval > 0 {
+			snapshot_ticker := time.NewTicker(p.cs.snapshot_interval)
+			defer snapshot_ticker.Stop()
+			snapshots = snapshot_ticker.C
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if p.wal != nil {
+				p.snapshot()
+				p.wal.Close()
+			}
+			if p.cs.logger != nil || p.c.audit != nil {
+				/* Expire everything, so that it flushes to log */
+				p.c.now = time.Now()
+				finished := p.c.expireAll()
+				if p.cs.logger != nil {
+					p.cs.logger.Log(finished)
+				}
+			}
+			return
+		case req := <-p.incoming_triggers:
+			/* Received some triggers from an agent over RPC */
+			p.processTriggers(req)
+		case req := <-p.incoming_breadcrumbs:
+			/* Received some breadcrumbs from an agent over RPC */
+			p.processBreadcrumbs(req)
+		case query := <-p.incoming_queries:
+			/* Someone is inspecting the breadcrumb graph */
+			query.ret <- p.c.query(query.req)
+		case <-snapshots:
+			p.snapshot()
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPartitionedServer(ctx context.Context, n int) *CoordinatorServer {
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	cs.ConfigurePartitions(n)
+	cs.ctx = ctx
+	for _, p := range cs.partitions {
+		go p.Run(ctx)
+	}
+	return &cs
+}
+
+func TestPartitionedCoordinator(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cs := newPartitionedServer(ctx, 4)
+	trace1, trace2 := uint64(75), uint64(76)
+	for cs.partition(trace1) == cs.partition(trace2) {
+		trace2++
+	}
+
+	sendBreadcrumbs(cs, "a", map[uint64][]string{trace1: {"b"}, trace2: {"e"}})
+	sendBreadcrumbs(cs, "b", map[uint64][]string{trace1: {"c"}})
+	sendBreadcrumbs(cs, "e", map[uint64][]string{trace2: {"f"}})
+
+	// A trigger spanning partitions is disseminated along the breadcrumbs of both traces
+	req := &datapb.TriggerRequest{Src: "a", Triggers: []*datapb.Trigger{{QueueId: 3, BaseTraceId: trace1, TraceIds: []uint64{trace1, trace2}}}}
+	rsp, _ := cs.LocalTrigger(context.Background(), req)
+	assert.Equal(int32(1), rsp.Accepted)
+	for _, addr := range []string{"b", "c", "e", "f"} {
+		assert.Equal(1, len(cs.GetAgent(addr).outgoing_triggers), "Trigger disseminated to %s", addr)
+	}
+	assert.Equal(0, len(cs.GetAgent("a").outgoing_triggers), "Trigger not sent back to its source")
+	assert.True(cs.partition(trace1).c.known_at(TriggerID{3, trace1}, "c"))
+	assert.False(cs.partition(trace1).c.known_at(TriggerID{3, trace1}, "f"), "Each partition only knows its own traces")
+
+	// Late breadcrumbs reach the partition that owns the trace
+	sendBreadcrumbs(cs, "f", map[uint64][]string{trace2: {"g"}})
+	assert.Equal(1, len(cs.GetAgent("g").outgoing_triggers))
+
+	// Queries for the trigger are merged across partitions
+	query, err := cs.Query(context.Background(), &datapb.QueryRequest{Trigger: &datapb.TriggerId{QueueId: 3, BaseTraceId: trace1}})
+	assert.NoError(err)
+	assert.Equal(1, len(query.Triggers))
+	assert.Equal(2, len(query.Triggers[0].TraceIds))
+	assert.Equal(6, len(query.Triggers[0].KnownAt), "Known at a, b, c, e, f, and g")
+	assert.Equal(2, len(query.Traces))
+}
+
+/* Takes the triggers queued for an agent, returning the trace IDs sent for a trigger */
+func takeTriggers(cs *CoordinatorServer, addr string, id TriggerID) (sent [][]uint64) {
+	queue := cs.GetAgent(addr).outgoing_triggers
+	for len(queue) > 0 {
+		for _, t := range <-queue {
+			if t.id == id {
+				trace_ids := append([]uint64{}, t.trace_ids...)
+				sort.Slice(trace_ids, func(i, j int) bool { return trace_ids[i] < trace_ids[j] })
+				sent = append(sent, trace_ids)
+			}
+		}
+	}
+	return
+}
+
+/* As TestCoordinatorAfterBreadcrumbs, with the trigger's traces in different partitions */
+func TestPartitionedLateralTrace(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cs := newPartitionedServer(ctx, 4)
+	trace1, trace2 := uint64(75), uint64(76)
+	for cs.partition(trace1) == cs.partition(trace2) {
+		trace2++
+	}
+	id := TriggerID{1, trace1}
+
+	sendBreadcrumbs(cs, "a", map[uint64][]string{trace1: {"b"}, trace2: {"e"}})
+	sendBreadcrumbs(cs, "b", map[uint64][]string{trace1: {"c"}})
+	sendBreadcrumbs(cs, "c", map[uint64][]string{trace1: {"d"}})
+	sendBreadcrumbs(cs, "e", map[uint64][]string{trace2: {"f"}})
+
+	cs.LocalTrigger(context.Background(), &datapb.TriggerRequest{Src: "a", Triggers: []*datapb.Trigger{{QueueId: 1, BaseTraceId: trace1, TraceIds: []uint64{trace1}}}})
+	for _, addr := range []string{"b", "c", "d"} {
+		assert.Equal([][]uint64{{trace1}}, takeTriggers(cs, addr, id), "Trigger disseminated to %s", addr)
+	}
+
+	// The trigger gains a lateral trace owned by another partition
+	cs.LocalTrigger(context.Background(), &datapb.TriggerRequest{Src: "b", Triggers: []*datapb.Trigger{{QueueId: 1, BaseTraceId: trace1, TraceIds: []uint64{trace2}}}})
+	for _, addr := range []string{"a", "c", "d", "e", "f"} {
+		sent := takeTriggers(cs, addr, id)
+		assert.NotEmpty(sent, "Trigger redisseminated to %s", addr)
+		for _, trace_ids := range sent {
+			assert.Contains(trace_ids, trace2, "The lateral trace reaches %s", addr)
+		}
+	}
+	assert.Empty(takeTriggers(cs, "b", id), "Trigger not sent back to its source")
+
+	// Late breadcrumbs of either trace carry the whole trigger
+	sendBreadcrumbs(cs, "f", map[uint64][]string{trace2: {"g"}})
+	assert.Equal([][]uint64{{trace1, trace2}}, takeTriggers(cs, "g", id))
+
+	query, err := cs.Query(context.Background(), &datapb.QueryRequest{Trigger: &datapb.TriggerId{QueueId: 1, BaseTraceId: trace1}})
+	assert.NoError(err)
+	assert.Equal([]uint64{trace1, trace2}, query.Triggers[0].TraceIds)
+	assert.Equal(7, len(query.Triggers[0].KnownAt), "Known at a, b, c, d, e, f, and g")
+}
+
+/* A trigger fanned out to several partitions is audited and finished only by its home partition */
+func TestPartitionedTriggerLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(filename, nil, 0, 0)
+	assert.NoError(err)
+	cancel := audit.Run()
+
+	trace1, trace2 := uint64(1), uint64(2)
+	var home, other Coordinator
+	home.Init()
+	home.audit = audit
+	home.owns = func(trace_id uint64) bool { return trace_id == trace1 }
+	other.Init()
+	other.audit = audit
+	other.owns = func(trace_id uint64) bool { return trace_id != trace1 }
+
+	trigger := Trigger{TriggerID{1, trace1}, []uint64{trace1, trace2}}
+	other.AddBreadcrumb("b", trace2, []string{"c"})
+	home.AddTrigger("a", trigger)
+	other.AddTrigger("a", trigger)
+	assert.Equal(map[uint64]struct{}{trace2: {}}, home.triggers[trigger.id].lateral)
+	assert.Equal(map[uint64]struct{}{trace1: {}}, other.triggers[trigger.id].lateral)
+
+	finished := append(home.expireAll(), other.expireAll()...)
+	assert.Equal(1, len(finished), "One finished trigger across partitions")
+	assert.Empty(other.triggers)
+
+	cancel()
+	audit.AwaitCompletion()
+	var names []string
+	for _, e := range readAudit(t, filename) {
+		names = append(names, e.Event)
+	}
+	assert.Equal([]string{"created", "known", "expired"}, names)
+}
+
+func TestPartitionedWAL(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "coordinator-wal")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	cs.ConfigurePartitions(2)
+	cs.ctx = ctx
+	assert.NoError(cs.ConfigureWAL(dir, 0))
+	wg := new(sync.WaitGroup)
+	for _, p := range cs.partitions {
+		wg.Add(1)
+		go func(p *Partition) {
+			p.Run(ctx)
+			wg.Done()
+		}(p)
+	}
+	for trace_id := uint64(1); trace_id <= 10; trace_id++ {
+		sendBreadcrumbs(&cs, "a", map[uint64][]string{trace_id: {"b"}})
+	}
+	cancel()
+	wg.Wait()
+
+	var recovered CoordinatorServer
+	recovered.Init("0", "")
+	recovered.ConfigurePartitions(2)
+	assert.NoError(recovered.ConfigureWAL(dir, 0))
+	total := 0
+	for _, p := range recovered.partitions {
+		assert.True(len(p.c.traces) > 0, "Traces are spread across partitions")
+		for trace_id := range p.c.traces {
+			assert.Equal(p, recovered.partition(trace_id), "Traces are recovered into the partition that owns them")
+		}
+		total += len(p.c.traces)
+	}
+	assert.Equal(10, total)
+
+	var mismatched CoordinatorServer
+	mismatched.Init("0", "")
+	mismatched.ConfigurePartitions(3)
+	assert.Error(mismatched.ConfigureWAL(dir, 0), "State can't be recovered into a different number of partitions")
+}
+
+/*
+Throughput of breadcrumbs and triggers received concurrently from many
+agents, e.g. go test -bench Partitions -cpu 1,2,4,8
+*/
+func BenchmarkPartitions(b *testing.B) {
+	log.SetOutput(ioutil.Discard) // Agents' backlogs overflow, since nothing is connected
+	defer log.SetOutput(os.Stderr)
+
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("partitions=%d", n), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cs := newPartitionedServer(ctx, n)
+
+			var seed int64
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				src := fmt.Sprintf("agent-%d", rng.Intn(16))
+				for i := 0; pb.Next(); i++ {
+					breadcrumbs := make(map[uint64][]string)
+					for j := 0; j < 10; j++ {
+						breadcrumbs[rng.Uint64()%100000] = []string{fmt.Sprintf("agent-%d", rng.Intn(16))}
+					}
+					cs.Breadcrumbs(context.Background(), breadcrumbsRequest(src, breadcrumbs))
+					if i%10 == 0 {
+						trace_id := rng.Uint64() % 100000
+						req := &datapb.TriggerRequest{Src: src, Triggers: []*datapb.Trigger{{QueueId: 1, BaseTraceId: trace_id, TraceIds: []uint64{trace_id, rng.Uint64() % 100000}}}}
+						cs.LocalTrigger(context.Background(), req)
+					}
+				}
+			})
+		})
+	}
+}
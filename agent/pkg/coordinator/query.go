@@ -0,0 +1,162 @@
+package coordinator
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+)
+
+/*
+Queries expose the coordinator's breadcrumb graph: for a trace, the agents
+where it is known and the triggers that cover it; for a trigger, the agents
+where it is known and the traces it covers.  Queries are answered by the
+partitions' goroutines, since they own the coordinator state.  A trace is
+looked up in the partition that owns it; a trigger can span partitions, so
+it is looked up in all of them and the results are merged.
+*/
+type IncomingQuery struct {
+	req *datapb.QueryRequest
+	ret chan *datapb.QueryReply
+}
+
+func unixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func knownAtInfo(known_at map[string]time.Time) (info []*datapb.KnownAt) {
+	for _, addr := range sortedAddrs(known_at) {
+		info = append(info, &datapb.KnownAt{Addr: addr, LearnedUnixMs: unixMs(known_at[addr])})
+	}
+	return
+}
+
+func triggerIdInfo(id TriggerID) *datapb.TriggerId {
+	return &datapb.TriggerId{QueueId: int32(id.queue_id), BaseTraceId: id.base_trace_id}
+}
+
+func (trace *tracestate) info() *datapb.TraceInfo {
+	info := &datapb.TraceInfo{
+		TraceId:            trace.id,
+		KnownAt:            knownAtInfo(trace.known_at),
+		CreatedUnixMs:      unixMs(trace.created),
+		LastModifiedUnixMs: unixMs(trace.last_modified),
+	}
+	for id := range trace.triggers {
+		info.Triggers = append(info.Triggers, triggerIdInfo(id))
+	}
+	sort.Slice(info.Triggers, func(i, j int) bool {
+		a, b := info.Triggers[i], info.Triggers[j]
+		return a.QueueId < b.QueueId || (a.QueueId == b.QueueId && a.BaseTraceId < b.BaseTraceId)
+	})
+	return info
+}
+
+func (trigger *triggerstate) info() *datapb.TriggerInfo {
+	info := &datapb.TriggerInfo{
+		Id:                 triggerIdInfo(trigger.id),
+		KnownAt:            knownAtInfo(trigger.known_at),
+		CreatedUnixMs:      unixMs(trigger.created),
+		LastModifiedUnixMs: unixMs(trigger.last_modified),
+	}
+	for trace_id := range trigger.traces {
+		info.TraceIds = append(info.TraceIds, trace_id)
+	}
+	sort.Slice(info.TraceIds, func(i, j int) bool { return info.TraceIds[i] < info.TraceIds[j] })
+	return info
+}
+
+func (c *Coordinator) query(req *datapb.QueryRequest) *datapb.QueryReply {
+	var rsp datapb.QueryReply
+	if req.Trigger != nil {
+		trigger, ok := c.triggers[TriggerID{queue_id: int(req.Trigger.QueueId), base_trace_id: req.Trigger.BaseTraceId}]
+		if !ok {
+			return &rsp
+		}
+		rsp.Triggers = append(rsp.Triggers, trigger.info())
+		for _, trace_id := range rsp.Triggers[0].TraceIds {
+			rsp.Traces = append(rsp.Traces, trigger.traces[trace_id].info())
+		}
+		return &rsp
+	}
+
+	trace, ok := c.traces[req.TraceId]
+	if !ok {
+		return &rsp
+	}
+	rsp.Traces = append(rsp.Traces, trace.info())
+	for _, id := range rsp.Traces[0].Triggers {
+		trigger := trace.triggers[TriggerID{queue_id: int(id.QueueId), base_trace_id: id.BaseTraceId}]
+		rsp.Triggers = append(rsp.Triggers, trigger.info())
+	}
+	return &rsp
+}
+
+/* Merges the parts of a trigger that spans partitions */
+func mergeTriggerInfo(merged *datapb.TriggerInfo, info *datapb.TriggerInfo) {
+	for _, k := range info.KnownAt {
+		found := false
+		for _, existing := range merged.KnownAt {
+			if existing.Addr == k.Addr {
+				found = true
+				if k.LearnedUnixMs < existing.LearnedUnixMs {
+					existing.LearnedUnixMs = k.LearnedUnixMs
+				}
+			}
+		}
+		if !found {
+			merged.KnownAt = append(merged.KnownAt, k)
+		}
+	}
+	sort.Slice(merged.KnownAt, func(i, j int) bool { return merged.KnownAt[i].Addr < merged.KnownAt[j].Addr })
+	merged.TraceIds = append(merged.TraceIds, info.TraceIds...)
+	sort.Slice(merged.TraceIds, func(i, j int) bool { return merged.TraceIds[i] < merged.TraceIds[j] })
+	if info.CreatedUnixMs < merged.CreatedUnixMs {
+		merged.CreatedUnixMs = info.CreatedUnixMs
+	}
+	if info.LastModifiedUnixMs > merged.LastModifiedUnixMs {
+		merged.LastModifiedUnixMs = info.LastModifiedUnixMs
+	}
+}
+
+func (p *Partition) query(ctx context.Context, req *datapb.QueryRequest) (*datapb.QueryReply, error) {
+	incoming := &IncomingQuery{req: req, ret: make(chan *datapb.QueryReply, 1)}
+	select {
+	case p.incoming_queries <- incoming:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case rsp := <-incoming.ret:
+		return rsp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/* Looks up the breadcrumb graph of a trace or trigger */
+func (s *CoordinatorServer) Query(ctx context.Context, req *datapb.QueryRequest) (*datapb.QueryReply, error) {
+	if req.Trigger == nil {
+		return s.partition(req.TraceId).query(ctx, req)
+	}
+
+	var merged datapb.QueryReply
+	for _, p := range s.partitions {
+		rsp, err := p.query(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(rsp.Triggers) == 0 {
+			continue
+		}
+		if len(merged.Triggers) == 0 {
+			merged.Triggers = rsp.Triggers
+		} else {
+			mergeTriggerInfo(merged.Triggers[0], rsp.Triggers[0])
+		}
+		merged.Traces = append(merged.Traces, rsp.Traces...)
+	}
+	sort.Slice(merged.Traces, func(i, j int) bool { return merged.Traces[i].TraceId < merged.Traces[j].TraceId })
+	return &merged, nil
+}
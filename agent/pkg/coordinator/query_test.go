@@ -0,0 +1,35 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Coordinator
+	c.Init()
+	c.AddBreadcrumb("a", uint64(75), []string{"b"})
+	c.AddTrigger("c", Trigger{TriggerID{3, uint64(75)}, []uint64{uint64(75), uint64(77)}})
+
+	rsp := c.query(&datapb.QueryRequest{TraceId: 75})
+	assert.Equal(1, len(rsp.Traces))
+	var addrs []string
+	for _, k := range rsp.Traces[0].KnownAt {
+		addrs = append(addrs, k.Addr)
+		assert.Equal(unixMs(c.now), k.LearnedUnixMs)
+	}
+	assert.Equal([]string{"a", "b", "c"}, addrs, "Trace is known at its breadcrumbs and the trigger source")
+	assert.Equal(1, len(rsp.Triggers), "Trigger covering the trace is included")
+	assert.Equal([]uint64{75, 77}, rsp.Triggers[0].TraceIds)
+
+	rsp = c.query(&datapb.QueryRequest{Trigger: &datapb.TriggerId{QueueId: 3, BaseTraceId: 75}})
+	assert.Equal(1, len(rsp.Triggers))
+	assert.Equal(2, len(rsp.Traces), "Traces covered by the trigger are included")
+
+	rsp = c.query(&datapb.QueryRequest{TraceId: 12345})
+	assert.Equal(0, len(rsp.Traces), "Unknown trace")
+}
@@ -3,6 +3,7 @@ package coordinator
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -10,31 +11,47 @@ import (
 	"time"
 
 	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/telemetry"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
 	"google.golang.org/grpc"
 )
 
 type IncomingBreadcrumbs struct {
-	req *datapb.BreadcrumbsRequest
-	ret chan error
+	src         string
+	breadcrumbs map[uint64][]string // Trace IDs to the addresses of their breadcrumbs
+	ret         chan error
 }
 
 type IncomingTriggers struct {
-	req *datapb.TriggerRequest
-	ret chan error
+	req    *datapb.TriggerRequest
+	ret    chan error
+	fanout chan *datapb.TriggerRequest // If set, the processed triggers with all of their traces are returned here instead of on ret
+}
+
+type IncomingStream struct {
+	src    string
+	stream *AgentStream
 }
 
 type CoordinatorServer struct {
 	datapb.UnimplementedCoordinatorServer
 
-	ctx     context.Context   // For shutdown
-	timeout time.Duration     // Time before expiring triggers / traces
-	c       Coordinator       // Manages coordination data
-	agents  map[string]*Agent // connections to agents
+	ctx        context.Context   // For shutdown
+	partitions []*Partition      // Coordination data, partitioned by trace ID
+	agents_mu  sync.Mutex        // Guards agents, which all partitions use
+	agents     map[string]*Agent // connections to agents
+	members    Membership        // Registered agents and their liveness
+
+	listen_port string         // Port to listen for connections from agents
+	tls         util.TLSConfig // Optional TLS for agent connections
 
-	listen_port string // Port to listen for connections from agents
+	self  string           // Our address in the hash ring, if sharded
+	ring  *util.HashRing   // Maps trace IDs to coordinator shards; nil if not sharded
+	peers map[string]*Peer // Other coordinator shards
 
-	incoming_triggers    chan *IncomingTriggers
-	incoming_breadcrumbs chan *IncomingBreadcrumbs
+	parent *Parent // Our parent, if we are a regional coordinator
+
+	incoming_streams chan *IncomingStream
 
 	dropped_incoming_triggers    uint64
 	dropped_incoming_breadcrumbs uint64
@@ -43,24 +60,55 @@ type CoordinatorServer struct {
 	last_trigger_warning         time.Time
 	last_breadcrumb_warning      time.Time
 
-	logger *CsvLogger
+	logger   *CsvLogger
+	audit    *AuditLog // Optional log of every trigger's lifecycle
+	metrics  CoordinatorMetrics
+	reporter *telemetry.Reporter // Optional; see ConfigureTelemetry
+
+	retry_after time.Duration // How long agents should back off when their requests are rejected
+
+	snapshot_interval time.Duration // How often to snapshot state to the WAL
 }
 
 type Agent struct {
+	mu                sync.Mutex // Guards id_to_addr and the warning state, since partitions share agents
 	addr              string
 	id_to_addr        map[int32]string
 	outgoing_triggers chan []Trigger
+	outgoing_crumbs   chan *datapb.BreadcrumbsRequest // For a regional coordinator, traces known in other regions
+	streams           chan *AgentStream               // Connect streams opened by the agent
 	dropped_triggers  int
 	last_warn         time.Time
+	cancel            context.CancelFunc // Stops the agent's send loop
+	metrics           *CoordinatorMetrics
+	audit             *AuditLog
+}
+
+/*
+A Connect stream opened by an agent.  The stream's Recv side is owned by
+the Connect handler, while Send is shared between the handler and the
+Agent's send loop, so sends are serialized with a mutex.
+*/
+type AgentStream struct {
+	stream datapb.Coordinator_ConnectServer
+	mu     sync.Mutex
+	done   chan struct{} // Closed when the Connect handler returns
+}
+
+func (as *AgentStream) Send(msg *datapb.CoordinatorMessage) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.stream.Send(msg)
 }
 
 func (s *CoordinatorServer) Init(port string, logfile string) (err error) {
-	s.c.Init()
-	s.timeout = -60 * time.Second
+	s.ConfigurePartitions(1)
 	s.agents = make(map[string]*Agent)
+	s.members.Init(1 * time.Second)
+	s.retry_after = 250 * time.Millisecond
+	s.metrics.Init()
 	s.listen_port = port
-	s.incoming_triggers = make(chan *IncomingTriggers, 10000)
-	s.incoming_breadcrumbs = make(chan *IncomingBreadcrumbs, 10000)
+	s.incoming_streams = make(chan *IncomingStream, 100)
 	if logfile != "" {
 		s.logger, err = NewCsvLogger(logfile)
 	} else {
@@ -71,10 +119,91 @@ func (s *CoordinatorServer) Init(port string, logfile string) (err error) {
 	return
 }
 
+/*
+Enables TLS for agent connections.  If the config includes a CA, agents must
+present a client certificate, and the certificate's identity is used in place
+of the src that agents claim in their requests.  Must be called before Run.
+*/
+func (s *CoordinatorServer) ConfigureTLS(config util.TLSConfig) {
+	s.tls = config
+	for _, peer := range s.peers {
+		peer.tls = config
+	}
+	if s.parent != nil {
+		s.parent.tls = config
+	}
+}
+
+/*
+Configures how long traces and triggers are kept after they were last
+modified.  queue_timeouts overrides trigger_timeout for specific queues.  If
+max_traces or max_triggers is nonzero, the least recently modified traces or
+triggers are evicted once there are more than that many; the limits are
+divided evenly between partitions.  Must be called before Run (and before
+ConfigureWAL, so that recovery honours the timeouts).
+*/
+func (s *CoordinatorServer) ConfigureExpiration(trace_timeout time.Duration, trigger_timeout time.Duration, queue_timeouts map[int]time.Duration, max_traces int, max_triggers int) {
+	n := len(s.partitions)
+	for _, p := range s.partitions {
+		p.c.trace_timeout = trace_timeout
+		p.c.trigger_timeout = trigger_timeout
+		for queue_id, timeout := range queue_timeouts {
+			p.c.queue_timeouts[queue_id] = timeout
+		}
+		p.c.max_traces = (max_traces + n - 1) / n
+		p.c.max_triggers = (max_triggers + n - 1) / n
+	}
+}
+
+/*
+Enables the audit log of every trigger's lifecycle; see NewAuditLog.  Must be
+called before Run.
+*/
+func (s *CoordinatorServer) ConfigureAudit(filename string, queues []int, max_size int64, keep int) (err error) {
+	s.audit, err = NewAuditLog(filename, queues, max_size, keep)
+	for _, p := range s.partitions {
+		p.c.audit = s.audit
+	}
+	return
+}
+
+/*
+Enables the write-ahead log in dir, recovering any state left by a previous
+run.  State is snapshotted every snapshot_interval; if zero, only on
+shutdown.  Must be called before Run.
+*/
+func (s *CoordinatorServer) ConfigureWAL(dir string, snapshot_interval time.Duration) (err error) {
+	err = s.checkWALPartitions(dir)
+	if err != nil {
+		return
+	}
+	s.snapshot_interval = snapshot_interval
+	for _, p := range s.partitions {
+		err = p.recover(s.partitionDir(dir, p.index))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Determines which agent a request came from.  With mutual TLS the identity in
+the client certificate is authoritative; otherwise the claimed src is used.
+*/
+func (s *CoordinatorServer) authenticate(ctx context.Context, src string) string {
+	if identity, ok := util.GrpcPeerIdentity(ctx); ok {
+		return identity
+	}
+	return src
+}
+
 func (a *Agent) Init(addr string) {
 	a.addr = addr
 	a.id_to_addr = make(map[int32]string)
 	a.outgoing_triggers = make(chan []Trigger, 10000)
+	a.outgoing_crumbs = make(chan *datapb.BreadcrumbsRequest, 1000)
+	a.streams = make(chan *AgentStream, 1)
 	a.dropped_triggers = 0
 	a.last_warn = time.Now()
 }
@@ -82,6 +211,20 @@ func (a *Agent) Init(addr string) {
 func (s *CoordinatorServer) Run(ctx context.Context) {
 	s.ctx = ctx
 	wg := new(sync.WaitGroup)
+	for _, peer := range s.peers {
+		wg.Add(1)
+		go func(peer *Peer) {
+			peer.Run(ctx)
+			wg.Done()
+		}(peer)
+	}
+	if s.parent != nil {
+		wg.Add(1)
+		go func() {
+			s.parent.Run(ctx)
+			wg.Done()
+		}()
+	}
 	wg.Add(2)
 	go func() {
 		s.runServer(ctx)
@@ -93,13 +236,39 @@ func (s *CoordinatorServer) Run(ctx context.Context) {
 		log.Println("Stopped main coordinator goroutine")
 		wg.Done()
 	}()
+	for _, p := range s.partitions {
+		wg.Add(1)
+		go func(p *Partition) {
+			p.Run(ctx)
+			wg.Done()
+		}(p)
+	}
+	if s.reporter != nil {
+		wg.Add(1)
+		go func() {
+			err := s.reporter.Run(ctx)
+			if err != nil {
+				log.Println("Error in telemetry reporter:", err)
+			}
+			wg.Done()
+		}()
+	}
+	var cancel_logger, cancel_audit context.CancelFunc
 	if s.logger != nil {
-		cancel := s.logger.Run()
-		wg.Wait()
-		cancel() // Done like this to ensure everything gets drained properly
+		cancel_logger = s.logger.Run()
+	}
+	if s.audit != nil {
+		cancel_audit = s.audit.Run()
+	}
+	wg.Wait()
+	// Done like this to ensure everything gets drained properly
+	if s.logger != nil {
+		cancel_logger()
 		s.logger.AwaitCompletion()
-	} else {
-		wg.Wait()
+	}
+	if s.audit != nil {
+		cancel_audit()
+		s.audit.AwaitCompletion()
 	}
 }
 
@@ -109,8 +278,12 @@ func (cs *CoordinatorServer) runServer(ctx context.Context) {
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	log.Println("Listening for agent connections on port", cs.listen_port)
-	grpcserver := grpc.NewServer()
+	log.Println("Listening for agent connections on port", cs.listen_port, "using", cs.tls.String())
+	opts, err := cs.tls.ServerOptions()
+	if err != nil {
+		log.Fatalf("failed to configure TLS: %v", err)
+	}
+	grpcserver := grpc.NewServer(opts...)
 	datapb.RegisterCoordinatorServer(grpcserver, cs)
 
 	go func() {
@@ -127,162 +300,120 @@ func (cs *CoordinatorServer) runServer(ctx context.Context) {
 }
 
 func (cs *CoordinatorServer) GetAgent(addr string) *Agent {
+	cs.agents_mu.Lock()
+	defer cs.agents_mu.Unlock()
 	if agent, ok := cs.agents[addr]; ok {
 		return agent
 	} else {
 		var agent Agent
 		agent.Init(addr)
+		agent.metrics = &cs.metrics
+		agent.audit = cs.audit
 		cs.agents[addr] = &agent
 		agent.Run(cs.ctx)
 		return &agent
 	}
 }
 
-func (cs *CoordinatorServer) checkExpirations() {
-	cs.c.now = time.Now()
-	cs.c.checkTraceExpiration(cs.c.now.Add(cs.timeout))
-	finished := cs.c.checkTriggerExpiration(cs.c.now.Add(cs.timeout))
-	if cs.logger != nil && len(finished) > 0 {
-		select {
-		case cs.logger.Finished <- finished:
-			return
-		default:
-			cs.logger.dropped_finished += len(finished)
+/* Sends triggers to agents, skipping any agents that are known to be dead */
+func (cs *CoordinatorServer) forward(triggers_to_forward map[string][]Trigger) {
+	for addr, triggers := range triggers_to_forward {
+		if cs.parent != nil && addr == cs.parent.addr {
+			cs.parent.Send(&datapb.AgentMessage{Triggers: triggerRequest(triggers)})
+			cs.metrics.update(addr, func(m *AgentMetrics) { m.triggers_sent += len(triggers) })
+			continue
+		}
+		if cs.members.IsDead(addr) {
+			cs.metrics.update(addr, func(m *AgentMetrics) { m.triggers_dropped += len(triggers) })
+			cs.audit.sent(triggers, addr, errAgentDead)
+			continue
 		}
+		cs.GetAgent(addr).SendTriggers(triggers)
 	}
 }
 
-func (cs *CoordinatorServer) processTriggersRequest(incoming *IncomingTriggers) {
-	cs.c.now = time.Now()
-	req := incoming.req
-
-	triggers_to_forward := make(map[string][]Trigger)
-	for _, t := range req.Triggers {
-		// Store the received trigger
-		var trigger Trigger
-		trigger.id.queue_id = int(t.QueueId)
-		trigger.id.base_trace_id = t.BaseTraceId
-		trigger.trace_ids = t.TraceIds
-		forwarding_addrs := cs.c.AddTrigger(req.Src, trigger)
-
-		// Forward the trigger to any addresses specified
-		for _, addr := range forwarding_addrs {
-			triggers_to_forward[addr] = append(triggers_to_forward[addr], trigger)
+/* Updates agent liveness and garbage collects state of long-dead agents */
+func (cs *CoordinatorServer) checkMembership() {
+	cs.agents_mu.Lock()
+	defer cs.agents_mu.Unlock()
+	for _, addr := range cs.members.Check(time.Now()) {
+		if agent, ok := cs.agents[addr]; ok {
+			log.Println("Agent", addr, "is dead; discarding its state")
+			agent.cancel()
+			delete(cs.agents, addr)
 		}
 	}
+}
 
-	// Do the forwarding
-	for addr, triggers := range triggers_to_forward {
-		cs.GetAgent(addr).SendTriggers(triggers)
+/*
+The "main" thread that receives incoming streams and messages from our
+parent.  Triggers and breadcrumbs are processed by the partitions.
+*/
+func (cs *CoordinatorServer) runCoordinator(ctx context.Context) {
+	log.Println("CoordinatorServer main goroutine running")
+	membership_ticker := time.NewTicker(cs.members.heartbeat_interval)
+	defer membership_ticker.Stop()
+
+	var from_parent chan *datapb.CoordinatorMessage
+	if cs.parent != nil {
+		from_parent = cs.parent.incoming
 	}
 
-	cs.checkExpirations()
-	select {
-	case incoming.ret <- nil:
-	default:
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case incoming := <-cs.incoming_streams:
+			/* An agent opened a Connect stream */
+			cs.GetAgent(incoming.src).Attach(incoming.stream)
+		case msg := <-from_parent:
+			/* Our parent sent triggers or breadcrumbs down to our region */
+			cs.processParentMessage(ctx, msg)
+		case <-membership_ticker.C:
+			cs.checkMembership()
+		}
 	}
 }
 
-func (cs *CoordinatorServer) processBreadcrumbRequest(incoming *IncomingBreadcrumbs) {
-	cs.c.now = time.Now()
-	req := incoming.req
-
-	origin := cs.GetAgent(req.Src)
-
-	// Breadcrumbs are received as IDs; unravel into addr strings
+/*
+Breadcrumbs are received as IDs; unravels them into addr strings, using and
+updating the sender's mapping of IDs to addresses
+*/
+func decodeBreadcrumbs(req *datapb.BreadcrumbsRequest, id_to_addr map[int32]string) (map[uint64][]string, error) {
 	for _, a := range req.Addresses {
-		origin.id_to_addr[a.Id] = a.Addr
+		id_to_addr[a.Id] = a.Addr
 	}
 
 	breadcrumbs := make(map[uint64][]string)
 	for _, b := range req.Breadcrumbs {
 		for _, addr_id := range b.Addrs {
-			if addr, ok := origin.id_to_addr[addr_id]; ok {
+			if addr, ok := id_to_addr[addr_id]; ok {
 				breadcrumbs[b.TraceId] = append(breadcrumbs[b.TraceId], addr)
 			} else {
-				e := fmt.Errorf("Received addr_id %d from %s that hasn't been mapped to an address", addr_id, req.Src)
-				select {
-				case incoming.ret <- e:
-				default:
-				}
-				return
-			}
-		}
-	}
-
-	// Now process them
-	triggers_to_forward := make(map[string][]Trigger)
-	for trace_id, addrs := range breadcrumbs {
-		// Store the received breadcrumbs
-		to_forward := cs.c.AddBreadcrumb(req.Src, trace_id, addrs)
-
-		// Forward any necessary triggers
-		for addr, triggers := range to_forward {
-			if len(triggers) > 0 {
-				triggers_to_forward[addr] = append(triggers_to_forward[addr], triggers...)
-			}
-		}
-	}
-
-	// Do the forwarding
-	for addr, triggers := range triggers_to_forward {
-		cs.GetAgent(addr).SendTriggers(triggers)
-	}
-
-	cs.checkExpirations()
-	select {
-	case incoming.ret <- nil:
-	default:
-	}
-}
-
-/* The "main" thread that receives incoming stuff and sends outgoing stuff */
-func (cs *CoordinatorServer) runCoordinator(ctx context.Context) {
-	log.Println("CoordinatorServer main goroutine running")
-	for {
-		select {
-		case <-ctx.Done():
-			if cs.logger != nil {
-				log.Println("CoordinatorServer flushing logs")
-				/* Expire everything, so that it flushes to log */
-				finished := cs.c.checkTriggerExpiration(time.Now().Add(1 * time.Second))
-				select {
-				case cs.logger.Finished <- finished:
-					break
-				default:
-					cs.logger.dropped_finished += len(finished)
-				}
+				return nil, fmt.Errorf("Received addr_id %d from %s that hasn't been mapped to an address", addr_id, req.Src)
 			}
-			return
-		case req := <-cs.incoming_triggers:
-			/* Received some triggers from an agent over RPC*/
-			cs.processTriggersRequest(req)
-		case req := <-cs.incoming_breadcrumbs:
-			/* Received some breadcrumbs from an agent over RPC */
-			cs.processBreadcrumbRequest(req)
 		}
 	}
+	return breadcrumbs, nil
 }
 
 /* An agent has sent us a trigger */
 func (s *CoordinatorServer) LocalTrigger(ctx context.Context, req *datapb.TriggerRequest) (rsp *datapb.TriggerReply, err error) {
-	var incoming IncomingTriggers
-	incoming.req = req
-	incoming.ret = make(chan error, 1)
+	s.authenticateTriggers(ctx, req)
 
 	rsp = &datapb.TriggerReply{}
 
-	select {
-	case s.incoming_triggers <- &incoming:
-		select {
-		case <-ctx.Done():
-			return
-		case err = <-incoming.ret:
-			if err != nil {
-				log.Println("Breadcrumbs error:", err.Error())
-			}
+	ok, err := s.handleTriggers(ctx, s.shardTriggers(req), false)
+	if ok {
+		rsp.Accepted = int32(len(req.Triggers))
+		s.metrics.update(req.Src, func(m *AgentMetrics) { m.triggers_received += len(req.Triggers) })
+		if err != nil {
+			log.Println("Triggers error:", err.Error())
 		}
-	default:
+	} else {
+		rsp.Rejected = int32(len(req.Triggers))
+		s.metrics.update(req.Src, func(m *AgentMetrics) { m.rejected_triggers += len(req.Triggers) })
+		rsp.RetryAfterMs = s.retry_after.Milliseconds()
 		atomic.AddUint64(&s.dropped_incoming_triggers, uint64(len(req.Triggers)))
 		if s.trigger_warn_mutex.TryLock() {
 			defer s.trigger_warn_mutex.Unlock()
@@ -292,7 +423,7 @@ func (s *CoordinatorServer) LocalTrigger(ctx context.Context, req *datapb.Trigge
 				atomic.AddUint64(&s.dropped_incoming_triggers, -dropped)
 
 				s.last_trigger_warning = time.Now()
-				log.Printf("Warning: coordinator is bottlenecked; %d incoming triggers dropped\n", dropped)
+				log.Printf("Warning: coordinator is bottlenecked; %d incoming triggers rejected\n", dropped)
 			}
 		}
 	}
@@ -301,23 +432,32 @@ func (s *CoordinatorServer) LocalTrigger(ctx context.Context, req *datapb.Trigge
 
 /* An agent has sent us breadcrumbs */
 func (s *CoordinatorServer) Breadcrumbs(ctx context.Context, req *datapb.BreadcrumbsRequest) (rsp *datapb.BreadcrumbsReply, err error) {
-	var incoming IncomingBreadcrumbs
-	incoming.req = req
-	incoming.ret = make(chan error, 1)
+	req.Src = s.authenticate(ctx, req.Src)
 
 	rsp = &datapb.BreadcrumbsReply{}
 
-	select {
-	case s.incoming_breadcrumbs <- &incoming:
-		select {
-		case <-ctx.Done():
-			return
-		case err = <-incoming.ret:
-			if err != nil {
-				log.Println("Breadcrumbs error:", err)
-			}
+	agent := s.GetAgent(req.Src)
+	agent.mu.Lock()
+	breadcrumbs, err := decodeBreadcrumbs(req, agent.id_to_addr)
+	agent.mu.Unlock()
+	if err != nil {
+		log.Println("Breadcrumbs error:", err)
+		return
+	}
+
+	ret := make(chan error, len(s.partitions))
+	submitted, ok := s.submitBreadcrumbs(req.Src, breadcrumbs, ret)
+	if ok {
+		rsp.Accepted = int32(len(req.Breadcrumbs))
+		s.metrics.update(req.Src, func(m *AgentMetrics) { m.breadcrumbs_received += len(req.Breadcrumbs) })
+		err = awaitPartitions(ctx, ret, submitted)
+		if err != nil {
+			log.Println("Breadcrumbs error:", err)
 		}
-	default:
+	} else {
+		rsp.Rejected = int32(len(req.Breadcrumbs))
+		s.metrics.update(req.Src, func(m *AgentMetrics) { m.rejected_breadcrumbs += len(req.Breadcrumbs) })
+		rsp.RetryAfterMs = s.retry_after.Milliseconds()
 		atomic.AddUint64(&s.dropped_incoming_breadcrumbs, uint64(len(req.Breadcrumbs)))
 		if s.breadcrumb_warn_mutex.TryLock() {
 			defer s.breadcrumb_warn_mutex.Unlock()
@@ -327,60 +467,164 @@ func (s *CoordinatorServer) Breadcrumbs(ctx context.Context, req *datapb.Breadcr
 				atomic.AddUint64(&s.dropped_incoming_breadcrumbs, -dropped)
 
 				s.last_breadcrumb_warning = time.Now()
-				log.Printf("Warning: coordinator is bottlenecked; %d incoming breadcrumbs dropped\n", dropped)
+				log.Printf("Warning: coordinator is bottlenecked; %d incoming breadcrumbs rejected\n", dropped)
 			}
 		}
 	}
 	return
 }
 
+/*
+An agent has opened a bidirectional stream.  The agent streams triggers and
+breadcrumbs up; remote triggers for the agent are streamed back down on the
+same stream.
+*/
+func (s *CoordinatorServer) Connect(stream datapb.Coordinator_ConnectServer) error {
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	src := s.authenticate(stream.Context(), hello.Src)
+	if src == "" {
+		return fmt.Errorf("First message on Connect stream must specify src")
+	}
+
+	as := &AgentStream{stream: stream, done: make(chan struct{})}
+	defer close(as.done)
+
+	select {
+	case s.incoming_streams <- &IncomingStream{src: src, stream: as}:
+	case <-stream.Context().Done():
+		return nil
+	}
+	log.Println("Agent", src, "connected")
+
+	msg := hello
+	rejecting := false // A message was rejected; discard messages until the agent replays
+	for {
+		if rejecting && !msg.Replay {
+			// Sent before the agent learned of the rejection; it will be resent
+		} else {
+			rejecting = false
+			var trigger_reply *datapb.TriggerReply
+			var breadcrumbs_reply *datapb.BreadcrumbsReply
+			if msg.Triggers != nil {
+				msg.Triggers.Src = src
+				msg.Triggers.Forwarded = false
+				trigger_reply, _ = s.LocalTrigger(stream.Context(), msg.Triggers)
+			}
+			if msg.Breadcrumbs != nil {
+				msg.Breadcrumbs.Src = src
+				breadcrumbs_reply, _ = s.Breadcrumbs(stream.Context(), msg.Breadcrumbs)
+			}
+
+			reply := &datapb.CoordinatorMessage{Ack: msg.Seq}
+			if trigger_reply.GetRejected() > 0 || breadcrumbs_reply.GetRejected() > 0 {
+				// Ask the agent to back off and resend; reprocessing any accepted part is harmless
+				reply = &datapb.CoordinatorMessage{Rejected: msg.Seq, TriggerReply: trigger_reply, BreadcrumbsReply: breadcrumbs_reply}
+				rejecting = msg.Seq != 0
+			}
+			if msg.Seq != 0 {
+				// The agent can discard an acked message, or must resend a rejected one
+				err = as.Send(reply)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		msg, err = stream.Recv()
+		if err == io.EOF {
+			log.Println("Agent", src, "disconnected")
+			return nil
+		} else if err != nil {
+			log.Println("Agent", src, "disconnected:", err)
+			return err
+		}
+	}
+}
+
+/* An agent has announced itself */
+func (s *CoordinatorServer) Register(ctx context.Context, req *datapb.RegisterRequest) (*datapb.RegisterReply, error) {
+	src := s.authenticate(ctx, req.Src)
+	if src == "" {
+		return nil, fmt.Errorf("Register must specify src")
+	}
+	s.members.Register(src, req.Version, req.Capabilities, time.Now())
+	log.Printf("Agent %s registered (version %s, capabilities %v)\n", src, req.Version, req.Capabilities)
+
+	rsp := &datapb.RegisterReply{HeartbeatIntervalMs: s.members.heartbeat_interval.Milliseconds()}
+	return rsp, nil
+}
+
+func (s *CoordinatorServer) Heartbeat(ctx context.Context, req *datapb.HeartbeatRequest) (*datapb.HeartbeatReply, error) {
+	src := s.authenticate(ctx, req.Src)
+	registered := s.members.Heartbeat(src, time.Now())
+	if registered && len(req.Members) > 0 {
+		// A regional coordinator reporting the agents of its region
+		s.members.SetRegion(src, req.Members)
+	}
+	return &datapb.HeartbeatReply{Registered: registered}, nil
+}
+
+/* Lists registered agents and their liveness */
+func (s *CoordinatorServer) Members(ctx context.Context, req *datapb.MembersRequest) (*datapb.MembersReply, error) {
+	var rsp datapb.MembersReply
+	for _, member := range s.members.List() {
+		var m datapb.Member
+		m.Addr = member.addr
+		m.Version = member.version
+		m.Capabilities = member.capabilities
+		m.State = member.state.String()
+		m.RegisteredUnixMs = member.registered.UnixNano() / int64(time.Millisecond)
+		m.LastHeartbeatUnixMs = member.last_heartbeat.UnixNano() / int64(time.Millisecond)
+		rsp.Members = append(rsp.Members, &m)
+	}
+	return &rsp, nil
+}
+
 func (a *Agent) Run(ctx context.Context) {
+	ctx, a.cancel = context.WithCancel(ctx)
 	go func() {
 		a.AgentLoop(ctx)
 	}()
 }
 
-/* Connects to an agent in a loop, then sends triggers once connected */
+/*
+Attaches a newly opened Connect stream to the agent, replacing any previous
+stream.  Invoked by the main coordinator goroutine.
+*/
+func (a *Agent) Attach(stream *AgentStream) {
+	select {
+	case <-a.streams:
+		// Discard a previous stream that the send loop hasn't picked up yet
+	default:
+	}
+	a.streams <- stream
+}
+
+/*
+Waits for the agent to connect, then sends triggers over its Connect stream.
+The coordinator never dials agents itself; remote triggers are queued until
+the agent opens a stream.
+*/
 func (a *Agent) AgentLoop(ctx context.Context) {
+	var stream *AgentStream
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			break
+		case stream = <-a.streams:
 		}
 
-		log.Println("Connecting to agent", a.addr)
-		conn, err := grpc.Dial(a.addr, grpc.WithInsecure(), grpc.WithTimeout(2*time.Second))
+		err := a.ReportTriggers(ctx, stream)
 		if err != nil {
-			log.Println("Unable to connect to", a.addr, "retrying in 2 seconds:", err)
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(2 * time.Second):
-				continue
-			}
-			continue
-		}
-		defer conn.Close()
-
-		rpcclient := datapb.NewAgentClient(conn)
-
-		err = a.ReportTriggers(ctx, rpcclient)
-		if err != nil {
-			log.Println("Connection error", a.addr, "retrying in 2 seconds:", err)
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(2 * time.Second):
-				continue
-			}
-			continue
+			log.Println("Connection error", a.addr, "awaiting reconnection:", err)
 		}
 	}
 }
 
-func (a *Agent) ReportTriggers(ctx context.Context, rpcclient datapb.AgentClient) error {
+func (a *Agent) ReportTriggers(ctx context.Context, stream *AgentStream) error {
 	for {
 		// Accumulate a batch of up to 100 triggers
 		var accumulated []Trigger
@@ -390,6 +634,16 @@ func (a *Agent) ReportTriggers(ctx context.Context, rpcclient datapb.AgentClient
 			select {
 			case <-ctx.Done():
 				return nil
+			case <-stream.done:
+				return nil
+			case next := <-a.streams:
+				// The agent reconnected; continue on the new stream
+				stream = next
+			case crumbs := <-a.outgoing_crumbs:
+				err := stream.Send(&datapb.CoordinatorMessage{Breadcrumbs: crumbs})
+				if err != nil {
+					return err
+				}
 			case triggers := <-a.outgoing_triggers:
 				if len(triggers) > 0 {
 					accumulated = append(accumulated, triggers...)
@@ -413,7 +667,7 @@ func (a *Agent) ReportTriggers(ctx context.Context, rpcclient datapb.AgentClient
 		}
 
 		// Send them
-		err := a.doSend(rpcclient, accumulated)
+		err := a.doSend(stream, accumulated)
 
 		if err != nil {
 			return err
@@ -421,8 +675,7 @@ func (a *Agent) ReportTriggers(ctx context.Context, rpcclient datapb.AgentClient
 	}
 }
 
-/* Send a batch of remove triggers to an agent */
-func (a *Agent) doSend(rpcclient datapb.AgentClient, triggers []Trigger) error {
+func triggerRequest(triggers []Trigger) *datapb.TriggerRequest {
 	var request datapb.TriggerRequest
 	for _, trigger := range triggers {
 		var t datapb.Trigger
@@ -431,12 +684,16 @@ func (a *Agent) doSend(rpcclient datapb.AgentClient, triggers []Trigger) error {
 		t.TraceIds = trigger.trace_ids
 		request.Triggers = append(request.Triggers, &t)
 	}
+	return &request
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	_, err := rpcclient.RemoteTrigger(ctx, &request)
-
+/* Send a batch of remote triggers to an agent */
+func (a *Agent) doSend(stream *AgentStream, triggers []Trigger) error {
+	err := stream.Send(&datapb.CoordinatorMessage{Triggers: triggerRequest(triggers)})
+	if err == nil {
+		a.metrics.update(a.addr, func(m *AgentMetrics) { m.triggers_sent += len(triggers) })
+	}
+	a.audit.sent(triggers, a.addr, err)
 	return err
 }
 
@@ -445,6 +702,10 @@ func (a *Agent) SendTriggers(triggers []Trigger) {
 	case a.outgoing_triggers <- triggers:
 		break
 	default:
+		a.metrics.update(a.addr, func(m *AgentMetrics) { m.triggers_dropped += len(triggers) })
+		a.audit.sent(triggers, a.addr, errAgentBacklog)
+		a.mu.Lock()
+		defer a.mu.Unlock()
 		a.dropped_triggers += len(triggers)
 		now := time.Now()
 		if now.After(a.last_warn.Add(1 * time.Second)) {
@@ -454,3 +715,18 @@ func (a *Agent) SendTriggers(triggers []Trigger) {
 		}
 	}
 }
+
+/* For a regional coordinator, sends breadcrumbs of traces that are known in other regions */
+func (a *Agent) SendBreadcrumbs(req *datapb.BreadcrumbsRequest) {
+	select {
+	case a.outgoing_crumbs <- req:
+	default:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		now := time.Now()
+		if now.After(a.last_warn.Add(1 * time.Second)) {
+			log.Printf("Warning: regional coordinator %s is bottlenecked; dropping breadcrumbs\n", a.addr)
+			a.last_warn = now
+		}
+	}
+}
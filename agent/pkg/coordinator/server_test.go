@@ -0,0 +1,66 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func TestRejectWhenOverloaded(t *testing.T) {
+	assert := assert.New(t)
+
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	cs.ctx = context.Background()
+	cs.partitions[0].incoming_triggers = make(chan *IncomingTriggers) // Nothing is draining the queues
+	cs.partitions[0].incoming_breadcrumbs = make(chan *IncomingBreadcrumbs)
+
+	trsp, _ := cs.LocalTrigger(context.Background(), &datapb.TriggerRequest{Src: "a", Triggers: []*datapb.Trigger{{}, {}}})
+	assert.Equal(int32(0), trsp.Accepted)
+	assert.Equal(int32(2), trsp.Rejected, "Triggers are rejected, not silently dropped")
+	assert.Equal(int64(250), trsp.RetryAfterMs)
+
+	brsp, _ := cs.Breadcrumbs(context.Background(), &datapb.BreadcrumbsRequest{Src: "a", Addresses: []*datapb.BreadcrumbAddress{{Id: 0, Addr: "b"}}, Breadcrumbs: []*datapb.Breadcrumbs{{Addrs: []int32{0}}}})
+	assert.Equal(int32(1), brsp.Rejected, "Breadcrumbs are rejected, not silently dropped")
+	assert.True(brsp.RetryAfterMs > 0)
+}
+
+/* The context of a request from a client that presented a verified certificate */
+func withIdentity(ctx context.Context, identity string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: identity}}
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestCertificateIdentityOverridesSrc(t *testing.T) {
+	assert := assert.New(t)
+
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	cs.ctx = context.Background()
+	cs.partitions[0].incoming_triggers = make(chan *IncomingTriggers)
+	cs.partitions[0].incoming_breadcrumbs = make(chan *IncomingBreadcrumbs)
+
+	ctx := withIdentity(context.Background(), "10.0.0.7:5050")
+	treq := &datapb.TriggerRequest{Src: "spoofed:1", Triggers: []*datapb.Trigger{{}}}
+	cs.LocalTrigger(ctx, treq)
+	assert.Equal("10.0.0.7:5050", treq.Src, "Triggers are attributed to the certificate identity")
+
+	breq := &datapb.BreadcrumbsRequest{Src: "spoofed:1", Addresses: []*datapb.BreadcrumbAddress{{Id: 0, Addr: "b"}}, Breadcrumbs: []*datapb.Breadcrumbs{{Addrs: []int32{0}}}}
+	cs.Breadcrumbs(ctx, breq)
+	assert.Equal("10.0.0.7:5050", breq.Src, "Breadcrumbs are attributed to the certificate identity")
+
+	stats := cs.metrics.takeStats()
+	assert.Equal([]string{"10.0.0.7:5050"}, stats.agent_addrs, "Nothing is recorded for the claimed source")
+
+	treq = &datapb.TriggerRequest{Src: "a:1", Triggers: []*datapb.Trigger{{}}}
+	cs.LocalTrigger(context.Background(), treq)
+	assert.Equal("a:1", treq.Src, "Without mutual TLS the claimed source is used")
+}
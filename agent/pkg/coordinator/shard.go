@@ -0,0 +1,249 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/geraldleizhang/hindsight/agent/pkg/util"
+	"google.golang.org/grpc"
+)
+
+/*
+Coordinator state can be sharded across several coordinators by trace ID.
+Agents route each trace's triggers and breadcrumbs to the coordinator that
+owns the trace, using the same consistent hash ring as the coordinators.
+
+A trigger can name several lateral traces that are owned by different
+shards.  The coordinator that receives such a trigger keeps the traces it
+owns and forwards the rest to their owners.  Forwarded triggers are marked
+as such and are never forwarded again.  An overloaded owner rejects forwarded
+triggers like any others, and they are retried, backing off for longer while
+the owner keeps rejecting them.
+*/
+type Peer struct {
+	addr      string
+	tls       util.TLSConfig
+	outgoing  chan *datapb.TriggerRequest
+	mu        sync.Mutex // Guards the warning state, since gRPC handlers share the peer
+	dropped   int
+	last_warn time.Time
+}
+
+/*
+Configures this coordinator as one shard of several.  peers lists every
+coordinator in the ring, and self is this coordinator's address as it
+appears in peers.  Must be called before Run.
+*/
+func (s *CoordinatorServer) ConfigureShards(self string, peers []string) error {
+	if self == "" {
+		return fmt.Errorf("Sharded coordinators must specify their own address")
+	}
+	found := false
+	for _, addr := range peers {
+		if addr == self {
+			found = true
+		}
+	}
+	if !found {
+		peers = append(peers, self)
+	}
+
+	s.self = self
+	s.ring = util.NewHashRing(peers, util.DefaultVirtualNodes)
+	s.peers = make(map[string]*Peer)
+	for _, addr := range s.ring.Nodes() {
+		if addr != self {
+			s.peers[addr] = &Peer{addr: addr, tls: s.tls, outgoing: make(chan *datapb.TriggerRequest, 10000), last_warn: time.Now()}
+		}
+	}
+	return nil
+}
+
+/*
+Splits the traces of incoming triggers into those owned by this shard and
+those owned by other shards.  Triggers for other shards are forwarded to
+them; the returned request contains only the local traces.
+*/
+func (s *CoordinatorServer) shardTriggers(req *datapb.TriggerRequest) *datapb.TriggerRequest {
+	if s.ring == nil || req.Forwarded {
+		return req
+	}
+
+	local := &datapb.TriggerRequest{Src: req.Src}
+	foreign := make(map[string]*datapb.TriggerRequest)
+	for _, t := range req.Triggers {
+		var local_trace_ids []uint64
+		foreign_trace_ids := make(map[string][]uint64)
+		for _, trace_id := range t.TraceIds {
+			if owner := s.ring.Get(trace_id); owner == s.self {
+				local_trace_ids = append(local_trace_ids, trace_id)
+			} else {
+				foreign_trace_ids[owner] = append(foreign_trace_ids[owner], trace_id)
+			}
+		}
+
+		if len(local_trace_ids) == len(t.TraceIds) {
+			local.Triggers = append(local.Triggers, t)
+			continue
+		}
+		if len(local_trace_ids) > 0 {
+			local.Triggers = append(local.Triggers, &datapb.Trigger{QueueId: t.QueueId, BaseTraceId: t.BaseTraceId, TraceIds: local_trace_ids})
+		}
+		for owner, trace_ids := range foreign_trace_ids {
+			fwd, ok := foreign[owner]
+			if !ok {
+				fwd = &datapb.TriggerRequest{Src: req.Src, Forwarded: true}
+				foreign[owner] = fwd
+			}
+			fwd.Triggers = append(fwd.Triggers, &datapb.Trigger{QueueId: t.QueueId, BaseTraceId: t.BaseTraceId, TraceIds: trace_ids})
+		}
+	}
+
+	for owner, fwd := range foreign {
+		s.peers[owner].Send(fwd)
+	}
+	return local
+}
+
+/*
+Determines who a trigger request came from.  A request forwarded by another
+shard carries the src of the originating agent; with mutual TLS this is only
+trusted if the request came from a peer coordinator.
+*/
+func (s *CoordinatorServer) authenticateTriggers(ctx context.Context, req *datapb.TriggerRequest) {
+	if req.Forwarded {
+		identity, ok := util.GrpcPeerIdentity(ctx)
+		if !ok {
+			return
+		}
+		if _, is_peer := s.peers[identity]; is_peer {
+			return
+		}
+		log.Printf("Ignoring forwarded flag on triggers from %s, which is not a peer coordinator\n", identity)
+		req.Forwarded = false
+	}
+	req.Src = s.authenticate(ctx, req.Src)
+}
+
+func (p *Peer) Send(req *datapb.TriggerRequest) {
+	select {
+	case p.outgoing <- req:
+	default:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.dropped += len(req.Triggers)
+		now := time.Now()
+		if now.After(p.last_warn.Add(1 * time.Second)) {
+			log.Printf("Warning: peer coordinator %s is bottlenecked; dropping %d triggers\n", p.addr, p.dropped)
+			p.dropped = 0
+			p.last_warn = now
+		}
+	}
+}
+
+func (p *Peer) warnRejected(rejected int, backoff time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.After(p.last_warn.Add(1 * time.Second)) {
+		log.Printf("Peer coordinator %s is overloaded and rejected %d triggers; retrying in %v\n", p.addr, rejected, backoff)
+		p.last_warn = now
+	}
+}
+
+/* Connects to the peer in a loop and forwards triggers to it */
+func (p *Peer) Run(ctx context.Context) {
+	var pending *datapb.TriggerRequest
+	firsttime := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		err := p.forwardLoop(ctx, &pending)
+		if err != nil {
+			if firsttime {
+				log.Printf("Unable to forward triggers to peer coordinator %s; will retry every 2 seconds (reason: %s)\n", p.addr, err.Error())
+				firsttime = false
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+				continue
+			}
+		}
+		firsttime = true
+	}
+}
+
+/* Longest a peer backs off for while its triggers are rejected */
+const maxPeerBackoff = 5 * time.Second
+
+/* Doubles the previous backoff, starting from the owner's requested retry_after */
+func nextBackoff(previous time.Duration, retry_after_ms int64) time.Duration {
+	retry_after := time.Duration(retry_after_ms) * time.Millisecond
+	if retry_after <= 0 {
+		retry_after = 100 * time.Millisecond
+	}
+	backoff := 2 * previous
+	if backoff < retry_after {
+		backoff = retry_after
+	}
+	if backoff > maxPeerBackoff {
+		backoff = maxPeerBackoff
+	}
+	return backoff
+}
+
+/*
+Forwards triggers until an error occurs.  A request that fails to send, or
+that the peer rejects, is left in pending and retried.
+*/
+func (p *Peer) forwardLoop(ctx context.Context, pending **datapb.TriggerRequest) error {
+	creds, err := p.tls.DialOption()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(p.addr, creds, grpc.WithBlock(), grpc.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := datapb.NewCoordinatorClient(conn)
+	log.Println("Forwarding triggers to peer coordinator", p.addr)
+
+	var backoff time.Duration
+	for {
+		if *pending == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case *pending = <-p.outgoing:
+			}
+		}
+
+		rsp, err := client.LocalTrigger(ctx, *pending)
+		if err != nil {
+			return err
+		}
+		if rsp.Rejected > 0 {
+			backoff = nextBackoff(backoff, rsp.RetryAfterMs)
+			p.warnRejected(int(rsp.Rejected), backoff)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		*pending = nil
+	}
+}
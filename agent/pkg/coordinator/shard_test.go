@@ -0,0 +1,91 @@
+package coordinator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geraldleizhang/hindsight/agent/pkg/datapb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestShardTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	var cs CoordinatorServer
+	cs.Init("0", "")
+	assert.NoError(cs.ConfigureShards("a:5252", []string{"a:5252", "b:5252"}))
+
+	// Find a trace owned by each shard
+	var local, foreign uint64
+	for trace_id := uint64(1); local == 0 || foreign == 0; trace_id++ {
+		if cs.ring.Get(trace_id) == "a:5252" {
+			local = trace_id
+		} else {
+			foreign = trace_id
+		}
+	}
+
+	req := &datapb.TriggerRequest{Src: "agent:1", Triggers: []*datapb.Trigger{
+		{QueueId: 3, BaseTraceId: local, TraceIds: []uint64{local, foreign}},
+	}}
+	kept := cs.shardTriggers(req)
+	assert.Equal(1, len(kept.Triggers))
+	assert.Equal([]uint64{local}, kept.Triggers[0].TraceIds, "Local traces are kept")
+
+	forwarded := <-cs.peers["b:5252"].outgoing
+	assert.True(forwarded.Forwarded)
+	assert.Equal("agent:1", forwarded.Src, "Forwarded triggers keep the original src")
+	assert.Equal([]uint64{foreign}, forwarded.Triggers[0].TraceIds, "Foreign traces are forwarded to their owner")
+	assert.Equal(local, forwarded.Triggers[0].BaseTraceId)
+
+	// Forwarded triggers are never forwarded again
+	assert.Equal(forwarded, cs.shardTriggers(forwarded))
+	assert.Equal(0, len(cs.peers["b:5252"].outgoing))
+}
+
+/* Returns the triggers received and rejected by a server for an agent */
+func triggerCounts(cs *CoordinatorServer, src string) (received int, rejected int) {
+	cs.metrics.mu.Lock()
+	defer cs.metrics.mu.Unlock()
+	if am, ok := cs.metrics.agents[src]; ok {
+		return am.triggers_received, am.rejected_triggers
+	}
+	return 0, 0
+}
+
+func TestForwardRejectedTriggers(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The owning shard is overloaded: nothing is draining its queues
+	var owner CoordinatorServer
+	owner.Init("0", "")
+	owner.ctx = ctx
+	owner.partitions[0].incoming_triggers = make(chan *IncomingTriggers)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	server := grpc.NewServer()
+	datapb.RegisterCoordinatorServer(server, &owner)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	peer := &Peer{addr: lis.Addr().String(), outgoing: make(chan *datapb.TriggerRequest, 1), last_warn: time.Now()}
+	go peer.Run(ctx)
+	peer.Send(&datapb.TriggerRequest{Src: "agent:1", Forwarded: true, Triggers: []*datapb.Trigger{{QueueId: 3, BaseTraceId: 7, TraceIds: []uint64{7}}}})
+
+	assert.Eventually(func() bool {
+		_, rejected := triggerCounts(&owner, "agent:1")
+		return rejected >= 2
+	}, 10*time.Second, 10*time.Millisecond, "Rejected triggers are retried")
+
+	// Once the owner recovers, the rejected triggers are delivered
+	go owner.partitions[0].Run(ctx)
+	assert.Eventually(func() bool {
+		received, _ := triggerCounts(&owner, "agent:1")
+		return received == 1
+	}, 10*time.Second, 10*time.Millisecond, "Rejected triggers are delivered rather than lost")
+}
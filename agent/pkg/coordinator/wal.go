@@ -0,0 +1,399 @@
+package coordinator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+The WAL is an optional write-ahead log of the coordinator's state.  Every
+trigger and breadcrumb received by the coordinator is appended to the log
+before it is applied, and the full state is periodically written to a
+snapshot, after which the log is truncated.
+
+On startup the coordinator loads the snapshot, replays the log on top of it
+(applying each record at the time it was originally received), and then
+expires anything older than the usual timeout.  The WAL protects against
+coordinator restarts; writes are not fsynced, so recent records can be lost
+if the host fails.
+*/
+type WAL struct {
+	dir     string
+	file    *os.File
+	w       *bufio.Writer
+	records int // Records written since the last snapshot
+}
+
+/* A single logged AddTrigger or AddBreadcrumb */
+type walRecord struct {
+	Time        int64 // Unix nanoseconds
+	Kind        byte
+	Src         string
+	QueueId     int
+	BaseTraceId uint64
+	TraceIds    []uint64 // Traces of a trigger, or the single trace of breadcrumbs
+	Addrs       []string
+}
+
+const (
+	walRecordTrigger    byte = 'T'
+	walRecordBreadcrumb byte = 'B'
+)
+
+type walSnapshot struct {
+	Time     int64
+	Traces   []snapshotTrace
+	Triggers []snapshotTrigger
+}
+
+type snapshotTrace struct {
+	Id             uint64
+	KnownAt        []string
+	LearnedAt      []int64 // When each of KnownAt was learned
+	Created        int64
+	LastModified   int64
+	LastBreadcrumb int64
+}
+
+type snapshotTrigger struct {
+	QueueId        int
+	BaseTraceId    uint64
+	KnownAt        []string
+	LearnedAt      []int64
+	Traces         []uint64
+	Lateral        []uint64 // Traces owned by other partitions
+	Created        int64
+	LastModified   int64
+	LastBreadcrumb int64
+}
+
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{dir: dir}, nil
+}
+
+func (w *WAL) logFilename() string {
+	return filepath.Join(w.dir, "coordinator.wal")
+}
+
+func (w *WAL) snapshotFilename() string {
+	return filepath.Join(w.dir, "coordinator.snapshot")
+}
+
+/*
+Rebuilds c from the snapshot and log, then opens the log for appending.
+Returns the number of log records replayed.
+*/
+func (w *WAL) Recover(c *Coordinator) (replayed int, err error) {
+	err = w.loadSnapshot(c)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(w.logFilename())
+	if err == nil {
+		replayed, err = w.replay(f, c)
+		f.Close()
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	w.file, err = os.OpenFile(w.logFilename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	w.w = bufio.NewWriter(w.file)
+	w.records = replayed
+	return
+}
+
+func (w *WAL) loadSnapshot(c *Coordinator) error {
+	f, err := os.Open(w.snapshotFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snapshot walSnapshot
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&snapshot)
+	if err != nil {
+		return fmt.Errorf("Unable to read snapshot %s: %v", w.snapshotFilename(), err)
+	}
+
+	// Snapshots are ordered oldest first, so pushing to the front restores LRU order
+	for _, st := range snapshot.Traces {
+		c.now = time.Unix(0, st.Created)
+		trace := c.getTrace(st.Id)
+		restoreKnownAt(trace.known_at, st.KnownAt, st.LearnedAt, c.now)
+		trace.last_modified = time.Unix(0, st.LastModified)
+		trace.last_breadcrumb = time.Unix(0, st.LastBreadcrumb)
+	}
+	for _, st := range snapshot.Triggers {
+		c.now = time.Unix(0, st.Created)
+		trigger := c.getTrigger(TriggerID{queue_id: st.QueueId, base_trace_id: st.BaseTraceId})
+		restoreKnownAt(trigger.known_at, st.KnownAt, st.LearnedAt, c.now)
+		for _, trace_id := range st.Traces {
+			if trace, ok := c.traces[trace_id]; ok {
+				trigger.traces[trace_id] = trace
+				trace.triggers[trigger.id] = trigger
+			}
+		}
+		for _, trace_id := range st.Lateral {
+			trigger.lateral[trace_id] = struct{}{}
+		}
+		trigger.last_modified = time.Unix(0, st.LastModified)
+		trigger.last_breadcrumb = time.Unix(0, st.LastBreadcrumb)
+	}
+	c.now = time.Unix(0, snapshot.Time)
+	return nil
+}
+
+func (w *WAL) replay(f *os.File, c *Coordinator) (replayed int, err error) {
+	r := bufio.NewReader(f)
+	for {
+		var payload []byte
+		payload, err = readWALFrame(r)
+		if err == io.EOF {
+			return replayed, nil
+		} else if err != nil {
+			// A truncated final record is expected if the coordinator crashed mid-write
+			log.Printf("Ignoring remainder of %s: %v\n", w.logFilename(), err)
+			return replayed, nil
+		}
+
+		var record walRecord
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&record)
+		if err != nil {
+			return
+		}
+
+		c.now = time.Unix(0, record.Time)
+		switch record.Kind {
+		case walRecordTrigger:
+			var trigger Trigger
+			trigger.id.queue_id = record.QueueId
+			trigger.id.base_trace_id = record.BaseTraceId
+			trigger.trace_ids = record.TraceIds
+			c.AddTrigger(record.Src, trigger)
+		case walRecordBreadcrumb:
+			if len(record.TraceIds) == 1 {
+				c.AddBreadcrumb(record.Src, record.TraceIds[0], record.Addrs)
+			}
+		}
+		replayed++
+	}
+}
+
+func writeWALFrame(w io.Writer, payload []byte) error {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func readWALFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header))
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return payload, err
+}
+
+func (w *WAL) append(record *walRecord) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(record)
+	if err == nil {
+		err = writeWALFrame(w.w, buf.Bytes())
+	}
+	if err != nil {
+		log.Println("Error writing to WAL", w.logFilename(), err)
+		return
+	}
+	w.records++
+}
+
+func (w *WAL) LogTrigger(now time.Time, src string, t Trigger) {
+	w.append(&walRecord{
+		Time:        now.UnixNano(),
+		Kind:        walRecordTrigger,
+		Src:         src,
+		QueueId:     t.id.queue_id,
+		BaseTraceId: t.id.base_trace_id,
+		TraceIds:    t.trace_ids,
+	})
+}
+
+func (w *WAL) LogBreadcrumb(now time.Time, src string, trace_id uint64, addrs []string) {
+	w.append(&walRecord{
+		Time:     now.UnixNano(),
+		Kind:     walRecordBreadcrumb,
+		Src:      src,
+		TraceIds: []uint64{trace_id},
+		Addrs:    addrs,
+	})
+}
+
+/* Writes buffered records to the log file; called after each request */
+func (w *WAL) Flush() {
+	err := w.w.Flush()
+	if err != nil {
+		log.Println("Error writing to WAL", w.logFilename(), err)
+	}
+}
+
+/*
+Writes the full state of c to a new snapshot, then truncates the log.  The
+snapshot is written to a temporary file and renamed, so a crash leaves
+either the old or the new snapshot in place.
+*/
+func (w *WAL) Snapshot(c *Coordinator) error {
+	var snapshot walSnapshot
+	snapshot.Time = c.now.UnixNano()
+	for e := c.trace_lru.Back(); e != nil; e = e.Prev() {
+		trace := e.Value.(*tracestate)
+		st := snapshotTrace{
+			Id:             trace.id,
+			KnownAt:        sortedAddrs(trace.known_at),
+			LearnedAt:      learnedAt(trace.known_at),
+			Created:        trace.created.UnixNano(),
+			LastModified:   trace.last_modified.UnixNano(),
+			LastBreadcrumb: trace.last_breadcrumb.UnixNano(),
+		}
+		snapshot.Traces = append(snapshot.Traces, st)
+	}
+	for e := c.trigger_lru.Back(); e != nil; e = e.Prev() {
+		trigger := e.Value.(*triggerstate)
+		st := snapshotTrigger{
+			QueueId:        trigger.id.queue_id,
+			BaseTraceId:    trigger.id.base_trace_id,
+			KnownAt:        sortedAddrs(trigger.known_at),
+			LearnedAt:      learnedAt(trigger.known_at),
+			Created:        trigger.created.UnixNano(),
+			LastModified:   trigger.last_modified.UnixNano(),
+			LastBreadcrumb: trigger.last_breadcrumb.UnixNano(),
+		}
+		for trace_id := range trigger.traces {
+			st.Traces = append(st.Traces, trace_id)
+		}
+		for trace_id := range trigger.lateral {
+			st.Lateral = append(st.Lateral, trace_id)
+		}
+		snapshot.Triggers = append(snapshot.Triggers, st)
+	}
+
+	tmp := w.snapshotFilename() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(&snapshot)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, w.snapshotFilename())
+	if err != nil {
+		return err
+	}
+
+	// Everything in the log is now covered by the snapshot
+	if w.file != nil {
+		w.w.Reset(w.file)
+		err = w.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	w.records = 0
+	return nil
+}
+
+func (w *WAL) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	w.Flush()
+	return w.file.Close()
+}
+
+/*
+All triggers that are still live, grouped by the agents where they are
+known.  After recovering from the WAL these are sent again, since
+dissemination that was in flight before the restart may have been lost.
+*/
+func (c *Coordinator) pendingDissemination() map[string][]Trigger {
+	to_disseminate := make(map[string][]Trigger)
+	for e := c.trigger_lru.Back(); e != nil; e = e.Prev() {
+		trigger := e.Value.(*triggerstate)
+		t := trigger.Trigger()
+		if len(t.trace_ids) == 0 {
+			continue
+		}
+		for addr := range trigger.known_at {
+			to_disseminate[addr] = append(to_disseminate[addr], t)
+		}
+	}
+	return to_disseminate
+}
+
+/* Sorts addresses so that snapshots are deterministic */
+func sortedAddrs(known_at map[string]time.Time) (addrs []string) {
+	for addr := range known_at {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return
+}
+
+/* When each address returned by sortedAddrs was learned */
+func learnedAt(known_at map[string]time.Time) (times []int64) {
+	for _, addr := range sortedAddrs(known_at) {
+		times = append(times, known_at[addr].UnixNano())
+	}
+	return
+}
+
+func restoreKnownAt(known_at map[string]time.Time, addrs []string, learned []int64, created time.Time) {
+	for i, addr := range addrs {
+		if i < len(learned) {
+			known_at[addr] = time.Unix(0, learned[i])
+		} else {
+			known_at[addr] = created
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWALRecovery(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	var c Coordinator
+	c.Init()
+	wal, err := OpenWAL(dir)
+	assert.NoError(err)
+	_, err = wal.Recover(&c)
+	assert.NoError(err)
+
+	trigger := Trigger{id: TriggerID{queue_id: 1, base_trace_id: 10}, trace_ids: []uint64{10}}
+	wal.LogTrigger(c.now, "a", trigger)
+	c.AddTrigger("a", trigger)
+	wal.LogBreadcrumb(c.now, "a", 10, []string{"b"})
+	c.AddBreadcrumb("a", 10, []string{"b"})
+	assert.NoError(wal.Snapshot(&c))
+
+	// Records after the snapshot are only in the log
+	wal.LogBreadcrumb(c.now, "b", 10, []string{"c"})
+	c.AddBreadcrumb("b", 10, []string{"c"})
+	assert.NoError(wal.Close())
+
+	var recovered Coordinator
+	recovered.Init()
+	wal, err = OpenWAL(dir)
+	assert.NoError(err)
+	replayed, err := wal.Recover(&recovered)
+	assert.NoError(err)
+	assert.Equal(1, replayed, "Only records since the snapshot are replayed")
+
+	for _, addr := range []string{"a", "b", "c"} {
+		assert.True(recovered.known_at(trigger.id, addr), "Trigger known at %s", addr)
+		assert.True(recovered.trace_known_at(10, addr), "Trace known at %s", addr)
+	}
+	pending := recovered.pendingDissemination()
+	assert.Equal([]uint64{10}, pending["c"][0].trace_ids, "Live triggers are re-disseminated")
+
+	// Recovered state expires as usual
+	recovered.checkTraceExpiration(time.Now().Add(time.Hour))
+	recovered.checkTriggerExpiration(time.Now().Add(time.Hour))
+	assert.Equal(0, len(recovered.triggers))
+	assert.NoError(wal.Close())
+}
@@ -106,6 +106,11 @@ var Agent_ServiceDesc = grpc.ServiceDesc{
 type CoordinatorClient interface {
 	LocalTrigger(ctx context.Context, in *TriggerRequest, opts ...grpc.CallOption) (*TriggerReply, error)
 	Breadcrumbs(ctx context.Context, in *BreadcrumbsRequest, opts ...grpc.CallOption) (*BreadcrumbsReply, error)
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Coordinator_ConnectClient, error)
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterReply, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error)
+	Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersReply, error)
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryReply, error)
 }
 
 type coordinatorClient struct {
@@ -134,12 +139,84 @@ func (c *coordinatorClient) Breadcrumbs(ctx context.Context, in *BreadcrumbsRequ
 	return out, nil
 }
 
+func (c *coordinatorClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Coordinator_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Coordinator_ServiceDesc.Streams[0], "/datapb.Coordinator/Connect", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &coordinatorConnectClient{stream}
+	return x, nil
+}
+
+type Coordinator_ConnectClient interface {
+	Send(*AgentMessage) error
+	Recv() (*CoordinatorMessage, error)
+	grpc.ClientStream
+}
+
+type coordinatorConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *coordinatorConnectClient) Send(m *AgentMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *coordinatorConnectClient) Recv() (*CoordinatorMessage, error) {
+	m := new(CoordinatorMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *coordinatorClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterReply, error) {
+	out := new(RegisterReply)
+	err := c.cc.Invoke(ctx, "/datapb.Coordinator/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *coordinatorClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error) {
+	out := new(HeartbeatReply)
+	err := c.cc.Invoke(ctx, "/datapb.Coordinator/Heartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *coordinatorClient) Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersReply, error) {
+	out := new(MembersReply)
+	err := c.cc.Invoke(ctx, "/datapb.Coordinator/Members", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *coordinatorClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryReply, error) {
+	out := new(QueryReply)
+	err := c.cc.Invoke(ctx, "/datapb.Coordinator/Query", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CoordinatorServer is the server API for Coordinator service.
 // All implementations must embed UnimplementedCoordinatorServer
 // for forward compatibility
 type CoordinatorServer interface {
 	LocalTrigger(context.Context, *TriggerRequest) (*TriggerReply, error)
 	Breadcrumbs(context.Context, *BreadcrumbsRequest) (*BreadcrumbsReply, error)
+	Connect(Coordinator_ConnectServer) error
+	Register(context.Context, *RegisterRequest) (*RegisterReply, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatReply, error)
+	Members(context.Context, *MembersRequest) (*MembersReply, error)
+	Query(context.Context, *QueryRequest) (*QueryReply, error)
 	mustEmbedUnimplementedCoordinatorServer()
 }
 
@@ -153,6 +230,21 @@ func (UnimplementedCoordinatorServer) LocalTrigger(context.Context, *TriggerRequ
 func (UnimplementedCoordinatorServer) Breadcrumbs(context.Context, *BreadcrumbsRequest) (*BreadcrumbsReply, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Breadcrumbs not implemented")
 }
+func (UnimplementedCoordinatorServer) Connect(Coordinator_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedCoordinatorServer) Register(context.Context, *RegisterRequest) (*RegisterReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedCoordinatorServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedCoordinatorServer) Members(context.Context, *MembersRequest) (*MembersReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Members not implemented")
+}
+func (UnimplementedCoordinatorServer) Query(context.Context, *QueryRequest) (*QueryReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
 func (UnimplementedCoordinatorServer) mustEmbedUnimplementedCoordinatorServer() {}
 
 // UnsafeCoordinatorServer may be embedded to opt out of forward compatibility for this service.
@@ -202,6 +294,104 @@ func _Coordinator_Breadcrumbs_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Coordinator_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CoordinatorServer).Connect(&coordinatorConnectServer{stream})
+}
+
+type Coordinator_ConnectServer interface {
+	Send(*CoordinatorMessage) error
+	Recv() (*AgentMessage, error)
+	grpc.ServerStream
+}
+
+type coordinatorConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *coordinatorConnectServer) Send(m *CoordinatorMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *coordinatorConnectServer) Recv() (*AgentMessage, error) {
+	m := new(AgentMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Coordinator_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CoordinatorServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datapb.Coordinator/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinatorServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coordinator_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CoordinatorServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datapb.Coordinator/Heartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinatorServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coordinator_Members_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CoordinatorServer).Members(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datapb.Coordinator/Members",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinatorServer).Members(ctx, req.(*MembersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coordinator_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CoordinatorServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datapb.Coordinator/Query",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinatorServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Coordinator_ServiceDesc is the grpc.ServiceDesc for Coordinator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -217,7 +407,30 @@ var Coordinator_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Breadcrumbs",
 			Handler:    _Coordinator_Breadcrumbs_Handler,
 		},
+		{
+			MethodName: "Register",
+			Handler:    _Coordinator_Register_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _Coordinator_Heartbeat_Handler,
+		},
+		{
+			MethodName: "Members",
+			Handler:    _Coordinator_Members_Handler,
+		},
+		{
+			MethodName: "Query",
+			Handler:    _Coordinator_Query_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Coordinator_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "datapb.proto",
 }
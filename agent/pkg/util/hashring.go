@@ -0,0 +1,95 @@
+package util
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A consistent hash ring that assigns trace IDs to nodes, used to shard
+coordinator state across multiple coordinators.  Each node is placed on the
+ring at several points (virtual nodes) so that keys are spread evenly, and
+adding or removing a node only moves the keys adjacent to its points.
+
+Agents and coordinators must be given the same set of nodes; the order in
+which nodes are given does not matter.
+*/
+type HashRing struct {
+	nodes  []string
+	points []uint64          // Sorted positions of virtual nodes
+	owners map[uint64]string // Virtual node position -> node
+}
+
+const DefaultVirtualNodes = 128
+
+func NewHashRing(nodes []string, vnodes int) *HashRing {
+	var r HashRing
+	r.owners = make(map[uint64]string)
+	for _, node := range nodes {
+		if _, exists := r.owners[hashString(node)]; exists {
+			continue // Duplicate node
+		}
+		r.nodes = append(r.nodes, node)
+		r.owners[hashString(node)] = node
+		r.points = append(r.points, hashString(node))
+		for i := 1; i < vnodes; i++ {
+			point := hashString(node + "#" + strconv.Itoa(i))
+			r.owners[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	sort.Strings(r.nodes)
+	return &r
+}
+
+/* Parses a comma-separated list of nodes */
+func ParseNodes(list string) (nodes []string) {
+	for _, node := range strings.Split(list, ",") {
+		node = strings.TrimSpace(node)
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+/* Trace IDs aren't necessarily uniformly distributed, so scramble them first */
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+/* Returns the node that owns key, or "" if the ring is empty */
+func (r *HashRing) Get(key uint64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := mix64(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+/* The nodes in the ring, sorted */
+func (r *HashRing) Nodes() []string {
+	return r.nodes
+}
+
+func (r *HashRing) Len() int {
+	return len(r.nodes)
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	assert := assert.New(t)
+
+	r1 := NewHashRing([]string{"a:5252", "b:5252", "c:5252"}, DefaultVirtualNodes)
+	r2 := NewHashRing([]string{"c:5252", "a:5252", "b:5252", "a:5252"}, DefaultVirtualNodes)
+	assert.Equal(3, r2.Len(), "Duplicates are ignored")
+
+	counts := make(map[string]int)
+	for key := uint64(1); key <= 30000; key++ {
+		owner := r1.Get(key)
+		assert.Equal(owner, r2.Get(key), "Node order doesn't matter")
+		counts[owner]++
+	}
+	for node, count := range counts {
+		assert.InDelta(10000, count, 2500, "Keys should be spread evenly; %s got %d", node, count)
+	}
+
+	// Adding a node should only move keys to the new node
+	r3 := NewHashRing([]string{"a:5252", "b:5252", "c:5252", "d:5252"}, DefaultVirtualNodes)
+	moved := 0
+	for key := uint64(1); key <= 30000; key++ {
+		if r1.Get(key) != r3.Get(key) {
+			assert.Equal("d:5252", r3.Get(key))
+			moved++
+		}
+	}
+	assert.InDelta(7500, moved, 2500, "About a quarter of keys should move")
+
+	assert.Equal("", NewHashRing(nil, DefaultVirtualNodes).Get(1))
+	assert.Equal([]string{"a:1", "b:2"}, ParseNodes(" a:1, b:2,"))
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+/*
+Agents report trace data to the collector over a TCP connection.  Every
+message is length prefixed (uint32, little endian).  The first message is a
+handshake naming the agent, and each subsequent message is a buffer.
+
+With acknowledged delivery, the handshake is ReportingAckMagic followed by
+a uint64 session ID, unique to a run of the agent, and then the agent's
+address.  The collector replies with the sequence number up to which it has
+durably written the session's buffers (a uint64, not length prefixed), and
+each buffer is preceded by its uint64 sequence number within the same
+message.  As the collector durably writes buffers, it sends the sequence
+number up to which all buffers are written.  After reconnecting, an agent
+resends anything that wasn't acknowledged, and the collector discards
+sequence numbers it has already received.
+
+Handshakes without ReportingAckMagic are just the agent's address, and are
+never acknowledged.
+*/
+const ReportingAckMagic = "HINDSIGHT-ACKED-v1\n"
+
+func EncodeAckedHandshake(session uint64, agent_addr string) []byte {
+	handshake := make([]byte, len(ReportingAckMagic)+8+len(agent_addr))
+	copy(handshake, ReportingAckMagic)
+	binary.LittleEndian.PutUint64(handshake[len(ReportingAckMagic):], session)
+	copy(handshake[len(ReportingAckMagic)+8:], agent_addr)
+	return handshake
+}
+
+/* Returns false if the handshake is not from an agent that expects acks */
+func DecodeAckedHandshake(handshake []byte) (session uint64, agent_addr string, ok bool) {
+	if len(handshake) < len(ReportingAckMagic)+8 || !strings.HasPrefix(string(handshake), ReportingAckMagic) {
+		return
+	}
+	session = binary.LittleEndian.Uint64(handshake[len(ReportingAckMagic):])
+	agent_addr = string(handshake[len(ReportingAckMagic)+8:])
+	ok = true
+	return
+}
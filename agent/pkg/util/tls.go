@@ -0,0 +1,162 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+/*
+TLS settings shared by the agent, coordinator, and collector.  All three
+files are optional:
+  * With no files, connections are plaintext
+  * CertFile and KeyFile give this process a certificate to present
+  * CAFile is used to verify the certificate presented by the other side.
+    On a server, setting CAFile requires clients to present a certificate
+    signed by the CA (mutual TLS).
+
+When mutual TLS is used, the identity of a client is the CommonName of its
+certificate.  For agents this must be the agent's advertised host:port, since
+that is how breadcrumbs name agents.
+*/
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.CAFile != ""
+}
+
+/*
+Checks that the files given make sense together.  A server always needs a
+certificate and key to present, so a CA alone is only valid for a process
+that just dials out.
+*/
+func (c *TLSConfig) Validate(server bool) error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("A TLS certificate and key must be given together")
+	}
+	if server && c.CAFile != "" && c.CertFile == "" {
+		return fmt.Errorf("A TLS CA also requires a certificate and key, to accept connections")
+	}
+	return nil
+}
+
+func (c *TLSConfig) String() string {
+	if !c.Enabled() {
+		return "plaintext"
+	}
+	if c.CertFile != "" && c.CAFile != "" {
+		return "mutual TLS"
+	}
+	return "TLS"
+}
+
+func (c *TLSConfig) loadCA() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", c.CAFile)
+	}
+	return pool, nil
+}
+
+/* Configuration for accepting connections */
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("A TLS server requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.CAFile != "" {
+		config.ClientCAs, err = c.loadCA()
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/* Configuration for dialing a server */
+func (c *TLSConfig) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pool, err := c.loadCA()
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+/* gRPC server option; plaintext if TLS is not enabled */
+func (c *TLSConfig) ServerOptions() ([]grpc.ServerOption, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	config, err := c.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}, nil
+}
+
+/* gRPC dial option; plaintext if TLS is not enabled */
+func (c *TLSConfig) DialOption() (grpc.DialOption, error) {
+	if !c.Enabled() {
+		return grpc.WithInsecure(), nil
+	}
+	config, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+/*
+Returns the identity from a verified client certificate, or false if the peer
+did not present a verified certificate
+*/
+func PeerIdentity(state tls.ConnectionState) (string, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	identity := state.VerifiedChains[0][0].Subject.CommonName
+	return identity, identity != ""
+}
+
+/* As PeerIdentity, for the caller of a gRPC method */
+func GrpcPeerIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", false
+	}
+	return PeerIdentity(info.State)
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Writes a PEM certificate and key signed by parent (or self-signed if parent is nil) */
+func writeTestCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentkey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentkey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLSIdentity(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	now := time.Now()
+	ca, cakey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "hindsight-ca"},
+		NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "collector"},
+		NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, cakey)
+	writeTestCert(t, dir, "agent", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "10.0.0.7:5050"},
+		NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, cakey)
+
+	server := TLSConfig{filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")}
+	client := TLSConfig{filepath.Join(dir, "agent.crt"), filepath.Join(dir, "agent.key"), filepath.Join(dir, "ca.crt")}
+	assert.Equal("mutual TLS", server.String())
+
+	serverconfig, err := server.ServerConfig()
+	assert.NoError(err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverconfig)
+	assert.NoError(err)
+	defer listener.Close()
+
+	identities := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			identities <- ""
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1)
+		conn.Read(buf) // completes the handshake
+		identity, _ := PeerIdentity(conn.(*tls.Conn).ConnectionState())
+		identities <- identity
+	}()
+
+	clientconfig, err := client.ClientConfig()
+	assert.NoError(err)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientconfig)
+	assert.NoError(err)
+	conn.Write([]byte{1})
+	defer conn.Close()
+
+	assert.Equal("10.0.0.7:5050", <-identities, "Identity is taken from the client certificate")
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError((&TLSConfig{}).Validate(true))
+	assert.NoError((&TLSConfig{CAFile: "ca.crt"}).Validate(false), "Clients can verify servers without a certificate")
+	assert.Error((&TLSConfig{CAFile: "ca.crt"}).Validate(true), "Servers need a certificate to present")
+	assert.Error((&TLSConfig{CertFile: "a.crt"}).Validate(false), "Certificate without a key")
+	assert.NoError((&TLSConfig{"a.crt", "a.key", "ca.crt"}).Validate(true))
+}
@@ -20,6 +20,11 @@ var Coordinator_port string
 var Reporting_addr string
 var Reporting_port string
 
+// coordinator expiration settings
+var Trace_timeout string
+var Trigger_timeout string
+var Queue_timeouts []string
+
 func Conf_init(service_name string) bool {
 	conf_file, err := os.Open("/etc/hindsight_conf/" + service_name + ".conf")
 	if err != nil {
@@ -61,6 +66,15 @@ func Conf_init(service_name string) bool {
 		if strings.Contains(scanner.Text(), "r_port") {
 			Reporting_port = strings.Split(scanner.Text(), " ")[1]
 		}
+		if strings.Contains(scanner.Text(), "trace_timeout") {
+			Trace_timeout = strings.Split(scanner.Text(), " ")[1]
+		}
+		if strings.Contains(scanner.Text(), "trigger_timeout") {
+			Trigger_timeout = strings.Split(scanner.Text(), " ")[1]
+		}
+		if strings.Contains(scanner.Text(), "queue_timeout") {
+			Queue_timeouts = append(Queue_timeouts, strings.Split(scanner.Text(), " ")[1])
+		}
 	}
 
 	return true